@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication event types
+const (
+	AuthEventSSH    = "ssh"
+	AuthEventSudo   = "sudo"
+	AuthEventLogin  = "login"
+	AuthEventLogout = "logout"
+)
+
+// Where an authentication event was read from
+const (
+	AuthSourceAuthLog = "auth_log"
+	AuthSourceJournal = "journal"
+	AuthSourceWtmp    = "wtmp"
+)
+
+const (
+	// maxAuthEvents caps the events read in one collection; the rest are
+	// read by the next one
+	maxAuthEvents = 1000
+
+	// maxAuthLogRead caps the bytes of log read in one collection
+	maxAuthLogRead = 4 * 1024 * 1024
+
+	maxAuthMessageLength = 512
+)
+
+// authLogPaths are the syslog files sshd and sudo write to, Debian first
+var authLogPaths = []string{"/var/log/auth.log", "/var/log/secure"}
+
+// AuthEvent is an SSH or sudo authentication attempt, or a login or logout
+// recorded in wtmp. Count is the number of identical attempts the line
+// stands for, e.g. "3 incorrect password attempts".
+type AuthEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Type       string    `json:"type"`
+	Success    bool      `json:"success"`
+	User       string    `json:"user"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	SourcePort int       `json:"source_port,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	TTY        string    `json:"tty,omitempty"`
+	TargetUser string    `json:"target_user,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	PID        int32     `json:"pid,omitempty"`
+	Count      int       `json:"count,omitempty"`
+	Source     string    `json:"source"`
+	Message    string    `json:"message,omitempty"`
+}
+
+var (
+	sshAcceptedPattern = regexp.MustCompile(`^Accepted (\S+) for (\S+) from (\S+) port (\d+)`)
+	sshFailedPattern   = regexp.MustCompile(`^Failed (\S+) for (?:invalid user )?(\S*) from (\S+) port (\d+)`)
+	sudoPattern        = regexp.MustCompile(`^\s*(\S+) : (.*?)TTY=(\S+) ; PWD=.*? ; USER=(\S+) ; (?:.*? ; )?COMMAND=(.*)$`)
+	sudoAttemptsRegexp = regexp.MustCompile(`(\d+) incorrect password attempts?`)
+	repeatedPattern    = regexp.MustCompile(`^message repeated (\d+) times: \[ ?(.*?) ?\]$`)
+	syslogPattern      = regexp.MustCompile(`^([\w.-]+)\[(\d+)\]: (.*)$`)
+	syslogNoPIDPattern = regexp.MustCompile(`^([\w.-]+): (.*)$`)
+)
+
+// logPosition is how far a log file has been read. The file's device and
+// inode tell when it was rotated.
+type logPosition struct {
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type authState struct {
+	AuthLog       logPosition `json:"auth_log"`
+	JournalCursor string      `json:"journal_cursor,omitempty"`
+	JournalSince  time.Time   `json:"journal_since"`
+	Wtmp          logPosition `json:"wtmp"`
+}
+
+// authCollector reads authentication events appended to the auth log (or
+// the journal where there is none) and wtmp since the previous collection.
+// Positions are persisted so nothing is read twice across restarts; on the
+// first run reading starts at the end.
+type authCollector struct {
+	statePath string
+	state     authState
+	lines     map[string]string // user of the latest login per terminal, for logouts
+}
+
+func newAuthCollector(statePath string) *authCollector {
+	c := &authCollector{statePath: statePath, lines: make(map[string]string)}
+
+	jsonData, err := os.ReadFile(statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading authentication log positions, starting at the end: %v", err)
+		}
+		c.state.JournalSince = time.Now()
+		return c
+	}
+	if err := json.Unmarshal(jsonData, &c.state); err != nil {
+		log.Printf("Discarding corrupt authentication log positions: %v", err)
+		c.state = authState{JournalSince: time.Now()}
+	}
+	return c
+}
+
+// Collect returns the authentication events logged since the previous call
+func (c *authCollector) Collect(ctx context.Context) ([]AuthEvent, error) {
+	var events []AuthEvent
+	var errs []string
+
+	// sshd and sudo log to syslog files where rsyslog runs, and only to the
+	// journal otherwise; reading both would report events twice
+	authLog := ""
+	for _, path := range authLogPaths {
+		if _, err := os.Stat(path); err == nil {
+			authLog = path
+			break
+		}
+	}
+
+	if authLog != "" {
+		found, err := c.readAuthLog(authLog, maxAuthEvents)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", authLog, err))
+		}
+		events = append(events, found...)
+	} else if _, err := exec.LookPath("journalctl"); err == nil {
+		found, err := c.readJournal(ctx, maxAuthEvents)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("journal: %v", err))
+		}
+		events = append(events, found...)
+	}
+
+	found, err := c.readWtmp(maxAuthEvents)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("wtmp: %v", err))
+	}
+	events = append(events, found...)
+
+	c.save()
+
+	log.Printf("Successfully collected %d authentication events", len(events))
+	if len(errs) > 0 {
+		return events, fmt.Errorf("failed to read authentication events: %s", strings.Join(errs, "; "))
+	}
+	return events, nil
+}
+
+// readAuthLog parses the lines appended to a syslog file. After a rotation
+// the rest of the rotated file is read before the new one.
+func (c *authCollector) readAuthLog(path string, limit int) ([]AuthEvent, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	identity, _ := statIdentity(info)
+
+	position := &c.state.AuthLog
+	if position.Path != path {
+		*position = logPosition{Path: path, Dev: identity.Dev, Inode: identity.Inode, Offset: info.Size()}
+		return nil, nil
+	}
+
+	var events []AuthEvent
+	if identity.Dev != position.Dev || identity.Inode != position.Inode {
+		rotatedPath := path + ".1"
+		if rotated, err := os.Stat(rotatedPath); err == nil {
+			if rotatedIdentity, _ := statIdentity(rotated); rotatedIdentity.Dev == position.Dev && rotatedIdentity.Inode == position.Inode {
+				events, _, err = readLogLines(rotatedPath, position.Offset, limit, parseAuthLogLine)
+				if err != nil {
+					log.Printf("Error reading rotated %s: %v", rotatedPath, err)
+				}
+			}
+		}
+		*position = logPosition{Path: path, Dev: identity.Dev, Inode: identity.Inode}
+	} else if info.Size() < position.Offset {
+		// Truncated in place
+		position.Offset = 0
+	}
+
+	found, offset, err := readLogLines(path, position.Offset, limit-len(events), parseAuthLogLine)
+	position.Offset = offset
+	return append(events, found...), err
+}
+
+// readLogLines parses the complete lines of a file from offset on, stopping
+// after limit events or maxAuthLogRead bytes. It returns the offset reading
+// should resume from.
+func readLogLines(path string, offset int64, limit int, parse func(line string, now time.Time) *AuthEvent) ([]AuthEvent, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	reader := bufio.NewReader(io.LimitReader(file, maxAuthLogRead))
+	now := time.Now()
+	var events []AuthEvent
+	for len(events) < limit {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial last line is read again once it is complete
+			if err == io.EOF {
+				break
+			}
+			return events, offset, err
+		}
+		offset += int64(len(line))
+
+		if event := parse(strings.TrimRight(line, "\r\n"), now); event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	return events, offset, nil
+}
+
+// parseAuthLogLine parses a traditional ("Jan 15 10:30:12 host sshd[42]:")
+// or RFC 3339 ("2024-01-15T10:30:12.418+00:00 host sshd[42]:") syslog line
+func parseAuthLogLine(line string, now time.Time) *AuthEvent {
+	var timestamp time.Time
+	var rest string
+	if len(line) > 16 && line[3] == ' ' && line[15] == ' ' {
+		parsed, err := time.ParseInLocation(time.Stamp, line[:15], time.Local)
+		if err != nil {
+			return nil
+		}
+		// Traditional timestamps have no year
+		timestamp = parsed.AddDate(now.Year(), 0, 0)
+		if timestamp.After(now.Add(24 * time.Hour)) {
+			timestamp = timestamp.AddDate(-1, 0, 0)
+		}
+		rest = line[16:]
+	} else {
+		stamp, remainder, found := strings.Cut(line, " ")
+		parsed, err := time.Parse(time.RFC3339Nano, stamp)
+		if !found || err != nil {
+			return nil
+		}
+		timestamp = parsed
+		rest = remainder
+	}
+
+	// Skip the hostname
+	_, rest, found := strings.Cut(rest, " ")
+	if !found {
+		return nil
+	}
+
+	var program, message string
+	var pid int32
+	if match := syslogPattern.FindStringSubmatch(rest); match != nil {
+		program, message = match[1], match[3]
+		if parsed, err := strconv.ParseInt(match[2], 10, 32); err == nil {
+			pid = int32(parsed)
+		}
+	} else if match := syslogNoPIDPattern.FindStringSubmatch(rest); match != nil {
+		program, message = match[1], match[2]
+	} else {
+		return nil
+	}
+
+	return parseAuthMessage(program, pid, message, timestamp.UTC(), AuthSourceAuthLog)
+}
+
+// parseAuthMessage recognizes sshd logins and sudo runs, successful or not
+func parseAuthMessage(program string, pid int32, message string, timestamp time.Time, source string) *AuthEvent {
+	count := 1
+	if match := repeatedPattern.FindStringSubmatch(message); match != nil {
+		count, _ = strconv.Atoi(match[1])
+		message = match[2]
+	}
+
+	event := &AuthEvent{
+		Timestamp: timestamp,
+		PID:       pid,
+		Count:     count,
+		Source:    source,
+		Message:   truncateString(strings.TrimSpace(message), maxAuthMessageLength),
+	}
+
+	switch program {
+	case "sshd", "sshd-session":
+		match := sshAcceptedPattern.FindStringSubmatch(message)
+		event.Success = match != nil
+		if match == nil {
+			match = sshFailedPattern.FindStringSubmatch(message)
+		}
+		if match == nil {
+			return nil
+		}
+		event.Type = AuthEventSSH
+		event.Method = match[1]
+		event.User = match[2]
+		event.SourceIP = match[3]
+		event.SourcePort, _ = strconv.Atoi(match[4])
+
+	case "sudo":
+		match := sudoPattern.FindStringSubmatch(message)
+		if match == nil {
+			return nil
+		}
+		event.Type = AuthEventSudo
+		event.User = match[1]
+		event.TTY = match[3]
+		event.TargetUser = match[4]
+		event.Command = match[5]
+
+		failure := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(match[2]), ";"))
+		event.Success = failure == ""
+		if attempts := sudoAttemptsRegexp.FindStringSubmatch(failure); attempts != nil {
+			event.Method = "password"
+			event.Count, _ = strconv.Atoi(attempts[1])
+		}
+
+	default:
+		return nil
+	}
+
+	if event.Count <= 1 {
+		event.Count = 0
+	}
+	return event
+}
+
+// journalEntry holds the fields read from journalctl's JSON output. MESSAGE
+// is an array of bytes when it is not valid UTF-8.
+type journalEntry struct {
+	Cursor            string          `json:"__CURSOR"`
+	RealtimeTimestamp string          `json:"__REALTIME_TIMESTAMP"`
+	Message           json.RawMessage `json:"MESSAGE"`
+	Comm              string          `json:"_COMM"`
+	SyslogIdentifier  string          `json:"SYSLOG_IDENTIFIER"`
+	PID               string          `json:"_PID"`
+}
+
+// readJournal parses the sshd and sudo journal entries logged after the
+// saved cursor, or since the agent first ran
+func (c *authCollector) readJournal(ctx context.Context, limit int) ([]AuthEvent, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := []string{"--no-pager", "-o", "json"}
+	if c.state.JournalCursor != "" {
+		args = append(args, "--after-cursor="+c.state.JournalCursor)
+	} else {
+		args = append(args, fmt.Sprintf("--since=@%d", c.state.JournalSince.Unix()))
+	}
+	args = append(args, "_COMM=sshd", "_COMM=sshd-session", "_COMM=sudo")
+
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var events []AuthEvent
+	var read int
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for len(events) < limit && read < maxAuthLogRead && scanner.Scan() {
+		read += len(scanner.Bytes())
+
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		c.state.JournalCursor = entry.Cursor
+
+		program := entry.SyslogIdentifier
+		if program == "" {
+			program = entry.Comm
+		}
+		micros, err := strconv.ParseInt(entry.RealtimeTimestamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		pid, _ := strconv.ParseInt(entry.PID, 10, 32)
+
+		event := parseAuthMessage(program, int32(pid), journalMessage(entry.Message), time.UnixMicro(micros).UTC(), AuthSourceJournal)
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	// Stop journalctl when the limit cut the output short
+	cancel()
+	waitErr := cmd.Wait()
+	if scanErr := scanner.Err(); scanErr != nil {
+		return events, scanErr
+	}
+	var exitErr *exec.ExitError
+	if waitErr != nil && ctx.Err() == nil && !errors.As(waitErr, &exitErr) {
+		return events, waitErr
+	}
+	return events, nil
+}
+
+func journalMessage(raw json.RawMessage) string {
+	var message string
+	if err := json.Unmarshal(raw, &message); err == nil {
+		return message
+	}
+	var data []byte
+	if err := json.Unmarshal(raw, &data); err == nil {
+		return string(data)
+	}
+	return ""
+}
+
+// save persists the read positions; without a state path they are only kept
+// in memory
+func (c *authCollector) save() {
+	if c.statePath == "" {
+		return
+	}
+	jsonData, err := json.Marshal(c.state)
+	if err != nil {
+		log.Printf("Error saving authentication log positions: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.statePath), 0700); err != nil {
+		log.Printf("Error saving authentication log positions: %v", err)
+		return
+	}
+	if err := writeFileAtomic(c.statePath, jsonData); err != nil {
+		log.Printf("Error saving authentication log positions: %v", err)
+	}
+}
+
+// defaultAuthStatePath returns the per-user location of the read positions
+func defaultAuthStatePath() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "auth.json")
+}
+
+func truncateString(value string, maxLength int) string {
+	if len(value) <= maxLength {
+		return value
+	}
+	return value[:maxLength]
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Persistence item types
+const (
+	PersistenceSystemdUnit  = "systemd_unit"
+	PersistenceCron         = "cron"
+	PersistenceAutostart    = "autostart"
+	PersistenceShellRC      = "shell_rc"
+	PersistenceLDPreload    = "ld_preload"
+	PersistenceKernelModule = "kernel_module"
+	PersistenceLaunchd      = "launchd"
+)
+
+// Whether a persistence item runs for the whole host or for one user
+const (
+	PersistenceScopeSystem = "system"
+	PersistenceScopeUser   = "user"
+)
+
+const (
+	// maxPersistenceFileSize caps the files read for their commands; larger
+	// files are still hashed
+	maxPersistenceFileSize = 1024 * 1024
+
+	maxPersistenceCommands = 50
+)
+
+// PersistenceItem is something the host runs automatically at boot, login,
+// on a schedule or in every process: a systemd unit, cron table, autostart
+// entry, shell startup file, preloaded library or kernel module. Key is
+// stable across collections and identifies the item to the backend.
+type PersistenceItem struct {
+	Key        string    `json:"key"`
+	Type       string    `json:"type"`
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Scope      string    `json:"scope"`
+	User       string    `json:"user,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	UID        *uint32   `json:"uid,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode,omitempty"`
+	LinkTarget string    `json:"link_target,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Commands   []string  `json:"commands,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// persistenceLocation is a set of files of one persistence type. Patterns
+// starting with "~/" are expanded in every home directory.
+type persistenceLocation struct {
+	itemType string
+	patterns []string
+	commands func(path string, content []byte) []string
+	detail   func(path string, content []byte) string
+}
+
+var systemdUnitPatterns = []string{"*.service", "*.timer", "*.socket", "*.path", "*.wants/*", "*.requires/*"}
+
+// persistenceLocations returns where each persistence type lives on this OS
+func persistenceLocations() []persistenceLocation {
+	cronLocation := persistenceLocation{
+		itemType: PersistenceCron,
+		patterns: []string{
+			"/etc/crontab",
+			"/etc/anacrontab",
+			"/etc/cron.d/*",
+			"/etc/cron.hourly/*",
+			"/etc/cron.daily/*",
+			"/etc/cron.weekly/*",
+			"/etc/cron.monthly/*",
+			"/var/spool/cron/*",
+			"/var/spool/cron/crontabs/*",
+			"/var/at/tabs/*",
+		},
+		commands: cronCommands,
+	}
+
+	shellRCLocation := persistenceLocation{
+		itemType: PersistenceShellRC,
+		patterns: []string{
+			"/etc/profile",
+			"/etc/profile.d/*",
+			"/etc/bash.bashrc",
+			"/etc/bashrc",
+			"/etc/environment",
+			"/etc/zshrc",
+			"/etc/zprofile",
+			"/etc/zsh/zshrc",
+			"/etc/zsh/zprofile",
+			"~/.bashrc",
+			"~/.bash_profile",
+			"~/.bash_login",
+			"~/.bash_logout",
+			"~/.profile",
+			"~/.zshrc",
+			"~/.zprofile",
+			"~/.zshenv",
+		},
+		commands: shellRCCommands,
+	}
+
+	if runtime.GOOS == "darwin" {
+		return []persistenceLocation{
+			{
+				itemType: PersistenceLaunchd,
+				patterns: []string{
+					"/Library/LaunchAgents/*.plist",
+					"/Library/LaunchDaemons/*.plist",
+					"/System/Library/LaunchAgents/*.plist",
+					"/System/Library/LaunchDaemons/*.plist",
+					"~/Library/LaunchAgents/*.plist",
+				},
+			},
+			cronLocation,
+			shellRCLocation,
+		}
+	}
+
+	var unitPatterns []string
+	for _, dir := range []string{
+		"/etc/systemd/system",
+		"/usr/local/lib/systemd/system",
+		"/usr/lib/systemd/system",
+		"/lib/systemd/system",
+		"/etc/systemd/user",
+		"/usr/lib/systemd/user",
+		"~/.config/systemd/user",
+	} {
+		for _, pattern := range systemdUnitPatterns {
+			unitPatterns = append(unitPatterns, dir+"/"+pattern)
+		}
+	}
+
+	return []persistenceLocation{
+		{itemType: PersistenceSystemdUnit, patterns: unitPatterns, commands: systemdUnitCommands},
+		cronLocation,
+		{
+			itemType: PersistenceAutostart,
+			patterns: []string{"/etc/xdg/autostart/*.desktop", "~/.config/autostart/*.desktop"},
+			commands: desktopEntryCommands,
+			detail:   desktopEntryDetail,
+		},
+		shellRCLocation,
+		{itemType: PersistenceLDPreload, patterns: []string{"/etc/ld.so.preload"}, commands: preloadLibraries},
+	}
+}
+
+// cachedPersistenceHash is the hash of a file as of its size and mtime
+type cachedPersistenceHash struct {
+	size       int64
+	modifiedAt time.Time
+	sha256     string
+}
+
+// persistenceCollector inventories persistence items. Hashes are cached
+// while a file's size and mtime are unchanged, and the previous inventory
+// is kept to log what was added and removed.
+type persistenceCollector struct {
+	hashes   map[string]cachedPersistenceHash
+	owners   map[uint32]string
+	previous map[string]PersistenceItem
+}
+
+func newPersistenceCollector() *persistenceCollector {
+	return &persistenceCollector{
+		hashes: make(map[string]cachedPersistenceHash),
+		owners: make(map[uint32]string),
+	}
+}
+
+// Collect returns every persistence item on the host, ordered by key. Items
+// that cannot be read are skipped.
+func (c *persistenceCollector) Collect(ctx context.Context) ([]PersistenceItem, error) {
+	homes := homeDirectories()
+	items := []PersistenceItem{}
+	seen := make(map[string]bool)
+	hashes := make(map[string]cachedPersistenceHash)
+
+	for _, location := range persistenceLocations() {
+		for _, pattern := range location.patterns {
+			for _, match := range expandPersistencePattern(pattern, homes) {
+				if ctx.Err() != nil {
+					return items, ctx.Err()
+				}
+
+				// /lib is a symlink to /usr/lib on merged-/usr systems
+				match.path = resolveParentDir(match.path)
+				key := location.itemType + ":" + match.path
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				item, ok := c.describe(ctx, location, match, hashes)
+				if !ok {
+					continue
+				}
+				item.Key = key
+				items = append(items, item)
+			}
+		}
+	}
+
+	modules, err := collectKernelModules(ctx, c, hashes)
+	if err != nil {
+		log.Printf("Error listing kernel modules: %v", err)
+	}
+	items = append(items, modules...)
+
+	// Forget the hashes of files that are gone
+	c.hashes = hashes
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	c.logChanges(items)
+
+	log.Printf("Successfully collected %d persistence items", len(items))
+	if err != nil {
+		return items, fmt.Errorf("failed to list kernel modules: %w", err)
+	}
+	return items, nil
+}
+
+// persistenceMatch is a file matched by a location pattern, with the user
+// whose home directory it is in
+type persistenceMatch struct {
+	path string
+	user string
+}
+
+func expandPersistencePattern(pattern string, homes map[string]string) []persistenceMatch {
+	var matches []persistenceMatch
+	if rest, ok := strings.CutPrefix(pattern, "~/"); ok {
+		for home, username := range homes {
+			paths, _ := filepath.Glob(filepath.Join(home, rest))
+			for _, path := range paths {
+				matches = append(matches, persistenceMatch{path: path, user: username})
+			}
+		}
+		return matches
+	}
+
+	paths, _ := filepath.Glob(pattern)
+	for _, path := range paths {
+		matches = append(matches, persistenceMatch{path: path})
+	}
+	return matches
+}
+
+// resolveParentDir resolves symlinks in the directory of path, leaving the
+// file itself alone so enablement symlinks are reported as such
+func resolveParentDir(path string) string {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return path
+	}
+	return filepath.Join(dir, filepath.Base(path))
+}
+
+// homeDirectories maps the home directories on the host to their users: the
+// agent user's, and every user's when the agent runs as root
+func homeDirectories() map[string]string {
+	homes := make(map[string]string)
+	if current, err := user.Current(); err == nil && current.HomeDir != "" {
+		homes[current.HomeDir] = current.Username
+	}
+
+	for _, pattern := range []string{"/home/*", "/Users/*", "/root"} {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				if _, known := homes[path]; !known {
+					homes[path] = filepath.Base(path)
+				}
+			}
+		}
+	}
+	return homes
+}
+
+// describe reads the state of a persistence file. Directories are skipped.
+func (c *persistenceCollector) describe(ctx context.Context, location persistenceLocation, match persistenceMatch, hashes map[string]cachedPersistenceHash) (PersistenceItem, bool) {
+	info, err := os.Lstat(match.path)
+	if err != nil || info.IsDir() {
+		return PersistenceItem{}, false
+	}
+
+	item := PersistenceItem{
+		Type:       location.itemType,
+		Path:       match.path,
+		Name:       filepath.Base(match.path),
+		Scope:      PersistenceScopeSystem,
+		User:       match.user,
+		Size:       info.Size(),
+		Mode:       fileModeString(info.Mode()),
+		ModifiedAt: info.ModTime().UTC(),
+	}
+	if match.user != "" || strings.Contains(match.path, "/systemd/user/") {
+		item.Scope = PersistenceScopeUser
+	}
+	if uid, _, ok := statOwner(info); ok {
+		item.UID = &uid
+		item.Owner = c.ownerName(uid)
+	}
+
+	// Enablement symlinks such as multi-user.target.wants/foo.service point
+	// at the unit they enable
+	if info.Mode()&os.ModeSymlink != 0 {
+		item.LinkTarget, _ = os.Readlink(match.path)
+		return item, true
+	}
+	if !info.Mode().IsRegular() {
+		return PersistenceItem{}, false
+	}
+
+	item.SHA256 = c.hash(ctx, match.path, info, hashes)
+
+	if (location.commands != nil || location.detail != nil) && info.Size() <= maxPersistenceFileSize {
+		if content, err := os.ReadFile(match.path); err == nil {
+			if location.commands != nil {
+				item.Commands = limitCommands(location.commands(match.path, content))
+			}
+			if location.detail != nil {
+				item.Detail = location.detail(match.path, content)
+			}
+		}
+	}
+
+	return item, true
+}
+
+// hash returns the SHA-256 of a file, from the cache while its size and
+// mtime are unchanged
+func (c *persistenceCollector) hash(ctx context.Context, path string, info os.FileInfo, hashes map[string]cachedPersistenceHash) string {
+	if cached, found := c.hashes[path]; found && cached.size == info.Size() && cached.modifiedAt.Equal(info.ModTime()) {
+		hashes[path] = cached
+		return cached.sha256
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fileInspectionTimeout)
+	defer cancel()
+	sha256, err := getFileSHA256(ctx, path)
+	if err != nil {
+		return ""
+	}
+
+	hashes[path] = cachedPersistenceHash{size: info.Size(), modifiedAt: info.ModTime(), sha256: sha256}
+	return sha256
+}
+
+func (c *persistenceCollector) ownerName(uid uint32) string {
+	if name, found := c.owners[uid]; found {
+		return name
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	if owner, err := user.LookupId(name); err == nil {
+		name = owner.Username
+	}
+	c.owners[uid] = name
+	return name
+}
+
+// logChanges logs the items added, removed and modified since the previous
+// collection
+func (c *persistenceCollector) logChanges(items []PersistenceItem) {
+	current := make(map[string]PersistenceItem, len(items))
+	for _, item := range items {
+		current[item.Key] = item
+	}
+
+	if c.previous != nil {
+		for key, item := range current {
+			previous, found := c.previous[key]
+			if !found {
+				log.Printf("Persistence item added: %s (sha256 %s)", key, item.SHA256)
+			} else if persistenceItemChanged(previous, item) {
+				log.Printf("Persistence item modified: %s (sha256 %s -> %s)", key, previous.SHA256, item.SHA256)
+			}
+		}
+		for key := range c.previous {
+			if _, found := current[key]; !found {
+				log.Printf("Persistence item removed: %s", key)
+			}
+		}
+	}
+
+	c.previous = current
+}
+
+// persistenceItemChanged compares what an item runs and who may change it
+func persistenceItemChanged(previous, current PersistenceItem) bool {
+	return previous.SHA256 != current.SHA256 || previous.LinkTarget != current.LinkTarget ||
+		previous.Mode != current.Mode || !equalOwner(previous.UID, current.UID) || previous.Detail != current.Detail
+}
+
+func limitCommands(commands []string) []string {
+	if len(commands) > maxPersistenceCommands {
+		commands = commands[:maxPersistenceCommands]
+	}
+	for i, command := range commands {
+		commands[i] = truncateString(command, maxAuthMessageLength)
+	}
+	return commands
+}
+
+// contentLines returns the non-empty lines of a file that are not comments
+func contentLines(content []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	scanner.Buffer(make([]byte, 64*1024), maxPersistenceFileSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// cronCommands returns the commands a cron table runs. Files in the
+// cron.{hourly,daily,...} directories are scripts and run as a whole.
+func cronCommands(path string, content []byte) []string {
+	if strings.Contains(filepath.Dir(path), "/cron.") && !strings.HasSuffix(filepath.Dir(path), "/cron.d") {
+		return nil
+	}
+
+	// System tables have a user field after the schedule
+	systemTable := path == "/etc/crontab" || strings.HasPrefix(path, "/etc/cron.d/")
+	var commands []string
+	for _, line := range contentLines(content) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || (strings.Contains(fields[0], "=") && !strings.HasPrefix(fields[0], "@")) {
+			// Variable assignment, e.g. PATH=...
+			continue
+		}
+
+		skip := 5
+		if strings.HasPrefix(fields[0], "@") {
+			skip = 1
+		}
+		if path == "/etc/anacrontab" {
+			skip = 3
+		} else if systemTable {
+			skip++
+		}
+		if len(fields) > skip {
+			commands = append(commands, strings.Join(fields[skip:], " "))
+		}
+	}
+	return commands
+}
+
+// systemdUnitCommands returns what a unit runs and what it activates
+func systemdUnitCommands(path string, content []byte) []string {
+	var commands []string
+	for _, line := range contentLines(content) {
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "ExecStart", "ExecStartPre", "ExecStartPost", "ExecStop", "ExecReload", "Unit", "Environment", "EnvironmentFile":
+			commands = append(commands, strings.TrimSpace(key)+"="+strings.TrimSpace(value))
+		}
+	}
+	return commands
+}
+
+// desktopEntryCommands returns the command an XDG autostart entry runs
+func desktopEntryCommands(path string, content []byte) []string {
+	for _, line := range contentLines(content) {
+		if value, found := strings.CutPrefix(line, "Exec="); found {
+			return []string{value}
+		}
+	}
+	return nil
+}
+
+// desktopEntryDetail reports an autostart entry that is switched off
+func desktopEntryDetail(path string, content []byte) string {
+	for _, line := range contentLines(content) {
+		switch line {
+		case "Hidden=true", "X-GNOME-Autostart-enabled=false":
+			return "disabled"
+		}
+	}
+	return ""
+}
+
+// shellRCCommands returns the lines of a shell startup file that change what
+// runs: preloads, PATH changes, aliases and sourced files
+func shellRCCommands(path string, content []byte) []string {
+	var commands []string
+	for _, line := range contentLines(content) {
+		if strings.Contains(line, "LD_PRELOAD") || strings.Contains(line, "LD_LIBRARY_PATH") ||
+			strings.Contains(line, "PROMPT_COMMAND") || strings.HasPrefix(line, "alias ") ||
+			strings.HasPrefix(line, "trap ") || strings.Contains(line, "curl ") || strings.Contains(line, "wget ") ||
+			strings.Contains(line, "nohup ") || strings.Contains(line, "/dev/tcp/") {
+			commands = append(commands, line)
+		}
+	}
+	return commands
+}
+
+// preloadLibraries returns the libraries /etc/ld.so.preload loads into every
+// process
+func preloadLibraries(path string, content []byte) []string {
+	var libraries []string
+	for _, line := range contentLines(content) {
+		libraries = append(libraries, strings.Fields(line)...)
+	}
+	return libraries
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// collectKernelModules lists the loaded kernel modules with the file each
+// was loaded from. Detail holds the module's taint flags, e.g. "OE" for an
+// unsigned out-of-tree module.
+func collectKernelModules(ctx context.Context, c *persistenceCollector, hashes map[string]cachedPersistenceHash) ([]PersistenceItem, error) {
+	// Kernels built without module support have no /proc/modules
+	file, err := os.Open("/proc/modules")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	paths := kernelModulePaths()
+
+	var items []PersistenceItem
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+
+		item := PersistenceItem{
+			Key:   PersistenceKernelModule + ":" + name,
+			Type:  PersistenceKernelModule,
+			Name:  name,
+			Scope: PersistenceScopeSystem,
+		}
+		if len(fields) > 6 {
+			item.Detail = strings.Trim(fields[6], "()")
+		}
+
+		if path, found := paths[name]; found {
+			if info, err := os.Stat(path); err == nil {
+				item.Path = path
+				item.Size = info.Size()
+				item.Mode = fileModeString(info.Mode())
+				item.ModifiedAt = info.ModTime().UTC()
+				if uid, _, ok := statOwner(info); ok {
+					item.UID = &uid
+					item.Owner = c.ownerName(uid)
+				}
+				item.SHA256 = c.hash(ctx, path, info, hashes)
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// kernelModulePaths maps module names to their files, from the running
+// kernel's modules.dep. Module names use underscores where file names may
+// use dashes.
+func kernelModulePaths() map[string]string {
+	paths := make(map[string]string)
+
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return paths
+	}
+	dir := filepath.Join("/lib/modules", strings.TrimSpace(string(release)))
+
+	file, err := os.Open(filepath.Join(dir, "modules.dep"))
+	if err != nil {
+		return paths
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		module, _, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		name, _, _ := strings.Cut(filepath.Base(module), ".ko")
+		paths[strings.ReplaceAll(name, "-", "_")] = filepath.Join(dir, module)
+	}
+	return paths
+}
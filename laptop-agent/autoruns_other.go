@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// collectKernelModules is only implemented for Linux; loaded kernel
+// extensions are not listed elsewhere
+func collectKernelModules(ctx context.Context, c *persistenceCollector, hashes map[string]cachedPersistenceHash) ([]PersistenceItem, error) {
+	return nil, nil
+}
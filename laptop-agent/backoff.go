@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRetryAfter bounds how long the agent heeds a Retry-After, so a
+	// misconfigured proxy cannot silence it for days
+	maxRetryAfter = time.Hour
+
+	// defaultStartupJitter bounds the random delay before the first
+	// collection
+	defaultStartupJitter = 30 * time.Second
+
+	// minCollectionInterval and maxCollectionInterval bound the collection
+	// interval the service may recommend
+	minCollectionInterval = 10 * time.Second
+	maxCollectionInterval = 24 * time.Hour
+)
+
+// retryBackoff spaces out retries exponentially with full jitter: each delay
+// is random up to a ceiling that doubles with every failure, so agents that
+// lost the service at the same moment do not retry in step
+type retryBackoff struct {
+	initial  time.Duration
+	max      time.Duration
+	attempts int
+}
+
+// next returns the delay before the next retry
+func (b *retryBackoff) next() time.Duration {
+	ceiling := b.max
+	if b.attempts < 32 {
+		if d := b.initial << b.attempts; d > 0 && d < b.max {
+			ceiling = d
+		}
+	}
+	b.attempts++
+	return jitter(ceiling)
+}
+
+// reset starts over after a success
+func (b *retryBackoff) reset() {
+	b.attempts = 0
+}
+
+// jitter returns a random duration up to d
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// throttledError is returned without contacting the service while the
+// agent waits out a Retry-After
+type throttledError struct {
+	Until time.Time
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("telemetry service asked to wait until %s", e.Until.Format(time.RFC3339))
+}
+
+// retryAfter returns how long the service asked the agent to wait before
+// trying again, or 0
+func retryAfter(err error) time.Duration {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		return max(time.Until(throttled.Until), 0)
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header of a 429 or 503 response, in
+// seconds or as an HTTP date. Other statuses, or a missing or unreadable
+// header, give 0.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = time.Until(at)
+	}
+	return min(max(wait, 0), maxRetryAfter)
+}
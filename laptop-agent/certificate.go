@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certificateCheckInterval is how often the agent checks whether its client
+// certificate is due for renewal
+const certificateCheckInterval = time.Hour
+
+// newTLSConfig trusts the CAs in caFile, or the system's without one
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in TLS_CA_FILE %s", caFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// loadClientCertificate reads a certificate and its key, or returns nil if
+// neither has been written yet
+func loadClientCertificate(certPath, keyPath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate %s: %w", certPath, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate %s: %w", certPath, err)
+		}
+	}
+	return &cert, nil
+}
+
+// certificateDue reports whether a certificate is missing, expired, or in
+// the last third of its lifetime, when the agent renews it
+func certificateDue(cert *tls.Certificate, now time.Time) bool {
+	if cert == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return now.After(cert.Leaf.NotAfter.Add(-lifetime / 3))
+}
+
+// getClientCertificate presents the current client certificate in TLS
+// handshakes, or none before the agent has one
+func (c *apiClient) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.certMu.Lock()
+	defer c.certMu.Unlock()
+
+	if c.certificate == nil {
+		return &tls.Certificate{}, nil
+	}
+	return c.certificate, nil
+}
+
+// RunCertificateRotation renews the client certificate before it expires,
+// until ctx is done
+func (c *apiClient) RunCertificateRotation(ctx context.Context) {
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.renewCertificateIfDue(ctx)
+		}
+	}
+}
+
+// renewCertificateIfDue renews the client certificate if it is missing or
+// due. The service only issues certificates to enrolled devices, so the
+// agent enrolls first if it has not. Failures are logged, as the current
+// certificate may still be good.
+func (c *apiClient) renewCertificateIfDue(ctx context.Context) {
+	c.certMu.Lock()
+	due := certificateDue(c.certificate, time.Now())
+	c.certMu.Unlock()
+	if !due {
+		return
+	}
+
+	if err := c.renewCertificate(ctx); err != nil {
+		log.Printf("Failed to renew client certificate: %v", err)
+	}
+}
+
+// renewCertificate has the service sign a new key for this device and saves
+// both before the agent presents them
+func (c *apiClient) renewCertificate(ctx context.Context) error {
+	credential, err := c.credential(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	identity := c.identity
+	c.mu.Unlock()
+	c.certMu.Lock()
+	current := c.certificate
+	c.certMu.Unlock()
+	if credential == "" && current == nil {
+		return errors.New("the device must enroll first; set ENROLLMENT_TOKEN")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	// The service names the certificate after the device it authenticated,
+	// whatever the subject; this one just makes the request readable
+	var subject pkix.Name
+	if identity != nil {
+		subject.CommonName = identity.DeviceID
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	request := map[string]string{
+		"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	}
+	var response struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := c.send(ctx, c.certificateEndpoint, credential, request, &response); err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	certPEM := []byte(response.Certificate)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("the service returned an unusable certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("the service returned an unusable certificate: %w", err)
+		}
+	}
+
+	// The key goes first: a certificate without its key fails to load, and
+	// the agent then asks for a new one
+	for _, path := range []string{c.clientKeyPath, c.clientCertPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to save client certificate: %w", err)
+		}
+	}
+	if err := writeFileAtomic(c.clientKeyPath, keyPEM); err != nil {
+		return fmt.Errorf("failed to save client key: %w", err)
+	}
+	if err := writeFileAtomic(c.clientCertPath, certPEM); err != nil {
+		return fmt.Errorf("failed to save client certificate: %w", err)
+	}
+
+	c.certMu.Lock()
+	c.certificate = &cert
+	c.certMu.Unlock()
+
+	// Connections made with the old certificate would keep using it
+	c.transport.CloseIdleConnections()
+
+	log.Printf("Client certificate renewed, valid until %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// defaultCertificateEndpoint derives the certificate endpoint from the
+// telemetry endpoint, e.g. https://host/api/telemetry becomes
+// https://host/api/agent/certificate
+func defaultCertificateEndpoint(apiEndpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(apiEndpoint, "/"), "/telemetry") + "/agent/certificate"
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// agentUserAgent identifies the agent in its requests
+	agentUserAgent = "SmartSec-Laptop-Agent/1.0"
+
+	// maxResponseSize bounds the responses the agent reads
+	maxResponseSize = 1024 * 1024
+)
+
+// apiClient makes the agent's requests to the telemetry service. With an
+// enrollment token it enrolls the device before its first request, and from
+// then on authenticates every request with the credential it was issued.
+// Without one, requests are unauthenticated and the service identifies the
+// device by its MAC address. With TLS_CLIENT_CERT and TLS_CLIENT_KEY it
+// presents a client certificate, which RunCertificateRotation obtains and
+// renews.
+type apiClient struct {
+	client              *http.Client
+	transport           *http.Transport
+	identityPath        string
+	enrollmentToken     string
+	enrollmentEndpoint  string
+	clientCertPath      string
+	clientKeyPath       string
+	certificateEndpoint string
+
+	mu          sync.Mutex // the spool, collections and tasks send concurrently
+	identity    *deviceIdentity
+	compression string
+	chunkSize   int
+	plainUntil  time.Time // the service refused compressed telemetry; it is retried after this
+
+	// certMu is apart from mu, as handshakes of requests made under mu,
+	// such as enrolling, read the certificate
+	certMu      sync.Mutex
+	certificate *tls.Certificate
+
+	// throttledUntil is when the Retry-After the service last sent ends, in
+	// Unix nanoseconds; requests made before then fail without being sent
+	throttledUntil atomic.Int64
+
+	// collectionInterval is the interval the service last recommended, or 0
+	collectionInterval atomic.Int64
+}
+
+// newAPIClient loads the device identity and client certificate. A saved
+// identity that cannot be read is an error rather than a reason to enroll
+// again, which would leave the device's history under its old ID; a
+// certificate that cannot be read is replaced.
+func newAPIClient(config Config) (*apiClient, error) {
+	identity, err := loadDeviceIdentity(config.IdentityPath)
+	if err != nil {
+		return nil, err
+	}
+	if (config.TLSClientCert == "") != (config.TLSClientKey == "") {
+		return nil, errors.New("TLS_CLIENT_CERT and TLS_CLIENT_KEY must be set together")
+	}
+	if !validCompression(config.UploadCompression) {
+		return nil, fmt.Errorf("invalid UPLOAD_COMPRESSION %q: must be %s, %s or %s", config.UploadCompression, compressionZstd, compressionGzip, compressionNone)
+	}
+	if config.UploadChunkSize <= 0 {
+		return nil, errors.New("UPLOAD_CHUNK_SIZE_MB must be positive")
+	}
+
+	tlsConfig, err := newTLSConfig(config.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	c := &apiClient{
+		client:              &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		transport:           transport,
+		identityPath:        config.IdentityPath,
+		enrollmentToken:     config.EnrollmentToken,
+		enrollmentEndpoint:  config.EnrollmentEndpoint,
+		clientCertPath:      config.TLSClientCert,
+		clientKeyPath:       config.TLSClientKey,
+		certificateEndpoint: config.CertificateEndpoint,
+		compression:         config.UploadCompression,
+		chunkSize:           config.UploadChunkSize,
+		identity:            identity,
+	}
+
+	if c.clientCertPath != "" {
+		c.certificate, err = loadClientCertificate(c.clientCertPath, c.clientKeyPath)
+		if err != nil {
+			log.Printf("Requesting a new client certificate: %v", err)
+		}
+		tlsConfig.GetClientCertificate = c.getClientCertificate
+	}
+	return c, nil
+}
+
+// usesClientCertificate reports whether the agent authenticates with a
+// client certificate
+func (c *apiClient) usesClientCertificate() bool {
+	return c.clientCertPath != ""
+}
+
+// post sends body as JSON to endpoint and decodes the response into
+// response unless it is nil
+func (c *apiClient) post(ctx context.Context, endpoint string, body any, response any) error {
+	credential, err := c.credential(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.send(ctx, endpoint, credential, body, response)
+	c.explainRejection(err, credential)
+	return err
+}
+
+// explainRejection logs what to do when the service refused a request
+// as unauthorized
+func (c *apiClient) explainRejection(err error, credential string) {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+		c.certMu.Lock()
+		certificate := c.certificate
+		c.certMu.Unlock()
+
+		switch {
+		case c.usesClientCertificate() && certificate == nil:
+			log.Printf("The agent has no client certificate yet; it requests one at %s", c.certificateEndpoint)
+		case credential != "":
+			log.Printf("The telemetry service rejected the credential of this device; remove %s to enroll again", c.identityPath)
+		default:
+			log.Printf("The telemetry service only accepts enrolled devices; set ENROLLMENT_TOKEN to enroll")
+		}
+	}
+}
+
+// credential returns the device's credential, enrolling first if the
+// device has an enrollment token but no identity yet, or "" without a token
+func (c *apiClient) credential(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.identity != nil {
+		return c.identity.Credential, nil
+	}
+	if c.enrollmentToken == "" {
+		return "", nil
+	}
+
+	identity, err := c.enroll(ctx)
+	if err != nil {
+		// Not wrapped: the status of the enrollment says nothing about
+		// whether the payload would be accepted
+		return "", fmt.Errorf("failed to enroll: %v", err)
+	}
+	c.identity = identity
+	return identity.Credential, nil
+}
+
+// deviceID returns the ID the service issued this device, or "" before it
+// enrolls
+func (c *apiClient) deviceID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.identity == nil {
+		return ""
+	}
+	return c.identity.DeviceID
+}
+
+// enroll exchanges the enrollment token for the device's ID and credential,
+// and saves them before they are used
+func (c *apiClient) enroll(ctx context.Context) (*deviceIdentity, error) {
+	hostInfo, err := collectHostMetadata(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect host metadata: %w", err)
+	}
+	macAddress, err := getMacAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	request := map[string]any{
+		"token":         c.enrollmentToken,
+		"mac_address":   macAddress,
+		"host_metadata": hostInfo,
+	}
+	var response struct {
+		DeviceID   string `json:"device_id"`
+		Credential string `json:"credential"`
+	}
+	if err := c.send(ctx, c.enrollmentEndpoint, "", request, &response); err != nil {
+		return nil, err
+	}
+	if response.DeviceID == "" || response.Credential == "" {
+		return nil, fmt.Errorf("no device ID or credential in the response")
+	}
+
+	identity := &deviceIdentity{
+		DeviceID:   response.DeviceID,
+		Credential: response.Credential,
+		EnrolledAt: time.Now(),
+	}
+	if err := saveDeviceIdentity(c.identityPath, identity); err != nil {
+		return nil, err
+	}
+	log.Printf("Enrolled as device %s, identity saved to %s", identity.DeviceID, c.identityPath)
+	return identity, nil
+}
+
+func (c *apiClient) send(ctx context.Context, endpoint, credential string, body any, response any) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return c.do(ctx, endpoint, credential, jsonData, nil, response)
+}
+
+// do posts payload, JSON encoded as header says, and accepts any success
+// status
+func (c *apiClient) do(ctx context.Context, endpoint, credential string, payload []byte, header http.Header, response any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	body, _, err := c.roundTrip(req, credential)
+	if err != nil || response == nil {
+		return err
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// fetch gets endpoint, returning the body and headers of a success
+func (c *apiClient) fetch(ctx context.Context, endpoint, credential string) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return c.roundTrip(req, credential)
+}
+
+// roundTrip sends a request with the agent's credential and reads the
+// response, failing with a statusError unless its status is a success.
+// While a Retry-After the service sent lasts, it fails right away.
+func (c *apiClient) roundTrip(req *http.Request, credential string) ([]byte, http.Header, error) {
+	if until := time.Unix(0, c.throttledUntil.Load()); time.Now().Before(until) {
+		return nil, nil, &throttledError{Until: until}
+	}
+
+	req.Header.Set("User-Agent", agentUserAgent)
+	if credential != "" {
+		req.Header.Set("Authorization", "Bearer "+credential)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		wait := parseRetryAfter(resp)
+		if wait > 0 {
+			c.throttledUntil.Store(time.Now().Add(wait).UnixNano())
+			log.Printf("The telemetry service asked the agent to wait %v (status %d)", wait, resp.StatusCode)
+		}
+		return nil, nil, &statusError{StatusCode: resp.StatusCode, RetryAfter: wait}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return body, resp.Header, nil
+}
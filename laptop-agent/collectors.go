@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Collector gathers one section of the telemetry payload
+type Collector interface {
+	// Name identifies the collector in the collectors configuration and in
+	// the payload
+	Name() string
+
+	// Interval is how often the collector runs unless configured otherwise;
+	// zero runs it with every collection
+	Interval() time.Duration
+
+	// Collect fills the collector's section of data. Collectors run in the
+	// order they were registered and may read the sections filled before
+	// them. An error marks the collector as failed; whatever it filled in
+	// is still sent.
+	Collect(ctx context.Context, data *TelemetryData) error
+}
+
+// collectorFunc adapts a function to the Collector interface
+type collectorFunc struct {
+	name     string
+	interval time.Duration
+	collect  func(ctx context.Context, data *TelemetryData) error
+}
+
+func (c collectorFunc) Name() string {
+	return c.name
+}
+
+func (c collectorFunc) Interval() time.Duration {
+	return c.interval
+}
+
+func (c collectorFunc) Collect(ctx context.Context, data *TelemetryData) error {
+	return c.collect(ctx, data)
+}
+
+// Outcomes of a collector in one collection
+const (
+	CollectorStatusOK       = "ok"
+	CollectorStatusFailed   = "failed"
+	CollectorStatusSkipped  = "skipped"  // not due in this collection
+	CollectorStatusDisabled = "disabled" // turned off in the configuration
+)
+
+// CollectorStatus reports how a collector fared in one collection
+type CollectorStatus struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// collectorStatus returns the status the named collector reported in the
+// payload, or "" if it is not registered
+func (t *TelemetryData) collectorStatus(name string) string {
+	for _, status := range t.Collectors {
+		if status.Name == name {
+			return status.Status
+		}
+	}
+	return ""
+}
+
+// CollectorSettings enables or schedules one collector. Unset fields keep
+// the collector's defaults.
+type CollectorSettings struct {
+	Enabled  *bool  `json:"enabled" yaml:"enabled"`
+	Interval string `json:"interval" yaml:"interval"` // a duration such as "1h"; "0" runs it with every collection
+}
+
+// mergeCollectorSettings returns base with the fields set in override
+// replacing those of the same collector
+func mergeCollectorSettings(base, override map[string]CollectorSettings) map[string]CollectorSettings {
+	merged := make(map[string]CollectorSettings, len(base)+len(override))
+	for name, setting := range base {
+		merged[name] = setting
+	}
+	for name, setting := range override {
+		current := merged[name]
+		if setting.Enabled != nil {
+			current.Enabled = setting.Enabled
+		}
+		if setting.Interval != "" {
+			current.Interval = setting.Interval
+		}
+		merged[name] = current
+	}
+	return merged
+}
+
+// loadCollectorSettings reads the collectors configuration: a JSON object
+// mapping collector names to their settings, e.g.
+//
+//	{"hashes": {"interval": "1h"}, "packages": {"enabled": false}}
+func loadCollectorSettings(path string) (map[string]CollectorSettings, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open collectors configuration: %w", err)
+	}
+	defer file.Close()
+
+	var settings map[string]CollectorSettings
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, fmt.Errorf("failed to parse collectors configuration %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// collectorRegistry runs the registered collectors on their schedules. Each
+// collection runs the collectors that are due; a collector's interval is
+// rounded to the nearest collection, so it runs at most once per
+// COLLECTION_INTERVAL.
+type collectorRegistry struct {
+	cycle      time.Duration
+	collectors []*scheduledCollector
+}
+
+type scheduledCollector struct {
+	Collector
+	enabled  bool
+	interval time.Duration
+	lastRun  time.Time
+}
+
+func newCollectorRegistry(cycle time.Duration) *collectorRegistry {
+	return &collectorRegistry{cycle: cycle}
+}
+
+// Register adds a collector, enabled on its default schedule
+func (r *collectorRegistry) Register(c Collector) {
+	r.collectors = append(r.collectors, &scheduledCollector{Collector: c, enabled: true, interval: c.Interval()})
+}
+
+// Configure applies the collectors configuration over the collectors'
+// defaults. Settings for collectors that are not registered, or with an
+// invalid interval, are rejected before any setting is applied, so a bad
+// configuration reloaded leaves the collectors as they were.
+func (r *collectorRegistry) Configure(settings map[string]CollectorSettings) error {
+	intervals := make(map[string]time.Duration)
+	for name, setting := range settings {
+		if r.lookup(name) == nil {
+			return fmt.Errorf("unknown collector %q, expected one of %s", name, strings.Join(r.Names(), ", "))
+		}
+		if setting.Interval != "" {
+			interval, err := time.ParseDuration(setting.Interval)
+			if err != nil || interval < 0 {
+				return fmt.Errorf("invalid interval %q for collector %s", setting.Interval, name)
+			}
+			intervals[name] = interval
+		}
+	}
+
+	for _, c := range r.collectors {
+		c.enabled, c.interval = true, c.Interval()
+		if setting := settings[c.Name()]; setting.Enabled != nil {
+			c.enabled = *setting.Enabled
+		}
+		if interval, ok := intervals[c.Name()]; ok {
+			c.interval = interval
+		}
+	}
+	return nil
+}
+
+// Disable turns a collector off regardless of the configuration
+func (r *collectorRegistry) Disable(name string) {
+	if c := r.lookup(name); c != nil {
+		c.enabled = false
+	}
+}
+
+// Enabled reports whether the named collector is registered and enabled
+func (r *collectorRegistry) Enabled(name string) bool {
+	c := r.lookup(name)
+	return c != nil && c.enabled
+}
+
+// Names lists the registered collectors in alphabetical order
+func (r *collectorRegistry) Names() []string {
+	names := make([]string, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		names = append(names, c.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *collectorRegistry) lookup(name string) *scheduledCollector {
+	for _, c := range r.collectors {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Run runs every enabled collector that is due, and those named in forced
+// whatever their schedule, recording each one's status in data. Failures
+// are also recorded as collection errors.
+func (r *collectorRegistry) Run(ctx context.Context, data *TelemetryData, forced []string) {
+	for _, c := range r.collectors {
+		name := c.Name()
+		status := CollectorStatus{Name: name, Status: CollectorStatusOK}
+
+		switch {
+		case !c.enabled:
+			status.Status = CollectorStatusDisabled
+		case !c.due(data.Timestamp, r.cycle) && !slices.Contains(forced, name):
+			status.Status = CollectorStatusSkipped
+		default:
+			start := time.Now()
+			err := c.Collect(ctx, data)
+			status.DurationMs = time.Since(start).Milliseconds()
+			c.lastRun = data.Timestamp
+			if err != nil {
+				log.Printf("Error collecting %s: %v", name, err)
+				data.addCollectionError(name, err)
+				status.Status = CollectorStatusFailed
+				status.Error = err.Error()
+			}
+		}
+
+		data.Collectors = append(data.Collectors, status)
+	}
+}
+
+// due reports whether the collector's interval has elapsed at the given
+// time, to the nearest collection
+func (c *scheduledCollector) due(at time.Time, cycle time.Duration) bool {
+	return c.lastRun.IsZero() || at.Sub(c.lastRun)+cycle/2 >= c.interval
+}
+
+// newAgentCollectors registers the built-in collectors of a, in the order
+// they depend on each other, and applies the collectors configuration
+func newAgentCollectors(a *agent, config Config) (*collectorRegistry, error) {
+	registry := newCollectorRegistry(config.CollectionInterval)
+
+	// Login sessions; a failed listing is sent as null so the backend does
+	// not end every session
+	registry.Register(collectorFunc{name: "sessions", collect: func(ctx context.Context, data *TelemetryData) error {
+		sessions, err := collectSessions(ctx)
+		data.Sessions = sessions
+		if err == nil {
+			a.sessions = sessions
+		}
+		return err
+	}})
+
+	// Processes, with the executable hashes already in the hash cache
+	registry.Register(collectorFunc{name: "processes", collect: func(ctx context.Context, data *TelemetryData) error {
+		collection, err := a.processes.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		data.Processes = collection.Processes
+		data.CollectionErrors = append(data.CollectionErrors, collection.Errors...)
+		if collection.Truncated {
+			log.Printf("Process collection truncated at %d processes by the %v deadline", len(collection.Processes), config.CollectionTimeout)
+			data.Truncated = true
+		}
+		a.lastProcesses = collection.Processes
+		return nil
+	}})
+
+	// Hash the executables of the latest process listing that are not in
+	// the hash cache yet, within the I/O budget
+	registry.Register(collectorFunc{name: "hashes", collect: func(ctx context.Context, data *TelemetryData) error {
+		events, errs := a.processes.HashExecutables(ctx, a.lastProcesses)
+		data.Events = append(data.Events, events...)
+		data.CollectionErrors = append(data.CollectionErrors, errs...)
+
+		hashStats := a.processes.hashCache.EndCycle()
+		data.HashCache = &hashStats
+		log.Printf("Hash cache: %d hits, %d misses, %d MB hashed, %d deferred by I/O budget, %d modified in place",
+			hashStats.Hits, hashStats.Misses, hashStats.BytesHashed/(1024*1024), hashStats.BudgetSkipped, hashStats.ModifiedInPlace)
+		return nil
+	}})
+
+	// Containers from every runtime; a failed runtime leaves the listing
+	// incomplete, so it is sent but flagged
+	registry.Register(collectorFunc{name: "containers", collect: func(ctx context.Context, data *TelemetryData) error {
+		containers, err := a.runtimes.Collect(ctx)
+		data.Containers = containers
+		a.lastContainers = containers
+		a.lastContainerCount = len(containers)
+		return err
+	}})
+
+	// The container lifecycle events streamed since the last payload
+	registry.Register(collectorFunc{name: "container_events", collect: func(ctx context.Context, data *TelemetryData) error {
+		streamed, dropped := a.runtimes.DrainEvents()
+		data.ContainerEvents = streamed
+		if dropped > 0 {
+			return fmt.Errorf("dropped %d events, buffer full", dropped)
+		}
+		return nil
+	}})
+
+	// Network connections, always sent in full as they change constantly
+	registry.Register(collectorFunc{name: "connections", collect: func(ctx context.Context, data *TelemetryData) error {
+		connections, err := collectConnections(ctx, a.lastProcesses)
+		if err != nil {
+			return err
+		}
+		data.Connections = connections
+		return nil
+	}})
+
+	// Host resource usage and the busiest processes of the latest listing
+	registry.Register(collectorFunc{name: "metrics", collect: func(ctx context.Context, data *TelemetryData) error {
+		hostMetrics, err := a.metrics.Collect(ctx, a.lastProcesses, a.lastContainerCount)
+		data.Metrics = hostMetrics
+		return err
+	}})
+
+	// The file changes found since the last payload
+	registry.Register(collectorFunc{name: "file_integrity", collect: func(ctx context.Context, data *TelemetryData) error {
+		changes, dropped := a.fim.Drain()
+		data.FileChanges = changes
+		if dropped > 0 {
+			return fmt.Errorf("dropped %d changes, buffer full", dropped)
+		}
+		return nil
+	}})
+
+	// The SSH, sudo and login events logged since the last payload
+	registry.Register(collectorFunc{name: "auth_events", collect: func(ctx context.Context, data *TelemetryData) error {
+		authEvents, err := a.auth.Collect(ctx)
+		data.AuthEvents = authEvents
+		return err
+	}})
+
+	// What the host runs automatically: units, cron, autostart entries,
+	// shell startup files, preloads and kernel modules
+	registry.Register(collectorFunc{name: "persistence", collect: func(ctx context.Context, data *TelemetryData) error {
+		persistence, err := a.autoruns.Collect(ctx)
+		data.Persistence = persistence
+		return err
+	}})
+
+	// Installed software inventory
+	registry.Register(collectorFunc{name: "packages", collect: func(ctx context.Context, data *TelemetryData) error {
+		packages, err := collectPackages()
+		if err != nil {
+			return err
+		}
+		data.Packages = packages
+		return nil
+	}})
+
+	// Local detection rules, over the latest listings with the hashes found
+	// so far, so a device detects threats while it is offline too
+	registry.Register(collectorFunc{name: "detections", collect: func(ctx context.Context, data *TelemetryData) error {
+		findings := a.detector.Evaluate(a.lastProcesses, a.lastContainers, data.Timestamp)
+		for _, finding := range findings {
+			log.Printf("Detection %s (%s): %s", finding.RuleID, finding.Severity, finding.Description)
+		}
+		data.Findings = append(data.Findings, findings...)
+		return nil
+	}})
+
+	if err := configureCollectors(registry, config); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// configureCollectors applies the collectors configuration of
+// COLLECTORS_CONFIG and, over it, the collectors settings of the
+// configuration file and policy
+func configureCollectors(registry *collectorRegistry, config Config) error {
+	settings := config.Collectors
+	if config.CollectorsConfig != "" {
+		fileSettings, err := loadCollectorSettings(config.CollectorsConfig)
+		if err != nil {
+			return err
+		}
+		settings = mergeCollectorSettings(fileSettings, config.Collectors)
+	}
+	if err := registry.Configure(settings); err != nil {
+		return err
+	}
+	if !config.FIMEnabled {
+		registry.Disable("file_integrity")
+	}
+	return nil
+}
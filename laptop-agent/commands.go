@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// errChecksFailed is returned by the check command when any check failed
+var errChecksFailed = errors.New("one or more checks failed")
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, `Usage: laptop-agent [command] [flags]
+
+Commands:
+  run        Collect telemetry at every COLLECTION_INTERVAL (the default)
+               --output api|log     send telemetry to API_ENDPOINT or write it to the log
+  collect    Collect telemetry and write it to a file
+               --once               collect once and exit (default true)
+               --output FILE        file to write, - for standard output (default -)
+  send       Send telemetry saved by collect, or a spooled snapshot
+               --file FILE          telemetry to send, - for standard input
+               --endpoint URL       telemetry endpoint (default API_ENDPOINT)
+  status     Show what the running agent last did
+               --json               print the status as JSON
+  check      Diagnose the configuration and connectivity
+  help       Show this help
+
+Configuration is read from the environment and from CONFIG_FILE, if set,
+see run.sh. The run command reloads it on SIGHUP or when the file changes.
+`)
+}
+
+// collectCommand collects telemetry without sending it. The daemon's
+// authentication log positions are left alone, so only events logged while
+// collecting are included, and file changes are only reported by run.
+func collectCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	once := flags.Bool("once", true, "collect once and exit; with --once=false collect every COLLECTION_INTERVAL, one JSON payload per line")
+	output := flags.String("output", "-", "file to write telemetry to, - for standard output")
+	flags.Parse(args)
+
+	config.AuthStatePath = ""
+	config.FIMEnabled = false
+	a, err := newAgent(config)
+	if err != nil {
+		return err
+	}
+
+	if *once {
+		jsonData, err := json.MarshalIndent(a.Collect(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal telemetry data: %w", err)
+		}
+		if *output == "-" {
+			_, err = fmt.Fprintln(os.Stdout, string(jsonData))
+			return err
+		}
+		if err := writeFileAtomic(*output, append(jsonData, '\n')); err != nil {
+			return fmt.Errorf("failed to write telemetry: %w", err)
+		}
+		log.Printf("Telemetry written to %s", *output)
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open output: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	ticker := time.NewTicker(config.CollectionInterval)
+	defer ticker.Stop()
+
+	encoder := json.NewEncoder(w)
+	for {
+		telemetry := a.Collect()
+		if err := encoder.Encode(telemetry); err != nil {
+			return fmt.Errorf("failed to write telemetry: %w", err)
+		}
+		log.Printf("Telemetry #%d written to %s", telemetry.Sequence, *output)
+		<-ticker.C
+	}
+}
+
+// sendCommand sends saved telemetry: a payload written by collect, the JSON
+// lines written by collect --once=false, or a file from the spool. Payloads
+// are marked replayed, as the backend has seen newer ones.
+func sendCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	path := flags.String("file", "", "telemetry to send, - for standard input")
+	endpoint := flags.String("endpoint", config.APIEndpoint, "telemetry endpoint")
+	flags.Parse(args)
+	if *path == "" {
+		return errors.New("--file is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *path != "-" {
+		file, err := os.Open(*path)
+		if err != nil {
+			return fmt.Errorf("failed to open telemetry: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	client, err := newAPIClient(config)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(r)
+	sent := 0
+	for {
+		var data TelemetryData
+		err := decoder.Decode(&data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read payload %d: %w", sent+1, err)
+		}
+
+		data.Replayed = true
+		if err := sendTelemetry(client, *endpoint, data); err != nil {
+			return fmt.Errorf("failed to send telemetry #%d: %w", data.Sequence, err)
+		}
+		sent++
+		fmt.Printf("Sent telemetry #%d (%s snapshot collected %s) to %s\n",
+			data.Sequence, data.SnapshotType, data.Timestamp.Format(time.RFC3339), *endpoint)
+	}
+
+	if sent == 0 {
+		return errors.New("no telemetry found in " + *path)
+	}
+	return nil
+}
+
+// statusReport is the status command's view of the agent
+type statusReport struct {
+	*agentStatus
+	Running        bool   `json:"running"`
+	DeviceID       string `json:"device_id,omitempty"`
+	SpoolDir       string `json:"spool_dir"`
+	SpoolSnapshots int    `json:"spool_snapshots"`
+	SpoolBytes     int64  `json:"spool_bytes"`
+}
+
+// statusCommand reports what the running agent last did, from the status
+// it saves after every collection, and how much telemetry awaits delivery
+func statusCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	flags.Parse(args)
+
+	status, err := readAgentStatus(config.StatusPath)
+	if err != nil {
+		return err
+	}
+
+	report := statusReport{agentStatus: status, SpoolDir: config.SpoolDir}
+	report.Running = status != nil && agentRunning(status)
+	identity, err := loadDeviceIdentity(config.IdentityPath)
+	if err != nil {
+		return err
+	}
+	if identity != nil {
+		report.DeviceID = identity.DeviceID
+	}
+	if entries, err := (&Spool{dir: config.SpoolDir}).entries(); err == nil {
+		report.SpoolSnapshots = len(entries)
+		for _, entry := range entries {
+			report.SpoolBytes += entry.size
+		}
+	}
+
+	if *asJSON {
+		jsonData, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal status: %w", err)
+		}
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	if status == nil {
+		fmt.Printf("Agent:              has not run (no status at %s)\n", config.StatusPath)
+	} else {
+		state := "not running"
+		if report.Running {
+			state = "running"
+		}
+		fmt.Printf("Agent:              %s (pid %d, started %s)\n", state, status.PID, formatStatusTime(&status.StartedAt))
+		if status.Output == outputAPI {
+			fmt.Printf("Output:             %s (%s)\n", status.Output, status.Endpoint)
+		} else {
+			fmt.Printf("Output:             %s\n", status.Output)
+		}
+		fmt.Printf("Interval:           %v\n", time.Duration(status.IntervalSeconds)*time.Second)
+		if status.PolicyIssuedAt != nil {
+			group := status.PolicyGroup
+			if group == "" {
+				group = "none"
+			}
+			fmt.Printf("Policy:             issued %s (group %s)\n", formatStatusTime(status.PolicyIssuedAt), group)
+		}
+		fmt.Printf("Last collection:    %s (#%d, %s)\n", formatStatusTime(status.LastCollectionAt), status.LastSequence, status.LastSnapshotType)
+		fmt.Printf("Last success:       %s\n", formatStatusTime(status.LastSuccessAt))
+		if status.LastError != "" {
+			fmt.Printf("Last error:         %s: %s\n", formatStatusTime(status.LastErrorAt), status.LastError)
+		} else {
+			fmt.Printf("Last error:         none\n")
+		}
+		for _, collector := range status.Collectors {
+			fmt.Printf("Collector:          %-16s %-8s %v\n", collector.Name, collector.Status, time.Duration(collector.DurationMs)*time.Millisecond)
+		}
+		for _, collectionErr := range status.CollectionErrors {
+			fmt.Printf("Collector failed:   %s: %s\n", collectionErr.Collector, collectionErr.Error)
+		}
+		if len(status.ContainerRuntimes) == 0 {
+			fmt.Printf("Container runtime:  none detected\n")
+		}
+		for _, daemon := range status.ContainerRuntimes {
+			fmt.Printf("Container runtime:  %s at %s\n", daemon.Runtime, daemon.Endpoint)
+		}
+	}
+	if identity != nil {
+		fmt.Printf("Device:             %s (enrolled %s)\n", identity.DeviceID, formatStatusTime(&identity.EnrolledAt))
+	} else {
+		fmt.Printf("Device:             not enrolled\n")
+	}
+	fmt.Printf("Spool:              %d snapshots, %.1f MB pending in %s\n",
+		report.SpoolSnapshots, float64(report.SpoolBytes)/(1024*1024), report.SpoolDir)
+
+	return nil
+}
+
+// agentRunning reports whether the agent that saved status is still running.
+// A process that started after the agent merely reuses its PID.
+func agentRunning(status *agentStatus) bool {
+	proc, err := process.NewProcess(int32(status.PID))
+	if err != nil {
+		return false
+	}
+	created, err := proc.CreateTime()
+	if err != nil {
+		return false
+	}
+	return !time.UnixMilli(created).After(status.StartedAt)
+}
+
+func formatStatusTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), time.Since(*t).Round(time.Second))
+}
+
+// checker prints the outcome of each diagnostic check
+type checker struct {
+	failed bool
+}
+
+func (c *checker) ok(format string, args ...interface{}) {
+	fmt.Printf("[OK]   "+format+"\n", args...)
+}
+
+func (c *checker) warn(format string, args ...interface{}) {
+	fmt.Printf("[WARN] "+format+"\n", args...)
+}
+
+func (c *checker) fail(format string, args ...interface{}) {
+	c.failed = true
+	fmt.Printf("[FAIL] "+format+"\n", args...)
+}
+
+// checkCommand diagnoses the configuration, the state directories and the
+// connections to the backend and the container runtimes
+func checkCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Parse(args)
+
+	// The checks report for themselves; collector logging would bury them
+	log.SetOutput(io.Discard)
+
+	c := &checker{}
+	checkSettings(c, config)
+	checkStateDirs(c, config)
+	checkBackend(c, config)
+	checkEnrollment(c, config)
+	checkClientCertificate(c, config)
+	checkPolicy(c, config)
+	checkContainerRuntimes(c)
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		c.warn("Not running as root: other users' processes, authentication logs and container sockets may be unreadable")
+	}
+
+	if c.failed {
+		return errChecksFailed
+	}
+	return nil
+}
+
+func checkSettings(c *checker, config Config) {
+	if config.ConfigFile != "" {
+		c.ok("Read configuration file %s", config.ConfigFile)
+	}
+
+	endpoint, err := url.Parse(config.APIEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		c.fail("API_ENDPOINT %q is not an http or https URL", config.APIEndpoint)
+	} else if endpoint.Scheme == "http" && endpoint.Hostname() != "localhost" && endpoint.Hostname() != "127.0.0.1" {
+		c.warn("API_ENDPOINT %s sends telemetry unencrypted", config.APIEndpoint)
+	} else {
+		c.ok("API_ENDPOINT %s", config.APIEndpoint)
+	}
+
+	if config.Output == outputLog {
+		c.warn("LOG_ONLY is set: the agent logs telemetry instead of sending it")
+	}
+
+	if config.CollectionInterval <= 0 || config.CollectionTimeout <= 0 || config.CollectionWorkers <= 0 {
+		c.fail("COLLECTION_INTERVAL, COLLECTION_TIMEOUT and COLLECTION_WORKERS must be positive")
+	} else if config.CollectionTimeout >= config.CollectionInterval {
+		c.warn("COLLECTION_TIMEOUT %v is not shorter than COLLECTION_INTERVAL %v", config.CollectionTimeout, config.CollectionInterval)
+	} else {
+		c.ok("Collecting every %v with %d workers and a %v deadline", config.CollectionInterval, config.CollectionWorkers, config.CollectionTimeout)
+	}
+
+	if !validCompression(config.UploadCompression) {
+		c.fail("UPLOAD_COMPRESSION %q must be %s, %s or %s", config.UploadCompression, compressionZstd, compressionGzip, compressionNone)
+	} else if config.UploadChunkSize <= 0 {
+		c.fail("UPLOAD_CHUNK_SIZE_MB must be positive")
+	} else {
+		c.ok("Uploading telemetry compressed with %s, in chunks of %d MB", config.UploadCompression, config.UploadChunkSize/(1024*1024))
+	}
+
+	if config.RedactionRules != "" {
+		rules, err := loadRedactionRules(config.RedactionRules)
+		if err != nil {
+			c.fail("REDACTION_RULES_FILE: %v", err)
+		} else {
+			c.ok("Loaded %d redaction rules from %s", len(rules), config.RedactionRules)
+		}
+	}
+	if len(config.InlineRedactionRules) > 0 {
+		rules, err := parseRedactionRules("redaction_rules", config.InlineRedactionRules)
+		if err != nil {
+			c.fail("CONFIG_FILE: %v", err)
+		} else {
+			c.ok("Loaded %d redaction rules from %s", len(rules), config.ConfigFile)
+		}
+	}
+
+	if config.DetectionRules != "" {
+		rules, err := loadDetectionRules(config.DetectionRules)
+		if err != nil {
+			c.fail("DETECTION_RULES_FILE: %v", err)
+		} else {
+			c.ok("Loaded %d detection rules from %s", len(rules), config.DetectionRules)
+		}
+	}
+
+	if config.CollectorsConfig != "" || len(config.Collectors) > 0 {
+		if collectors, err := newAgentCollectors(&agent{}, config); err != nil {
+			c.fail("Collectors configuration: %v", err)
+		} else {
+			var disabled []string
+			for _, name := range collectors.Names() {
+				if !collectors.Enabled(name) {
+					disabled = append(disabled, name)
+				}
+			}
+			c.ok("Loaded collectors configuration (disabled: %v)", disabled)
+		}
+	}
+
+	if config.FIMEnabled {
+		var missing []string
+		for _, path := range config.FIMPaths {
+			if _, err := os.Stat(path); err != nil {
+				missing = append(missing, path)
+			}
+		}
+		if len(missing) > 0 {
+			c.warn("File integrity monitoring cannot see %d of %d paths: %v", len(missing), len(config.FIMPaths), missing)
+		} else {
+			c.ok("File integrity monitoring covers %d paths", len(config.FIMPaths))
+		}
+	}
+}
+
+// checkStateDirs checks that the agent can write every directory it keeps
+// state in
+func checkStateDirs(c *checker, config Config) {
+	dirs := []string{config.SpoolDir, filepath.Dir(config.StatusPath), filepath.Dir(config.HashCachePath), filepath.Dir(config.AuthStatePath),
+		filepath.Dir(config.IdentityPath)}
+	if config.TLSClientCert != "" {
+		dirs = append(dirs, filepath.Dir(config.TLSClientCert))
+	}
+	if config.FIMEnabled {
+		dirs = append(dirs, filepath.Dir(config.FIMStatePath))
+	}
+
+	checked := make(map[string]bool)
+	for _, dir := range dirs {
+		if checked[dir] {
+			continue
+		}
+		checked[dir] = true
+
+		if err := checkWritable(dir); err != nil {
+			c.fail("State directory %s is not writable: %v", dir, err)
+		} else {
+			c.ok("State directory %s is writable", dir)
+		}
+	}
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, spoolTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkBackend checks that the telemetry service answers its health check
+func checkBackend(c *checker, config Config) {
+	endpoint, err := url.Parse(config.APIEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return
+	}
+	healthURL := endpoint.Scheme + "://" + endpoint.Host + "/health"
+
+	tlsConfig, err := newTLSConfig(config.TLSCAFile)
+	if err != nil {
+		c.fail("%v", err)
+		return
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		c.fail("Telemetry service unreachable: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.fail("Telemetry service at %s is unhealthy: status %d", healthURL, resp.StatusCode)
+		return
+	}
+	c.ok("Telemetry service at %s is healthy", healthURL)
+}
+
+// checkEnrollment reports how the device identifies itself to the service
+func checkEnrollment(c *checker, config Config) {
+	identity, err := loadDeviceIdentity(config.IdentityPath)
+	switch {
+	case err != nil:
+		c.fail("%v", err)
+	case identity != nil:
+		c.ok("Enrolled as device %s", identity.DeviceID)
+	case config.EnrollmentToken != "":
+		c.ok("Not enrolled yet: the agent enrolls at %s with ENROLLMENT_TOKEN", config.EnrollmentEndpoint)
+	default:
+		c.warn("Not enrolled and ENROLLMENT_TOKEN is not set: the device is identified by its MAC address")
+	}
+}
+
+// checkClientCertificate reports on the certificate the agent presents
+func checkClientCertificate(c *checker, config Config) {
+	if config.TLSClientCert == "" && config.TLSClientKey == "" {
+		return
+	}
+	if config.TLSClientCert == "" || config.TLSClientKey == "" {
+		c.fail("TLS_CLIENT_CERT and TLS_CLIENT_KEY must be set together")
+		return
+	}
+
+	cert, err := loadClientCertificate(config.TLSClientCert, config.TLSClientKey)
+	switch {
+	case err != nil:
+		c.warn("%v; the agent will request a new one at %s", err, config.CertificateEndpoint)
+	case cert == nil:
+		c.ok("No client certificate yet: the agent requests one at %s", config.CertificateEndpoint)
+	case time.Now().After(cert.Leaf.NotAfter):
+		c.warn("Client certificate for %s expired %s; the agent will request a new one", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	default:
+		c.ok("Client certificate for %s valid until %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkPolicy checks the key the agent verifies its policy with
+func checkPolicy(c *checker, config Config) {
+	if config.PolicyPublicKey == "" {
+		return
+	}
+	if _, err := loadPolicyPublicKey(config.PolicyPublicKey); err != nil {
+		c.fail("%v", err)
+		return
+	}
+	c.ok("Following the policy at %s, signed with %s", config.PolicyEndpoint, config.PolicyPublicKey)
+}
+
+// checkContainerRuntimes lists containers as a collection would, reporting
+// the runtimes reached
+func checkContainerRuntimes(c *checker) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	runtimes := newContainerCollector()
+	containers, err := runtimes.Collect(ctx)
+	if err != nil {
+		c.warn("Container listing incomplete: %v", err)
+	}
+
+	connected := runtimes.Connected()
+	if len(connected) == 0 {
+		c.warn("No container runtime detected")
+		return
+	}
+	for _, daemon := range connected {
+		c.ok("Connected to %s at %s", daemon.Runtime, daemon.Endpoint)
+	}
+	c.ok("Listed %d containers", len(containers))
+}
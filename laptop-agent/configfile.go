@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configDuration is a duration in the configuration file or a policy: a
+// number of seconds, as in the environment, or a duration such as "5m"
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalYAML(node *yaml.Node) error {
+	var seconds int
+	if err := node.Decode(&seconds); err == nil {
+		if seconds < 0 {
+			return fmt.Errorf("line %d: duration %d must not be negative", node.Line, seconds)
+		}
+		*d = configDuration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	var text string
+	if err := node.Decode(&text); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration < 0 {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, text)
+	}
+	*d = configDuration(duration)
+	return nil
+}
+
+// policySettings are the settings a running agent changes without a
+// restart, and the only ones the telemetry service's policy may set
+type policySettings struct {
+	CollectionInterval *configDuration              `yaml:"collection_interval"`
+	CheckpointInterval *configDuration              `yaml:"checkpoint_interval"`
+	CollectionTimeout  *configDuration              `yaml:"collection_timeout"`
+	Collectors         map[string]CollectorSettings `yaml:"collectors"`
+	RedactionRules     []string                     `yaml:"redaction_rules"`
+	UploadCompression  *string                      `yaml:"upload_compression"`
+	UploadChunkSizeMB  *int                         `yaml:"upload_chunk_size_mb"`
+}
+
+// configFile is the agent's configuration file, in YAML or JSON. Settings
+// are named after their environment variables, in lower case, and override
+// them; settings left out keep the environment's value. Relative paths are
+// relative to the file. When the file is reloaded, the policy settings and
+// the rule and collectors files apply; the others, such as the endpoint,
+// spool and TLS settings, are held by the client, spool and goroutines
+// started with the agent, and take effect when it restarts.
+type configFile struct {
+	policySettings `yaml:",inline"`
+
+	APIEndpoint        *string         `yaml:"api_endpoint"`
+	StartupJitter      *configDuration `yaml:"startup_jitter"`
+	CollectionWorkers  *int            `yaml:"collection_workers"`
+	CollectorsConfig   *string         `yaml:"collectors_config"`
+	RedactionRulesFile *string         `yaml:"redaction_rules_file"`
+	DetectionRulesFile *string         `yaml:"detection_rules_file"`
+	SpoolDir           *string         `yaml:"spool_dir"`
+	SpoolMaxSizeMB     *int            `yaml:"spool_max_size_mb"`
+	SpoolMaxAgeHours   *int            `yaml:"spool_max_age_hours"`
+	HashIOBudgetMB     *int            `yaml:"hash_io_budget_mb"`
+	FIMEnabled         *bool           `yaml:"fim_enabled"`
+	FIMPaths           []string        `yaml:"fim_paths"`
+	FIMRescanInterval  *configDuration `yaml:"fim_rescan_interval"`
+	MetricsTopN        *int            `yaml:"metrics_top_n"`
+	TasksEnabled       *bool           `yaml:"tasks_enabled"`
+	TaskPollInterval   *configDuration `yaml:"task_poll_interval"`
+	EnrollmentToken    *string         `yaml:"enrollment_token"`
+	TLSCAFile          *string         `yaml:"tls_ca_file"`
+	TLSClientCert      *string         `yaml:"tls_client_cert"`
+	TLSClientKey       *string         `yaml:"tls_client_key"`
+	PolicyPublicKey    *string         `yaml:"policy_public_key"`
+	PolicyInterval     *configDuration `yaml:"policy_interval"`
+
+	dir string
+}
+
+// loadConfigFile reads the configuration file, refusing settings it does
+// not know rather than ignoring a misspelt one
+func loadConfigFile(path string) (*configFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open configuration file: %w", err)
+	}
+	defer file.Close()
+
+	config := &configFile{dir: filepath.Dir(path)}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse configuration file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// apply overrides config with the settings in the file
+func (f *configFile) apply(config *Config) {
+	f.policySettings.apply(config)
+
+	setString(&config.APIEndpoint, f.APIEndpoint)
+	setDuration(&config.StartupJitter, f.StartupJitter)
+	setInt(&config.CollectionWorkers, f.CollectionWorkers)
+	setString(&config.CollectorsConfig, f.path(f.CollectorsConfig))
+	setString(&config.RedactionRules, f.path(f.RedactionRulesFile))
+	setString(&config.DetectionRules, f.path(f.DetectionRulesFile))
+	setString(&config.SpoolDir, f.path(f.SpoolDir))
+	if f.SpoolMaxSizeMB != nil {
+		config.SpoolMaxBytes = int64(*f.SpoolMaxSizeMB) * 1024 * 1024
+	}
+	if f.SpoolMaxAgeHours != nil {
+		config.SpoolMaxAge = time.Duration(*f.SpoolMaxAgeHours) * time.Hour
+	}
+	if f.HashIOBudgetMB != nil {
+		config.HashIOBudget = int64(*f.HashIOBudgetMB) * 1024 * 1024
+	}
+	if f.FIMEnabled != nil {
+		config.FIMEnabled = *f.FIMEnabled
+	}
+	if len(f.FIMPaths) > 0 {
+		config.FIMPaths = f.FIMPaths
+	}
+	setDuration(&config.FIMRescanInterval, f.FIMRescanInterval)
+	setInt(&config.MetricsTopN, f.MetricsTopN)
+	if f.TasksEnabled != nil {
+		config.TasksEnabled = *f.TasksEnabled
+	}
+	setDuration(&config.TaskPollInterval, f.TaskPollInterval)
+	setString(&config.EnrollmentToken, f.EnrollmentToken)
+	setString(&config.TLSCAFile, f.path(f.TLSCAFile))
+	setString(&config.TLSClientCert, f.path(f.TLSClientCert))
+	setString(&config.TLSClientKey, f.path(f.TLSClientKey))
+	setString(&config.PolicyPublicKey, f.path(f.PolicyPublicKey))
+	setDuration(&config.PolicyInterval, f.PolicyInterval)
+}
+
+// path resolves a path in the file against the file's directory
+func (f *configFile) path(path *string) *string {
+	if path == nil || *path == "" || filepath.IsAbs(*path) {
+		return path
+	}
+	resolved := filepath.Join(f.dir, *path)
+	return &resolved
+}
+
+// apply overrides config with the settings that are set. Collectors
+// settings are merged collector by collector, and redaction rules are added
+// to those already configured, so neither a file nor a policy can drop the
+// organisation's rules.
+func (p *policySettings) apply(config *Config) {
+	setDuration(&config.CollectionInterval, p.CollectionInterval)
+	setDuration(&config.CheckpointInterval, p.CheckpointInterval)
+	setDuration(&config.CollectionTimeout, p.CollectionTimeout)
+	if len(p.Collectors) > 0 {
+		config.Collectors = mergeCollectorSettings(config.Collectors, p.Collectors)
+	}
+	if len(p.RedactionRules) > 0 {
+		config.InlineRedactionRules = slices.Concat(config.InlineRedactionRules, p.RedactionRules)
+	}
+	setString(&config.UploadCompression, p.UploadCompression)
+	if p.UploadChunkSizeMB != nil {
+		config.UploadChunkSize = *p.UploadChunkSizeMB * 1024 * 1024
+	}
+}
+
+func setString(field *string, value *string) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func setInt(field *int, value *int) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func setDuration(field *time.Duration, value *configDuration) {
+	if value != nil {
+		*field = time.Duration(*value)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// ConnectionInfo describes a TCP or UDP socket and the process that owns it
+type ConnectionInfo struct {
+	Protocol      string `json:"protocol"`
+	Family        string `json:"family"`
+	LocalAddress  string `json:"local_address"`
+	LocalPort     uint32 `json:"local_port"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	RemotePort    uint32 `json:"remote_port,omitempty"`
+	State         string `json:"state"`
+	PID           int32  `json:"pid"`
+	ProcessKey    string `json:"process_key,omitempty"`
+}
+
+// collectConnections lists TCP and UDP sockets and links each to the process
+// instance from the same collection. Sockets of other users' processes may
+// show no PID unless the agent runs with elevated privileges.
+func collectConnections(ctx context.Context, processes []ProcessInfo) ([]ConnectionInfo, error) {
+	processKeys := make(map[int32]string, len(processes))
+	for _, proc := range processes {
+		processKeys[proc.PID] = proc.ProcessKey
+	}
+
+	var connections []ConnectionInfo
+	for _, protocol := range []string{"tcp", "udp"} {
+		stats, err := net.ConnectionsWithContext(ctx, protocol)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s connections: %w", protocol, err)
+		}
+
+		for _, stat := range stats {
+			family := "ipv4"
+			if strings.Contains(stat.Laddr.IP, ":") {
+				family = "ipv6"
+			}
+
+			state := stat.Status
+			if protocol == "udp" && (state == "" || state == "NONE") {
+				state = "UNCONN"
+				if stat.Raddr.IP != "" && stat.Raddr.Port != 0 {
+					state = "CONNECTED"
+				}
+			}
+
+			connections = append(connections, ConnectionInfo{
+				Protocol:      protocol,
+				Family:        family,
+				LocalAddress:  stat.Laddr.IP,
+				LocalPort:     stat.Laddr.Port,
+				RemoteAddress: stat.Raddr.IP,
+				RemotePort:    stat.Raddr.Port,
+				State:         state,
+				PID:           stat.Pid,
+				ProcessKey:    processKeys[stat.Pid],
+			})
+		}
+	}
+
+	log.Printf("Successfully collected %d network connections", len(connections))
+	return connections, nil
+}
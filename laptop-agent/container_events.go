@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// maxBufferedContainerEvents caps the events held between two payloads;
+// the oldest are dropped first
+const maxBufferedContainerEvents = 5000
+
+// watchedContainerActions are the container lifecycle events forwarded to
+// the telemetry service
+var watchedContainerActions = []events.Action{
+	events.ActionCreate,
+	events.ActionStart,
+	events.ActionDie,
+	events.ActionExecCreate,
+	events.ActionDestroy,
+}
+
+// ContainerEvent is a container lifecycle event from a Docker API events
+// stream
+type ContainerEvent struct {
+	ContainerID string            `json:"container_id"`
+	Runtime     string            `json:"runtime"`
+	Action      string            `json:"action"`
+	Image       string            `json:"image,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	ExitCode    *int              `json:"exit_code,omitempty"`
+	ExecCommand string            `json:"exec_command,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+}
+
+// containerEventWatcher subscribes to the events stream of a Docker API
+// daemon (Docker or Podman) the container collector connected to and buffers container lifecycle events until
+// the next payload, so containers that start and exit between two collections
+// are still reported. When the stream breaks, the next collection resubscribes
+// from the last event seen and the daemon replays what was missed.
+type containerEventWatcher struct {
+	runtime string
+
+	mu       sync.Mutex
+	running  bool
+	buffered []ContainerEvent
+	dropped  int
+
+	// Position in the stream, to resume without duplicates
+	lastNano int64
+	lastKeys map[string]bool
+}
+
+func newContainerEventWatcher(runtime string) *containerEventWatcher {
+	return &containerEventWatcher{
+		runtime:  runtime,
+		lastNano: time.Now().UnixNano(),
+		lastKeys: make(map[string]bool),
+	}
+}
+
+// Watch starts streaming events from the daemon reached with opts unless a
+// stream is already running.
+func (w *containerEventWatcher) Watch(opts []client.Opt) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running {
+		return
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		log.Printf("Failed to create %s client for events: %v", w.runtime, err)
+		return
+	}
+
+	w.running = true
+	go w.stream(cli)
+}
+
+// Drain returns the events buffered since the previous call and how many
+// were dropped because the buffer was full.
+func (w *containerEventWatcher) Drain() ([]ContainerEvent, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buffered, dropped := w.buffered, w.dropped
+	w.buffered, w.dropped = nil, 0
+	return buffered, dropped
+}
+
+func (w *containerEventWatcher) stream(cli *client.Client) {
+	defer func() {
+		cli.Close()
+		w.mu.Lock()
+		w.running = false
+		w.mu.Unlock()
+	}()
+
+	args := filters.NewArgs(filters.Arg("type", string(events.ContainerEventType)))
+	for _, action := range watchedContainerActions {
+		args.Add("event", string(action))
+	}
+
+	w.mu.Lock()
+	since := fmt.Sprintf("%d.%09d", w.lastNano/int64(time.Second), w.lastNano%int64(time.Second))
+	w.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, errs := cli.Events(ctx, events.ListOptions{Since: since, Filters: args})
+	log.Printf("Streaming %s container events from %s", w.runtime, cli.DaemonHost())
+
+	for {
+		select {
+		case message := <-messages:
+			w.add(message)
+		case err := <-errs:
+			log.Printf("Container event stream closed: %v", err)
+			return
+		}
+	}
+}
+
+// add buffers one event, skipping events already seen before a resubscribe
+func (w *containerEventWatcher) add(message events.Message) {
+	event := containerEventFromMessage(message)
+	event.Runtime = w.runtime
+	key := event.ContainerID + "/" + string(message.Action)
+	eventNano := event.Timestamp.UnixNano()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case eventNano < w.lastNano:
+		return
+	case eventNano == w.lastNano:
+		if w.lastKeys[key] {
+			return
+		}
+	default:
+		w.lastNano = eventNano
+		w.lastKeys = make(map[string]bool)
+	}
+	w.lastKeys[key] = true
+
+	if len(w.buffered) >= maxBufferedContainerEvents {
+		w.buffered = w.buffered[1:]
+		w.dropped++
+	}
+	w.buffered = append(w.buffered, event)
+}
+
+// containerEventFromMessage converts a Docker event. exec_create actions
+// carry the command after a colon ("exec_create: sh -c id").
+func containerEventFromMessage(message events.Message) ContainerEvent {
+	action, command, _ := strings.Cut(string(message.Action), ":")
+
+	// Daemons before API 1.22 only report whole seconds
+	timestamp := time.Unix(message.Time, 0)
+	if message.TimeNano != 0 {
+		timestamp = time.Unix(0, message.TimeNano)
+	}
+
+	event := ContainerEvent{
+		ContainerID: message.Actor.ID,
+		Action:      action,
+		ExecCommand: strings.TrimSpace(command),
+		Attributes:  message.Actor.Attributes,
+		Timestamp:   timestamp.UTC(),
+	}
+	if attributes := message.Actor.Attributes; attributes != nil {
+		event.Image = attributes["image"]
+		event.Name = attributes["name"]
+		if exitCode, err := strconv.Atoi(attributes["exitCode"]); err == nil {
+			event.ExitCode = &exitCode
+		}
+	}
+
+	return event
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// ContainerSecurity is the security-relevant configuration of a container,
+// taken from ContainerInspect and ImageInspect
+type ContainerSecurity struct {
+	Privileged          bool             `json:"privileged"`
+	HostPID             bool             `json:"host_pid"`
+	HostNetwork         bool             `json:"host_network"`
+	HostIPC             bool             `json:"host_ipc"`
+	User                string           `json:"user"`
+	RunsAsRoot          bool             `json:"runs_as_root"`
+	CapAdd              []string         `json:"cap_add,omitempty"`
+	CapDrop             []string         `json:"cap_drop,omitempty"`
+	SecurityOpt         []string         `json:"security_opt,omitempty"`
+	ReadonlyRootfs      bool             `json:"readonly_rootfs"`
+	Mounts              []ContainerMount `json:"mounts,omitempty"`
+	DockerSocketMounted bool             `json:"docker_socket_mounted"`
+	ImageID             string           `json:"image_id,omitempty"`
+	ImageDigest         string           `json:"image_digest,omitempty"`
+}
+
+// ContainerMount is a bind mount or volume of a container
+type ContainerMount struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only"`
+}
+
+// inspectContainerSecurity builds the security profile of a listed
+// container. imageDigests caches image lookups for the collection, since
+// many containers usually share an image.
+func inspectContainerSecurity(ctx context.Context, cli *client.Client, summary container.Summary, imageDigests map[string]imageDetails) (*ContainerSecurity, error) {
+	inspect, err := cli.ContainerInspect(ctx, summary.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	security := &ContainerSecurity{ImageID: summary.ImageID}
+
+	if hostConfig := inspect.HostConfig; hostConfig != nil {
+		security.Privileged = hostConfig.Privileged
+		security.HostPID = hostConfig.PidMode.IsHost()
+		security.HostNetwork = hostConfig.NetworkMode.IsHost()
+		security.HostIPC = hostConfig.IpcMode.IsHost()
+		security.CapAdd = hostConfig.CapAdd
+		security.CapDrop = hostConfig.CapDrop
+		security.SecurityOpt = hostConfig.SecurityOpt
+		security.ReadonlyRootfs = hostConfig.ReadonlyRootfs
+	}
+
+	for _, mount := range inspect.Mounts {
+		security.Mounts = append(security.Mounts, ContainerMount{
+			Type:        string(mount.Type),
+			Source:      mount.Source,
+			Destination: mount.Destination,
+			ReadOnly:    !mount.RW,
+		})
+		if isDockerSocket(mount.Source) || isDockerSocket(mount.Destination) {
+			security.DockerSocketMounted = true
+		}
+	}
+
+	image, found := imageDigests[summary.ImageID]
+	if !found {
+		image = inspectImage(ctx, cli, summary.ImageID)
+		imageDigests[summary.ImageID] = image
+	}
+	security.ImageDigest = repoDigest(image.repoDigests, summary.Image)
+
+	// The container's user overrides the image's; neither set means root
+	if inspect.Config != nil {
+		security.User = inspect.Config.User
+	}
+	if security.User == "" {
+		security.User = image.user
+	}
+	security.RunsAsRoot = isRootUser(security.User)
+
+	return security, nil
+}
+
+type imageDetails struct {
+	repoDigests []string
+	user        string
+}
+
+func inspectImage(ctx context.Context, cli *client.Client, imageID string) imageDetails {
+	image, err := cli.ImageInspect(ctx, imageID)
+	if err != nil {
+		return imageDetails{}
+	}
+
+	details := imageDetails{repoDigests: image.RepoDigests}
+	if image.Config != nil {
+		details.user = image.Config.User
+	}
+	return details
+}
+
+// repoDigest picks the digest of the repository the container was started
+// from, e.g. nginx@sha256:... for an nginx:latest container
+func repoDigest(repoDigests []string, imageRef string) string {
+	if len(repoDigests) == 0 {
+		return ""
+	}
+
+	repository := imageRef
+	if at := strings.Index(repository, "@"); at >= 0 {
+		repository = repository[:at]
+	}
+	if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository = repository[:colon]
+	}
+
+	for _, digest := range repoDigests {
+		name, _, _ := strings.Cut(digest, "@")
+		if name == repository || strings.TrimPrefix(name, "docker.io/library/") == repository ||
+			strings.TrimPrefix(name, "docker.io/") == repository {
+			return digest
+		}
+	}
+	return repoDigests[0]
+}
+
+// isDockerSocket matches the Docker API socket wherever it is mounted from
+func isDockerSocket(filePath string) bool {
+	return path.Base(filePath) == "docker.sock"
+}
+
+// isRootUser reports whether a container user spec ("", "0", "root",
+// "root:staff", "0:0") resolves to UID 0
+func isRootUser(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	return name == "" || name == "0" || name == "root"
+}
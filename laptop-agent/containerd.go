@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// containerdAddresses are the containerd sockets queried with ctr: the
+// system daemon (used by nerdctl and Kubernetes) and k3s's embedded one
+var containerdAddresses = []string{"/run/containerd/containerd.sock", "/run/k3s/containerd/containerd.sock"}
+
+// containerdSkippedNamespaces hold containers managed by Docker, which are
+// listed through the Docker API instead
+var containerdSkippedNamespaces = map[string]bool{"moby": true, "plugins.moby": true}
+
+// containerdContainer is the part of `ctr containers info` output the agent
+// uses
+type containerdContainer struct {
+	ID        string            `json:"ID"`
+	Image     string            `json:"Image"`
+	Labels    map[string]string `json:"Labels"`
+	CreatedAt time.Time         `json:"CreatedAt"`
+}
+
+// nerdctlPort is a published port as recorded in the nerdctl/ports label
+type nerdctlPort struct {
+	HostPort      int `json:"HostPort"`
+	ContainerPort int `json:"ContainerPort"`
+}
+
+// containerdRuntime lists containers of every containerd namespace through
+// the ctr tool that ships with containerd
+type containerdRuntime struct {
+	endpoints *apiEndpoints
+}
+
+func (r *containerdRuntime) Name() string {
+	return RuntimeContainerd
+}
+
+func (r *containerdRuntime) Collect(ctx context.Context) ([]ContainerInfo, error) {
+	if _, err := exec.LookPath("ctr"); err != nil {
+		return nil, nil
+	}
+
+	var containers []ContainerInfo
+	var errs []string
+	for _, address := range containerdAddresses {
+		// The socket is root-only on most hosts; an agent that may not use
+		// it has nothing to list
+		conn, err := net.DialTimeout("unix", address, time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		found, err := collectContainerdContainers(ctx, address)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", address, err))
+		} else {
+			r.endpoints.connected = append(r.endpoints.connected, RuntimeEndpoint{Runtime: RuntimeContainerd, Endpoint: "unix://" + address})
+		}
+		containers = append(containers, found...)
+	}
+
+	if len(errs) > 0 {
+		return containers, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return containers, nil
+}
+
+// collectContainerdContainers lists the containers of every namespace of the
+// containerd daemon at address
+func collectContainerdContainers(ctx context.Context, address string) ([]ContainerInfo, error) {
+	output, err := runCtr(ctx, address, "namespaces", "list", "--quiet")
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []ContainerInfo
+	for _, namespace := range strings.Fields(string(output)) {
+		if containerdSkippedNamespaces[namespace] {
+			continue
+		}
+
+		found, err := collectContainerdNamespace(ctx, address, namespace)
+		if err != nil {
+			return containers, fmt.Errorf("namespace %s: %w", namespace, err)
+		}
+		containers = append(containers, found...)
+	}
+
+	return containers, nil
+}
+
+func collectContainerdNamespace(ctx context.Context, address, namespace string) ([]ContainerInfo, error) {
+	output, err := runCtr(ctx, address, "--namespace", namespace, "containers", "list", "--quiet")
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(string(output))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	taskStatuses, err := containerdTaskStatuses(ctx, address, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []ContainerInfo
+	for _, id := range ids {
+		output, err := runCtr(ctx, address, "--namespace", namespace, "containers", "info", id)
+		if err != nil {
+			// Removed since it was listed
+			continue
+		}
+
+		var info containerdContainer
+		if err := json.Unmarshal(output, &info); err != nil {
+			return containers, fmt.Errorf("failed to parse container %s: %w", id, err)
+		}
+
+		status, hasTask := taskStatuses[id]
+		state := "created"
+		if hasTask {
+			state = containerdState(status)
+		}
+
+		containers = append(containers, ContainerInfo{
+			ID:        info.ID,
+			Runtime:   RuntimeContainerd,
+			Namespace: namespace,
+			Image:     info.Image,
+			Names:     containerdNames(info),
+			Status:    status,
+			State:     state,
+			Ports:     containerdPorts(info.Labels),
+			Labels:    info.Labels,
+			Created:   info.CreatedAt.Unix(),
+		})
+	}
+
+	return containers, nil
+}
+
+// containerdTaskStatuses maps container IDs to the status of their task;
+// containers that were never started have no task
+func containerdTaskStatuses(ctx context.Context, address, namespace string) (map[string]string, error) {
+	output, err := runCtr(ctx, address, "--namespace", namespace, "tasks", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// TASK PID STATUS
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] == "TASK" {
+			continue
+		}
+		statuses[fields[0]] = fields[2]
+	}
+
+	return statuses, nil
+}
+
+// containerdState translates a task status to the Docker state vocabulary
+func containerdState(status string) string {
+	switch status {
+	case "RUNNING":
+		return "running"
+	case "STOPPED":
+		return "exited"
+	case "PAUSED", "PAUSING":
+		return "paused"
+	case "CREATED":
+		return "created"
+	default:
+		return strings.ToLower(status)
+	}
+}
+
+// containerdNames takes the container's name from the labels nerdctl and
+// Kubernetes set, falling back to its ID
+func containerdNames(info containerdContainer) []string {
+	for _, label := range []string{"nerdctl/name", "io.kubernetes.container.name"} {
+		if name := info.Labels[label]; name != "" {
+			return []string{name}
+		}
+	}
+	return []string{info.ID}
+}
+
+// containerdPorts reads the ports nerdctl published, in the host:container
+// form used for Docker containers
+func containerdPorts(labels map[string]string) []string {
+	var published []nerdctlPort
+	if err := json.Unmarshal([]byte(labels["nerdctl/ports"]), &published); err != nil {
+		return nil
+	}
+
+	var ports []string
+	for _, port := range published {
+		if port.HostPort != 0 {
+			ports = append(ports, fmt.Sprintf("%d:%d", port.HostPort, port.ContainerPort))
+		}
+	}
+	return ports
+}
+
+// runCtr runs ctr against the containerd daemon at address
+func runCtr(ctx context.Context, address string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ctr", append([]string{"--address", address}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("ctr %s: %w: %s", strings.Join(args, " "), err, message)
+		}
+		return nil, fmt.Errorf("ctr %s: %w", strings.Join(args, " "), err)
+	}
+	return output, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// Container runtimes the agent can list containers from
+const (
+	RuntimeDocker     = "docker"
+	RuntimePodman     = "podman"
+	RuntimeContainerd = "containerd"
+)
+
+// containerRuntime lists the containers of one container engine. Runtimes
+// that are not installed or not reachable return no containers and no error.
+type containerRuntime interface {
+	Name() string
+	Collect(ctx context.Context) ([]ContainerInfo, error)
+}
+
+// containerCollector lists containers from every runtime found on the host
+type containerCollector struct {
+	endpoints *apiEndpoints
+	runtimes  []containerRuntime
+}
+
+func newContainerCollector() *containerCollector {
+	endpoints := &apiEndpoints{watchers: make(map[string]*containerEventWatcher)}
+	return &containerCollector{
+		endpoints: endpoints,
+		runtimes: []containerRuntime{
+			&dockerAPIRuntime{name: RuntimeDocker, endpoints: endpoints, candidates: dockerEndpoints, firstOnly: true},
+			&dockerAPIRuntime{name: RuntimePodman, endpoints: endpoints, candidates: podmanEndpoints},
+			&containerdRuntime{endpoints: endpoints},
+		},
+	}
+}
+
+// Collect lists the containers of every runtime, each container once even
+// when several sockets lead to the same engine. When a runtime fails, the
+// containers of the others are returned along with the error.
+func (c *containerCollector) Collect(ctx context.Context) ([]ContainerInfo, error) {
+	c.endpoints.claimed = make(map[string]bool)
+	c.endpoints.connected = nil
+
+	containers := []ContainerInfo{}
+	seen := make(map[string]bool)
+	var errs []string
+
+	for _, runtime := range c.runtimes {
+		found, err := runtime.Collect(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", runtime.Name(), err))
+		}
+		for _, containerInfo := range found {
+			if seen[containerInfo.ID] {
+				continue
+			}
+			seen[containerInfo.ID] = true
+			containers = append(containers, containerInfo)
+		}
+	}
+
+	log.Printf("Successfully collected %d containers", len(containers))
+	if len(errs) > 0 {
+		return containers, fmt.Errorf("failed to list containers: %s", strings.Join(errs, "; "))
+	}
+	return containers, nil
+}
+
+// Connected returns the runtime daemons reached by the last collection
+func (c *containerCollector) Connected() []RuntimeEndpoint {
+	return c.endpoints.connected
+}
+
+// DrainEvents returns the container events streamed since the previous call,
+// oldest first, and how many were dropped because a buffer was full.
+func (c *containerCollector) DrainEvents() ([]ContainerEvent, int) {
+	var streamed []ContainerEvent
+	dropped := 0
+	for _, watcher := range c.endpoints.watchers {
+		events, watcherDropped := watcher.Drain()
+		streamed = append(streamed, events...)
+		dropped += watcherDropped
+	}
+
+	sort.SliceStable(streamed, func(i, j int) bool {
+		return streamed[i].Timestamp.Before(streamed[j].Timestamp)
+	})
+	return streamed, dropped
+}
+
+// apiEndpoints tracks the Docker API sockets in use. A socket is claimed by
+// the first runtime that connects to it in a collection, so a docker.sock
+// symlinked to Podman's socket is not listed twice, and each socket gets one
+// event stream.
+type apiEndpoints struct {
+	claimed   map[string]bool
+	connected []RuntimeEndpoint
+	watchers  map[string]*containerEventWatcher
+}
+
+// RuntimeEndpoint is a container runtime daemon the agent reached
+type RuntimeEndpoint struct {
+	Runtime  string `json:"runtime"`
+	Endpoint string `json:"endpoint"`
+}
+
+// claim reserves the daemon at host for this collection, reporting false if
+// another runtime already connected to it
+func (e *apiEndpoints) claim(host string) bool {
+	key := endpointKey(host)
+	if e.claimed[key] {
+		return false
+	}
+	e.claimed[key] = true
+	return true
+}
+
+// watch makes sure the daemon's events are being streamed
+func (e *apiEndpoints) watch(host, runtime string, opts []client.Opt) {
+	key := endpointKey(host)
+	watcher, found := e.watchers[key]
+	if !found {
+		watcher = newContainerEventWatcher(runtime)
+		e.watchers[key] = watcher
+	}
+	watcher.Watch(opts)
+}
+
+// endpointKey identifies a daemon by the real path of its Unix socket
+func endpointKey(host string) string {
+	socketPath, isUnix := strings.CutPrefix(host, "unix://")
+	if !isUnix {
+		return host
+	}
+	if realPath, err := filepath.EvalSymlinks(socketPath); err == nil {
+		return "unix://" + realPath
+	}
+	return host
+}
+
+// dockerEndpoint is one way to reach a Docker API daemon
+type dockerEndpoint struct {
+	description string
+	opts        []client.Opt
+}
+
+// dockerAPIRuntime lists containers through the Docker Engine API, which
+// Podman also serves on its API socket
+type dockerAPIRuntime struct {
+	name       string
+	endpoints  *apiEndpoints
+	candidates func() []dockerEndpoint
+	firstOnly  bool // stop at the first reachable daemon
+}
+
+func (r *dockerAPIRuntime) Name() string {
+	return r.name
+}
+
+func (r *dockerAPIRuntime) Collect(ctx context.Context) ([]ContainerInfo, error) {
+	var containers []ContainerInfo
+	var errs []string
+
+	for _, endpoint := range r.candidates() {
+		cli, err := client.NewClientWithOpts(endpoint.opts...)
+		if err != nil {
+			log.Printf("Failed to create %s client for %s: %v", r.name, endpoint.description, err)
+			continue
+		}
+		if !r.endpoints.claim(cli.DaemonHost()) {
+			cli.Close()
+			continue
+		}
+
+		// Test connection with timeout
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		_, pingErr := cli.Ping(pingCtx)
+		cancel()
+		if pingErr != nil {
+			log.Printf("Failed to connect to %s daemon at %s: %v", r.name, endpoint.description, pingErr)
+			cli.Close()
+			continue
+		}
+
+		// A docker.sock may well be served by Podman
+		runtime := r.name
+		if isPodmanDaemon(ctx, cli) {
+			runtime = RuntimePodman
+		}
+		log.Printf("Connected to %s daemon at %s", runtime, endpoint.description)
+
+		found, err := listAPIContainers(ctx, cli, runtime)
+		host := cli.DaemonHost()
+		cli.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", endpoint.description, err))
+			continue
+		}
+		containers = append(containers, found...)
+		r.endpoints.connected = append(r.endpoints.connected, RuntimeEndpoint{Runtime: runtime, Endpoint: host})
+		r.endpoints.watch(host, runtime, endpoint.opts)
+
+		if r.firstOnly {
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return containers, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return containers, nil
+}
+
+// isPodmanDaemon recognises Podman's Docker-compatible API by its version
+// components
+func isPodmanDaemon(ctx context.Context, cli *client.Client) bool {
+	versionCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	version, err := cli.ServerVersion(versionCtx)
+	if err != nil {
+		return false
+	}
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			return true
+		}
+	}
+	return false
+}
+
+// listAPIContainers lists every container of a Docker API daemon with its
+// security profile
+func listAPIContainers(ctx context.Context, cli *client.Client, runtime string) ([]ContainerInfo, error) {
+	listCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	containers, err := cli.ContainerList(listCtx, container.ListOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var containerInfos []ContainerInfo
+	imageDigests := make(map[string]imageDetails)
+
+	for _, container := range containers {
+		var ports []string
+		for _, port := range container.Ports {
+			if port.PublicPort != 0 {
+				ports = append(ports, fmt.Sprintf("%d:%d", port.PublicPort, port.PrivatePort))
+			}
+		}
+
+		containerInfo := ContainerInfo{
+			ID:      container.ID,
+			Runtime: runtime,
+			Image:   container.Image,
+			Names:   container.Names,
+			Status:  container.Status,
+			State:   container.State,
+			Ports:   ports,
+			Labels:  container.Labels,
+			Created: container.Created,
+		}
+
+		security, err := inspectContainerSecurity(listCtx, cli, container, imageDigests)
+		if err != nil {
+			log.Printf("Failed to inspect container %s: %v", container.ID, err)
+		} else {
+			containerInfo.Security = security
+		}
+
+		containerInfos = append(containerInfos, containerInfo)
+	}
+
+	return containerInfos, nil
+}
+
+// dockerEndpoints returns DOCKER_HOST when set, then the common Docker
+// socket locations that exist
+func dockerEndpoints() []dockerEndpoint {
+	var endpoints []dockerEndpoint
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		endpoints = append(endpoints, dockerEndpoint{
+			description: host,
+			opts:        []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()},
+		})
+	}
+
+	homeDir := userHomeDir()
+	return append(endpoints, socketEndpoints([]string{
+		"/var/run/docker.sock",                                                          // Standard Docker (Linux)
+		filepath.Join(homeDir, ".rd/docker.sock"),                                       // Rancher Desktop
+		filepath.Join(homeDir, ".docker/run/docker.sock"),                               // Docker Desktop
+		filepath.Join(homeDir, ".docker/desktop/docker.sock"),                           // Docker Desktop alternative
+		filepath.Join(homeDir, "Library/Containers/com.docker.docker/Data/docker.sock"), // Docker Desktop macOS
+		"/tmp/docker.sock",               // Alternative location
+		"/usr/local/var/run/docker.sock", // Homebrew Docker
+	})...)
+}
+
+// podmanEndpoints returns CONTAINER_HOST when it is a Unix socket, then the
+// rootful socket, the rootless sockets of the agent's user and, when the
+// agent runs as root, of every logged-in user, and podman machine sockets
+func podmanEndpoints() []dockerEndpoint {
+	var endpoints []dockerEndpoint
+	if host := os.Getenv("CONTAINER_HOST"); strings.HasPrefix(host, "unix://") {
+		endpoints = append(endpoints, dockerEndpoint{
+			description: host,
+			opts:        []client.Opt{client.WithHost(host), client.WithAPIVersionNegotiation()},
+		})
+	}
+
+	paths := []string{"/run/podman/podman.sock"}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		paths = append(paths, filepath.Join(runtimeDir, "podman", "podman.sock"))
+	}
+	userSockets, _ := filepath.Glob("/run/user/*/podman/podman.sock")
+	paths = append(paths, userSockets...)
+
+	machineDir := filepath.Join(userHomeDir(), ".local/share/containers/podman/machine")
+	machineSockets, _ := filepath.Glob(filepath.Join(machineDir, "*", "podman.sock"))
+	paths = append(paths, filepath.Join(machineDir, "podman.sock"))
+	paths = append(paths, machineSockets...)
+
+	return append(endpoints, socketEndpoints(paths)...)
+}
+
+// socketEndpoints keeps the socket paths that exist
+func socketEndpoints(paths []string) []dockerEndpoint {
+	var endpoints []dockerEndpoint
+	seen := make(map[string]bool)
+	for _, socketPath := range paths {
+		if seen[socketPath] {
+			continue
+		}
+		seen[socketPath] = true
+		if _, err := os.Stat(socketPath); err != nil {
+			continue
+		}
+
+		host := "unix://" + socketPath
+		endpoints = append(endpoints, dockerEndpoint{
+			description: host,
+			opts:        []client.Opt{client.WithHost(host), client.WithAPIVersionNegotiation()},
+		})
+	}
+	return endpoints
+}
+
+// userHomeDir returns the agent user's home directory
+func userHomeDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		homeDir = os.Getenv("HOME")
+		if homeDir == "" {
+			homeDir = "/tmp" // fallback
+		}
+	}
+	return homeDir
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	SnapshotTypeFull  = "full"
+	SnapshotTypeDelta = "delta"
+
+	defaultCheckpointInterval = time.Hour
+)
+
+// TelemetryDelta carries the changes since the previous payload in the
+// sequence. Processes are identified by PID plus start time so that a reused
+// PID is reported as an exit followed by a start. Processes whose executable
+// was hashed after they started are sent again with the hash.
+type TelemetryDelta struct {
+	ProcessesStarted  []ProcessInfo   `json:"processes_started"`
+	ProcessesExited   []ProcessRef    `json:"processes_exited"`
+	ContainersCreated []ContainerInfo `json:"containers_created"`
+	ContainersUpdated []ContainerInfo `json:"containers_updated"`
+	ContainersRemoved []string        `json:"containers_removed"`
+	// Persistence items added or modified, and the keys of those removed
+	PersistenceChanged []PersistenceItem `json:"persistence_changed,omitempty"`
+	PersistenceRemoved []string          `json:"persistence_removed,omitempty"`
+}
+
+// ProcessRef identifies a process instance on the host
+type ProcessRef struct {
+	PID       int32 `json:"pid"`
+	StartTime int64 `json:"start_time"`
+}
+
+// deltaTracker turns successive collections into a full baseline followed by
+// deltas, sending a full checkpoint periodically or when the server asks for
+// a resync. It is shared by the collection loop and the spool replay loop.
+type deltaTracker struct {
+	mu                 sync.Mutex
+	checkpointInterval time.Duration
+	sequence           uint64
+	lastCheckpoint     time.Time
+	resync             bool
+	processes          map[ProcessRef]string // SHA256 of the executable, if hashed
+	containers         map[string]ContainerInfo
+	packagesHash       string
+	persistence        map[string]PersistenceItem
+}
+
+func newDeltaTracker(checkpointInterval time.Duration) *deltaTracker {
+	return &deltaTracker{
+		checkpointInterval: checkpointInterval,
+		resync:             true,
+	}
+}
+
+// RequestResync makes the next payload a full snapshot.
+func (t *deltaTracker) RequestResync() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resync = true
+}
+
+// SetCheckpointInterval changes how often a full checkpoint is sent
+func (t *deltaTracker) SetCheckpointInterval(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checkpointInterval = interval
+}
+
+// snapshotCollectors are the collectors whose listings a full snapshot
+// replaces, so they run whenever one is due
+var snapshotCollectors = []string{"processes", "containers", "persistence"}
+
+// FullDue reports whether the payload collected at the given time will be a
+// full snapshot, if its listings succeed
+func (t *deltaTracker) FullDue(at time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resync || t.processes == nil || at.Sub(t.lastCheckpoint) >= t.checkpointInterval
+}
+
+// Apply stamps data with the next sequence number and, unless a full
+// snapshot is due, replaces the process, container and persistence lists
+// with a delta against the previous payload. A listing whose collector
+// failed or did not run contributes no changes instead of reporting
+// everything as gone.
+func (t *deltaTracker) Apply(data *TelemetryData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sequence++
+	data.Sequence = t.sequence
+
+	processesOK := data.collectorStatus("processes") == CollectorStatusOK && !data.Truncated
+	containersOK := data.collectorStatus("containers") == CollectorStatusOK
+	persistenceOK := data.collectorStatus("persistence") == CollectorStatusOK
+
+	// A routine checkpoint waits for a cycle in which no listing failed, so
+	// a transient failure is not reported as everything exiting
+	checkpointDue := data.Timestamp.Sub(t.lastCheckpoint) >= t.checkpointInterval
+	listingFailed := data.Truncated ||
+		data.collectorStatus("processes") == CollectorStatusFailed ||
+		data.collectorStatus("containers") == CollectorStatusFailed
+	full := t.resync || t.processes == nil || (checkpointDue && !listingFailed)
+
+	currentProcesses := t.processes
+	if processesOK || currentProcesses == nil {
+		currentProcesses = make(map[ProcessRef]string, len(data.Processes))
+		for _, proc := range data.Processes {
+			// A hash missing from this listing is still known
+			sha256 := proc.SHA256
+			if sha256 == "" {
+				sha256 = t.processes[processRef(proc)]
+			}
+			currentProcesses[processRef(proc)] = sha256
+		}
+	}
+
+	currentContainers := t.containers
+	if containersOK || currentContainers == nil {
+		currentContainers = make(map[string]ContainerInfo, len(data.Containers))
+		for _, container := range data.Containers {
+			currentContainers[container.ID] = container
+		}
+	}
+
+	currentPersistence := t.persistence
+	if persistenceOK || currentPersistence == nil {
+		currentPersistence = make(map[string]PersistenceItem, len(data.Persistence))
+		for _, item := range data.Persistence {
+			currentPersistence[item.Key] = item
+		}
+	}
+
+	if full {
+		data.SnapshotType = SnapshotTypeFull
+		t.lastCheckpoint = data.Timestamp
+		t.resync = false
+	} else {
+		data.SnapshotType = SnapshotTypeDelta
+		delta := &TelemetryDelta{}
+
+		if processesOK {
+			for _, proc := range data.Processes {
+				previousSHA256, seen := t.processes[processRef(proc)]
+				if !seen || (proc.SHA256 != "" && proc.SHA256 != previousSHA256) {
+					delta.ProcessesStarted = append(delta.ProcessesStarted, proc)
+				}
+			}
+			for ref := range t.processes {
+				if _, running := currentProcesses[ref]; !running {
+					delta.ProcessesExited = append(delta.ProcessesExited, ref)
+				}
+			}
+		}
+
+		if containersOK {
+			for _, container := range data.Containers {
+				previous, seen := t.containers[container.ID]
+				if !seen {
+					delta.ContainersCreated = append(delta.ContainersCreated, container)
+				} else if containerChanged(previous, container) {
+					delta.ContainersUpdated = append(delta.ContainersUpdated, container)
+				}
+			}
+			for id := range t.containers {
+				if _, exists := currentContainers[id]; !exists {
+					delta.ContainersRemoved = append(delta.ContainersRemoved, id)
+				}
+			}
+		}
+
+		if persistenceOK {
+			for _, item := range data.Persistence {
+				previous, seen := t.persistence[item.Key]
+				if !seen || !reflect.DeepEqual(previous, item) {
+					delta.PersistenceChanged = append(delta.PersistenceChanged, item)
+				}
+			}
+			for key := range t.persistence {
+				if _, exists := currentPersistence[key]; !exists {
+					delta.PersistenceRemoved = append(delta.PersistenceRemoved, key)
+				}
+			}
+		}
+
+		data.Processes = nil
+		data.Containers = nil
+		data.Persistence = nil
+		data.Delta = delta
+	}
+
+	// The package inventory rarely changes, so it is only sent with full
+	// snapshots and when it differs from the inventory last sent
+	if data.Packages != nil {
+		hash := packagesHash(data.Packages)
+		if !full && hash == t.packagesHash {
+			data.Packages = nil
+		} else {
+			t.packagesHash = hash
+		}
+	}
+
+	t.processes = currentProcesses
+	t.containers = currentContainers
+	t.persistence = currentPersistence
+}
+
+func processRef(proc ProcessInfo) ProcessRef {
+	return ProcessRef{PID: proc.PID, StartTime: proc.StartTime}
+}
+
+// containerChanged ignores the human-readable status ("Up 5 minutes"), which
+// changes on every collection, and compares the machine state instead.
+func containerChanged(previous, current ContainerInfo) bool {
+	previous.Status = ""
+	current.Status = ""
+	return !reflect.DeepEqual(previous, current)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// collection returns a payload whose process, container and persistence
+// collectors all succeeded
+func collection(at time.Time, processes []ProcessInfo, containers []ContainerInfo, persistence []PersistenceItem) *TelemetryData {
+	return &TelemetryData{
+		Timestamp:   at,
+		Processes:   processes,
+		Containers:  containers,
+		Persistence: persistence,
+		Collectors: []CollectorStatus{
+			{Name: "processes", Status: CollectorStatusOK},
+			{Name: "containers", Status: CollectorStatusOK},
+			{Name: "persistence", Status: CollectorStatusOK},
+		},
+	}
+}
+
+func TestDeltaTrackerApply(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+	proc := func(pid int32, sha256 string) ProcessInfo {
+		return ProcessInfo{PID: pid, StartTime: int64(pid) * 100, SHA256: sha256}
+	}
+	ref := func(pid int32) ProcessRef {
+		return ProcessRef{PID: pid, StartTime: int64(pid) * 100}
+	}
+	failed := func(data *TelemetryData, collector string) *TelemetryData {
+		for i := range data.Collectors {
+			if data.Collectors[i].Name == collector {
+				data.Collectors[i].Status = CollectorStatusFailed
+			}
+		}
+		return data
+	}
+	truncated := func(data *TelemetryData) *TelemetryData {
+		data.Truncated = true
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		baseline *TelemetryData
+		next     *TelemetryData
+		want     TelemetryDelta
+	}{
+		{
+			name:     "processes started and exited",
+			baseline: collection(t0, []ProcessInfo{proc(1, ""), proc(2, "")}, nil, nil),
+			next:     collection(t1, []ProcessInfo{proc(2, ""), proc(3, "")}, nil, nil),
+			want: TelemetryDelta{
+				ProcessesStarted: []ProcessInfo{proc(3, "")},
+				ProcessesExited:  []ProcessRef{ref(1)},
+			},
+		},
+		{
+			name:     "process hashed after it started is sent again",
+			baseline: collection(t0, []ProcessInfo{proc(1, "")}, nil, nil),
+			next:     collection(t1, []ProcessInfo{proc(1, "abc")}, nil, nil),
+			want:     TelemetryDelta{ProcessesStarted: []ProcessInfo{proc(1, "abc")}},
+		},
+		{
+			name:     "hash missing from a listing is still known",
+			baseline: collection(t0, []ProcessInfo{proc(1, "abc")}, nil, nil),
+			next:     collection(t1, []ProcessInfo{proc(1, "")}, nil, nil),
+			want:     TelemetryDelta{},
+		},
+		{
+			name:     "failed process listing reports no exits",
+			baseline: collection(t0, []ProcessInfo{proc(1, "")}, nil, nil),
+			next:     failed(collection(t1, nil, nil, nil), "processes"),
+			want:     TelemetryDelta{},
+		},
+		{
+			name:     "truncated process listing reports no exits",
+			baseline: collection(t0, []ProcessInfo{proc(1, ""), proc(2, "")}, nil, nil),
+			next:     truncated(collection(t1, []ProcessInfo{proc(3, "")}, nil, nil)),
+			want:     TelemetryDelta{},
+		},
+		{
+			name:     "containers created and removed",
+			baseline: collection(t0, nil, []ContainerInfo{{ID: "a"}}, nil),
+			next:     collection(t1, nil, []ContainerInfo{{ID: "b"}}, nil),
+			want: TelemetryDelta{
+				ContainersCreated: []ContainerInfo{{ID: "b"}},
+				ContainersRemoved: []string{"a"},
+			},
+		},
+		{
+			name:     "container status text ignored",
+			baseline: collection(t0, nil, []ContainerInfo{{ID: "a", State: "running", Status: "Up 5 minutes"}}, nil),
+			next:     collection(t1, nil, []ContainerInfo{{ID: "a", State: "running", Status: "Up 6 minutes"}}, nil),
+			want:     TelemetryDelta{},
+		},
+		{
+			name:     "container state change",
+			baseline: collection(t0, nil, []ContainerInfo{{ID: "a", State: "running"}}, nil),
+			next:     collection(t1, nil, []ContainerInfo{{ID: "a", State: "exited"}}, nil),
+			want:     TelemetryDelta{ContainersUpdated: []ContainerInfo{{ID: "a", State: "exited"}}},
+		},
+		{
+			name:     "failed container listing reports no removals",
+			baseline: collection(t0, nil, []ContainerInfo{{ID: "a"}}, nil),
+			next:     failed(collection(t1, nil, nil, nil), "containers"),
+			want:     TelemetryDelta{},
+		},
+		{
+			name:     "persistence changed and removed",
+			baseline: collection(t0, nil, nil, []PersistenceItem{{Key: "a", Path: "/a"}, {Key: "b", Path: "/b"}}),
+			next:     collection(t1, nil, nil, []PersistenceItem{{Key: "a", Path: "/a2"}, {Key: "c", Path: "/c"}}),
+			want: TelemetryDelta{
+				PersistenceChanged: []PersistenceItem{{Key: "a", Path: "/a2"}, {Key: "c", Path: "/c"}},
+				PersistenceRemoved: []string{"b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newDeltaTracker(time.Hour)
+			tracker.Apply(tt.baseline)
+			if tt.baseline.SnapshotType != SnapshotTypeFull || tt.baseline.Sequence != 1 {
+				t.Fatalf("baseline is %s #%d, want full #1", tt.baseline.SnapshotType, tt.baseline.Sequence)
+			}
+
+			tracker.Apply(tt.next)
+			if tt.next.SnapshotType != SnapshotTypeDelta || tt.next.Sequence != 2 {
+				t.Fatalf("next is %s #%d, want delta #2", tt.next.SnapshotType, tt.next.Sequence)
+			}
+			if tt.next.Processes != nil || tt.next.Containers != nil || tt.next.Persistence != nil {
+				t.Error("delta still carries full listings")
+			}
+
+			got := *tt.next.Delta
+			sort.Slice(got.ProcessesExited, func(i, j int) bool { return got.ProcessesExited[i].PID < got.ProcessesExited[j].PID })
+			sort.Strings(got.ContainersRemoved)
+			sort.Strings(got.PersistenceRemoved)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("delta = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeltaTrackerCheckpoints(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	processesFailed := func(at time.Time) *TelemetryData {
+		data := collection(at, nil, nil, nil)
+		data.Collectors[0].Status = CollectorStatusFailed
+		return data
+	}
+
+	// FullDue cannot know whether the listings will succeed, so a checkpoint
+	// that waits for them is still reported due
+	tests := []struct {
+		name    string
+		resync  bool
+		next    *TelemetryData
+		wantDue bool
+		want    string
+	}{
+		{"within the checkpoint interval", false, collection(t0.Add(time.Minute), nil, nil, nil), false, SnapshotTypeDelta},
+		{"checkpoint due", false, collection(t0.Add(time.Hour), nil, nil, nil), true, SnapshotTypeFull},
+		{"checkpoint waits for a listing that succeeds", false, processesFailed(t0.Add(time.Hour)), true, SnapshotTypeDelta},
+		{"resync requested", true, collection(t0.Add(time.Minute), nil, nil, nil), true, SnapshotTypeFull},
+		{"resync despite a failed listing", true, processesFailed(t0.Add(time.Minute)), true, SnapshotTypeFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newDeltaTracker(time.Hour)
+			tracker.Apply(collection(t0, nil, nil, nil))
+			if tt.resync {
+				tracker.RequestResync()
+			}
+
+			if got := tracker.FullDue(tt.next.Timestamp); got != tt.wantDue {
+				t.Errorf("FullDue() = %v, want %v", got, tt.wantDue)
+			}
+			tracker.Apply(tt.next)
+			if tt.next.SnapshotType != tt.want {
+				t.Errorf("snapshot type = %s, want %s", tt.next.SnapshotType, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeltaTrackerFullDue(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker := newDeltaTracker(time.Hour)
+	if !tracker.FullDue(t0) {
+		t.Error("FullDue() = false before the first payload, want true")
+	}
+
+	tracker.Apply(collection(t0, nil, nil, nil))
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{t0.Add(time.Minute), false},
+		{t0.Add(time.Hour - time.Second), false},
+		{t0.Add(time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := tracker.FullDue(tt.at); got != tt.want {
+			t.Errorf("FullDue(%v) = %v, want %v", tt.at.Sub(t0), got, tt.want)
+		}
+	}
+
+	tracker.SetCheckpointInterval(time.Minute)
+	if !tracker.FullDue(t0.Add(time.Minute)) {
+		t.Error("FullDue() = false past a shortened checkpoint interval, want true")
+	}
+}
+
+func TestDeltaTrackerPackages(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	packages := []PackageInfo{{Name: "curl", Version: "8.0", Source: "apt"}}
+	upgraded := []PackageInfo{{Name: "curl", Version: "8.1", Source: "apt"}}
+
+	tracker := newDeltaTracker(time.Hour)
+	steps := []struct {
+		packages []PackageInfo
+		wantSent bool
+	}{
+		{packages, true},
+		{packages, false},
+		{upgraded, true},
+		{upgraded, false},
+	}
+	for i, step := range steps {
+		data := collection(t0.Add(time.Duration(i)*time.Minute), nil, nil, nil)
+		data.Packages = step.packages
+		tracker.Apply(data)
+		if sent := data.Packages != nil; sent != step.wantSent {
+			t.Errorf("payload %d: packages sent = %v, want %v", i+1, sent, step.wantSent)
+		}
+	}
+}
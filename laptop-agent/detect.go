@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severities of detection rules, as the telemetry service grades findings
+var detectionSeverities = []string{"low", "medium", "high", "critical"}
+
+// maxEvidenceLength bounds each evidence value, e.g. a long command line
+const maxEvidenceLength = 1024
+
+// Finding is a match of a local detection rule. It names the process or
+// the container that matched and what about it matched the rule.
+type Finding struct {
+	RuleID      string            `json:"rule_id"`
+	RuleName    string            `json:"rule_name"`
+	Severity    string            `json:"severity"`
+	Description string            `json:"description"`
+	Timestamp   time.Time         `json:"timestamp"`
+	ProcessKey  string            `json:"process_key,omitempty"`
+	ContainerID string            `json:"container_id,omitempty"`
+	Evidence    map[string]string `json:"evidence"`
+}
+
+// detectionRuleFile is a rule pack, in YAML or JSON, e.g.
+//
+//	rules:
+//	  - id: netcat-shell
+//	    name: Shell served with netcat
+//	    severity: high
+//	    process:
+//	      name: [nc, ncat]
+//	      cmdline: '\s-e\s+\S*sh\b'
+//	  - id: cryptominer-image
+//	    name: Cryptominer container
+//	    severity: critical
+//	    container:
+//	      image: ['*xmrig*']
+type detectionRuleFile struct {
+	Rules []detectionRule `yaml:"rules"`
+}
+
+// detectionRule matches either processes or containers. Every condition
+// that is set must hold; a list holds when any of its entries matches.
+// Names, paths, users and images are globs, in which * matches any text,
+// including path separators.
+type detectionRule struct {
+	ID          string               `yaml:"id"`
+	Name        string               `yaml:"name"`
+	Severity    string               `yaml:"severity"`
+	Description string               `yaml:"description"`
+	Process     *processConditions   `yaml:"process"`
+	Container   *containerConditions `yaml:"container"`
+}
+
+type processConditions struct {
+	Name    globList `yaml:"name"`
+	Path    globList `yaml:"path"`
+	SHA256  []string `yaml:"sha256"`
+	Cmdline string   `yaml:"cmdline"` // a regular expression, matched against the redacted command line
+	User    globList `yaml:"user"`
+	Parent  globList `yaml:"parent"` // names of the parent process
+
+	cmdline *regexp.Regexp
+	sha256  map[string]bool
+}
+
+type containerConditions struct {
+	Image  globList            `yaml:"image"`
+	Labels map[string]globList `yaml:"labels"` // every label must be present, with a matching value
+}
+
+// globList is a list of globs, or a single one, compiled to regular
+// expressions
+type globList []*regexp.Regexp
+
+func (l *globList) UnmarshalYAML(node *yaml.Node) error {
+	var texts []string
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	} else if node.Kind == yaml.ScalarNode {
+		texts = []string{node.Value}
+	} else if err := node.Decode(&texts); err != nil {
+		return err
+	}
+	for _, text := range texts {
+		var expr strings.Builder
+		expr.WriteString("^")
+		for _, r := range text {
+			switch r {
+			case '*':
+				expr.WriteString(".*")
+			case '?':
+				expr.WriteString(".")
+			default:
+				expr.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		expr.WriteString("$")
+		*l = append(*l, regexp.MustCompile(expr.String()))
+	}
+	return nil
+}
+
+// match reports whether any of the globs matches value
+func (l globList) match(value string) bool {
+	for _, pattern := range l {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDetectionRules reads a rule pack, refusing rules it does not
+// understand rather than silently never matching them
+func loadDetectionRules(path string) ([]detectionRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open detection rules: %w", err)
+	}
+	defer file.Close()
+
+	var pack detectionRuleFile
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&pack); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse detection rules %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range pack.Rules {
+		rule := &pack.Rules[i]
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i+1, rule.ID, err)
+		}
+		if seen[rule.ID] {
+			return nil, fmt.Errorf("%s: rule %d: duplicate rule ID %s", path, i+1, rule.ID)
+		}
+		seen[rule.ID] = true
+	}
+	return pack.Rules, nil
+}
+
+// compile checks a rule and prepares its conditions
+func (r *detectionRule) compile() error {
+	switch {
+	case r.ID == "" || r.Name == "":
+		return errors.New("a rule needs an id and a name")
+	case len(r.ID) > 100 || len(r.Name) > 255:
+		return errors.New("the id is limited to 100 characters and the name to 255")
+	case !slices.Contains(detectionSeverities, r.Severity):
+		return fmt.Errorf("invalid severity %q: must be one of %s", r.Severity, strings.Join(detectionSeverities, ", "))
+	case (r.Process == nil) == (r.Container == nil):
+		return errors.New("a rule matches either a process or a container")
+	}
+
+	if p := r.Process; p != nil {
+		if len(p.Name) == 0 && len(p.Path) == 0 && len(p.SHA256) == 0 && p.Cmdline == "" && len(p.User) == 0 && len(p.Parent) == 0 {
+			return errors.New("a process rule needs at least one condition")
+		}
+		if p.Cmdline != "" {
+			pattern, err := regexp.Compile(p.Cmdline)
+			if err != nil {
+				return fmt.Errorf("invalid cmdline: %w", err)
+			}
+			p.cmdline = pattern
+		}
+		p.sha256 = make(map[string]bool, len(p.SHA256))
+		for _, hash := range p.SHA256 {
+			p.sha256[strings.ToLower(hash)] = true
+		}
+	}
+	if c := r.Container; c != nil && len(c.Image) == 0 && len(c.Labels) == 0 {
+		return errors.New("a container rule needs at least one condition")
+	}
+	return nil
+}
+
+// detector evaluates the rule pack against the latest listings. A process
+// or container is reported once per rule it matches, for as long as it
+// keeps matching, rather than with every collection.
+type detector struct {
+	rules    []detectionRule
+	reported map[string]bool // rule ID and process key or container ID
+}
+
+func newDetector(rules []detectionRule) *detector {
+	return &detector{rules: rules, reported: make(map[string]bool)}
+}
+
+// loadConfiguredDetectionRules loads the rules of DETECTION_RULES_FILE, or
+// none without one
+func loadConfiguredDetectionRules(config Config) ([]detectionRule, error) {
+	if config.DetectionRules == "" {
+		return nil, nil
+	}
+	rules, err := loadDetectionRules(config.DetectionRules)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d detection rules from %s", len(rules), config.DetectionRules)
+	return rules, nil
+}
+
+// setRules replaces the rule pack. Matches already reported for rules that
+// remain are not reported again.
+func (d *detector) setRules(rules []detectionRule) {
+	d.rules = rules
+}
+
+// Evaluate returns the findings of processes and containers that match a
+// rule and have not been reported for it yet
+func (d *detector) Evaluate(processes []ProcessInfo, containers []ContainerInfo, at time.Time) []Finding {
+	if len(d.rules) == 0 {
+		return nil
+	}
+
+	byKey := make(map[string]*ProcessInfo, len(processes))
+	for i := range processes {
+		byKey[processes[i].ProcessKey] = &processes[i]
+	}
+
+	var findings []Finding
+	matched := make(map[string]bool)
+	report := func(rule *detectionRule, key string, finding Finding) {
+		key = rule.ID + "|" + key
+		matched[key] = true
+		if d.reported[key] {
+			return
+		}
+		finding.RuleID, finding.RuleName, finding.Severity = rule.ID, rule.Name, rule.Severity
+		finding.Timestamp = at
+		findings = append(findings, finding)
+	}
+
+	for i := range d.rules {
+		rule := &d.rules[i]
+		if rule.Process != nil {
+			for j := range processes {
+				proc := &processes[j]
+				var parent *ProcessInfo
+				if proc.ParentKey != "" {
+					parent = byKey[proc.ParentKey]
+				}
+				if evidence, ok := rule.Process.match(proc, parent); ok {
+					report(rule, proc.ProcessKey, Finding{
+						Description: describeFinding(rule, fmt.Sprintf("process %s (pid %d)", proc.Name, proc.PID)),
+						ProcessKey:  proc.ProcessKey,
+						Evidence:    evidence,
+					})
+				}
+			}
+		}
+		if rule.Container != nil {
+			for j := range containers {
+				container := &containers[j]
+				if evidence, ok := rule.Container.match(container); ok {
+					report(rule, "container:"+container.ID, Finding{
+						Description: describeFinding(rule, fmt.Sprintf("container %s (%s)", containerName(container), container.Image)),
+						ContainerID: container.ID,
+						Evidence:    evidence,
+					})
+				}
+			}
+		}
+	}
+
+	// Forget what no longer matches, so it is reported again if it comes back
+	d.reported = matched
+	return findings
+}
+
+// describeFinding prefixes the rule's description, if it has one, to what
+// matched
+func describeFinding(rule *detectionRule, subject string) string {
+	description := fmt.Sprintf("%s matched rule %s", subject, rule.Name)
+	if rule.Description != "" {
+		description = rule.Description + ": " + description
+	}
+	return strings.ToUpper(description[:1]) + description[1:]
+}
+
+// match reports whether a process meets every condition, and the values
+// that met them
+func (p *processConditions) match(proc *ProcessInfo, parent *ProcessInfo) (map[string]string, bool) {
+	evidence := map[string]string{"pid": strconv.Itoa(int(proc.PID))}
+	check := func(name, value string, ok bool) bool {
+		if ok {
+			evidence[name] = truncateEvidence(value)
+		}
+		return ok
+	}
+
+	if len(p.Name) > 0 && !check("name", proc.Name, p.Name.match(proc.Name)) {
+		return nil, false
+	}
+	if len(p.Path) > 0 && !check("path", proc.ExePath, p.Path.match(proc.ExePath)) {
+		return nil, false
+	}
+	if len(p.SHA256) > 0 && !check("sha256", proc.SHA256, p.sha256[strings.ToLower(proc.SHA256)]) {
+		return nil, false
+	}
+	if p.cmdline != nil {
+		cmdline := strings.Join(proc.Cmdline, " ")
+		if !check("cmdline", cmdline, p.cmdline.MatchString(cmdline)) {
+			return nil, false
+		}
+	}
+	if len(p.User) > 0 && !check("user", proc.Username, p.User.match(proc.Username)) {
+		return nil, false
+	}
+	if len(p.Parent) > 0 {
+		if parent == nil || !check("parent", parent.Name, p.Parent.match(parent.Name)) {
+			return nil, false
+		}
+	}
+
+	// Identify the process even when the rule did not look at its name
+	evidence["name"] = proc.Name
+	if proc.ExePath != "" {
+		evidence["path"] = proc.ExePath
+	}
+	return evidence, true
+}
+
+// match reports whether a container meets every condition, and the values
+// that met them
+func (c *containerConditions) match(container *ContainerInfo) (map[string]string, bool) {
+	if len(c.Image) > 0 && !c.Image.match(container.Image) {
+		return nil, false
+	}
+	evidence := map[string]string{
+		"container_id": container.ID,
+		"image":        container.Image,
+	}
+	if container.Runtime != "" {
+		evidence["runtime"] = container.Runtime
+	}
+
+	names := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, found := container.Labels[name]
+		if !found || !c.Labels[name].match(value) {
+			return nil, false
+		}
+		evidence["label:"+name] = truncateEvidence(value)
+	}
+	return evidence, true
+}
+
+func containerName(container *ContainerInfo) string {
+	if len(container.Names) > 0 {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+	return container.ID[:min(12, len(container.ID))]
+}
+
+func truncateEvidence(value string) string {
+	if len(value) > maxEvidenceLength {
+		return strings.ToValidUTF8(value[:maxEvidenceLength], "")
+	}
+	return value
+}
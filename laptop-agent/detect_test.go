@@ -0,0 +1,268 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRules writes a rule pack to a temporary file and returns its path
+func writeRules(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDetectionRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantIDs []string
+		wantErr string
+	}{
+		{
+			name:    "empty pack",
+			text:    "",
+			wantIDs: nil,
+		},
+		{
+			name: "process and container rules",
+			text: `
+rules:
+  - id: netcat-shell
+    name: Shell served with netcat
+    severity: high
+    process:
+      name: [nc, ncat]
+      cmdline: '\s-e\s+\S*sh\b'
+  - id: cryptominer-image
+    name: Cryptominer container
+    severity: critical
+    container:
+      image: '*xmrig*'
+`,
+			wantIDs: []string{"netcat-shell", "cryptominer-image"},
+		},
+		{
+			name:    "JSON pack",
+			text:    `{"rules": [{"id": "a", "name": "A", "severity": "low", "process": {"user": "root"}}]}`,
+			wantIDs: []string{"a"},
+		},
+		{
+			name:    "unknown field",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: low\n    process:\n      command: nc\n",
+			wantErr: "field command not found",
+		},
+		{
+			name:    "missing id",
+			text:    "rules:\n  - name: A\n    severity: low\n    process:\n      name: nc\n",
+			wantErr: "needs an id and a name",
+		},
+		{
+			name:    "invalid severity",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: urgent\n    process:\n      name: nc\n",
+			wantErr: "invalid severity",
+		},
+		{
+			name:    "process and container in one rule",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: low\n    process:\n      name: nc\n    container:\n      image: nc\n",
+			wantErr: "either a process or a container",
+		},
+		{
+			name:    "process rule without conditions",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: low\n    process: {}\n",
+			wantErr: "at least one condition",
+		},
+		{
+			name:    "container rule without conditions",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: low\n    container: {}\n",
+			wantErr: "at least one condition",
+		},
+		{
+			name:    "invalid cmdline",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: low\n    process:\n      cmdline: '(nc'\n",
+			wantErr: "invalid cmdline",
+		},
+		{
+			name:    "duplicate id",
+			text:    "rules:\n  - id: a\n    name: A\n    severity: low\n    process:\n      name: nc\n  - id: a\n    name: B\n    severity: low\n    process:\n      name: ncat\n",
+			wantErr: "duplicate rule ID a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := loadDetectionRules(writeRules(t, tt.text))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadDetectionRules() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadDetectionRules() error = %v", err)
+			}
+			var ids []string
+			for _, rule := range rules {
+				ids = append(ids, rule.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("rule IDs = %q, want %q", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestDetectorEvaluate(t *testing.T) {
+	at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	shell := ProcessInfo{PID: 10, Name: "bash", ExePath: "/usr/bin/bash", Username: "alice", ProcessKey: "p10"}
+	netcat := ProcessInfo{
+		PID: 11, Name: "nc", ExePath: "/usr/bin/nc", Username: "root", ProcessKey: "p11", ParentKey: "p10",
+		Cmdline: []string{"nc", "-l", "-p", "4444", "-e", "/bin/sh"},
+		SHA256:  "ABCDEF0123",
+	}
+	miner := ContainerInfo{ID: "c1234567890abcdef", Names: []string{"/miner"}, Image: "docker.io/evil/xmrig:latest", Labels: map[string]string{"env": "prod"}}
+
+	tests := []struct {
+		name         string
+		rule         string
+		wantKeys     []string
+		wantEvidence map[string]string
+	}{
+		{
+			name:     "name",
+			rule:     "process:\n      name: [nc, ncat]",
+			wantKeys: []string{"p11"},
+			wantEvidence: map[string]string{
+				"pid": "11", "name": "nc", "path": "/usr/bin/nc",
+			},
+		},
+		{
+			name:     "path glob spanning directories",
+			rule:     "process:\n      path: '/usr/*sh'",
+			wantKeys: []string{"p10"},
+		},
+		{
+			name:     "hash in any case",
+			rule:     "process:\n      sha256: [abcdef0123]",
+			wantKeys: []string{"p11"},
+		},
+		{
+			name:     "command line",
+			rule:     "process:\n      cmdline: '\\s-e\\s+\\S*sh\\b'",
+			wantKeys: []string{"p11"},
+			wantEvidence: map[string]string{
+				"pid": "11", "name": "nc", "path": "/usr/bin/nc", "cmdline": "nc -l -p 4444 -e /bin/sh",
+			},
+		},
+		{
+			name:     "parent",
+			rule:     "process:\n      name: nc\n      parent: '*sh'",
+			wantKeys: []string{"p11"},
+		},
+		{
+			name:     "every condition must hold",
+			rule:     "process:\n      name: nc\n      user: alice",
+			wantKeys: nil,
+		},
+		{
+			name:     "process without a listed parent",
+			rule:     "process:\n      parent: '*'",
+			wantKeys: []string{"p11"},
+		},
+		{
+			name:     "container image",
+			rule:     "container:\n      image: '*xmrig*'",
+			wantKeys: []string{"container:c1234567890abcdef"},
+			wantEvidence: map[string]string{
+				"container_id": "c1234567890abcdef", "image": "docker.io/evil/xmrig:latest",
+			},
+		},
+		{
+			name:     "container label",
+			rule:     "container:\n      labels:\n        env: [prod, staging]",
+			wantKeys: []string{"container:c1234567890abcdef"},
+		},
+		{
+			name:     "container label missing",
+			rule:     "container:\n      labels:\n        team: '*'",
+			wantKeys: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "rules:\n  - id: rule\n    name: Rule\n    severity: high\n    " + tt.rule + "\n"
+			rules, err := loadDetectionRules(writeRules(t, text))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			findings := newDetector(rules).Evaluate([]ProcessInfo{shell, netcat}, []ContainerInfo{miner}, at)
+			var keys []string
+			for _, finding := range findings {
+				key := finding.ProcessKey
+				if finding.ContainerID != "" {
+					key = "container:" + finding.ContainerID
+				}
+				keys = append(keys, key)
+				if finding.RuleID != "rule" || finding.Severity != "high" || !finding.Timestamp.Equal(at) {
+					t.Errorf("finding = %+v, want rule \"rule\", severity high, at %v", finding, at)
+				}
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Fatalf("findings for %q, want %q", keys, tt.wantKeys)
+			}
+			if tt.wantEvidence != nil && !reflect.DeepEqual(findings[0].Evidence, tt.wantEvidence) {
+				t.Errorf("evidence = %v, want %v", findings[0].Evidence, tt.wantEvidence)
+			}
+		})
+	}
+}
+
+func TestDetectorReportsOnce(t *testing.T) {
+	rules, err := loadDetectionRules(writeRules(t, "rules:\n  - id: netcat\n    name: Netcat\n    severity: medium\n    description: netcat is running\n    process:\n      name: nc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	netcat := []ProcessInfo{{PID: 11, Name: "nc", ProcessKey: "p11"}}
+	at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	d := newDetector(rules)
+	steps := []struct {
+		processes []ProcessInfo
+		want      int
+	}{
+		{netcat, 1},
+		{netcat, 0}, // still matching, already reported
+		{nil, 0},    // gone
+		{netcat, 1}, // back, so reported again
+	}
+	for i, step := range steps {
+		findings := d.Evaluate(step.processes, nil, at)
+		if len(findings) != step.want {
+			t.Fatalf("collection %d: %d findings, want %d", i+1, len(findings), step.want)
+		}
+		if len(findings) > 0 {
+			if want := "Netcat is running: process nc (pid 11) matched rule Netcat"; findings[0].Description != want {
+				t.Errorf("description = %q, want %q", findings[0].Description, want)
+			}
+		}
+	}
+}
+
+func TestTruncateEvidence(t *testing.T) {
+	long := strings.Repeat("a", maxEvidenceLength-1) + "é"
+	if got := truncateEvidence(long); len(got) != maxEvidenceLength-1 {
+		t.Errorf("truncateEvidence() kept %d bytes, want %d without the split rune", len(got), maxEvidenceLength-1)
+	}
+	if got := truncateEvidence("short"); got != "short" {
+		t.Errorf("truncateEvidence() = %q, want it unchanged", got)
+	}
+}
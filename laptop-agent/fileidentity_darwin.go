@@ -0,0 +1,33 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIdentity reads the device, inode and change times of a file
+func statIdentity(info os.FileInfo) (fileIdentity, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileIdentity{}, false
+	}
+
+	return fileIdentity{
+		Dev:     uint64(stat.Dev),
+		Inode:   stat.Ino,
+		Size:    info.Size(),
+		MtimeNs: stat.Mtimespec.Sec*1e9 + stat.Mtimespec.Nsec,
+		CtimeNs: stat.Ctimespec.Sec*1e9 + stat.Ctimespec.Nsec,
+	}, true
+}
+
+// statOwner reads the user and group owning a file
+func statOwner(info os.FileInfo) (uint32, uint32, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIdentity reads the device, inode and change times of a file
+func statIdentity(info os.FileInfo) (fileIdentity, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileIdentity{}, false
+	}
+
+	return fileIdentity{
+		Dev:     uint64(stat.Dev),
+		Inode:   uint64(stat.Ino),
+		Size:    info.Size(),
+		MtimeNs: int64(stat.Mtim.Sec)*1e9 + int64(stat.Mtim.Nsec),
+		CtimeNs: int64(stat.Ctim.Sec)*1e9 + int64(stat.Ctim.Nsec),
+	}, true
+}
+
+// statOwner reads the user and group owning a file
+func statOwner(info os.FileInfo) (uint32, uint32, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
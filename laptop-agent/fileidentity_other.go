@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// statIdentity is unavailable without inode numbers; files are then hashed
+// on every collection
+func statIdentity(info os.FileInfo) (fileIdentity, bool) {
+	return fileIdentity{}, false
+}
+
+// statOwner is unavailable on platforms without Unix ownership
+func statOwner(info os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File change actions
+const (
+	FileChangeCreate = "create"
+	FileChangeModify = "modify"
+	FileChangeDelete = "delete"
+	FileChangeChmod  = "chmod"
+)
+
+// How a file change was noticed
+const (
+	DetectedByWatch  = "watch"
+	DetectedByRescan = "rescan"
+)
+
+const (
+	defaultFIMRescanInterval = 10 * time.Minute
+
+	// fimSettleDelay is how long a file must go without events before it is
+	// checked, so a file being written is hashed once it is complete
+	fimSettleDelay = 2 * time.Second
+
+	// fimMaxFiles caps the files monitored, fimMaxHashSize the files hashed
+	fimMaxFiles    = 10000
+	fimMaxHashSize = 32 * 1024 * 1024
+
+	maxBufferedFileChanges = 5000
+)
+
+// defaultFIMPaths are monitored unless FIM_PATHS is set. Directories are
+// monitored recursively; "~" is the agent user's home directory, and the
+// /home globs cover every user when the agent runs as root.
+var defaultFIMPaths = []string{
+	"/etc/sudoers",
+	"/etc/sudoers.d",
+	"/etc/hosts",
+	"/etc/passwd",
+	"/etc/group",
+	"/etc/ssh/sshd_config",
+	"~/.ssh/authorized_keys",
+	"/root/.ssh/authorized_keys",
+	"/home/*/.ssh/authorized_keys",
+	"/etc/profile",
+	"/etc/profile.d",
+	"/etc/bash.bashrc",
+	"/etc/zshrc",
+	"/etc/zsh/zshrc",
+	"~/.bashrc",
+	"~/.bash_profile",
+	"~/.profile",
+	"~/.zshrc",
+	"~/.zprofile",
+	"/home/*/.bashrc",
+	"/home/*/.bash_profile",
+	"/home/*/.profile",
+	"/home/*/.zshrc",
+	"/etc/systemd/system",
+	"~/.config/systemd/user",
+	"/home/*/.config/systemd/user",
+}
+
+// FileState is what the monitor records about a file
+type FileState struct {
+	SHA256     string    `json:"sha256,omitempty"`
+	LinkTarget string    `json:"link_target,omitempty"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	UID        *uint32   `json:"uid,omitempty"`
+	GID        *uint32   `json:"gid,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// FileChange is a change to a monitored file, with its state before and
+// after (Before is nil for a create, After for a delete)
+type FileChange struct {
+	Path       string     `json:"path"`
+	Action     string     `json:"action"`
+	Timestamp  time.Time  `json:"timestamp"`
+	DetectedBy string     `json:"detected_by"`
+	Before     *FileState `json:"before,omitempty"`
+	After      *FileState `json:"after,omitempty"`
+}
+
+// fimRecord is the baseline of one file; the identity tells whether the
+// file needs to be looked at again
+type fimRecord struct {
+	State    FileState    `json:"state"`
+	Identity fileIdentity `json:"identity"`
+}
+
+type fimStateFile struct {
+	Files map[string]fimRecord `json:"files"`
+}
+
+// fileWatcher reports paths changed in the directories it watches. An empty
+// path means events were lost and everything must be rescanned.
+type fileWatcher interface {
+	Add(dir string) error
+	Changes() <-chan string
+	Close() error
+}
+
+// fileIntegrityMonitor baselines the files matched by a policy of paths and
+// globs and reports their changes. Changes are noticed through a file
+// watcher where the platform has one, and by a periodic rescan otherwise and
+// as a fallback. The baseline is persisted so changes made while the agent
+// was down are reported too.
+type fileIntegrityMonitor struct {
+	patterns       []string
+	statePath      string
+	rescanInterval time.Duration
+	watcher        fileWatcher
+
+	mu        sync.Mutex
+	files     map[string]fimRecord
+	roots     []string // directories monitored recursively
+	baselined bool
+	dirty     bool
+	changes   []FileChange
+	dropped   int
+}
+
+// NewFileIntegrityMonitor loads the persisted baseline at statePath. Without
+// one, the first scan builds the baseline without reporting changes.
+func NewFileIntegrityMonitor(patterns []string, statePath string, rescanInterval time.Duration) *fileIntegrityMonitor {
+	homeDir := userHomeDir()
+	var expanded []string
+	for _, pattern := range patterns {
+		if pattern == "~" || strings.HasPrefix(pattern, "~/") {
+			pattern = filepath.Join(homeDir, strings.TrimPrefix(pattern, "~"))
+		}
+		expanded = append(expanded, filepath.Clean(pattern))
+	}
+
+	m := &fileIntegrityMonitor{
+		patterns:       expanded,
+		statePath:      statePath,
+		rescanInterval: rescanInterval,
+		files:          make(map[string]fimRecord),
+	}
+
+	jsonData, err := os.ReadFile(statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading file integrity baseline, starting over: %v", err)
+		}
+		return m
+	}
+
+	var state fimStateFile
+	if err := json.Unmarshal(jsonData, &state); err != nil {
+		log.Printf("Discarding corrupt file integrity baseline: %v", err)
+		return m
+	}
+	if state.Files != nil {
+		m.files = state.Files
+		m.baselined = true
+	}
+
+	return m
+}
+
+// Run monitors files until ctx is cancelled
+func (m *fileIntegrityMonitor) Run(ctx context.Context) {
+	watcher, err := newFileWatcher()
+	if err != nil {
+		log.Printf("File integrity monitoring relies on rescans every %v: %v", m.rescanInterval, err)
+	} else {
+		m.watcher = watcher
+		defer watcher.Close()
+	}
+
+	m.rescan(DetectedByRescan)
+	m.mu.Lock()
+	log.Printf("File integrity monitoring %d files", len(m.files))
+	m.mu.Unlock()
+
+	rescanTicker := time.NewTicker(m.rescanInterval)
+	defer rescanTicker.Stop()
+	settleTicker := time.NewTicker(fimSettleDelay / 2)
+	defer settleTicker.Stop()
+
+	var changes <-chan string
+	if m.watcher != nil {
+		changes = m.watcher.Changes()
+	}
+
+	// Paths with events, by the time of their latest event
+	pending := make(map[string]time.Time)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case path, ok := <-changes:
+			if !ok {
+				log.Printf("File watcher stopped, relying on rescans every %v", m.rescanInterval)
+				changes = nil
+				continue
+			}
+			if path == "" {
+				log.Printf("File watcher lost events, rescanning")
+				m.rescan(DetectedByRescan)
+				continue
+			}
+			if m.covers(path) {
+				pending[path] = time.Now()
+			}
+
+		case now := <-settleTicker.C:
+			for path, lastEvent := range pending {
+				if now.Sub(lastEvent) >= fimSettleDelay {
+					m.checkPath(path, DetectedByWatch)
+					delete(pending, path)
+				}
+			}
+			m.save()
+
+		case <-rescanTicker.C:
+			m.rescan(DetectedByRescan)
+		}
+	}
+}
+
+// Drain returns the changes found since the previous call and how many were
+// dropped because the buffer was full.
+func (m *fileIntegrityMonitor) Drain() ([]FileChange, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changes, dropped := m.changes, m.dropped
+	m.changes, m.dropped = nil, 0
+	return changes, dropped
+}
+
+// rescan expands the policy again and compares every file with its baseline
+func (m *fileIntegrityMonitor) rescan(detectedBy string) {
+	files, roots, dirs := m.expand()
+
+	m.mu.Lock()
+	m.roots = roots
+	var known []string
+	for path := range m.files {
+		known = append(known, path)
+	}
+	m.mu.Unlock()
+
+	for _, path := range files {
+		m.checkFile(path, detectedBy)
+	}
+
+	// Files that are gone were deleted; files that still exist have merely
+	// dropped out of the policy
+	current := make(map[string]bool, len(files))
+	for _, path := range files {
+		current[path] = true
+	}
+	for _, path := range known {
+		if current[path] {
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			m.checkFile(path, detectedBy)
+		} else {
+			m.mu.Lock()
+			delete(m.files, path)
+			m.dirty = true
+			m.mu.Unlock()
+		}
+	}
+
+	if m.watcher != nil {
+		for _, dir := range dirs {
+			m.watch(dir)
+		}
+	}
+
+	m.mu.Lock()
+	if !m.baselined {
+		m.baselined = true
+		m.dirty = true
+	}
+	m.mu.Unlock()
+	m.save()
+}
+
+// expand returns the files the policy matches, the directories monitored
+// recursively, and the directories to watch for changes
+func (m *fileIntegrityMonitor) expand() ([]string, []string, []string) {
+	var files, roots []string
+	dirs := make(map[string]bool)
+	seen := make(map[string]bool)
+
+	addFile := func(path string) {
+		if !seen[path] && len(files) < fimMaxFiles {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, pattern := range m.patterns {
+		// Watch the parents so files are noticed when they are created
+		parents, _ := filepath.Glob(filepath.Dir(pattern))
+		for _, parent := range parents {
+			dirs[parent] = true
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("Invalid file integrity pattern %q: %v", pattern, err)
+			continue
+		}
+
+		for _, match := range matches {
+			dirs[filepath.Dir(match)] = true
+
+			info, err := os.Lstat(match)
+			if err != nil {
+				continue
+			}
+			if !info.IsDir() {
+				addFile(match)
+				continue
+			}
+
+			roots = append(roots, match)
+			filepath.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if entry.IsDir() {
+					dirs[path] = true
+					return nil
+				}
+				addFile(path)
+				return nil
+			})
+		}
+	}
+
+	if len(files) >= fimMaxFiles {
+		log.Printf("File integrity policy matches more than %d files, monitoring the first %d", fimMaxFiles, fimMaxFiles)
+	}
+
+	var watchDirs []string
+	for dir := range dirs {
+		watchDirs = append(watchDirs, dir)
+	}
+	sort.Strings(watchDirs)
+	return files, roots, watchDirs
+}
+
+// covers reports whether the policy applies to path
+func (m *fileIntegrityMonitor) covers(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, known := m.files[path]; known {
+		return true
+	}
+	for _, root := range m.roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	for _, pattern := range m.patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPath checks a path a watcher reported. New directories inside a
+// recursively monitored directory are watched and their files checked.
+func (m *fileIntegrityMonitor) checkPath(path, detectedBy string) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.IsDir() {
+		m.checkFile(path, detectedBy)
+		return
+	}
+
+	filepath.WalkDir(path, func(walked string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if m.watcher != nil {
+				m.watch(walked)
+			}
+			return nil
+		}
+		m.checkFile(walked, detectedBy)
+		return nil
+	})
+}
+
+// checkFile compares a file with its baseline, records any change, and
+// updates the baseline
+func (m *fileIntegrityMonitor) checkFile(path, detectedBy string) {
+	info, statErr := os.Lstat(path)
+
+	m.mu.Lock()
+	previous, known := m.files[path]
+	m.mu.Unlock()
+
+	if statErr != nil {
+		if os.IsNotExist(statErr) && known {
+			m.mu.Lock()
+			delete(m.files, path)
+			m.dirty = true
+			m.mu.Unlock()
+			before := previous.State
+			m.record(FileChange{Path: path, Action: FileChangeDelete, DetectedBy: detectedBy, Before: &before})
+		}
+		return
+	}
+
+	// Only regular files and symlinks are monitored
+	if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		return
+	}
+
+	identity, hasIdentity := statIdentity(info)
+	if known && hasIdentity && identity == previous.Identity {
+		return
+	}
+
+	state := describeFile(path, info)
+	if known && !contentChanged(previous.State, state) && !attributesChanged(previous.State, state) {
+		// Unchanged, e.g. a file touched without changes on a platform
+		// without file identities
+		m.mu.Lock()
+		m.files[path] = fimRecord{State: state, Identity: identity}
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	m.files[path] = fimRecord{State: state, Identity: identity}
+	m.dirty = true
+	baselined := m.baselined
+	m.mu.Unlock()
+
+	switch {
+	case !known:
+		if baselined {
+			after := state
+			m.record(FileChange{Path: path, Action: FileChangeCreate, DetectedBy: detectedBy, After: &after})
+		}
+	case contentChanged(previous.State, state):
+		before, after := previous.State, state
+		m.record(FileChange{Path: path, Action: FileChangeModify, DetectedBy: detectedBy, Before: &before, After: &after})
+	case attributesChanged(previous.State, state):
+		before, after := previous.State, state
+		m.record(FileChange{Path: path, Action: FileChangeChmod, DetectedBy: detectedBy, Before: &before, After: &after})
+	}
+}
+
+// contentChanged compares content, falling back on size and modification
+// time for files too large to hash
+func contentChanged(before, after FileState) bool {
+	if before.SHA256 != "" && after.SHA256 != "" {
+		return before.SHA256 != after.SHA256 || before.LinkTarget != after.LinkTarget
+	}
+	return before.SHA256 != after.SHA256 || before.LinkTarget != after.LinkTarget ||
+		before.Size != after.Size || !before.ModifiedAt.Equal(after.ModifiedAt)
+}
+
+// attributesChanged compares permissions and ownership
+func attributesChanged(before, after FileState) bool {
+	return before.Mode != after.Mode || !equalOwner(before.UID, after.UID) || !equalOwner(before.GID, after.GID)
+}
+
+func equalOwner(a, b *uint32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (m *fileIntegrityMonitor) record(change FileChange) {
+	change.Timestamp = time.Now()
+	log.Printf("File integrity: %s %s", change.Action, change.Path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.changes) >= maxBufferedFileChanges {
+		m.changes = m.changes[1:]
+		m.dropped++
+	}
+	m.changes = append(m.changes, change)
+}
+
+// watch adds a directory to the watcher; watching a directory again is
+// harmless and picks up directories that were deleted and recreated
+func (m *fileIntegrityMonitor) watch(dir string) {
+	if err := m.watcher.Add(dir); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to watch %s: %v", dir, err)
+	}
+}
+
+// save writes the baseline if it changed
+func (m *fileIntegrityMonitor) save() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return
+	}
+
+	jsonData, err := json.Marshal(fimStateFile{Files: m.files})
+	if err != nil {
+		log.Printf("Error saving file integrity baseline: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(m.statePath), 0700); err != nil {
+		log.Printf("Error saving file integrity baseline: %v", err)
+		return
+	}
+	if err := writeFileAtomic(m.statePath, jsonData); err != nil {
+		log.Printf("Error saving file integrity baseline: %v", err)
+		return
+	}
+	m.dirty = false
+}
+
+// describeFile reads the state of a regular file or symlink
+func describeFile(path string, info os.FileInfo) FileState {
+	state := FileState{
+		Size:       info.Size(),
+		Mode:       fileModeString(info.Mode()),
+		ModifiedAt: info.ModTime().UTC(),
+	}
+	if uid, gid, ok := statOwner(info); ok {
+		state.UID, state.GID = &uid, &gid
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		state.LinkTarget, _ = os.Readlink(path)
+		return state
+	}
+
+	if info.Size() <= fimMaxHashSize {
+		ctx, cancel := context.WithTimeout(context.Background(), fileInspectionTimeout)
+		defer cancel()
+		state.SHA256, _ = getFileSHA256(ctx, path)
+	}
+	return state
+}
+
+// fileModeString formats permissions the way chmod takes them, e.g. "4755"
+func fileModeString(mode os.FileMode) string {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+	return fmt.Sprintf("%04o", perm)
+}
+
+// defaultFIMStatePath returns the per-user location of the baseline
+func defaultFIMStatePath() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "fim.json")
+}
+
+// parseFIMPaths splits a comma-separated FIM_PATHS value
+func parseFIMPaths(value string) []string {
+	var paths []string
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask covers content, attribute and directory entry changes
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// inotifyWatcher watches directories with inotify. The descriptor is
+// non-blocking so closing the file interrupts a pending read.
+type inotifyWatcher struct {
+	fd      int // kept apart: File.Fd would make the file blocking
+	file    *os.File
+	changes chan string
+
+	mu   sync.Mutex
+	dirs map[int]string
+}
+
+func newFileWatcher() (fileWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan string, 1024),
+		dirs:    make(map[int]string),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Add(dir string) error {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, inotifyMask|unix.IN_ONLYDIR)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+
+	w.mu.Lock()
+	w.dirs[wd] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+// read turns inotify events into changed paths until the watcher is closed
+func (w *inotifyWatcher) read() {
+	defer close(w.changes)
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				// Let the monitor fall back on rescans
+				w.changes <- ""
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			name := string(buffer[nameStart:nameEnd])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			offset = nameEnd
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				w.changes <- ""
+				continue
+			}
+
+			w.mu.Lock()
+			dir, found := w.dirs[int(event.Wd)]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+			}
+			w.mu.Unlock()
+			if !found {
+				continue
+			}
+
+			if name == "" {
+				w.changes <- dir
+			} else {
+				w.changes <- filepath.Join(dir, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newFileWatcher is only implemented with inotify; other platforms rely on
+// periodic rescans
+func newFileWatcher() (fileWatcher, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
@@ -0,0 +1,29 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+// ioregSerialPattern finds the serial number in ioreg's platform expert
+// output
+var ioregSerialPattern = regexp.MustCompile(`"IOPlatformSerialNumber" = "([^"]*)"`)
+
+// readHardwareSerial reads the serial number from the I/O Kit registry
+func readHardwareSerial() string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ioreg", "-c", "IOPlatformExpertDevice", "-d", "2").Output()
+	if err != nil {
+		return ""
+	}
+	if match := ioregSerialPattern.FindSubmatch(output); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
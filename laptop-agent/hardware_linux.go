@@ -0,0 +1,16 @@
+//go:build linux
+
+package main
+
+import "os"
+
+// readHardwareSerial reads the serial number from the DMI tables, which only
+// root may read on most distributions
+func readHardwareSerial() string {
+	for _, path := range []string{"/sys/class/dmi/id/product_serial", "/sys/class/dmi/id/board_serial"} {
+		if serial, err := os.ReadFile(path); err == nil && len(serial) > 0 {
+			return string(serial)
+		}
+	}
+	return ""
+}
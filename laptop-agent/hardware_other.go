@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// readHardwareSerial is unavailable on this platform
+func readHardwareSerial() string {
+	return ""
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// readHardwareSerial reads the serial number the BIOS reports
+func readHardwareSerial() string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+		"(Get-CimInstance -ClassName Win32_BIOS).SerialNumber").Output()
+	if err != nil {
+		return ""
+	}
+	return string(output)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	EventTypeBinaryModifiedInPlace = "binary_modified_in_place"
+
+	defaultHashIOBudget   = 256 * 1024 * 1024
+	hashCacheMaxEntries   = 20000
+	hashCacheEntryMaxIdle = 30 * 24 * time.Hour
+)
+
+// errHashBudgetExceeded is returned when hashing a file would exceed the
+// cycle's I/O budget; the file is hashed in a later cycle instead.
+var errHashBudgetExceeded = errors.New("hash I/O budget exceeded for this cycle")
+
+// fileIdentity changes whenever a file's content may have changed: a new
+// inode for replaced files, and a new size, mtime or ctime for files
+// modified in place (ctime cannot be set back by the writer).
+type fileIdentity struct {
+	Dev     uint64 `json:"dev"`
+	Inode   uint64 `json:"inode"`
+	Size    int64  `json:"size"`
+	MtimeNs int64  `json:"mtime_ns"`
+	CtimeNs int64  `json:"ctime_ns"`
+}
+
+type hashCacheEntry struct {
+	Identity fileIdentity `json:"identity"`
+	SHA256   string       `json:"sha256"`
+	LastUsed time.Time    `json:"last_used"`
+}
+
+// hashCachePath remembers the last hash seen at a path, to tell a binary
+// modified in place from one replaced by a new file
+type hashCachePath struct {
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	SHA256 string `json:"sha256"`
+}
+
+type hashCacheFile struct {
+	Entries []*hashCacheEntry        `json:"entries"`
+	Paths   map[string]hashCachePath `json:"paths"`
+}
+
+// HashCacheStats reports how the hash cache performed in one collection
+type HashCacheStats struct {
+	Hits            int   `json:"hits"`
+	Misses          int   `json:"misses"`
+	BytesHashed     int64 `json:"bytes_hashed"`
+	BudgetSkipped   int   `json:"budget_skipped"`
+	ModifiedInPlace int   `json:"modified_in_place"`
+	Entries         int   `json:"entries"`
+}
+
+// AgentEvent is a notable change the agent observed on the host
+type AgentEvent struct {
+	Type           string    `json:"type"`
+	Timestamp      time.Time `json:"timestamp"`
+	Path           string    `json:"path"`
+	PID            int32     `json:"pid,omitempty"`
+	ProcessKey     string    `json:"process_key,omitempty"`
+	PreviousSHA256 string    `json:"previous_sha256,omitempty"`
+	SHA256         string    `json:"sha256,omitempty"`
+}
+
+// HashCache is a persistent cache of executable hashes keyed on device,
+// inode, size, mtime and ctime, so unchanged binaries are not re-read every
+// collection. Hashing of uncached files is limited to an I/O budget per
+// hashing cycle.
+type HashCache struct {
+	path   string
+	budget int64
+
+	mu      sync.Mutex
+	entries map[fileIdentity]*hashCacheEntry
+	paths   map[string]hashCachePath
+	dirty   bool
+	stats   HashCacheStats
+}
+
+// NewHashCache loads the cache file at path, starting empty when it is
+// missing or unreadable.
+func NewHashCache(path string, budget int64) *HashCache {
+	c := &HashCache{
+		path:    path,
+		budget:  budget,
+		entries: make(map[fileIdentity]*hashCacheEntry),
+		paths:   make(map[string]hashCachePath),
+	}
+
+	jsonData, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading hash cache, starting empty: %v", err)
+		}
+		return c
+	}
+
+	var file hashCacheFile
+	if err := json.Unmarshal(jsonData, &file); err != nil {
+		log.Printf("Discarding corrupt hash cache: %v", err)
+		return c
+	}
+	for _, entry := range file.Entries {
+		c.entries[entry.Identity] = entry
+	}
+	if file.Paths != nil {
+		c.paths = file.Paths
+	}
+
+	return c
+}
+
+// EndCycle prunes and saves the cache and returns the statistics since the
+// previous call, resetting them and the I/O budget for the next hashing cycle
+func (c *HashCache) EndCycle() HashCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune()
+	if c.dirty {
+		if err := c.save(); err != nil {
+			log.Printf("Error saving hash cache: %v", err)
+		} else {
+			c.dirty = false
+		}
+	}
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	c.stats = HashCacheStats{}
+	return stats
+}
+
+// Cached returns the SHA256 of the file at path when the cache holds it for
+// the file as it is now, without reading the file. It returns "" otherwise.
+func (c *HashCache) Cached(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	identity, ok := statIdentity(info)
+	if !ok {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[identity]
+	if !found {
+		return ""
+	}
+	if time.Since(entry.LastUsed) > time.Hour {
+		entry.LastUsed = time.Now()
+		c.dirty = true
+	}
+	c.stats.Hits++
+	return entry.SHA256
+}
+
+// Hash returns the SHA256 of the file at path, from the cache when the file
+// is unchanged. When the file at path kept its inode but its content changed
+// since it was last hashed, it also returns a binary_modified_in_place event.
+func (c *HashCache) Hash(ctx context.Context, path string) (string, *AgentEvent, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	identity, ok := statIdentity(info)
+	if !ok {
+		// No stable identity on this platform, so nothing can be cached
+		sha, err := getFileSHA256(ctx, path)
+		return sha, nil, err
+	}
+
+	c.mu.Lock()
+	if entry, found := c.entries[identity]; found {
+		// Only persist the last use occasionally; it merely drives pruning
+		if time.Since(entry.LastUsed) > time.Hour {
+			entry.LastUsed = time.Now()
+			c.dirty = true
+		}
+		c.stats.Hits++
+		c.mu.Unlock()
+		return entry.SHA256, nil, nil
+	}
+
+	// Reserve the budget up front so concurrent callers cannot overshoot it.
+	// The first file of a cycle is always hashed, however large.
+	if c.stats.BytesHashed > 0 && c.stats.BytesHashed+identity.Size > c.budget {
+		c.stats.BudgetSkipped++
+		c.mu.Unlock()
+		return "", nil, errHashBudgetExceeded
+	}
+	c.stats.Misses++
+	c.stats.BytesHashed += identity.Size
+	c.mu.Unlock()
+
+	sha, err := getFileSHA256(ctx, path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Don't cache a hash of a file that changed while it was being read
+	if after, err := os.Stat(path); err != nil {
+		return sha, nil, nil
+	} else if afterIdentity, _ := statIdentity(after); afterIdentity != identity {
+		return sha, nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var event *AgentEvent
+	previous, seen := c.paths[path]
+	if seen && previous.Dev == identity.Dev && previous.Inode == identity.Inode && previous.SHA256 != sha {
+		c.stats.ModifiedInPlace++
+		event = &AgentEvent{
+			Type:           EventTypeBinaryModifiedInPlace,
+			Timestamp:      time.Now(),
+			Path:           path,
+			PreviousSHA256: previous.SHA256,
+			SHA256:         sha,
+		}
+	}
+
+	c.entries[identity] = &hashCacheEntry{Identity: identity, SHA256: sha, LastUsed: time.Now()}
+	c.paths[path] = hashCachePath{Dev: identity.Dev, Inode: identity.Inode, SHA256: sha}
+	c.dirty = true
+
+	return sha, event, nil
+}
+
+// prune drops entries unused for hashCacheEntryMaxIdle and caps the cache at
+// hashCacheMaxEntries, least recently used first. Callers hold c.mu.
+func (c *HashCache) prune() {
+	cutoff := time.Now().Add(-hashCacheEntryMaxIdle)
+	var entries []*hashCacheEntry
+	for identity, entry := range c.entries {
+		if entry.LastUsed.Before(cutoff) {
+			delete(c.entries, identity)
+			c.dirty = true
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > hashCacheMaxEntries {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].LastUsed.Before(entries[j].LastUsed)
+		})
+		for _, entry := range entries[:len(entries)-hashCacheMaxEntries] {
+			delete(c.entries, entry.Identity)
+		}
+		c.dirty = true
+	}
+
+	// Forget paths whose file is no longer cached
+	live := make(map[[2]uint64]bool, len(c.entries))
+	for identity := range c.entries {
+		live[[2]uint64{identity.Dev, identity.Inode}] = true
+	}
+	for path, record := range c.paths {
+		if !live[[2]uint64{record.Dev, record.Inode}] {
+			delete(c.paths, path)
+			c.dirty = true
+		}
+	}
+}
+
+// save writes the cache atomically. Callers hold c.mu.
+func (c *HashCache) save() error {
+	file := hashCacheFile{Paths: c.paths}
+	for _, entry := range c.entries {
+		file.Entries = append(file.Entries, entry)
+	}
+
+	jsonData, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hash cache: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create hash cache directory: %w", err)
+	}
+
+	return writeFileAtomic(c.path, jsonData)
+}
+
+// defaultHashCachePath returns the per-user cache location for the hash cache
+func defaultHashCachePath() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "hashcache.json")
+}
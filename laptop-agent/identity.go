@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deviceIdentity is what the telemetry service issued this device when it
+// enrolled. The credential authenticates every request the agent makes.
+type deviceIdentity struct {
+	DeviceID   string    `json:"device_id"`
+	Credential string    `json:"credential"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+}
+
+// loadDeviceIdentity reads the identity saved at path, or returns nil if the
+// device has not enrolled
+func loadDeviceIdentity(path string) (*deviceIdentity, error) {
+	jsonData, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device identity: %w", err)
+	}
+
+	identity := &deviceIdentity{}
+	if err := json.Unmarshal(jsonData, identity); err != nil {
+		return nil, fmt.Errorf("failed to parse device identity %s: %w", path, err)
+	}
+	if identity.DeviceID == "" || identity.Credential == "" {
+		return nil, fmt.Errorf("device identity %s has no device ID or credential", path)
+	}
+	return identity, nil
+}
+
+// saveDeviceIdentity writes the identity readable by the agent's user only
+func saveDeviceIdentity(path string, identity *deviceIdentity) error {
+	jsonData, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal device identity: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to save device identity: %w", err)
+	}
+	if err := writeFileAtomic(path, jsonData); err != nil {
+		return fmt.Errorf("failed to save device identity: %w", err)
+	}
+	return nil
+}
+
+// defaultIdentityPath keeps the identity with the user's configuration
+// rather than in the cache, which may be cleared
+func defaultIdentityPath() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "identity.json")
+}
+
+// defaultEnrollmentEndpoint derives the enrollment endpoint from the
+// telemetry endpoint, e.g. http://host/api/telemetry becomes
+// http://host/api/agent/enroll
+func defaultEnrollmentEndpoint(apiEndpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(apiEndpoint, "/"), "/telemetry") + "/agent/enroll"
+}
+
+// hardwareSerial is the serial number of the machine, read once as it does
+// not change; it is "" when the agent may not read it
+var hardwareSerial = sync.OnceValue(func() string {
+	serial := strings.TrimSpace(readHardwareSerial())
+	if placeholderSerials[strings.ToLower(serial)] {
+		return ""
+	}
+	return serial
+})
+
+// placeholderSerials are what vendors leave in the serial number field of
+// machines they did not give one
+var placeholderSerials = map[string]bool{
+	"":                       true,
+	"0":                      true,
+	"none":                   true,
+	"default string":         true,
+	"not specified":          true,
+	"system serial number":   true,
+	"to be filled by o.e.m.": true,
+	"0123456789":             true,
+}
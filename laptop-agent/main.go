@@ -1,33 +1,55 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/net"
-	"github.com/shirou/gopsutil/v3/process"
 )
 
 type TelemetryData struct {
-	Timestamp    time.Time       `json:"timestamp"`
-	HostMetadata HostMetadata    `json:"host_metadata"`
-	Processes    []ProcessInfo   `json:"processes"`
-	Containers   []ContainerInfo `json:"containers"`
-	MacAddress   string          `json:"mac_address"`
+	Timestamp        time.Time         `json:"timestamp"`
+	HostMetadata     HostMetadata      `json:"host_metadata"`
+	Processes        []ProcessInfo     `json:"processes"`
+	Containers       []ContainerInfo   `json:"containers"`
+	Connections      []ConnectionInfo  `json:"connections"`
+	ContainerEvents  []ContainerEvent  `json:"container_events,omitempty"`
+	FileChanges      []FileChange      `json:"file_changes,omitempty"`
+	Metrics          *HostMetrics      `json:"metrics,omitempty"`
+	Sessions         []SessionInfo     `json:"sessions"`
+	AuthEvents       []AuthEvent       `json:"auth_events,omitempty"`
+	Persistence      []PersistenceItem `json:"persistence"`
+	Packages         []PackageInfo     `json:"packages,omitempty"`
+	Events           []AgentEvent      `json:"events,omitempty"`
+	Findings         []Finding         `json:"findings,omitempty"`
+	HashCache        *HashCacheStats   `json:"hash_cache,omitempty"`
+	CollectionErrors []CollectionError `json:"collection_errors,omitempty"`
+	Collectors       []CollectorStatus `json:"collectors,omitempty"`
+	Truncated        bool              `json:"truncated,omitempty"`
+	MacAddress       string            `json:"mac_address"`
+	Replayed         bool              `json:"replayed,omitempty"`
+	SnapshotType     string            `json:"snapshot_type"`
+	Sequence         uint64            `json:"sequence"`
+	Delta            *TelemetryDelta   `json:"delta,omitempty"`
+}
+
+// addCollectionError records that a collector failed as a whole
+func (t *TelemetryData) addCollectionError(collector string, err error) {
+	t.CollectionErrors = append(t.CollectionErrors, CollectionError{Collector: collector, Error: err.Error()})
 }
 
 type HostMetadata struct {
@@ -37,77 +59,480 @@ type HostMetadata struct {
 	Version     string `json:"version"`
 	CurrentUser string `json:"current_user"`
 	Uptime      uint64 `json:"uptime"`
+
+	// Identify the machine to the service alongside the MAC address
+	MachineID      string `json:"machine_id,omitempty"`
+	HardwareSerial string `json:"hardware_serial,omitempty"`
 }
 
 type ProcessInfo struct {
-	PID       int32    `json:"pid"`
-	Name      string   `json:"name"`
-	Cmdline   []string `json:"cmdline"`
-	Username  string   `json:"username"`
-	ExePath   string   `json:"exe_path"`
-	StartTime int64    `json:"start_time"`
-	Status    string   `json:"status"`
-	SHA256    string   `json:"sha256,omitempty"`
-	Version   string   `json:"version,omitempty"`
-	FileSize  int64    `json:"file_size,omitempty"`
+	PID             int32        `json:"pid"`
+	PPID            int32        `json:"ppid"`
+	Name            string       `json:"name"`
+	Cmdline         []string     `json:"cmdline"`
+	Redaction       *Redaction   `json:"redaction"`
+	Username        string       `json:"username"`
+	ExePath         string       `json:"exe_path"`
+	StartTime       int64        `json:"start_time"`
+	ParentStartTime int64        `json:"parent_start_time,omitempty"`
+	ProcessKey      string       `json:"process_key"`
+	ParentKey       string       `json:"parent_key,omitempty"`
+	Status          string       `json:"status"`
+	SHA256          string       `json:"sha256,omitempty"`
+	Version         string       `json:"version,omitempty"`
+	VersionInfo     *VersionInfo `json:"version_info,omitempty"`
+	FileSize        int64        `json:"file_size,omitempty"`
+	CPUPercent      float64      `json:"cpu_percent"`
+	MemoryRSS       uint64       `json:"memory_rss"`
+
+	cpuTime float64 // user plus system CPU seconds, for CPUPercent
 }
 
 type ContainerInfo struct {
-	ID      string            `json:"id"`
-	Image   string            `json:"image"`
-	Names   []string          `json:"names"`
-	Status  string            `json:"status"`
-	Ports   []string          `json:"ports"`
-	Labels  map[string]string `json:"labels"`
-	Created int64             `json:"created"`
+	ID        string             `json:"id"`
+	Runtime   string             `json:"runtime"`
+	Namespace string             `json:"namespace,omitempty"`
+	Image     string             `json:"image"`
+	Names     []string           `json:"names"`
+	Status    string             `json:"status"`
+	State     string             `json:"state"`
+	Ports     []string           `json:"ports"`
+	Labels    map[string]string  `json:"labels"`
+	Created   int64              `json:"created"`
+	Security  *ContainerSecurity `json:"security,omitempty"`
 }
 
+// Destinations for collected telemetry
+const (
+	outputAPI = "api" // send it to API_ENDPOINT
+	outputLog = "log" // write it to the log
+)
+
 type Config struct {
-	APIEndpoint        string
-	CollectionInterval time.Duration
-	LogOnly            bool
+	APIEndpoint          string
+	CollectionInterval   time.Duration
+	Output               string
+	SpoolDir             string
+	SpoolMaxBytes        int64
+	SpoolMaxAge          time.Duration
+	CheckpointInterval   time.Duration
+	HashCachePath        string
+	HashIOBudget         int64
+	CollectionWorkers    int
+	CollectionTimeout    time.Duration
+	CollectorsConfig     string
+	Collectors           map[string]CollectorSettings
+	FIMEnabled           bool
+	FIMPaths             []string
+	FIMStatePath         string
+	FIMRescanInterval    time.Duration
+	MetricsTopN          int
+	AuthStatePath        string
+	RedactionRules       string
+	InlineRedactionRules []string
+	DetectionRules       string
+	TasksEnabled         bool
+	TasksEndpoint        string
+	TaskPollInterval     time.Duration
+	StatusPath           string
+	IdentityPath         string
+	EnrollmentToken      string
+	EnrollmentEndpoint   string
+	TLSCAFile            string
+	TLSClientCert        string
+	TLSClientKey         string
+	CertificateEndpoint  string
+	UploadCompression    string
+	UploadChunkSize      int
+	StartupJitter        time.Duration
+	ConfigFile           string
+	PolicyPublicKey      string
+	PolicyEndpoint       string
+	PolicyInterval       time.Duration
+	PolicyPath           string
 }
 
-type ProcessFileInfo struct {
-	SHA256   string
-	FileSize int64
-	Version  string
+func main() {
+	// Without a command the agent runs as before, so existing services and
+	// scheduled tasks keep working
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "run":
+		err = runCommand(config, args)
+	case "collect":
+		err = collectCommand(config, args)
+	case "send":
+		err = sendCommand(config, args)
+	case "status":
+		err = statusCommand(config, args)
+	case "check":
+		err = checkCommand(config, args)
+	case "help":
+		printUsage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		os.Exit(1)
+	}
 }
 
-func main() {
+// loadConfig reads the agent's configuration from the environment and, if
+// CONFIG_FILE names one, the configuration file, whose settings win
+func loadConfig() (Config, error) {
 	config := Config{
 		APIEndpoint:        getEnvOrDefault("API_ENDPOINT", "http://localhost:8080/api/telemetry"),
 		CollectionInterval: time.Duration(getEnvOrDefaultInt("COLLECTION_INTERVAL", 60)) * time.Second,
-		LogOnly:            getEnvOrDefault("LOG_ONLY", "false") == "true",
+		Output:             outputAPI,
+		SpoolDir:           getEnvOrDefault("SPOOL_DIR", defaultSpoolDir()),
+		SpoolMaxBytes:      int64(getEnvOrDefaultInt("SPOOL_MAX_SIZE_MB", defaultSpoolMaxBytes/(1024*1024))) * 1024 * 1024,
+		SpoolMaxAge:        time.Duration(getEnvOrDefaultInt("SPOOL_MAX_AGE_HOURS", int(defaultSpoolMaxAge/time.Hour))) * time.Hour,
+		CheckpointInterval: time.Duration(getEnvOrDefaultInt("CHECKPOINT_INTERVAL", int(defaultCheckpointInterval/time.Second))) * time.Second,
+		HashCachePath:      getEnvOrDefault("HASH_CACHE_PATH", defaultHashCachePath()),
+		HashIOBudget:       int64(getEnvOrDefaultInt("HASH_IO_BUDGET_MB", defaultHashIOBudget/(1024*1024))) * 1024 * 1024,
+		CollectionWorkers:  getEnvOrDefaultInt("COLLECTION_WORKERS", defaultCollectionWorkers),
+		CollectionTimeout:  time.Duration(getEnvOrDefaultInt("COLLECTION_TIMEOUT", int(defaultCollectionTimeout/time.Second))) * time.Second,
+		CollectorsConfig:   os.Getenv("COLLECTORS_CONFIG"),
+		FIMEnabled:         getEnvOrDefault("FIM_ENABLED", "true") == "true",
+		FIMPaths:           defaultFIMPaths,
+		FIMStatePath:       getEnvOrDefault("FIM_STATE_PATH", defaultFIMStatePath()),
+		FIMRescanInterval:  time.Duration(getEnvOrDefaultInt("FIM_RESCAN_INTERVAL", int(defaultFIMRescanInterval/time.Second))) * time.Second,
+		MetricsTopN:        getEnvOrDefaultInt("METRICS_TOP_N", defaultMetricsTopN),
+		AuthStatePath:      getEnvOrDefault("AUTH_STATE_PATH", defaultAuthStatePath()),
+		RedactionRules:     os.Getenv("REDACTION_RULES_FILE"),
+		DetectionRules:     os.Getenv("DETECTION_RULES_FILE"),
+		TasksEnabled:       getEnvOrDefault("TASKS_ENABLED", "true") == "true",
+		TaskPollInterval:   time.Duration(getEnvOrDefaultInt("TASK_POLL_INTERVAL", int(defaultTaskPollInterval/time.Second))) * time.Second,
+		StatusPath:         getEnvOrDefault("STATUS_PATH", defaultStatusPath()),
+		IdentityPath:       getEnvOrDefault("IDENTITY_PATH", defaultIdentityPath()),
+		EnrollmentToken:    os.Getenv("ENROLLMENT_TOKEN"),
+		TLSCAFile:          os.Getenv("TLS_CA_FILE"),
+		TLSClientCert:      os.Getenv("TLS_CLIENT_CERT"),
+		TLSClientKey:       os.Getenv("TLS_CLIENT_KEY"),
+		UploadCompression:  getEnvOrDefault("UPLOAD_COMPRESSION", compressionGzip),
+		UploadChunkSize:    getEnvOrDefaultInt("UPLOAD_CHUNK_SIZE_MB", defaultUploadChunkSize/(1024*1024)) * 1024 * 1024,
+		StartupJitter:      time.Duration(getEnvOrDefaultInt("STARTUP_JITTER", int(defaultStartupJitter/time.Second))) * time.Second,
+		ConfigFile:         os.Getenv("CONFIG_FILE"),
+		PolicyPublicKey:    os.Getenv("POLICY_PUBLIC_KEY"),
+		PolicyInterval:     time.Duration(getEnvOrDefaultInt("POLICY_INTERVAL", int(defaultPolicyInterval/time.Second))) * time.Second,
+		PolicyPath:         getEnvOrDefault("POLICY_PATH", defaultPolicyPath()),
+	}
+	if paths := parseFIMPaths(os.Getenv("FIM_PATHS")); len(paths) > 0 {
+		config.FIMPaths = paths
+	}
+
+	if config.ConfigFile != "" {
+		file, err := loadConfigFile(config.ConfigFile)
+		if err != nil {
+			return config, err
+		}
+		file.apply(&config)
+	}
+
+	// The endpoints follow API_ENDPOINT, wherever it was set
+	config.TasksEndpoint = getEnvOrDefault("TASKS_ENDPOINT", defaultTasksEndpoint(config.APIEndpoint))
+	config.EnrollmentEndpoint = getEnvOrDefault("ENROLLMENT_ENDPOINT", defaultEnrollmentEndpoint(config.APIEndpoint))
+	config.CertificateEndpoint = getEnvOrDefault("CERTIFICATE_ENDPOINT", defaultCertificateEndpoint(config.APIEndpoint))
+	config.PolicyEndpoint = getEnvOrDefault("POLICY_ENDPOINT", defaultPolicyEndpoint(config.APIEndpoint))
+
+	// LOG_ONLY predates the run command's --output flag
+	if getEnvOrDefault("LOG_ONLY", "false") == "true" {
+		config.Output = outputLog
+	}
+
+	return config, nil
+}
+
+// agent holds the collectors and the delta state that successive
+// collections share
+type agent struct {
+	config     Config
+	tracker    *deltaTracker
+	collectors *collectorRegistry
+	redactor   *redactor
+	processes  *processCollector
+	runtimes   *containerCollector
+	metrics    *metricsCollector
+	auth       *authCollector
+	autoruns   *persistenceCollector
+	detector   *detector
+	fim        *fileIntegrityMonitor // nil unless file integrity is monitored
+	client     *apiClient            // nil unless telemetry is sent to the service
+	policy     *policyClient         // nil unless policies are verified with POLICY_PUBLIC_KEY
+
+	// The latest listings, for collectors that depend on them but may run
+	// in collections that did not list
+	sessions           []SessionInfo
+	lastProcesses      []ProcessInfo
+	lastContainers     []ContainerInfo
+	lastContainerCount int
+}
+
+// newAgent sets up the collectors. It refuses to start without the
+// organisation's redaction rules rather than send the secrets they were
+// written for.
+func newAgent(config Config) (*agent, error) {
+	redactionRules, err := loadConfiguredRedactionRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading redaction rules: %w", err)
+	}
+	detectionRules, err := loadConfiguredDetectionRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading detection rules: %w", err)
+	}
+
+	hashCache := NewHashCache(config.HashCachePath, config.HashIOBudget)
+	redactor := newRedactor(redactionRules)
+	a := &agent{
+		config:    config,
+		tracker:   newDeltaTracker(config.CheckpointInterval),
+		redactor:  redactor,
+		processes: newProcessCollector(hashCache, redactor, config.CollectionWorkers),
+		runtimes:  newContainerCollector(),
+		metrics:   newMetricsCollector(config.MetricsTopN),
+		auth:      newAuthCollector(config.AuthStatePath),
+		autoruns:  newPersistenceCollector(),
+		detector:  newDetector(detectionRules),
 	}
 
-	if config.LogOnly {
-		log.Printf("Starting laptop agent in LOG_ONLY mode with collection interval: %v", config.CollectionInterval)
+	collectors, err := newAgentCollectors(a, config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading collectors configuration: %w", err)
+	}
+	a.collectors = collectors
+
+	// File changes are found in the background, by the run command only
+	if collectors.Enabled("file_integrity") {
+		a.fim = NewFileIntegrityMonitor(config.FIMPaths, config.FIMStatePath, config.FIMRescanInterval)
+	}
+
+	return a, nil
+}
+
+// runCommand runs the agent as a daemon, collecting at every interval
+func runCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.StringVar(&config.Output, "output", config.Output, "where telemetry goes: api sends it to API_ENDPOINT, log writes it to the log")
+	flags.Parse(args)
+	if config.Output != outputAPI && config.Output != outputLog {
+		return fmt.Errorf("invalid output %q: must be %s or %s", config.Output, outputAPI, outputLog)
+	}
+
+	a, err := newAgent(config)
+	if err != nil {
+		return err
+	}
+	status := newAgentStatus(config)
+
+	// Monitor file integrity in the background; changes are sent with the
+	// next telemetry
+	if a.fim != nil {
+		go a.fim.Run(context.Background())
+	}
+
+	if config.Output == outputLog {
+		log.Printf("Starting laptop agent logging telemetry with collection interval: %v", config.CollectionInterval)
 	} else {
 		log.Printf("Starting laptop agent with collection interval: %v, endpoint: %s", config.CollectionInterval, config.APIEndpoint)
 	}
 
-	ticker := time.NewTicker(config.CollectionInterval)
+	// Open the spool that holds snapshots the backend could not accept
+	var spool *Spool
+	if config.Output == outputAPI {
+		a.client, err = newAPIClient(config)
+		if err != nil {
+			return err
+		}
+		if a.client.usesClientCertificate() {
+			log.Printf("Authenticating with client certificate %s, renewed at %s", config.TLSClientCert, config.CertificateEndpoint)
+			// Obtain a certificate before the first request that needs one
+			a.client.renewCertificateIfDue(context.Background())
+			go a.client.RunCertificateRotation(context.Background())
+		}
+
+		spool, err = NewSpool(config.SpoolDir, config.SpoolMaxBytes, config.SpoolMaxAge)
+		if err != nil {
+			log.Printf("Telemetry spool disabled: %v", err)
+		} else {
+			log.Printf("Telemetry spool at %s (%d pending snapshots)", config.SpoolDir, spool.Len())
+			go spool.RunReplay(context.Background(), func(data TelemetryData) error {
+				err := sendTelemetryTracked(a.client, config.APIEndpoint, data, a.tracker)
+				status.recordDelivery(err)
+				return err
+			})
+		}
+	}
+
+	// Follow the policy the service issues this device. The first is
+	// fetched before collecting; without it, the cached one applies.
+	reload := make(chan struct{}, 1)
+	if config.Output == outputAPI && config.PolicyPublicKey != "" {
+		a.policy, err = newPolicyClient(a.client, config)
+		if err != nil {
+			return err
+		}
+		log.Printf("Following the policy at %s every %v", config.PolicyEndpoint, config.PolicyInterval)
+		if _, err := a.policy.Refresh(context.Background()); err != nil {
+			log.Printf("Error fetching policy: %v", err)
+		}
+		if a.policy.Current() != nil {
+			if err := a.reconfigure(a.policy.Apply(a.config)); err != nil {
+				log.Printf("Error applying policy: %v", err)
+			}
+			status.recordPolicy(a.policy.Current())
+		}
+		go a.policy.Run(context.Background(), reload)
+	}
+	if config.ConfigFile != "" {
+		log.Printf("Configuration file %s, reloaded when it changes", config.ConfigFile)
+	}
+	go watchConfig(context.Background(), config.ConfigFile, reload)
+
+	// Poll for tasks queued by the backend; collect_now tasks trigger an
+	// extra collection through collectNow
+	collectNow := make(chan struct{}, 1)
+	if config.TasksEnabled && config.Output == outputAPI {
+		log.Printf("Polling for tasks at %s every %v", config.TasksEndpoint, config.TaskPollInterval)
+		go newTaskRunner(a.client, a.redactor, config.TasksEndpoint, config.TaskPollInterval, collectNow).Run(context.Background())
+	}
+
+	// Spread the first collection, so agents started together, such as
+	// after a fleet-wide restart, do not report in step
+	if config.Output == outputAPI && config.StartupJitter > 0 {
+		delay := jitter(config.StartupJitter)
+		log.Printf("First collection in %v", delay.Round(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-collectNow:
+		}
+	}
+
+	interval := a.collectionInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	status.recordInterval(interval)
 
 	// Collect and send initial telemetry
-	collectAndSend(config)
+	a.collectAndSend(spool, status)
+
+	// Continue collecting at intervals, or right away when a task asks.
+	// Reloads apply between collections, so a collection never sees half
+	// of a configuration.
+	for {
+		if next := a.collectionInterval(); next != interval {
+			log.Printf("Collection interval changed from %v to %v", interval, next)
+			interval = next
+			ticker.Reset(interval)
+			a.collectors.cycle = interval
+			status.recordInterval(interval)
+		}
 
-	// Continue collecting at intervals
-	for range ticker.C {
-		collectAndSend(config)
+		select {
+		case <-ticker.C:
+		case <-collectNow:
+			log.Println("Collection requested by task")
+		case <-reload:
+			a.reload(status)
+			continue
+		}
+		a.collectAndSend(spool, status)
+	}
+}
+
+// collectionInterval is the interval the device's policy sets, if it sets
+// one, as an administrator chose it for this device. Otherwise it is the
+// interval the telemetry service recommended, if it recommended one, or
+// else the configured one.
+func (a *agent) collectionInterval() time.Duration {
+	if policy := a.policy.Current(); policy != nil && policy.settings.CollectionInterval != nil {
+		// The policy is applied over the configuration
+		return a.config.CollectionInterval
+	}
+	if recommended := a.client.recommendedInterval(); recommended > 0 {
+		return recommended
+	}
+	return a.config.CollectionInterval
+}
+
+// collectAndSend runs one collection and delivers it, spooling it when the
+// backend cannot take it, and records the outcome in status
+func (a *agent) collectAndSend(spool *Spool, status *agentStatus) {
+	telemetry := a.Collect()
+	status.recordCollection(telemetry, a.runtimes.Connected())
+	defer status.save()
+
+	// Keep snapshots in order: while older ones are still spooled, queue behind them
+	if spool != nil && spool.Len() > 0 {
+		if err := spool.Enqueue(telemetry); err != nil {
+			log.Printf("Error spooling telemetry: %v", err)
+		} else {
+			log.Printf("Telemetry spooled behind %d pending snapshots", spool.Len()-1)
+		}
+		return
+	}
+
+	// Send telemetry
+	err := sendTelemetryOrLog(a.config, a.client, telemetry, a.tracker)
+	status.recordDelivery(err)
+	if err != nil {
+		log.Printf("Error sending telemetry: %v", err)
+		var statusErr *statusError
+		if spool != nil && !(errors.As(err, &statusErr) && statusErr.isPermanent()) {
+			if err := spool.Enqueue(telemetry); err != nil {
+				log.Printf("Error spooling telemetry: %v", err)
+			} else {
+				log.Printf("Telemetry spooled for later delivery")
+			}
+		}
+	} else {
+		if a.config.Output == outputLog {
+			log.Printf("Telemetry #%d logged successfully", telemetry.Sequence)
+		} else {
+			log.Printf("Telemetry #%d sent successfully", telemetry.Sequence)
+		}
 	}
 }
 
-func collectAndSend(config Config) {
+// Collect gathers one payload from the collectors that are due, reduced to
+// a delta against the previous payload unless a checkpoint is due
+func (a *agent) Collect() TelemetryData {
 	log.Println("Collecting telemetry data...")
 
 	telemetry := TelemetryData{
 		Timestamp: time.Now(),
 	}
 
+	// Every collector shares the cycle deadline
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.CollectionTimeout)
+	defer cancel()
+
+	// A full snapshot replaces the listings, so their collectors run
+	// whatever their schedule
+	var forced []string
+	if a.tracker.FullDue(telemetry.Timestamp) {
+		forced = snapshotCollectors
+	}
+	a.collectors.Run(ctx, &telemetry, forced)
+
+	// Command lines never leave the host unredacted, wherever they were found
+	a.redactor.RedactPayload(&telemetry)
+
 	// Collect host metadata
-	hostInfo, err := collectHostMetadata()
+	hostInfo, err := collectHostMetadata(a.sessions)
 	if err != nil {
 		log.Printf("Error collecting host metadata: %v", err)
 	} else {
@@ -122,44 +547,36 @@ func collectAndSend(config Config) {
 		telemetry.MacAddress = macAddr
 	}
 
-	// Collect processes
-	processes, err := collectProcesses()
-	if err != nil {
-		log.Printf("Error collecting processes: %v", err)
-	} else {
-		telemetry.Processes = processes
-	}
+	log.Printf("Collected %d processes, %d containers, %d connections",
+		len(telemetry.Processes), len(telemetry.Containers), len(telemetry.Connections))
 
-	// Collect containers
-	containers, err := collectContainers()
-	if err != nil {
-		log.Printf("Error collecting containers: %v", err)
+	// Reduce to a delta against the previous payload unless a checkpoint is due
+	a.tracker.Apply(&telemetry)
+	if telemetry.Delta != nil {
+		log.Printf("Telemetry #%d is a delta: %d processes started, %d exited, %d containers created, %d updated, %d removed",
+			telemetry.Sequence,
+			len(telemetry.Delta.ProcessesStarted), len(telemetry.Delta.ProcessesExited),
+			len(telemetry.Delta.ContainersCreated), len(telemetry.Delta.ContainersUpdated), len(telemetry.Delta.ContainersRemoved))
 	} else {
-		telemetry.Containers = containers
+		log.Printf("Telemetry #%d is a full snapshot", telemetry.Sequence)
 	}
 
-	// Send telemetry
-	err = sendTelemetryOrLog(config, telemetry)
-	if err != nil {
-		log.Printf("Error sending telemetry: %v", err)
-	} else {
-		if config.LogOnly {
-			log.Printf("Telemetry logged successfully: %d processes, %d containers",
-				len(telemetry.Processes), len(telemetry.Containers))
-		} else {
-			log.Printf("Telemetry sent successfully: %d processes, %d containers",
-				len(telemetry.Processes), len(telemetry.Containers))
-		}
-	}
+	return telemetry
 }
 
-func collectHostMetadata() (HostMetadata, error) {
+// collectHostMetadata reports the user of the host's login sessions; the
+// agent's own user is only a fallback, as it is root or a service account
+// when the agent runs as a service
+func collectHostMetadata(sessions []SessionInfo) (HostMetadata, error) {
 	info, err := host.Info()
 	if err != nil {
 		return HostMetadata{}, err
 	}
 
-	currentUser := os.Getenv("USER")
+	currentUser := activeUser(sessions)
+	if currentUser == "" {
+		currentUser = os.Getenv("USER")
+	}
 	if currentUser == "" {
 		currentUser = os.Getenv("USERNAME")
 	}
@@ -171,270 +588,114 @@ func collectHostMetadata() (HostMetadata, error) {
 		Version:     info.PlatformVersion,
 		CurrentUser: currentUser,
 		Uptime:      info.Uptime,
+
+		MachineID:      info.HostID,
+		HardwareSerial: hardwareSerial(),
 	}, nil
 }
 
+// virtualInterfacePrefixes name the interfaces of container runtimes,
+// hypervisors, VPNs and tunnels, which come and go
+var virtualInterfacePrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vnet", "vmnet", "vboxnet", "cni", "flannel", "cali", "lxc", "lxd",
+	"podman", "ifb", "tun", "tap", "wg", "zt", "utun", "awdl", "llw", "bridge", "anpi", "ap",
+}
+
+// getMacAddress returns the MAC address of the first physical interface.
+// Virtual interfaces and locally administered (e.g. randomized) addresses
+// change across reboots and networks, so they are only used when there is
+// nothing better. The MAC address is only an attribute of enrolled devices,
+// but it still identifies the others.
 func getMacAddress() (string, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return "", err
 	}
 
+	best, bestRank := "", 0
 	for _, iface := range interfaces {
-		// Skip loopback interfaces and get first available MAC
-		if iface.Name != "lo" && iface.HardwareAddr != "" {
-			return iface.HardwareAddr, nil
+		if slices.Contains(iface.Flags, "loopback") || iface.Name == "lo" || iface.HardwareAddr == "" {
+			continue
 		}
-	}
-
-	return "", fmt.Errorf("no MAC address found")
-}
-
-func collectProcesses() ([]ProcessInfo, error) {
-	pids, err := process.Pids()
-	if err != nil {
-		return nil, err
-	}
-
-	var processes []ProcessInfo
-	processedFiles := make(map[string]ProcessFileInfo) // Cache for file info
-
-	log.Printf("Collecting information for %d processes...", len(pids))
-	processCount := 0
 
-	for _, pid := range pids {
-		proc, err := process.NewProcess(pid)
-		if err != nil {
-			continue // Skip processes we can't access
-		}
-
-		name, _ := proc.Name()
-		cmdlineStr, _ := proc.Cmdline()
-		username, _ := proc.Username()
-		exe, _ := proc.Exe()
-		createTime, _ := proc.CreateTime()
-		status, _ := proc.Status()
-
-		// Convert cmdline string to slice
-		var cmdline []string
-		if cmdlineStr != "" {
-			cmdline = []string{cmdlineStr}
-		}
-
-		// Convert status slice to string
-		var statusStr string
-		if len(status) > 0 {
-			statusStr = status[0]
-		}
-
-		processInfo := ProcessInfo{
-			PID:       pid,
-			Name:      name,
-			Cmdline:   cmdline,
-			Username:  username,
-			ExePath:   exe,
-			StartTime: createTime,
-			Status:    statusStr,
-		}
-
-		// Enhance with security information (with caching and timeout)
-		if exe != "" && exe != "0" {
-			if fileInfo, exists := processedFiles[exe]; exists {
-				// Use cached information
-				processInfo.SHA256 = fileInfo.SHA256
-				processInfo.FileSize = fileInfo.FileSize
-				processInfo.Version = fileInfo.Version
-			} else {
-				// Collect file information with timeout
-				fileInfo := collectFileInfoWithTimeout(exe, 2*time.Second)
-				processedFiles[exe] = fileInfo
-				processInfo.SHA256 = fileInfo.SHA256
-				processInfo.FileSize = fileInfo.FileSize
-				processInfo.Version = fileInfo.Version
-			}
-		}
-
-		processes = append(processes, processInfo)
-		processCount++
-
-		// Log progress every 100 processes
-		if processCount%100 == 0 {
-			log.Printf("Processed %d/%d processes...", processCount, len(pids))
-		}
-	}
-
-	log.Printf("Finished collecting information for %d processes", len(processes))
-	return processes, nil
-}
-
-func collectContainers() ([]ContainerInfo, error) {
-	// Try to connect to Docker daemon with different socket paths
-	var cli *client.Client
-	var err error
-
-	// Get user's home directory
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = os.Getenv("HOME")
-		if homeDir == "" {
-			homeDir = "/tmp" // fallback
-		}
-	}
-
-	// Try common Docker socket locations
-	socketPaths := []string{
-		"unix:///var/run/docker.sock",                                                           // Standard Docker (Linux)
-		fmt.Sprintf("unix://%s/.rd/docker.sock", homeDir),                                       // Rancher Desktop
-		fmt.Sprintf("unix://%s/.docker/run/docker.sock", homeDir),                               // Docker Desktop
-		fmt.Sprintf("unix://%s/.docker/desktop/docker.sock", homeDir),                           // Docker Desktop alternative
-		fmt.Sprintf("unix://%s/Library/Containers/com.docker.docker/Data/docker.sock", homeDir), // Docker Desktop macOS
-		"unix:///tmp/docker.sock",                                                               // Alternative location
-		"unix:///usr/local/var/run/docker.sock",                                                 // Homebrew Docker
-	}
-
-	// Filter socket paths to only include those that actually exist
-	var validSocketPaths []string
-	for _, socketPath := range socketPaths {
-		// Extract the file path from the unix:// prefix
-		filePath := strings.TrimPrefix(socketPath, "unix://")
-		if _, err := os.Stat(filePath); err == nil {
-			validSocketPaths = append(validSocketPaths, socketPath)
-		}
-	}
-
-	// First try with environment variables
-	cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err == nil {
-		// Test connection with timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		_, pingErr := cli.Ping(ctx)
-		cancel()
-		if pingErr == nil {
-			log.Printf("Connected to Docker daemon via environment settings")
-		} else {
-			cli.Close()
-			cli = nil
-		}
-	}
-
-	// If environment connection failed, try different socket paths
-	if cli == nil {
-		// Use valid socket paths if any were found, otherwise fall back to all paths
-		pathsToTry := validSocketPaths
-		if len(pathsToTry) == 0 {
-			pathsToTry = socketPaths
-			log.Printf("No existing Docker socket files found, trying all paths")
-		} else {
-			log.Printf("Found %d existing Docker socket files", len(pathsToTry))
+		// 3: physical, 2: physical with a local address, 1: virtual
+		rank := 3
+		if slices.ContainsFunc(virtualInterfacePrefixes, func(prefix string) bool {
+			return strings.HasPrefix(iface.Name, prefix)
+		}) {
+			rank = 1
+		} else if firstOctet, err := strconv.ParseUint(iface.HardwareAddr[:min(2, len(iface.HardwareAddr))], 16, 8); err != nil || firstOctet&0x02 != 0 {
+			rank = 2
 		}
 
-		for _, socketPath := range pathsToTry {
-			cli, err = client.NewClientWithOpts(client.WithHost(socketPath), client.WithAPIVersionNegotiation())
-			if err != nil {
-				log.Printf("Failed to create Docker client for %s: %v", socketPath, err)
-				continue
-			}
-
-			// Test connection with timeout
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			_, pingErr := cli.Ping(ctx)
-			cancel()
-
-			if pingErr == nil {
-				log.Printf("Connected to Docker daemon at: %s", socketPath)
-				break
-			} else {
-				log.Printf("Failed to connect to Docker daemon at %s: %v", socketPath, pingErr)
-				cli.Close()
-				cli = nil
-			}
+		if rank > bestRank {
+			best, bestRank = iface.HardwareAddr, rank
 		}
 	}
 
-	if cli == nil {
-		log.Printf("Docker daemon not accessible at any known location")
-		return []ContainerInfo{}, nil // Return empty slice instead of nil
+	if best == "" {
+		return "", fmt.Errorf("no MAC address found")
 	}
-	defer cli.Close()
-
-	// Test connection with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return best, nil
+}
 
-	_, err = cli.Ping(ctx)
-	if err != nil {
-		log.Printf("Docker daemon not accessible: %v", err)
-		return []ContainerInfo{}, nil // Return empty slice instead of nil
-	}
+// processKey identifies a process instance by PID and start time, which stays
+// unambiguous when the kernel later reuses the PID.
+func processKey(pid int32, startTime int64) string {
+	return fmt.Sprintf("%d:%d", pid, startTime)
+}
 
-	containers, err := cli.ContainerList(ctx, container.ListOptions{
-		All: true,
-	})
-	if err != nil {
-		log.Printf("Failed to list containers: %v", err)
-		return []ContainerInfo{}, nil // Return empty slice instead of nil
+// linkParents resolves each process's PPID to the parent instance seen in the
+// same collection. A parent that started after its child cannot be the
+// original parent (the PID was reused after the parent exited), so it is
+// left unlinked.
+func linkParents(processes []ProcessInfo) {
+	startTimes := make(map[int32]int64, len(processes))
+	for _, proc := range processes {
+		startTimes[proc.PID] = proc.StartTime
 	}
 
-	var containerInfos []ContainerInfo
-
-	for _, container := range containers {
-		var ports []string
-		for _, port := range container.Ports {
-			if port.PublicPort != 0 {
-				ports = append(ports, fmt.Sprintf("%d:%d", port.PublicPort, port.PrivatePort))
-			}
+	for i := range processes {
+		proc := &processes[i]
+		if proc.PPID == 0 || proc.PPID == proc.PID {
+			continue
 		}
 
-		containerInfo := ContainerInfo{
-			ID:      container.ID,
-			Image:   container.Image,
-			Names:   container.Names,
-			Status:  container.Status,
-			Ports:   ports,
-			Labels:  container.Labels,
-			Created: container.Created,
+		parentStart, found := startTimes[proc.PPID]
+		if !found || parentStart > proc.StartTime {
+			continue
 		}
 
-		containerInfos = append(containerInfos, containerInfo)
+		proc.ParentStartTime = parentStart
+		proc.ParentKey = processKey(proc.PPID, parentStart)
 	}
-
-	log.Printf("Successfully collected %d containers", len(containerInfos))
-	return containerInfos, nil
 }
 
-func sendTelemetry(endpoint string, data TelemetryData) error {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal telemetry data: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "SmartSec-Laptop-Agent/1.0")
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+func sendTelemetry(client *apiClient, endpoint string, data TelemetryData) error {
+	return client.postTelemetry(context.Background(), endpoint, data)
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+// statusError reports a non-success HTTP status from the telemetry service.
+// RetryAfter is how long a 429 or 503 response asked the agent to wait.
+type statusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status: %d", resp.StatusCode)
-	}
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned status: %d", e.StatusCode)
+}
 
-	return nil
+// isPermanent reports whether the server rejected the payload itself, so
+// resending the same snapshot can never succeed. An unauthorized device may
+// yet enroll, so its payloads are kept.
+func (e *statusError) isPermanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusTooManyRequests && e.StatusCode != http.StatusUnauthorized
 }
 
-func sendTelemetryOrLog(config Config, data TelemetryData) error {
-	if config.LogOnly {
+func sendTelemetryOrLog(config Config, client *apiClient, data TelemetryData, tracker *deltaTracker) error {
+	if config.Output == outputLog {
 		// Log the telemetry data instead of sending it
 		jsonData, err := json.MarshalIndent(data, "", "  ")
 		if err != nil {
@@ -445,7 +706,23 @@ func sendTelemetryOrLog(config Config, data TelemetryData) error {
 		return nil
 	}
 
-	return sendTelemetry(config.APIEndpoint, data)
+	return sendTelemetryTracked(client, config.APIEndpoint, data, tracker)
+}
+
+// sendTelemetryTracked sends telemetry and schedules a full snapshot when the
+// server reports a gap in the delta sequence. The server keeps the events and
+// findings of a delta it refused for a gap, and already has those of one it
+// refused as stale, so the delta is dropped.
+func sendTelemetryTracked(client *apiClient, endpoint string, data TelemetryData, tracker *deltaTracker) error {
+	err := sendTelemetry(client, endpoint, data)
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		log.Printf("Server requested a full resync after telemetry #%d", data.Sequence)
+		tracker.RequestResync()
+	}
+
+	return err
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -457,15 +734,18 @@ func getEnvOrDefault(key, defaultValue string) string {
 
 func getEnvOrDefaultInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
-		if intValue, err := time.ParseDuration(value + "s"); err == nil {
-			return int(intValue.Seconds())
+		intValue, err := strconv.Atoi(value)
+		if err == nil {
+			return intValue
 		}
+		log.Printf("Ignoring %s=%q: not a whole number; using %d", key, value, defaultValue)
 	}
 	return defaultValue
 }
 
-// getFileSHA256 calculates the SHA256 hash of a file
-func getFileSHA256(filePath string) (string, error) {
+// getFileSHA256 calculates the SHA256 hash of a file, stopping early when
+// ctx is done
+func getFileSHA256(ctx context.Context, filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -473,7 +753,7 @@ func getFileSHA256(filePath string) (string, error) {
 	defer file.Close()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, &contextReader{ctx: ctx, r: file}); err != nil {
 		return "", err
 	}
 
@@ -488,147 +768,3 @@ func getFileSize(filePath string) (int64, error) {
 	}
 	return info.Size(), nil
 }
-
-// getFileVersion attempts to extract version information from a file
-func getFileVersion(filePath string) (string, error) {
-	// Try different approaches based on the OS and file type
-
-	// For macOS/Linux, try to get version from the binary itself
-	if version := getMacOSVersion(filePath); version != "" {
-		return version, nil
-	}
-
-	// Try to get version from file command
-	if version := getVersionFromFile(filePath); version != "" {
-		return version, nil
-	}
-
-	// Try to get version from strings in the binary
-	if version := getVersionFromStrings(filePath); version != "" {
-		return version, nil
-	}
-
-	return "", fmt.Errorf("version information not available")
-}
-
-// getMacOSVersion tries to extract version from macOS binaries
-func getMacOSVersion(filePath string) string {
-	// Try otool command for macOS binaries
-	cmd := exec.Command("otool", "-l", filePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return ""
-	}
-
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "version") {
-			parts := strings.Fields(line)
-			for i, part := range parts {
-				if strings.Contains(part, "version") && i+1 < len(parts) {
-					return parts[i+1]
-				}
-			}
-		}
-	}
-
-	return ""
-}
-
-// getVersionFromFile tries to get version using the file command
-func getVersionFromFile(filePath string) string {
-	cmd := exec.Command("file", filePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return ""
-	}
-
-	outputStr := string(output)
-	// Look for version patterns in file output
-	if strings.Contains(outputStr, "version") {
-		parts := strings.Split(outputStr, " ")
-		for i, part := range parts {
-			if strings.Contains(part, "version") && i+1 < len(parts) {
-				return parts[i+1]
-			}
-		}
-	}
-
-	return ""
-}
-
-// getVersionFromStrings tries to extract version from strings in the binary
-func getVersionFromStrings(filePath string) string {
-	cmd := exec.Command("strings", filePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return ""
-	}
-
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Look for common version patterns
-		if strings.Contains(strings.ToLower(line), "version") && len(line) < 50 {
-			// Extract version number patterns
-			if strings.Contains(line, ".") && (strings.Contains(line, "v") || strings.Contains(line, "V")) {
-				return line
-			}
-		}
-		// Look for semantic version patterns (x.y.z)
-		if len(line) > 3 && len(line) < 20 {
-			parts := strings.Split(line, ".")
-			if len(parts) >= 3 {
-				// Check if it looks like a version number
-				hasDigits := false
-				for _, part := range parts {
-					if len(part) > 0 && part[0] >= '0' && part[0] <= '9' {
-						hasDigits = true
-						break
-					}
-				}
-				if hasDigits {
-					return line
-				}
-			}
-		}
-	}
-
-	return ""
-}
-
-// collectFileInfoWithTimeout collects file information with a timeout to prevent hanging
-func collectFileInfoWithTimeout(filePath string, timeout time.Duration) ProcessFileInfo {
-	result := ProcessFileInfo{}
-
-	// Create a channel to receive the result
-	done := make(chan struct{})
-
-	go func() {
-		defer close(done)
-
-		// Get SHA256 hash
-		if sha256Hash, err := getFileSHA256(filePath); err == nil {
-			result.SHA256 = sha256Hash
-		}
-
-		// Get file size
-		if fileSize, err := getFileSize(filePath); err == nil {
-			result.FileSize = fileSize
-		}
-
-		// Get version information (this is the most time-consuming part)
-		if version, err := getFileVersion(filePath); err == nil && version != "" {
-			result.Version = version
-		}
-	}()
-
-	// Wait for completion or timeout
-	select {
-	case <-done:
-		return result
-	case <-time.After(timeout):
-		// Timeout occurred, return what we have so far
-		return result
-	}
-}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectionIntervalPrefersPolicy(t *testing.T) {
+	policyInterval := configDuration(5 * time.Minute)
+	withPolicy := &policyClient{current: &agentPolicy{settings: policySettings{CollectionInterval: &policyInterval}}}
+	withoutInterval := &policyClient{current: &agentPolicy{}}
+
+	tests := []struct {
+		name        string
+		policy      *policyClient
+		recommended time.Duration
+		configured  time.Duration
+		want        time.Duration
+	}{
+		{"configured", nil, 0, time.Minute, time.Minute},
+		{"recommended over configured", nil, 30 * time.Second, time.Minute, 30 * time.Second},
+		{"recommended over policy without an interval", withoutInterval, 30 * time.Second, time.Minute, 30 * time.Second},
+		{"policy over recommended", withPolicy, 30 * time.Second, 5 * time.Minute, 5 * time.Minute},
+		{"policy without a recommendation", withPolicy, 0, 5 * time.Minute, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &apiClient{}
+			client.collectionInterval.Store(int64(tt.recommended))
+			a := &agent{config: Config{CollectionInterval: tt.configured}, client: client, policy: tt.policy}
+
+			if got := a.collectionInterval(); got != tt.want {
+				t.Errorf("collectionInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectionIntervalWithoutClient(t *testing.T) {
+	a := &agent{config: Config{CollectionInterval: time.Minute}}
+	if got := a.collectionInterval(); got != time.Minute {
+		t.Errorf("collectionInterval() = %v, want %v", got, time.Minute)
+	}
+}
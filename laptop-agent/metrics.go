@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+const defaultMetricsTopN = 10
+
+// HostMetrics is a sample of host resource usage. Rates are averaged over the
+// interval since the previous sample and are omitted from the first one.
+// Process CPU percentages are of one core, as top reports them.
+type HostMetrics struct {
+	CPUPercent           float64          `json:"cpu_percent"`
+	CPUCount             int              `json:"cpu_count"`
+	Load1                float64          `json:"load1"`
+	Load5                float64          `json:"load5"`
+	Load15               float64          `json:"load15"`
+	MemoryTotal          uint64           `json:"memory_total"`
+	MemoryUsed           uint64           `json:"memory_used"`
+	MemoryPercent        float64          `json:"memory_percent"`
+	SwapTotal            uint64           `json:"swap_total"`
+	SwapUsed             uint64           `json:"swap_used"`
+	DiskTotal            uint64           `json:"disk_total"`
+	DiskUsed             uint64           `json:"disk_used"`
+	DiskPercent          float64          `json:"disk_percent"`
+	DiskReadBytesPerSec  *float64         `json:"disk_read_bytes_per_sec,omitempty"`
+	DiskWriteBytesPerSec *float64         `json:"disk_write_bytes_per_sec,omitempty"`
+	NetworkRxBytesPerSec *float64         `json:"network_rx_bytes_per_sec,omitempty"`
+	NetworkTxBytesPerSec *float64         `json:"network_tx_bytes_per_sec,omitempty"`
+	ProcessCount         int              `json:"process_count"`
+	ContainerCount       int              `json:"container_count"`
+	TopProcesses         []ProcessMetrics `json:"top_processes,omitempty"`
+}
+
+// ProcessMetrics is the resource usage of one of the busiest processes
+type ProcessMetrics struct {
+	PID        int32   `json:"pid"`
+	ProcessKey string  `json:"process_key"`
+	Name       string  `json:"name"`
+	Username   string  `json:"username"`
+	ExePath    string  `json:"exe_path,omitempty"`
+	CPUPercent float64 `json:"cpu_percent"`
+	MemoryRSS  uint64  `json:"memory_rss"`
+}
+
+// ioCounters are the cumulative byte counters rates are derived from
+type ioCounters struct {
+	at           time.Time
+	diskRead     uint64
+	diskWrite    uint64
+	networkRx    uint64
+	networkTx    uint64
+	cpuBusy      float64
+	cpuTotal     float64
+	haveDisk     bool
+	haveNetwork  bool
+	haveCPUTimes bool
+}
+
+// metricsCollector samples host resource usage, keeping the previous
+// counters to turn them into rates
+type metricsCollector struct {
+	topN     int
+	previous *ioCounters
+}
+
+func newMetricsCollector(topN int) *metricsCollector {
+	if topN < 0 {
+		topN = 0
+	}
+	return &metricsCollector{topN: topN}
+}
+
+// Collect samples host CPU, memory, disk and network usage and picks the
+// processes using the most CPU and memory from the cycle's listing. When
+// some counters cannot be read, the rest are returned along with the error.
+func (c *metricsCollector) Collect(ctx context.Context, processes []ProcessInfo, containerCount int) (*HostMetrics, error) {
+	metrics := &HostMetrics{
+		ProcessCount:   len(processes),
+		ContainerCount: containerCount,
+		TopProcesses:   topProcesses(processes, c.topN),
+	}
+	current := &ioCounters{at: time.Now()}
+	var errs []string
+
+	if times, err := cpu.TimesWithContext(ctx, false); err != nil || len(times) == 0 {
+		errs = append(errs, fmt.Sprintf("cpu: %v", err))
+	} else {
+		current.cpuTotal = times[0].Total()
+		current.cpuBusy = current.cpuTotal - times[0].Idle - times[0].Iowait
+		current.haveCPUTimes = true
+
+		// The first sample covers the time since boot
+		busy, total := current.cpuBusy, current.cpuTotal
+		if c.previous != nil && c.previous.haveCPUTimes {
+			busy -= c.previous.cpuBusy
+			total -= c.previous.cpuTotal
+		}
+		if total > 0 {
+			metrics.CPUPercent = roundMetric(math.Max(0, busy/total*100))
+		}
+	}
+	if count, err := cpu.CountsWithContext(ctx, true); err == nil {
+		metrics.CPUCount = count
+	}
+
+	// Load averages do not exist on Windows
+	if runtime.GOOS != "windows" {
+		if avg, err := load.AvgWithContext(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("load: %v", err))
+		} else {
+			metrics.Load1, metrics.Load5, metrics.Load15 = avg.Load1, avg.Load5, avg.Load15
+		}
+	}
+
+	if memory, err := mem.VirtualMemoryWithContext(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("memory: %v", err))
+	} else {
+		metrics.MemoryTotal = memory.Total
+		metrics.MemoryUsed = memory.Used
+		metrics.MemoryPercent = roundMetric(memory.UsedPercent)
+	}
+	if swap, err := mem.SwapMemoryWithContext(ctx); err == nil {
+		metrics.SwapTotal, metrics.SwapUsed = swap.Total, swap.Used
+	}
+
+	if usage, err := disk.UsageWithContext(ctx, rootFilesystem()); err != nil {
+		errs = append(errs, fmt.Sprintf("disk usage: %v", err))
+	} else {
+		metrics.DiskTotal = usage.Total
+		metrics.DiskUsed = usage.Used
+		metrics.DiskPercent = roundMetric(usage.UsedPercent)
+	}
+
+	if counters, err := disk.IOCountersWithContext(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("disk I/O: %v", err))
+	} else {
+		for _, counter := range counters {
+			current.diskRead += counter.ReadBytes
+			current.diskWrite += counter.WriteBytes
+		}
+		current.haveDisk = true
+	}
+
+	if counters, err := net.IOCountersWithContext(ctx, true); err != nil {
+		errs = append(errs, fmt.Sprintf("network I/O: %v", err))
+	} else {
+		for _, counter := range counters {
+			if isLoopbackInterface(counter.Name) {
+				continue
+			}
+			current.networkRx += counter.BytesRecv
+			current.networkTx += counter.BytesSent
+		}
+		current.haveNetwork = true
+	}
+
+	if previous := c.previous; previous != nil {
+		elapsed := current.at.Sub(previous.at).Seconds()
+		if elapsed > 0 && current.haveDisk && previous.haveDisk {
+			metrics.DiskReadBytesPerSec = counterRate(previous.diskRead, current.diskRead, elapsed)
+			metrics.DiskWriteBytesPerSec = counterRate(previous.diskWrite, current.diskWrite, elapsed)
+		}
+		if elapsed > 0 && current.haveNetwork && previous.haveNetwork {
+			metrics.NetworkRxBytesPerSec = counterRate(previous.networkRx, current.networkRx, elapsed)
+			metrics.NetworkTxBytesPerSec = counterRate(previous.networkTx, current.networkTx, elapsed)
+		}
+	}
+	c.previous = current
+
+	log.Printf("Host metrics: CPU %.1f%%, memory %.1f%%, disk %.1f%%", metrics.CPUPercent, metrics.MemoryPercent, metrics.DiskPercent)
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("failed to read host metrics: %s", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+// topProcesses returns the n processes using the most CPU together with the
+// n using the most memory, busiest first
+func topProcesses(processes []ProcessInfo, n int) []ProcessMetrics {
+	if n == 0 || len(processes) == 0 {
+		return nil
+	}
+
+	byCPU := make([]*ProcessInfo, len(processes))
+	for i := range processes {
+		byCPU[i] = &processes[i]
+	}
+	byRSS := append([]*ProcessInfo(nil), byCPU...)
+	sort.SliceStable(byCPU, func(i, j int) bool { return byCPU[i].CPUPercent > byCPU[j].CPUPercent })
+	sort.SliceStable(byRSS, func(i, j int) bool { return byRSS[i].MemoryRSS > byRSS[j].MemoryRSS })
+
+	var top []ProcessMetrics
+	seen := make(map[string]bool)
+	for _, ranking := range [][]*ProcessInfo{byCPU, byRSS} {
+		for _, proc := range ranking[:min(n, len(ranking))] {
+			if seen[proc.ProcessKey] {
+				continue
+			}
+			seen[proc.ProcessKey] = true
+			top = append(top, ProcessMetrics{
+				PID:        proc.PID,
+				ProcessKey: proc.ProcessKey,
+				Name:       proc.Name,
+				Username:   proc.Username,
+				ExePath:    proc.ExePath,
+				CPUPercent: proc.CPUPercent,
+				MemoryRSS:  proc.MemoryRSS,
+			})
+		}
+	}
+	return top
+}
+
+// counterRate turns two readings of a cumulative counter into a rate. A
+// counter that went backwards was reset, e.g. by an interface going away.
+func counterRate(previous, current uint64, elapsed float64) *float64 {
+	rate := 0.0
+	if current >= previous {
+		rate = roundMetric(float64(current-previous) / elapsed)
+	}
+	return &rate
+}
+
+func roundMetric(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// rootFilesystem returns the path of the filesystem the OS runs from
+func rootFilesystem() string {
+	if runtime.GOOS == "windows" {
+		if drive := os.Getenv("SystemDrive"); drive != "" {
+			return drive + `\`
+		}
+		return `C:\`
+	}
+	return "/"
+}
+
+func isLoopbackInterface(name string) bool {
+	return name == "lo" || strings.HasPrefix(name, "lo0") || strings.HasPrefix(name, "Loopback")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PackageSourceDpkg    = "dpkg"
+	PackageSourceRPM     = "rpm"
+	PackageSourceSnap    = "snap"
+	PackageSourceFlatpak = "flatpak"
+
+	dpkgStatusPath = "/var/lib/dpkg/status"
+	snapMountDir   = "/snap"
+	snapStatePath  = "/var/lib/snapd/state.json"
+	rpmQueryFormat = "%{NAME}\t%{EPOCHNUM}:%{VERSION}-%{RELEASE}\t%{ARCH}\n"
+)
+
+// rpmDBDirs are the RPM database locations, legacy and /usr/lib/sysimage
+var rpmDBDirs = []string{"/var/lib/rpm", "/usr/lib/sysimage/rpm"}
+
+// PackageInfo describes one installed software package
+type PackageInfo struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+	Source       string `json:"source"`
+}
+
+var flatpakReleaseVersion = regexp.MustCompile(`<release[^>]*\sversion="([^"]+)"`)
+
+// packageInventory caches the installed package list and only re-reads the
+// package databases when one of them has been modified.
+type packageInventory struct {
+	mu        sync.Mutex
+	signature string
+	packages  []PackageInfo
+}
+
+var inventory = &packageInventory{}
+
+// collectPackages returns the installed dpkg, RPM, snap and flatpak packages,
+// sorted by source and name. Missing package managers are skipped.
+func collectPackages() ([]PackageInfo, error) {
+	inventory.mu.Lock()
+	defer inventory.mu.Unlock()
+
+	signature := packageDatabasesSignature()
+	if signature == inventory.signature && inventory.packages != nil {
+		return inventory.packages, nil
+	}
+
+	var packages []PackageInfo
+	var errs []string
+
+	collectors := []struct {
+		source  string
+		collect func() ([]PackageInfo, error)
+	}{
+		{PackageSourceDpkg, collectDpkgPackages},
+		{PackageSourceRPM, collectRPMPackages},
+		{PackageSourceSnap, collectSnapPackages},
+		{PackageSourceFlatpak, collectFlatpakPackages},
+	}
+
+	for _, collector := range collectors {
+		found, err := collector.collect()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", collector.source, err))
+			continue
+		}
+		packages = append(packages, found...)
+	}
+
+	if len(errs) > 0 && len(packages) == 0 {
+		return nil, fmt.Errorf("failed to read package databases: %s", strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		log.Printf("Error reading package database %s", err)
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Source != packages[j].Source {
+			return packages[i].Source < packages[j].Source
+		}
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Architecture < packages[j].Architecture
+	})
+	if packages == nil {
+		packages = []PackageInfo{}
+	}
+
+	inventory.signature = signature
+	inventory.packages = packages
+
+	log.Printf("Successfully collected %d installed packages", len(packages))
+	return packages, nil
+}
+
+// packagesHash fingerprints an inventory so unchanged inventories need not be
+// sent again.
+func packagesHash(packages []PackageInfo) string {
+	jsonData, _ := json.Marshal(packages)
+	sum := sha256.Sum256(jsonData)
+	return hex.EncodeToString(sum[:])
+}
+
+// packageDatabasesSignature combines the modification times of every package
+// database location.
+func packageDatabasesSignature() string {
+	paths := []string{dpkgStatusPath, snapMountDir, snapStatePath}
+	for _, dir := range rpmDBDirs {
+		for _, name := range []string{"rpmdb.sqlite", "Packages", "Packages.db"} {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	for _, installation := range flatpakInstallations() {
+		// flatpak touches .changed after every install, update and uninstall
+		paths = append(paths, filepath.Join(installation, ".changed"))
+	}
+
+	var signature strings.Builder
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&signature, "%s=%d;", path, info.ModTime().UnixNano())
+		}
+	}
+	return signature.String()
+}
+
+// collectDpkgPackages parses the dpkg status database
+func collectDpkgPackages() ([]PackageInfo, error) {
+	file, err := os.Open(dpkgStatusPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var packages []PackageInfo
+	var current PackageInfo
+	var installed bool
+
+	flush := func() {
+		if current.Name != "" && installed {
+			current.Source = PackageSourceDpkg
+			packages = append(packages, current)
+		}
+		current = PackageInfo{}
+		installed = false
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue // Continuation of a multi-line field
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "Package":
+			current.Name = value
+		case "Version":
+			current.Version = value
+		case "Architecture":
+			current.Architecture = value
+		case "Status":
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// collectRPMPackages queries the RPM database through the rpm tool, which
+// understands every on-disk backend (BerkeleyDB, NDB and SQLite)
+func collectRPMPackages() ([]PackageInfo, error) {
+	hasDatabase := false
+	for _, dir := range rpmDBDirs {
+		if _, err := os.Stat(dir); err == nil {
+			hasDatabase = true
+		}
+	}
+	if !hasDatabase {
+		return nil, nil
+	}
+	if _, err := exec.LookPath("rpm"); err != nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "rpm", "-qa", "--queryformat", rpmQueryFormat).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []PackageInfo
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+
+		// Drop the zero epoch so versions read the way users expect
+		version := strings.TrimPrefix(fields[1], "0:")
+
+		packages = append(packages, PackageInfo{
+			Name:         fields[0],
+			Version:      version,
+			Architecture: fields[2],
+			Source:       PackageSourceRPM,
+		})
+	}
+
+	return packages, nil
+}
+
+// collectSnapPackages reads the metadata of the active revision of each snap
+func collectSnapPackages() ([]PackageInfo, error) {
+	entries, err := os.ReadDir(snapMountDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []PackageInfo
+	for _, entry := range entries {
+		if entry.Name() == "bin" {
+			continue
+		}
+
+		metadata, err := os.ReadFile(filepath.Join(snapMountDir, entry.Name(), "current", "meta", "snap.yaml"))
+		if err != nil {
+			continue
+		}
+
+		pkg := PackageInfo{Name: entry.Name(), Source: PackageSourceSnap}
+		for _, line := range strings.Split(string(metadata), "\n") {
+			key, value, found := strings.Cut(line, ":")
+			if !found || strings.HasPrefix(key, " ") {
+				continue
+			}
+			value = strings.Trim(strings.TrimSpace(value), `'"`)
+			switch key {
+			case "name":
+				pkg.Name = value
+			case "version":
+				pkg.Version = value
+			}
+		}
+		packages = append(packages, pkg)
+	}
+
+	return packages, nil
+}
+
+// collectFlatpakPackages lists installed flatpak applications and runtimes
+// from the system and per-user installations
+func collectFlatpakPackages() ([]PackageInfo, error) {
+	var packages []PackageInfo
+	for _, installation := range flatpakInstallations() {
+		for _, kind := range []string{"app", "runtime"} {
+			refs, err := os.ReadDir(filepath.Join(installation, kind))
+			if err != nil {
+				continue
+			}
+
+			for _, ref := range refs {
+				refDir := filepath.Join(installation, kind, ref.Name())
+				arches, err := os.ReadDir(refDir)
+				if err != nil {
+					continue
+				}
+
+				for _, arch := range arches {
+					branches, err := os.ReadDir(filepath.Join(refDir, arch.Name()))
+					if err != nil {
+						continue
+					}
+
+					for _, branch := range branches {
+						activeDir := filepath.Join(refDir, arch.Name(), branch.Name(), "active")
+						if _, err := os.Stat(activeDir); err != nil {
+							continue
+						}
+
+						version := flatpakVersion(activeDir, ref.Name())
+						if version == "" {
+							version = branch.Name()
+						}
+
+						packages = append(packages, PackageInfo{
+							Name:         ref.Name(),
+							Version:      version,
+							Architecture: arch.Name(),
+							Source:       PackageSourceFlatpak,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return packages, nil
+}
+
+// flatpakVersion reads the newest release version from the AppStream
+// metainfo shipped with a flatpak
+func flatpakVersion(activeDir, id string) string {
+	for _, dir := range []string{"metainfo", "appdata"} {
+		for _, ext := range []string{".metainfo.xml", ".appdata.xml"} {
+			metainfo, err := os.ReadFile(filepath.Join(activeDir, "files", "share", dir, id+ext))
+			if err != nil {
+				continue
+			}
+			if match := flatpakReleaseVersion.FindSubmatch(metainfo); match != nil {
+				return string(match[1])
+			}
+		}
+	}
+	return ""
+}
+
+// flatpakInstallations returns the system and per-user flatpak directories
+func flatpakInstallations() []string {
+	installations := []string{"/var/lib/flatpak"}
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		installations = append(installations, filepath.Join(homeDir, ".local", "share", "flatpak"))
+	}
+	return installations
+}
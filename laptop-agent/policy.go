@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPolicyInterval is how often the agent asks for its policy
+const defaultPolicyInterval = 5 * time.Minute
+
+// agentPolicy is the policy the telemetry service issued this device: the
+// settings of its organisation, group and device, merged by the service
+type agentPolicy struct {
+	DeviceID string          `json:"device_id"`
+	Group    string          `json:"group,omitempty"`
+	IssuedAt time.Time       `json:"issued_at"`
+	Settings json.RawMessage `json:"settings"`
+
+	settings policySettings
+}
+
+// signedPolicy is a policy document as the service sent it, with its
+// signature, as the agent caches it
+type signedPolicy struct {
+	Document  []byte `json:"document"`
+	Signature string `json:"signature"`
+}
+
+// policyClient fetches the device's policy, which overrides the local
+// configuration. Only policies signed with POLICY_PUBLIC_KEY for this
+// device are applied, and the last one is cached so it still applies when
+// the agent restarts without reaching the service.
+type policyClient struct {
+	client    *apiClient
+	endpoint  string
+	publicKey ed25519.PublicKey
+	path      string
+	interval  time.Duration
+
+	mu      sync.Mutex
+	current *agentPolicy
+}
+
+// newPolicyClient loads the public key and the cached policy. A cached
+// policy that does not verify is ignored until the service sends another.
+func newPolicyClient(client *apiClient, config Config) (*policyClient, error) {
+	publicKey, err := loadPolicyPublicKey(config.PolicyPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &policyClient{
+		client:    client,
+		endpoint:  config.PolicyEndpoint,
+		publicKey: publicKey,
+		path:      config.PolicyPath,
+		interval:  config.PolicyInterval,
+	}
+
+	jsonData, err := os.ReadFile(p.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Ignoring cached policy: %v", err)
+		}
+		return p, nil
+	}
+	var cached signedPolicy
+	if err := json.Unmarshal(jsonData, &cached); err != nil {
+		log.Printf("Ignoring cached policy %s: %v", p.path, err)
+		return p, nil
+	}
+	if p.current, err = p.verify(cached.Document, cached.Signature); err != nil {
+		log.Printf("Ignoring cached policy %s: %v", p.path, err)
+	}
+	return p, nil
+}
+
+// loadPolicyPublicKey reads the Ed25519 public key policies are signed
+// with, as written by localca policy-key
+func loadPolicyPublicKey(path string) (ed25519.PublicKey, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read POLICY_PUBLIC_KEY: %w", err)
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in POLICY_PUBLIC_KEY %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse POLICY_PUBLIC_KEY %s: %w", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("POLICY_PUBLIC_KEY %s is not an Ed25519 key", path)
+	}
+	return publicKey, nil
+}
+
+// verify checks a policy document's signature and that it was issued to
+// this device, and parses it. Settings this agent does not know are
+// ignored, as newer services may send them.
+func (p *policyClient) verify(document []byte, signature string) (*agentPolicy, error) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(p.publicKey, document, sig) {
+		return nil, errors.New("the policy signature does not verify")
+	}
+
+	policy := &agentPolicy{}
+	if err := json.Unmarshal(document, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if deviceID := p.client.deviceID(); policy.DeviceID != deviceID {
+		return nil, fmt.Errorf("the policy was issued to device %s, not %s", policy.DeviceID, deviceID)
+	}
+	if len(policy.Settings) > 0 {
+		// JSON is YAML, and the settings are those of the configuration file
+		if err := yaml.Unmarshal(policy.Settings, &policy.settings); err != nil {
+			return nil, fmt.Errorf("failed to parse policy settings: %w", err)
+		}
+	}
+	return policy, nil
+}
+
+// Refresh fetches the device's policy, reporting whether its settings
+// changed. A policy issued before the current one is refused, so an old
+// response cannot be replayed to undo a change.
+func (p *policyClient) Refresh(ctx context.Context) (bool, error) {
+	credential, err := p.client.credential(ctx)
+	if err != nil {
+		return false, err
+	}
+	document, header, err := p.client.fetch(ctx, p.endpoint, credential)
+	if err != nil {
+		p.client.explainRejection(err, credential)
+		return false, err
+	}
+	signature := header.Get("X-Policy-Signature")
+	policy, err := p.verify(document, signature)
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.Lock()
+	current := p.current
+	if current != nil && policy.IssuedAt.Before(current.IssuedAt) {
+		p.mu.Unlock()
+		return false, fmt.Errorf("the policy was issued at %s, before the current one", policy.IssuedAt.Format(time.RFC3339))
+	}
+	changed := current == nil || current.Group != policy.Group || !bytes.Equal(current.Settings, policy.Settings)
+	p.current = policy
+	p.mu.Unlock()
+
+	if changed {
+		jsonData, err := json.Marshal(signedPolicy{Document: document, Signature: signature})
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(p.path), 0700)
+		}
+		if err == nil {
+			err = writeFileAtomic(p.path, jsonData)
+		}
+		if err != nil {
+			log.Printf("Error caching policy: %v", err)
+		}
+	}
+	return changed, nil
+}
+
+// Current returns the policy in effect, or nil before the agent has one
+func (p *policyClient) Current() *agentPolicy {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// Apply returns config with the current policy's settings over it
+func (p *policyClient) Apply(config Config) Config {
+	if policy := p.Current(); policy != nil {
+		policy.settings.apply(&config)
+	}
+	return config
+}
+
+// Run refreshes the policy every interval until ctx is done, asking for a
+// reload through reload when it changes. Failures are logged; the current
+// policy stays in effect.
+func (p *policyClient) Run(ctx context.Context, reload chan<- struct{}) {
+	delay := p.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay = p.interval
+		changed, err := p.Refresh(ctx)
+		var statusErr *statusError
+		switch {
+		case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotImplemented:
+			log.Printf("The telemetry service does not serve agent policies")
+		case err != nil:
+			log.Printf("Error refreshing policy: %v", err)
+			delay = max(delay, retryAfter(err))
+		case changed:
+			log.Printf("Policy changed; reloading the configuration")
+			requestReload(reload)
+		}
+	}
+}
+
+// defaultPolicyPath keeps the cached policy with the device identity
+func defaultPolicyPath() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "policy.json")
+}
+
+// defaultPolicyEndpoint derives the policy endpoint from the telemetry
+// endpoint, e.g. https://host/api/telemetry becomes
+// https://host/api/agents/policy
+func defaultPolicyEndpoint(apiEndpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(apiEndpoint, "/"), "/telemetry") + "/agents/policy"
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+const (
+	defaultCollectionWorkers = 8
+	defaultCollectionTimeout = 30 * time.Second
+
+	// fileInspectionTimeout bounds hashing and version extraction of one
+	// executable
+	fileInspectionTimeout = 10 * time.Second
+
+	// maxCollectionErrors caps the errors reported in one payload
+	maxCollectionErrors = 100
+)
+
+// CollectionError reports something a collector could not collect. An empty
+// Target means the collector as a whole failed.
+type CollectionError struct {
+	Collector string `json:"collector"`
+	Target    string `json:"target,omitempty"`
+	Error     string `json:"error"`
+}
+
+type ProcessFileInfo struct {
+	SHA256      string
+	FileSize    int64
+	Version     string
+	VersionInfo *VersionInfo
+	Event       *AgentEvent
+}
+
+// processCollection is the result of one process collection. Truncated is
+// set when the cycle deadline expired before every process was listed.
+type processCollection struct {
+	Processes []ProcessInfo
+	Errors    []CollectionError
+	Truncated bool
+}
+
+// processCollector lists processes and inspects their executables with a
+// bounded pool of workers. File inspections run under their own timeout and
+// hold a slot until they really finish, so executables stuck on a hung
+// network filesystem cannot pile up goroutines across cycles.
+type processCollector struct {
+	hashCache *HashCache
+	redactor  *redactor
+	workers   int
+	fileSlots chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]bool // executables whose inspection is still running
+
+	// CPU time of each process at the previous collection
+	cpuTimes      map[string]float64
+	lastCollected time.Time
+}
+
+func newProcessCollector(hashCache *HashCache, redactor *redactor, workers int) *processCollector {
+	if workers < 1 {
+		workers = 1
+	}
+	return &processCollector{
+		hashCache: hashCache,
+		redactor:  redactor,
+		workers:   workers,
+		fileSlots: make(chan struct{}, workers),
+		pending:   make(map[string]bool),
+	}
+}
+
+// Collect lists every process and then inspects each distinct executable,
+// stopping when ctx is done. Processes listed before the deadline are
+// returned even if their executables could not all be inspected.
+func (c *processCollector) Collect(ctx context.Context) (*processCollection, error) {
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Collecting information for %d processes with %d workers...", len(pids), c.workers)
+
+	result := &processCollection{}
+	var errMu sync.Mutex
+	addError := func(target string, err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if len(result.Errors) < maxCollectionErrors {
+			result.Errors = append(result.Errors, CollectionError{Collector: "processes", Target: target, Error: err.Error()})
+		}
+	}
+
+	// List processes
+	listed := make([]*ProcessInfo, len(pids))
+	var processCount atomic.Int64
+	c.runPool(ctx, len(pids), func(i int) {
+		listed[i] = describeProcess(ctx, pids[i])
+		if count := processCount.Add(1); count%100 == 0 {
+			log.Printf("Processed %d/%d processes...", count, len(pids))
+		}
+	})
+
+	// Command lines never leave the host unredacted
+	for _, proc := range listed {
+		if proc != nil {
+			proc.Cmdline, proc.Redaction = c.redactor.Redact(proc.Cmdline)
+			result.Processes = append(result.Processes, *proc)
+		}
+	}
+	if int(processCount.Load()) < len(pids) {
+		result.Truncated = true
+		addError("", fmt.Errorf("collection deadline expired after %d of %d processes", processCount.Load(), len(pids)))
+	}
+
+	// Inspect each distinct executable once
+	var exePaths []string
+	owners := make(map[string][]int)
+	for i, proc := range result.Processes {
+		if proc.ExePath == "" || proc.ExePath == "0" {
+			continue
+		}
+		if _, seen := owners[proc.ExePath]; !seen {
+			exePaths = append(exePaths, proc.ExePath)
+		}
+		owners[proc.ExePath] = append(owners[proc.ExePath], i)
+	}
+
+	fileInfos := make([]*ProcessFileInfo, len(exePaths))
+	c.runPool(ctx, len(exePaths), func(i int) {
+		fileInfo, err := c.inspectFile(ctx, exePaths[i], collectFileInfo)
+		if err != nil {
+			addError(exePaths[i], err)
+		}
+		fileInfos[i] = &fileInfo
+	})
+
+	skipped := 0
+	for i, exe := range exePaths {
+		fileInfo := fileInfos[i]
+		if fileInfo == nil {
+			skipped++
+			continue
+		}
+
+		for _, index := range owners[exe] {
+			proc := &result.Processes[index]
+			proc.SHA256 = fileInfo.SHA256
+			proc.FileSize = fileInfo.FileSize
+			proc.Version = fileInfo.Version
+			proc.VersionInfo = fileInfo.VersionInfo
+		}
+	}
+	if skipped > 0 {
+		addError("", fmt.Errorf("collection deadline expired before %d of %d executables were inspected", skipped, len(exePaths)))
+	}
+
+	linkParents(result.Processes)
+	c.accountCPU(result.Processes, time.Now())
+
+	log.Printf("Finished collecting information for %d processes", len(result.Processes))
+	return result, nil
+}
+
+// HashExecutables hashes the executables of the listed processes that have
+// no hash yet, within the hash cache's I/O budget, and fills in their
+// SHA256. Executables modified in place are reported as events, attributed
+// to the first process running them.
+func (c *processCollector) HashExecutables(ctx context.Context, processes []ProcessInfo) ([]AgentEvent, []CollectionError) {
+	var events []AgentEvent
+	var errs []CollectionError
+	var errMu sync.Mutex
+	addError := func(target string, err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if len(errs) < maxCollectionErrors {
+			errs = append(errs, CollectionError{Collector: "hashes", Target: target, Error: err.Error()})
+		}
+	}
+
+	var exePaths []string
+	owners := make(map[string][]int)
+	for i, proc := range processes {
+		if proc.SHA256 != "" || proc.ExePath == "" || proc.ExePath == "0" {
+			continue
+		}
+		if _, seen := owners[proc.ExePath]; !seen {
+			exePaths = append(exePaths, proc.ExePath)
+		}
+		owners[proc.ExePath] = append(owners[proc.ExePath], i)
+	}
+
+	fileInfos := make([]*ProcessFileInfo, len(exePaths))
+	c.runPool(ctx, len(exePaths), func(i int) {
+		fileInfo, err := c.inspectFile(ctx, exePaths[i], hashExecutable)
+		if err != nil {
+			addError(exePaths[i], err)
+		}
+		fileInfos[i] = &fileInfo
+	})
+
+	skipped := 0
+	for i, exe := range exePaths {
+		fileInfo := fileInfos[i]
+		if fileInfo == nil {
+			skipped++
+			continue
+		}
+
+		for _, index := range owners[exe] {
+			processes[index].SHA256 = fileInfo.SHA256
+		}
+
+		// Attribute the event to the first process running the executable
+		if fileInfo.Event != nil {
+			proc := processes[owners[exe][0]]
+			event := *fileInfo.Event
+			event.PID = proc.PID
+			event.ProcessKey = proc.ProcessKey
+			events = append(events, event)
+		}
+	}
+	if skipped > 0 {
+		addError("", fmt.Errorf("collection deadline expired before %d of %d executables were hashed", skipped, len(exePaths)))
+	}
+
+	return events, errs
+}
+
+// accountCPU sets each process's CPU usage over the interval since the
+// previous collection, as a percentage of one core. Processes first seen in
+// this collection get their average over their lifetime instead.
+func (c *processCollector) accountCPU(processes []ProcessInfo, now time.Time) {
+	cpuTimes := make(map[string]float64, len(processes))
+	elapsed := now.Sub(c.lastCollected).Seconds()
+
+	for i := range processes {
+		proc := &processes[i]
+		cpuTimes[proc.ProcessKey] = proc.cpuTime
+
+		var percent float64
+		if previous, found := c.cpuTimes[proc.ProcessKey]; found && elapsed > 0 {
+			percent = (proc.cpuTime - previous) / elapsed * 100
+		} else if proc.StartTime > 0 {
+			if lifetime := now.Sub(time.UnixMilli(proc.StartTime)).Seconds(); lifetime > 0 {
+				percent = proc.cpuTime / lifetime * 100
+			}
+		}
+		proc.CPUPercent = roundMetric(max(percent, 0))
+	}
+
+	c.cpuTimes = cpuTimes
+	c.lastCollected = now
+}
+
+// runPool calls fn for every index in [0, n) from c.workers goroutines and
+// waits for them. Indexes not yet started when ctx is done are skipped.
+func (c *processCollector) runPool(ctx context.Context, n int, fn func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// describeProcess reads the basic attributes of a process. It returns nil
+// for processes that exited or cannot be accessed.
+func describeProcess(ctx context.Context, pid int32) *ProcessInfo {
+	proc, err := process.NewProcessWithContext(ctx, pid)
+	if err != nil {
+		return nil // Skip processes we can't access
+	}
+
+	name, _ := proc.NameWithContext(ctx)
+	ppid, _ := proc.PpidWithContext(ctx)
+	cmdlineStr, _ := proc.CmdlineWithContext(ctx)
+	username, _ := proc.UsernameWithContext(ctx)
+	exe, _ := proc.ExeWithContext(ctx)
+	createTime, _ := proc.CreateTimeWithContext(ctx)
+	status, _ := proc.StatusWithContext(ctx)
+
+	// CPU time is turned into a percentage once every process is listed
+	var cpuTime float64
+	if times, err := proc.TimesWithContext(ctx); err == nil {
+		cpuTime = times.User + times.System
+	}
+	var rss uint64
+	if memory, err := proc.MemoryInfoWithContext(ctx); err == nil {
+		rss = memory.RSS
+	}
+
+	// Convert cmdline string to slice
+	var cmdline []string
+	if cmdlineStr != "" {
+		cmdline = []string{cmdlineStr}
+	}
+
+	// Convert status slice to string
+	var statusStr string
+	if len(status) > 0 {
+		statusStr = status[0]
+	}
+
+	return &ProcessInfo{
+		PID:        pid,
+		PPID:       ppid,
+		Name:       name,
+		Cmdline:    cmdline,
+		Username:   username,
+		ExePath:    exe,
+		StartTime:  createTime,
+		ProcessKey: processKey(pid, createTime),
+		Status:     statusStr,
+		MemoryRSS:  rss,
+		cpuTime:    cpuTime,
+	}
+}
+
+// inspectFile runs inspect on an executable under fileInspectionTimeout. The
+// inspection runs in its own goroutine holding a file slot: on timeout the
+// caller moves on, and the goroutine stops at its next context check, or
+// keeps its slot while blocked in the kernel.
+func (c *processCollector) inspectFile(ctx context.Context, filePath string, inspect func(context.Context, *HashCache, string) (ProcessFileInfo, error)) (ProcessFileInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, fileInspectionTimeout)
+
+	c.mu.Lock()
+	if c.pending[filePath] {
+		c.mu.Unlock()
+		cancel()
+		return ProcessFileInfo{}, errors.New("previous inspection still running")
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.fileSlots <- struct{}{}:
+	case <-ctx.Done():
+		cancel()
+		return ProcessFileInfo{}, fmt.Errorf("waiting for a file inspection slot: %w", ctx.Err())
+	}
+
+	c.mu.Lock()
+	c.pending[filePath] = true
+	c.mu.Unlock()
+
+	// Buffered so the goroutine can always deliver and exit, even after the
+	// caller has given up on it
+	done := make(chan fileInspection, 1)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, filePath)
+			c.mu.Unlock()
+			<-c.fileSlots
+			cancel()
+		}()
+		fileInfo, err := inspect(ctx, c.hashCache, filePath)
+		done <- fileInspection{fileInfo, err}
+	}()
+
+	select {
+	case inspection := <-done:
+		return inspection.info, inspection.err
+	case <-ctx.Done():
+		return ProcessFileInfo{}, fmt.Errorf("inspecting executable: %w", ctx.Err())
+	}
+}
+
+type fileInspection struct {
+	info ProcessFileInfo
+	err  error
+}
+
+// collectFileInfo extracts an executable's version, giving up as soon as ctx
+// is done. Its hash is only taken from the cache; hashing is left to
+// HashExecutables, which may run less often.
+func collectFileInfo(ctx context.Context, hashCache *HashCache, filePath string) (ProcessFileInfo, error) {
+	result := ProcessFileInfo{
+		SHA256: hashCache.Cached(filePath),
+	}
+
+	// Get file size
+	if fileSize, err := getFileSize(filePath); err == nil {
+		result.FileSize = fileSize
+	}
+
+	// Get version information from the binary and its owning package
+	if versionInfo := extractVersionInfo(ctx, filePath); versionInfo != nil {
+		result.Version = versionInfo.Version
+		result.VersionInfo = versionInfo
+	}
+
+	return result, nil
+}
+
+// hashExecutable hashes an executable, from the cache when the binary is
+// unchanged. Files deferred by the I/O budget and files that vanished or may
+// not be read are left unhashed without an error.
+func hashExecutable(ctx context.Context, hashCache *HashCache, filePath string) (ProcessFileInfo, error) {
+	sha256Hash, event, err := hashCache.Hash(ctx, filePath)
+	if err != nil {
+		if errors.Is(err, errHashBudgetExceeded) || isRoutineFileError(err) {
+			return ProcessFileInfo{}, nil
+		}
+		return ProcessFileInfo{}, fmt.Errorf("hashing executable: %w", err)
+	}
+	return ProcessFileInfo{SHA256: sha256Hash, Event: event}, nil
+}
+
+// contextReader fails reads once its context is done, so long copies such as
+// hashing a large file can be cancelled between reads
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// isRoutineFileError reports errors that are expected while inspecting
+// executables and not worth reporting: processes that exited or binaries the
+// agent may not read.
+func isRoutineFileError(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactionVersion identifies the built-in detectors. It is sent with every
+// process so the backend can tell redacted command lines from those of agents
+// that predate redaction.
+const redactionVersion = 2
+
+// redactedText replaces every secret found in a command line
+const redactedText = "[REDACTED]"
+
+// Redaction marks a process whose command line went through the redaction
+// engine. Rules names the detectors that found something, if any.
+type Redaction struct {
+	Version int      `json:"version"`
+	Rules   []string `json:"rules,omitempty"`
+}
+
+// redactionRule finds secrets in a command line. When the pattern has a
+// capture group only the first group is redacted, so "--password=x" keeps its
+// key; otherwise the whole match is. Accept, when set, must also approve the
+// redacted text. A RedactsNext rule matches an argument naming a secret,
+// such as "--password", and redacts the argument after it instead.
+type redactionRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Accept      func(string) bool
+	RedactsNext bool
+}
+
+// builtinRedactionRuleText is the one definition of the built-in rules,
+// which the telemetry service embeds a copy of
+//
+//go:embed redaction_rules.txt
+var builtinRedactionRuleText string
+
+// builtinRedactionRules run after the organisation's rules, in order; text
+// already replaced by an earlier rule is not matched again
+var builtinRedactionRules = mustParseBuiltinRedactionRules()
+
+// redactionChecks approve what the built-in rule of the same name matched
+var redactionChecks = map[string]func(string) bool{
+	"high_entropy": isHighEntropyToken,
+}
+
+// redactionFlagRules are the built-in rules that redact the argument after
+// the one they match
+var redactionFlagRules = map[string]bool{
+	"secret_flag": true,
+}
+
+func mustParseBuiltinRedactionRules() []redactionRule {
+	rules, err := parseRedactionRules("redaction_rules.txt", strings.Split(builtinRedactionRuleText, "\n"))
+	if err != nil {
+		panic(err)
+	}
+	for i := range rules {
+		rules[i].Accept = redactionChecks[rules[i].Name]
+		rules[i].RedactsNext = redactionFlagRules[rules[i].Name]
+	}
+	return rules
+}
+
+// redactor removes secrets from command lines before they leave the host.
+// Its rules are replaced when the configuration is reloaded, while the task
+// runner may be using it.
+type redactor struct {
+	mu    sync.RWMutex
+	rules []redactionRule
+}
+
+// newRedactor returns a redactor applying custom, then the built-in rules
+func newRedactor(custom []redactionRule) *redactor {
+	r := &redactor{}
+	r.setRules(custom)
+	return r
+}
+
+// setRules replaces the organisation's rules
+func (r *redactor) setRules(custom []redactionRule) {
+	rules := make([]redactionRule, 0, len(custom)+len(builtinRedactionRules))
+	rules = append(rules, custom...)
+	rules = append(rules, builtinRedactionRules...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+}
+
+// Redact returns the command line with every secret replaced, and the marker
+// to send with it
+func (r *redactor) Redact(cmdline []string) ([]string, *Redaction) {
+	marker := &Redaction{Version: redactionVersion}
+	if len(cmdline) == 0 {
+		return cmdline, marker
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fired := make(map[string]bool)
+	redacted := make([]string, len(cmdline))
+	flag := "" // the rule that matched the previous argument, naming a secret
+	for i, arg := range cmdline {
+		if flag != "" && isSecretValue(arg) {
+			fired[flag] = true
+			redacted[i], flag = redactedText, ""
+			continue
+		}
+		flag = ""
+		for _, rule := range r.rules {
+			if rule.RedactsNext {
+				if rule.Pattern.MatchString(arg) {
+					flag = rule.Name
+				}
+				continue
+			}
+			var found bool
+			arg, found = rule.apply(arg)
+			if found {
+				fired[rule.Name] = true
+			}
+		}
+		redacted[i] = arg
+	}
+
+	for name := range fired {
+		marker.Rules = append(marker.Rules, name)
+	}
+	sort.Strings(marker.Rules)
+	return redacted, marker
+}
+
+// RedactText returns a command line collected as one string, e.g. from a
+// log, with every secret replaced
+func (r *redactor) RedactText(text string) string {
+	if text == "" {
+		return text
+	}
+	redacted, _ := r.Redact([]string{text})
+	return redacted[0]
+}
+
+// RedactPayload replaces the secrets in the command lines of a payload's
+// events and persistence items. Processes are redacted as they are listed,
+// before the detection rules see them.
+func (r *redactor) RedactPayload(data *TelemetryData) {
+	for i := range data.AuthEvents {
+		data.AuthEvents[i].Command = r.RedactText(data.AuthEvents[i].Command)
+	}
+	for i := range data.ContainerEvents {
+		data.ContainerEvents[i].ExecCommand = r.RedactText(data.ContainerEvents[i].ExecCommand)
+	}
+	for i := range data.Persistence {
+		data.Persistence[i].Commands, _ = r.Redact(data.Persistence[i].Commands)
+	}
+}
+
+// RedactJSON replaces the secrets in every string of a JSON document, such
+// as a task's result. Redacting the document's text instead could break its
+// quoting.
+func (r *redactor) RedactJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(r.redactValue(document))
+}
+
+func (r *redactor) redactValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		return r.RedactText(v)
+	case []any:
+		for i := range v {
+			v[i] = r.redactValue(v[i])
+		}
+	case map[string]any:
+		for key := range v {
+			v[key] = r.redactValue(v[key])
+		}
+	}
+	return value
+}
+
+// isSecretValue reports whether the argument after a flag naming a secret
+// is its value, rather than another flag
+func isSecretValue(arg string) bool {
+	return arg != "" && arg != redactedText && !strings.HasPrefix(arg, "-")
+}
+
+// apply replaces every match of the rule in text and reports whether any was
+// found
+func (rule redactionRule) apply(text string) (string, bool) {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, false
+	}
+
+	var b strings.Builder
+	last, found := 0, false
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) >= 4 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		secret := text[start:end]
+		if secret == "" || secret == redactedText || (rule.Accept != nil && !rule.Accept(secret)) {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(redactedText)
+		last, found = end, true
+	}
+	if !found {
+		return text, false
+	}
+	b.WriteString(text[last:])
+	return b.String(), true
+}
+
+// isHighEntropyToken reports tokens that look randomly generated: letters of
+// both cases and digits, and at least 4.2 bits of entropy per character.
+// Hex digests and UUIDs fail the mixed-case test and are kept.
+func isHighEntropyToken(token string) bool {
+	var upper, lower, digit bool
+	counts := make(map[rune]int)
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		counts[c]++
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	var entropy float64
+	length := float64(len(token))
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= 4.2
+}
+
+// loadRedactionRules reads the organisation's redaction rules: one rule per
+// line, a name followed by a regular expression, with blank lines and lines
+// starting with "#" ignored
+func loadRedactionRules(path string) ([]redactionRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseRedactionRules(path, lines)
+}
+
+// parseRedactionRules parses redaction rules in the format of
+// loadRedactionRules, one per line; source names where they came from in
+// errors
+func parseRedactionRules(source string, lines []string) ([]redactionRule, error) {
+	var rules []redactionRule
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.IndexAny(line, " \t")
+		if separator < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a rule name and a regular expression", source, i+1)
+		}
+		name, expr := line[:separator], strings.TrimSpace(line[separator:])
+		if expr == "" {
+			return nil, fmt.Errorf("%s:%d: expected a rule name and a regular expression", source, i+1)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", source, i+1, err)
+		}
+		rules = append(rules, redactionRule{Name: name, Pattern: pattern})
+	}
+	return rules, nil
+}
+
+// loadConfiguredRedactionRules loads the rules of REDACTION_RULES_FILE and
+// those of the configuration file and policy
+func loadConfiguredRedactionRules(config Config) ([]redactionRule, error) {
+	var customRules []redactionRule
+	if config.RedactionRules != "" {
+		rules, err := loadRedactionRules(config.RedactionRules)
+		if err != nil {
+			return nil, err
+		}
+		customRules = rules
+	}
+	if len(config.InlineRedactionRules) > 0 {
+		rules, err := parseRedactionRules("redaction_rules", config.InlineRedactionRules)
+		if err != nil {
+			return nil, err
+		}
+		customRules = append(customRules, rules...)
+	}
+	if len(customRules) > 0 {
+		log.Printf("Loaded %d redaction rules", len(customRules))
+	}
+	return customRules, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configWatchInterval is how often the agent checks whether the
+// configuration file changed
+const configWatchInterval = 5 * time.Second
+
+// watchConfig asks for a reload through reload on SIGHUP, and when the
+// configuration file at path, if any, is written, until ctx is done
+func watchConfig(ctx context.Context, path string, reload chan<- struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var checks <-chan time.Time
+	var modTime time.Time
+	var size int64
+	if path != "" {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		checks = ticker.C
+		if info, err := os.Stat(path); err == nil {
+			modTime, size = info.ModTime(), info.Size()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Printf("Received SIGHUP; reloading the configuration")
+			requestReload(reload)
+		case <-checks:
+			// Editors often replace the file, so its size and time are
+			// compared rather than watching it
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			log.Printf("Configuration file %s changed; reloading the configuration", path)
+			requestReload(reload)
+		}
+	}
+}
+
+// requestReload asks for a reload unless one is already pending
+func requestReload(reload chan<- struct{}) {
+	select {
+	case reload <- struct{}{}:
+	default:
+	}
+}
+
+// reload reads the configuration again, with the policy over it, and
+// applies what changed. A configuration that fails to load or apply is
+// logged and the agent carries on as it was.
+func (a *agent) reload(status *agentStatus) {
+	next, err := loadConfig()
+	if err != nil {
+		log.Printf("Keeping the current configuration: %v", err)
+		return
+	}
+	next.Output = a.config.Output
+
+	if err := a.reconfigure(a.policy.Apply(next)); err != nil {
+		log.Printf("Keeping the current configuration: %v", err)
+		return
+	}
+	status.recordPolicy(a.policy.Current())
+	log.Printf("Configuration reloaded")
+}
+
+// reconfigure applies the settings of next that a running agent can change,
+// checking all of them before applying any. Changes to the others are
+// logged, as they take effect when the agent restarts.
+func (a *agent) reconfigure(next Config) error {
+	if next.CollectionInterval <= 0 {
+		return errors.New("the collection interval must be positive")
+	}
+	if next.CollectionTimeout <= 0 {
+		return errors.New("the collection timeout must be positive")
+	}
+	if !validCompression(next.UploadCompression) {
+		return fmt.Errorf("invalid upload compression %q: must be %s, %s or %s", next.UploadCompression, compressionZstd, compressionGzip, compressionNone)
+	}
+	if next.UploadChunkSize <= 0 {
+		return errors.New("the upload chunk size must be positive")
+	}
+	redactionRules, err := loadConfiguredRedactionRules(next)
+	if err != nil {
+		return fmt.Errorf("error loading redaction rules: %w", err)
+	}
+	detectionRules, err := loadConfiguredDetectionRules(next)
+	if err != nil {
+		return fmt.Errorf("error loading detection rules: %w", err)
+	}
+	if err := configureCollectors(a.collectors, next); err != nil {
+		return fmt.Errorf("error loading collectors configuration: %w", err)
+	}
+
+	// The file integrity monitor only starts with the agent
+	if a.fim == nil {
+		a.collectors.Disable("file_integrity")
+	}
+	a.redactor.setRules(redactionRules)
+	a.detector.setRules(detectionRules)
+	a.tracker.SetCheckpointInterval(next.CheckpointInterval)
+	if a.client != nil {
+		a.client.setUpload(next.UploadCompression, next.UploadChunkSize)
+	}
+
+	if changed := restartSettings(a.config, next); len(changed) > 0 {
+		log.Printf("Restart the agent to apply the new %s", strings.Join(changed, ", "))
+	}
+
+	a.config.CollectionInterval = next.CollectionInterval
+	a.config.CheckpointInterval = next.CheckpointInterval
+	a.config.CollectionTimeout = next.CollectionTimeout
+	a.config.CollectorsConfig = next.CollectorsConfig
+	a.config.Collectors = next.Collectors
+	a.config.RedactionRules = next.RedactionRules
+	a.config.InlineRedactionRules = next.InlineRedactionRules
+	a.config.DetectionRules = next.DetectionRules
+	a.config.UploadCompression = next.UploadCompression
+	a.config.UploadChunkSize = next.UploadChunkSize
+	return nil
+}
+
+// restartSettings names the settings that differ between old and next but
+// only take effect when the agent starts. The client, spool, file integrity
+// monitor, task runner and policy client are built from them at startup and
+// used by goroutines running since, so they are not rebuilt on a reload.
+func restartSettings(old, next Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("API_ENDPOINT", old.APIEndpoint != next.APIEndpoint)
+	check("SPOOL_DIR", old.SpoolDir != next.SpoolDir)
+	check("SPOOL_MAX_SIZE_MB", old.SpoolMaxBytes != next.SpoolMaxBytes)
+	check("SPOOL_MAX_AGE_HOURS", old.SpoolMaxAge != next.SpoolMaxAge)
+	check("HASH_IO_BUDGET_MB", old.HashIOBudget != next.HashIOBudget)
+	check("COLLECTION_WORKERS", old.CollectionWorkers != next.CollectionWorkers)
+	check("FIM_ENABLED", old.FIMEnabled != next.FIMEnabled)
+	check("FIM_PATHS", !slices.Equal(old.FIMPaths, next.FIMPaths))
+	check("FIM_RESCAN_INTERVAL", old.FIMRescanInterval != next.FIMRescanInterval)
+	check("METRICS_TOP_N", old.MetricsTopN != next.MetricsTopN)
+	check("TASKS_ENABLED", old.TasksEnabled != next.TasksEnabled)
+	check("TASK_POLL_INTERVAL", old.TaskPollInterval != next.TaskPollInterval)
+	check("ENROLLMENT_TOKEN", old.EnrollmentToken != next.EnrollmentToken)
+	check("TLS_CA_FILE", old.TLSCAFile != next.TLSCAFile)
+	check("TLS_CLIENT_CERT", old.TLSClientCert != next.TLSClientCert)
+	check("TLS_CLIENT_KEY", old.TLSClientKey != next.TLSClientKey)
+	check("POLICY_PUBLIC_KEY", old.PolicyPublicKey != next.PolicyPublicKey)
+	check("POLICY_INTERVAL", old.PolicyInterval != next.PolicyInterval)
+	return changed
+}
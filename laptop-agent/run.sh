@@ -9,6 +9,56 @@ echo "Starting SmartSec Laptop Agent..."
 export API_ENDPOINT="${API_ENDPOINT:-https://api.smartsec.local/telemetry}"
 export COLLECTION_INTERVAL="${COLLECTION_INTERVAL:-60}"
 export LOG_ONLY="${LOG_ONLY:-false}"
+export SPOOL_MAX_SIZE_MB="${SPOOL_MAX_SIZE_MB:-100}"
+export SPOOL_MAX_AGE_HOURS="${SPOOL_MAX_AGE_HOURS:-72}"
+export CHECKPOINT_INTERVAL="${CHECKPOINT_INTERVAL:-3600}"
+export HASH_IO_BUDGET_MB="${HASH_IO_BUDGET_MB:-256}"
+export COLLECTION_WORKERS="${COLLECTION_WORKERS:-8}"
+export COLLECTION_TIMEOUT="${COLLECTION_TIMEOUT:-30}"
+export FIM_ENABLED="${FIM_ENABLED:-true}"
+export FIM_RESCAN_INTERVAL="${FIM_RESCAN_INTERVAL:-600}"
+export METRICS_TOP_N="${METRICS_TOP_N:-10}"
+# Optional JSON file enabling, disabling and scheduling collectors, e.g.
+# {"hashes": {"interval": "1h"}, "packages": {"enabled": false}}
+export COLLECTORS_CONFIG="${COLLECTORS_CONFIG:-}"
+# Organisation bootstrap token; the agent enrolls with it once and saves the
+# device ID and credential it is issued to IDENTITY_PATH
+export ENROLLMENT_TOKEN="${ENROLLMENT_TOKEN:-}"
+# Mutual TLS: TLS_CA_FILE is the CA bundle the service's certificate is
+# checked against, and the agent presents TLS_CLIENT_CERT and TLS_CLIENT_KEY,
+# obtaining them from the service and renewing them before they expire
+export TLS_CA_FILE="${TLS_CA_FILE:-}"
+export TLS_CLIENT_CERT="${TLS_CLIENT_CERT:-}"
+export TLS_CLIENT_KEY="${TLS_CLIENT_KEY:-}"
+# Telemetry is compressed with zstd, gzip or none, and snapshots with more
+# JSON than UPLOAD_CHUNK_SIZE_MB are sent in chunks
+export UPLOAD_COMPRESSION="${UPLOAD_COMPRESSION:-gzip}"
+export UPLOAD_CHUNK_SIZE_MB="${UPLOAD_CHUNK_SIZE_MB:-4}"
+# The first collection waits a random delay of up to STARTUP_JITTER seconds,
+# so a fleet restarted together does not report in step; the telemetry
+# service may then recommend a different COLLECTION_INTERVAL
+export STARTUP_JITTER="${STARTUP_JITTER:-30}"
+# Optional YAML or JSON configuration file whose settings, named after these
+# variables in lower case, override them; the running agent reloads it on
+# SIGHUP or when it changes. A reload applies the intervals, the collection
+# timeout, collectors, redaction and detection rules and upload settings;
+# the endpoint, spool, TLS, enrollment, task, file integrity and policy
+# settings only take effect when the agent restarts, e.g.
+#   collection_interval: 5m
+#   collectors: {packages: {enabled: false}}
+#   redaction_rules: ['vault-token hvs\.[A-Za-z0-9]+']
+export CONFIG_FILE="${CONFIG_FILE:-}"
+# Optional YAML or JSON rule pack evaluated against every collection; matches
+# are sent as findings, and spooled with the telemetry while offline, e.g.
+#   rules:
+#     - {id: netcat-shell, name: Shell served with netcat, severity: high,
+#        process: {name: [nc, ncat], cmdline: '\s-e\s'}}
+export DETECTION_RULES_FILE="${DETECTION_RULES_FILE:-}"
+# Public key (from localca policy-key) the policy the telemetry service
+# issues this device is verified with; the policy is fetched every
+# POLICY_INTERVAL seconds and overrides the local configuration
+export POLICY_PUBLIC_KEY="${POLICY_PUBLIC_KEY:-}"
+export POLICY_INTERVAL="${POLICY_INTERVAL:-300}"
 
 # Show current configuration
 if [ "$LOG_ONLY" = "true" ]; then
@@ -20,5 +70,6 @@ fi
 # Create logs directory if it doesn't exist
 mkdir -p logs
 
-# Run the agent with logging
-./laptop-agent 2>&1 | tee logs/agent-$(date +%Y%m%d-%H%M%S).log
+# Run the agent with logging; see ./laptop-agent help for the collect, send,
+# status and check troubleshooting commands
+./laptop-agent run 2>&1 | tee logs/agent-$(date +%Y%m%d-%H%M%S).log
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+// Where a login session was listed from
+const (
+	SessionSourceLogind = "logind"
+	SessionSourceUtmp   = "utmp"
+)
+
+// SessionInfo is a login session on the host
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	UID        *uint32   `json:"uid,omitempty"`
+	TTY        string    `json:"tty,omitempty"`
+	Seat       string    `json:"seat,omitempty"`
+	RemoteHost string    `json:"remote_host,omitempty"`
+	Remote     bool      `json:"remote"`
+	Service    string    `json:"service,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	State      string    `json:"state,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	Source     string    `json:"source"`
+}
+
+// logindTimestampLayout is how loginctl formats timestamps
+const logindTimestampLayout = "Mon 2006-01-02 15:04:05 MST"
+
+// collectSessions lists login sessions from systemd-logind, or from utmp
+// where logind is not running
+func collectSessions(ctx context.Context) ([]SessionInfo, error) {
+	sessions, err := collectLogindSessions(ctx)
+	if err == nil {
+		log.Printf("Successfully collected %d login sessions from logind", len(sessions))
+		return sessions, nil
+	}
+
+	// No utmp file means nobody has logged in since boot
+	users, utmpErr := host.UsersWithContext(ctx)
+	if utmpErr != nil && !errors.Is(utmpErr, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list login sessions: logind: %v; utmp: %v", err, utmpErr)
+	}
+
+	sessions = []SessionInfo{}
+	for _, user := range users {
+		sessions = append(sessions, SessionInfo{
+			ID:         fmt.Sprintf("%s:%d", user.Terminal, user.Started),
+			User:       user.User,
+			TTY:        user.Terminal,
+			RemoteHost: user.Host,
+			Remote:     isRemoteHost(user.Host),
+			StartedAt:  time.Unix(int64(user.Started), 0).UTC(),
+			Source:     SessionSourceUtmp,
+		})
+	}
+
+	log.Printf("Successfully collected %d login sessions from utmp", len(sessions))
+	return sessions, nil
+}
+
+// collectLogindSessions asks loginctl for every session and its properties
+func collectLogindSessions(ctx context.Context) ([]SessionInfo, error) {
+	if _, err := os.Stat("/run/systemd/seats"); err != nil {
+		return nil, fmt.Errorf("logind is not running")
+	}
+
+	output, err := exec.CommandContext(ctx, "loginctl", "list-sessions", "--no-legend", "--no-pager").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			ids = append(ids, fields[0])
+		}
+	}
+	sessions := []SessionInfo{}
+	if len(ids) == 0 {
+		return sessions, nil
+	}
+
+	args := append([]string{"show-session", "--no-pager",
+		"-p", "Id", "-p", "Name", "-p", "User", "-p", "TTY", "-p", "Seat", "-p", "Remote", "-p", "RemoteHost",
+		"-p", "Service", "-p", "Type", "-p", "Class", "-p", "State", "-p", "Timestamp"}, ids...)
+	output, err = exec.CommandContext(ctx, "loginctl", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// One block of properties per session, separated by blank lines
+	properties := make(map[string]string)
+	flush := func() {
+		if properties["Id"] != "" {
+			sessions = append(sessions, logindSession(properties))
+		}
+		properties = make(map[string]string)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if key, value, found := strings.Cut(line, "="); found {
+			properties[key] = value
+		}
+	}
+	flush()
+
+	return sessions, scanner.Err()
+}
+
+func logindSession(properties map[string]string) SessionInfo {
+	session := SessionInfo{
+		ID:         properties["Id"],
+		User:       properties["Name"],
+		TTY:        properties["TTY"],
+		Seat:       properties["Seat"],
+		RemoteHost: properties["RemoteHost"],
+		Remote:     properties["Remote"] == "yes",
+		Service:    properties["Service"],
+		Type:       properties["Type"],
+		Class:      properties["Class"],
+		State:      properties["State"],
+		Source:     SessionSourceLogind,
+	}
+
+	var uid uint32
+	if _, err := fmt.Sscan(properties["User"], &uid); err == nil {
+		session.UID = &uid
+	}
+	if startedAt, err := time.Parse(logindTimestampLayout, properties["Timestamp"]); err == nil {
+		session.StartedAt = startedAt.UTC()
+	}
+	return session
+}
+
+// activeUser returns the user sitting at the host: the owner of the active
+// local session, or of the most recent local and then remote session.
+// Greeter and other system sessions are not users.
+func activeUser(sessions []SessionInfo) string {
+	var candidates []SessionInfo
+	for _, session := range sessions {
+		if session.User == "" || (session.Class != "" && session.Class != "user") {
+			continue
+		}
+		candidates = append(candidates, session)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if (a.State == "active") != (b.State == "active") {
+			return a.State == "active"
+		}
+		if a.Remote != b.Remote {
+			return !a.Remote
+		}
+		if (a.Seat != "") != (b.Seat != "") {
+			return a.Seat != ""
+		}
+		return a.StartedAt.After(b.StartedAt)
+	})
+
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].User
+}
+
+// isRemoteHost reports whether a utmp host is a remote machine rather than
+// an X display such as ":0"
+func isRemoteHost(host string) bool {
+	return host != "" && !strings.HasPrefix(host, ":")
+}
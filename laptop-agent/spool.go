@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolFileExt         = ".json"
+	spoolTempPrefix      = ".tmp-"
+	spoolInitialBackoff  = 5 * time.Second
+	spoolMaxBackoff      = 5 * time.Minute
+	defaultSpoolMaxBytes = 100 * 1024 * 1024
+	defaultSpoolMaxAge   = 72 * time.Hour
+)
+
+// Spool is a bounded on-disk queue of telemetry snapshots that could not be
+// delivered. Every snapshot is stored in its own file whose name sorts in
+// collection order, and is written via temp file, fsync and rename so that a
+// crash never leaves a half-written entry behind.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	seq    uint64
+	notify chan struct{}
+}
+
+type spoolEntry struct {
+	path      string
+	timestamp time.Time
+	size      int64
+}
+
+// NewSpool opens (creating if needed) the spool directory and removes any
+// temp files left over from an interrupted write.
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, spoolTempPrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan spool directory: %w", err)
+	}
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		notify:   make(chan struct{}, 1),
+	}
+
+	if err := s.prune(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Enqueue persists a snapshot and wakes up the replay loop.
+func (s *Spool) Enqueue(data TelemetryData) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spooled telemetry: %w", err)
+	}
+
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", data.Timestamp.UnixNano(), s.seq%1000000, spoolFileExt)
+	s.mu.Unlock()
+
+	if err := writeFileAtomic(filepath.Join(s.dir, name), jsonData); err != nil {
+		return fmt.Errorf("failed to write spooled telemetry: %w", err)
+	}
+
+	if err := s.prune(); err != nil {
+		log.Printf("Error pruning telemetry spool: %v", err)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Len returns the number of snapshots waiting to be replayed.
+func (s *Spool) Len() int {
+	entries, err := s.entries()
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// RunReplay delivers spooled snapshots oldest first until ctx is cancelled.
+// A failed delivery stops the current pass and schedules the next one with
+// jittered exponential backoff, or after the Retry-After the service sent if
+// that is longer, so an unreachable endpoint is not hammered.
+func (s *Spool) RunReplay(ctx context.Context, send func(TelemetryData) error) {
+	backoff := &retryBackoff{initial: spoolInitialBackoff, max: spoolMaxBackoff}
+	var nextAttempt time.Time
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+			if time.Now().Before(nextAttempt) {
+				continue
+			}
+		case <-timer.C:
+		}
+
+		sent, err := s.drain(ctx, send)
+		if sent > 0 {
+			log.Printf("Replayed %d spooled telemetry snapshots", sent)
+		}
+		if err == nil {
+			backoff.reset()
+			nextAttempt = time.Time{}
+			continue
+		}
+
+		delay := backoff.next()
+		if wait := retryAfter(err); wait > delay {
+			// Spread agents told to wait the same time
+			delay = wait + jitter(wait/10)
+		}
+		log.Printf("Telemetry replay failed, retrying in %v (%d snapshots pending): %v", delay.Round(time.Second), s.Len(), err)
+		nextAttempt = time.Now().Add(delay)
+		timer.Reset(delay)
+	}
+}
+
+// drain sends spooled snapshots in order, removing each one after it has been
+// accepted. It stops at the first delivery error.
+func (s *Spool) drain(ctx context.Context, send func(TelemetryData) error) (int, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		jsonData, err := os.ReadFile(entry.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // Pruned while we were draining
+			}
+			return sent, fmt.Errorf("failed to read spooled telemetry: %w", err)
+		}
+
+		var data TelemetryData
+		if err := json.Unmarshal(jsonData, &data); err != nil {
+			log.Printf("Discarding corrupt spooled telemetry %s: %v", filepath.Base(entry.path), err)
+			os.Remove(entry.path)
+			continue
+		}
+		data.Replayed = true
+
+		if err := send(data); err != nil {
+			var statusErr *statusError
+			if !errors.As(err, &statusErr) || !statusErr.isPermanent() {
+				return sent, err
+			}
+			log.Printf("Discarding spooled telemetry %s rejected by server: %v", filepath.Base(entry.path), err)
+			os.Remove(entry.path)
+			continue
+		}
+
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return sent, fmt.Errorf("failed to remove replayed telemetry: %w", err)
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// prune enforces the age and size caps, dropping the oldest snapshots first.
+func (s *Spool) prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	cutoff := time.Now().Add(-s.maxAge)
+	dropped := 0
+	for _, entry := range entries {
+		if !entry.timestamp.Before(cutoff) && total <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to prune spooled telemetry: %w", err)
+		}
+		total -= entry.size
+		dropped++
+	}
+
+	if dropped > 0 {
+		log.Printf("Dropped %d spooled telemetry snapshots exceeding spool limits", dropped)
+	}
+
+	return nil
+}
+
+// entries lists spooled snapshots sorted oldest first.
+func (s *Spool) entries() ([]spoolEntry, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var entries []spoolEntry
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || strings.HasPrefix(name, spoolTempPrefix) || !strings.HasSuffix(name, spoolFileExt) {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, spoolEntry{
+			path:      filepath.Join(s.dir, name),
+			timestamp: time.Unix(0, nanos),
+			size:      info.Size(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	return entries, nil
+}
+
+// writeFileAtomic writes data to a temp file in the target directory, syncs it
+// and renames it into place, then syncs the directory so the rename survives
+// a power loss.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, spoolTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// defaultSpoolDir returns the per-user cache location for the spool.
+func defaultSpoolDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "spool")
+}
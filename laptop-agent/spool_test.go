@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry.json")
+
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("writeFileAtomic() error = %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("file holds %q, want %q", got, content)
+		}
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(dir, spoolTempPrefix+"*"))
+	if len(leftovers) != 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
+
+func TestNewSpoolRemovesTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, spoolTempPrefix+"123")
+	if err := os.WriteFile(tmp, []byte("half written"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSpool(dir, defaultSpoolMaxBytes, defaultSpoolMaxAge); err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temp file %s kept, want it removed", tmp)
+	}
+}
+
+func TestSpoolReplaysInCollectionOrder(t *testing.T) {
+	s, err := NewSpool(t.TempDir(), defaultSpoolMaxBytes, defaultSpoolMaxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now().Truncate(time.Second)
+	for _, offset := range []time.Duration{2 * time.Minute, 0, time.Minute} {
+		if err := s.Enqueue(TelemetryData{Timestamp: base.Add(offset)}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+
+	var replayed []TelemetryData
+	sent, err := s.drain(context.Background(), func(data TelemetryData) error {
+		replayed = append(replayed, data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("drain() error = %v", err)
+	}
+	if sent != 3 || len(replayed) != 3 {
+		t.Fatalf("drain() sent %d, want 3", sent)
+	}
+	for i, want := range []time.Duration{0, time.Minute, 2 * time.Minute} {
+		if !replayed[i].Timestamp.Equal(base.Add(want)) {
+			t.Errorf("snapshot %d has timestamp %v, want %v", i, replayed[i].Timestamp, base.Add(want))
+		}
+		if !replayed[i].Replayed {
+			t.Errorf("snapshot %d not marked replayed", i)
+		}
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len() = %d after drain, want 0", n)
+	}
+}
+
+func TestSpoolDrainFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantErr   bool
+		remaining int
+	}{
+		{"bad request discarded", &statusError{StatusCode: http.StatusBadRequest}, false, 0},
+		{"unprocessable discarded", &statusError{StatusCode: http.StatusUnprocessableEntity}, false, 0},
+		{"unauthorized kept", &statusError{StatusCode: http.StatusUnauthorized}, true, 2},
+		{"too many requests kept", &statusError{StatusCode: http.StatusTooManyRequests}, true, 2},
+		{"server error kept", &statusError{StatusCode: http.StatusServiceUnavailable}, true, 2},
+		{"network error kept", errors.New("connection refused"), true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSpool(t.TempDir(), defaultSpoolMaxBytes, defaultSpoolMaxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := time.Now().Truncate(time.Second)
+			for i := range 2 {
+				if err := s.Enqueue(TelemetryData{Timestamp: base.Add(time.Duration(i) * time.Second)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sent, err := s.drain(context.Background(), func(TelemetryData) error { return tt.err })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("drain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sent != 0 {
+				t.Errorf("drain() sent %d, want 0", sent)
+			}
+			if n := s.Len(); n != tt.remaining {
+				t.Errorf("Len() = %d, want %d", n, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestSpoolDiscardsCorruptEntries(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, defaultSpoolMaxBytes, defaultSpoolMaxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001-000001"+spoolFileExt), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := s.drain(context.Background(), func(TelemetryData) error { return nil })
+	if err != nil || sent != 0 {
+		t.Errorf("drain() = %d, %v, want 0, nil", sent, err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len() = %d, want the corrupt entry removed", n)
+	}
+}
+
+func TestSpoolPrune(t *testing.T) {
+	// Every entry marshals to the same size, as their timestamps differ only
+	// in whole seconds
+	probe, err := NewSpool(t.TempDir(), defaultSpoolMaxBytes, defaultSpoolMaxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := probe.Enqueue(TelemetryData{Timestamp: time.Now().Truncate(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := probe.entries()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("entries() = %v, %v", entries, err)
+	}
+	entrySize := entries[0].size
+
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxAge   time.Duration
+		offsets  []time.Duration
+		want     []time.Duration
+	}{
+		{
+			name:     "within limits",
+			maxBytes: defaultSpoolMaxBytes,
+			maxAge:   time.Hour,
+			offsets:  []time.Duration{-3 * time.Second, -2 * time.Second, -time.Second},
+			want:     []time.Duration{-3 * time.Second, -2 * time.Second, -time.Second},
+		},
+		{
+			name:     "older than max age",
+			maxBytes: defaultSpoolMaxBytes,
+			maxAge:   time.Hour,
+			offsets:  []time.Duration{-2 * time.Hour, -90 * time.Minute, -time.Second},
+			want:     []time.Duration{-time.Second},
+		},
+		{
+			name:     "over max bytes drops the oldest",
+			maxBytes: 2*entrySize + entrySize/2,
+			maxAge:   time.Hour,
+			offsets:  []time.Duration{-time.Second, -3 * time.Second, -2 * time.Second},
+			want:     []time.Duration{-2 * time.Second, -time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSpool(t.TempDir(), tt.maxBytes, tt.maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, offset := range tt.offsets {
+				if err := s.Enqueue(TelemetryData{Timestamp: now.Add(offset)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entries, err := s.entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("%d entries kept, want %d", len(entries), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !entries[i].timestamp.Equal(now.Add(want)) {
+					t.Errorf("entry %d has timestamp %v, want %v", i, entries[i].timestamp, now.Add(want))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// agentStatus is what the running agent last did, saved after every
+// collection for the status command to read
+type agentStatus struct {
+	PID               int               `json:"pid"`
+	StartedAt         time.Time         `json:"started_at"`
+	Output            string            `json:"output"`
+	Endpoint          string            `json:"endpoint,omitempty"`
+	IntervalSeconds   int               `json:"collection_interval_seconds"`
+	PolicyIssuedAt    *time.Time        `json:"policy_issued_at,omitempty"`
+	PolicyGroup       string            `json:"policy_group,omitempty"`
+	LastCollectionAt  *time.Time        `json:"last_collection_at,omitempty"`
+	LastSequence      uint64            `json:"last_sequence"`
+	LastSnapshotType  string            `json:"last_snapshot_type,omitempty"`
+	LastSuccessAt     *time.Time        `json:"last_success_at,omitempty"`
+	LastError         string            `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time        `json:"last_error_at,omitempty"`
+	CollectionErrors  []CollectionError `json:"collection_errors,omitempty"`
+	Collectors        []CollectorStatus `json:"collectors,omitempty"`
+	ContainerRuntimes []RuntimeEndpoint `json:"container_runtimes"`
+
+	path string
+	mu   sync.Mutex // the spool replays concurrently with collections
+}
+
+func newAgentStatus(config Config) *agentStatus {
+	status := &agentStatus{
+		PID:             os.Getpid(),
+		StartedAt:       time.Now(),
+		Output:          config.Output,
+		IntervalSeconds: int(config.CollectionInterval / time.Second),
+		path:            config.StatusPath,
+	}
+	if config.Output == outputAPI {
+		status.Endpoint = config.APIEndpoint
+	}
+	return status
+}
+
+// recordCollection notes a collection and the container runtimes it reached
+func (s *agentStatus) recordCollection(telemetry TelemetryData, runtimes []RuntimeEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collectedAt := telemetry.Timestamp
+	s.LastCollectionAt = &collectedAt
+	s.LastSequence = telemetry.Sequence
+	s.LastSnapshotType = telemetry.SnapshotType
+	s.CollectionErrors = telemetry.CollectionErrors
+	s.Collectors = telemetry.Collectors
+	s.ContainerRuntimes = runtimes
+}
+
+// recordDelivery notes whether telemetry reached the backend
+func (s *agentStatus) recordDelivery(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if err != nil {
+		s.LastError = err.Error()
+		s.LastErrorAt = &now
+	} else {
+		s.LastSuccessAt = &now
+	}
+}
+
+// recordInterval notes a change of the collection interval
+func (s *agentStatus) recordInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.IntervalSeconds = int(interval / time.Second)
+}
+
+// recordPolicy notes the policy in effect
+func (s *agentStatus) recordPolicy(policy *agentPolicy) {
+	if policy == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issuedAt := policy.IssuedAt
+	s.PolicyIssuedAt = &issuedAt
+	s.PolicyGroup = policy.Group
+}
+
+// save persists the status; failing to is logged but never stops the agent
+func (s *agentStatus) save() {
+	s.mu.Lock()
+	jsonData, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Error saving agent status: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		log.Printf("Error saving agent status: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, jsonData); err != nil {
+		log.Printf("Error saving agent status: %v", err)
+	}
+}
+
+// readAgentStatus reads the status the agent saved at path, or returns nil
+// if it has never saved one
+func readAgentStatus(path string) (*agentStatus, error) {
+	jsonData, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent status: %w", err)
+	}
+
+	status := &agentStatus{path: path}
+	if err := json.Unmarshal(jsonData, status); err != nil {
+		return nil, fmt.Errorf("failed to parse agent status: %w", err)
+	}
+	return status, nil
+}
+
+func defaultStatusPath() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "smartsec-agent", "status.json")
+}
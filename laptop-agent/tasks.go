@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+const (
+	defaultTaskPollInterval = 30 * time.Second
+
+	// defaultTaskTimeout applies to tasks queued without a timeout;
+	// maxTaskTimeout caps the timeout a task may ask for
+	defaultTaskTimeout = 60 * time.Second
+	maxTaskTimeout     = 5 * time.Minute
+
+	// maxTaskOutput caps the result sent back for one task; larger results are
+	// cut and flagged as truncated
+	maxTaskOutput = 256 * 1024
+
+	// maxDirectoryEntries caps the entries a list_directory task returns
+	maxDirectoryEntries = 1000
+)
+
+// Task types the agent runs. Anything else is refused.
+const (
+	TaskCollectNow       = "collect_now"
+	TaskHashFile         = "hash_file"
+	TaskListDirectory    = "list_directory"
+	TaskContainerInspect = "container_inspect"
+)
+
+// Task is work queued for this device by the telemetry service
+type Task struct {
+	ID             string            `json:"id"`
+	Type           string            `json:"type"`
+	Parameters     map[string]string `json:"parameters"`
+	TimeoutSeconds int               `json:"timeout_seconds"`
+}
+
+// TaskResult reports the outcome of a task
+type TaskResult struct {
+	Status          string          `json:"status"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	OutputTruncated bool            `json:"output_truncated"`
+}
+
+const (
+	TaskStatusCompleted = "completed"
+	TaskStatusFailed    = "failed"
+)
+
+// taskHandler runs one type of task and returns its result
+type taskHandler func(ctx context.Context, params map[string]string) (any, error)
+
+// taskRunner polls the telemetry service for tasks and runs them one at a
+// time. Only the task types in handlers can run; none of them change the
+// host. Results are redacted like command lines before they are sent.
+type taskRunner struct {
+	endpoint   string
+	interval   time.Duration
+	collectNow chan<- struct{}
+	client     *apiClient
+	redactor   *redactor
+	handlers   map[string]taskHandler
+}
+
+func newTaskRunner(client *apiClient, redactor *redactor, endpoint string, interval time.Duration, collectNow chan<- struct{}) *taskRunner {
+	r := &taskRunner{
+		endpoint:   endpoint,
+		interval:   interval,
+		collectNow: collectNow,
+		client:     client,
+		redactor:   redactor,
+	}
+	r.handlers = map[string]taskHandler{
+		TaskCollectNow:       r.runCollectNow,
+		TaskHashFile:         runHashFile,
+		TaskListDirectory:    runListDirectory,
+		TaskContainerInspect: r.runContainerInspect,
+	}
+	return r
+}
+
+// Run polls for tasks until ctx is done. The first poll comes at a random
+// point of the first interval, so agents started together poll apart, and
+// polls wait out any Retry-After the service sends. The service only hands
+// tasks to enrolled devices, so nothing is polled until this one enrolls.
+func (r *taskRunner) Run(ctx context.Context) {
+	timer := time.NewTimer(jitter(r.interval))
+	defer timer.Stop()
+
+	warned := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		delay := r.interval
+		credential, err := r.client.credential(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Error polling for tasks: %v", err)
+		case credential == "":
+			if !warned {
+				log.Printf("Tasks are only served to enrolled devices; set ENROLLMENT_TOKEN to enroll")
+				warned = true
+			}
+		default:
+			tasks, err := r.poll(ctx)
+			if err != nil {
+				log.Printf("Error polling for tasks: %v", err)
+				delay = max(delay, retryAfter(err))
+			}
+			for _, task := range tasks {
+				r.report(ctx, task, r.run(ctx, task))
+			}
+		}
+		timer.Reset(delay)
+	}
+}
+
+// poll claims the tasks queued for this device
+func (r *taskRunner) poll(ctx context.Context) ([]Task, error) {
+	var response struct {
+		Tasks []Task `json:"tasks"`
+	}
+	if err := r.client.post(ctx, r.endpoint+"/poll", struct{}{}, &response); err != nil {
+		return nil, err
+	}
+	return response.Tasks, nil
+}
+
+// run executes a task under its timeout and caps its output
+func (r *taskRunner) run(ctx context.Context, task Task) TaskResult {
+	handler, allowed := r.handlers[task.Type]
+	if !allowed {
+		log.Printf("Refusing task %s: %s is not an allowed task type", task.ID, task.Type)
+		return TaskResult{Status: TaskStatusFailed, Error: fmt.Sprintf("task type %q is not allowed", task.Type)}
+	}
+
+	timeout := defaultTaskTimeout
+	if task.TimeoutSeconds > 0 {
+		timeout = min(time.Duration(task.TimeoutSeconds)*time.Second, maxTaskTimeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Printf("Running task %s (%s)", task.ID, task.Type)
+	output, err := handler(ctx, task.Parameters)
+	if err != nil {
+		log.Printf("Task %s failed: %v", task.ID, err)
+		return TaskResult{Status: TaskStatusFailed, Error: truncateString(r.redactor.RedactText(err.Error()), 1024)}
+	}
+
+	data, err := json.Marshal(output)
+	if err == nil {
+		data, err = r.redactor.RedactJSON(data)
+	}
+	if err != nil {
+		return TaskResult{Status: TaskStatusFailed, Error: fmt.Sprintf("failed to marshal result: %v", err)}
+	}
+
+	result := TaskResult{Status: TaskStatusCompleted, Result: data}
+	if len(data) > maxTaskOutput {
+		// Cut JSON is no longer JSON, so send the prefix as a string
+		result.Result, _ = json.Marshal(map[string]string{"output": string(data[:maxTaskOutput])})
+		result.OutputTruncated = true
+	}
+	return result
+}
+
+// report sends a task's result back to the telemetry service
+func (r *taskRunner) report(ctx context.Context, task Task, result TaskResult) {
+	if err := r.client.post(ctx, r.endpoint+"/"+url.PathEscape(task.ID)+"/result", result, nil); err != nil {
+		log.Printf("Error reporting result of task %s: %v", task.ID, err)
+		return
+	}
+	log.Printf("Task %s %s", task.ID, result.Status)
+}
+
+// runCollectNow asks the main loop for a collection right away. A request
+// made while another is still waiting is folded into it.
+func (r *taskRunner) runCollectNow(ctx context.Context, params map[string]string) (any, error) {
+	select {
+	case r.collectNow <- struct{}{}:
+		return map[string]bool{"queued": true, "coalesced": false}, nil
+	default:
+		return map[string]bool{"queued": true, "coalesced": true}, nil
+	}
+}
+
+// runHashFile hashes one regular file
+func runHashFile(ctx context.Context, params map[string]string) (any, error) {
+	path, err := taskPath(params)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	state := FileState{
+		Size:       info.Size(),
+		Mode:       fileModeString(info.Mode()),
+		ModifiedAt: info.ModTime().UTC(),
+	}
+	if uid, gid, ok := statOwner(info); ok {
+		state.UID, state.GID = &uid, &gid
+	}
+	if state.SHA256, err = getFileSHA256(ctx, path); err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", path, err)
+	}
+
+	return struct {
+		Path string `json:"path"`
+		FileState
+	}{path, state}, nil
+}
+
+// directoryEntry is one entry of a list_directory result
+type directoryEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	FileState
+}
+
+// runListDirectory lists a directory's entries without following symlinks or
+// hashing anything, up to maxDirectoryEntries
+func runListDirectory(ctx context.Context, params map[string]string) (any, error) {
+	path, err := taskPath(params)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := len(entries) > maxDirectoryEntries
+	if truncated {
+		entries = entries[:maxDirectoryEntries]
+	}
+
+	listed := make([]directoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Removed since the listing
+		}
+
+		item := directoryEntry{
+			Name: entry.Name(),
+			Type: directoryEntryType(info.Mode()),
+			FileState: FileState{
+				Size:       info.Size(),
+				Mode:       fileModeString(info.Mode()),
+				ModifiedAt: info.ModTime().UTC(),
+			},
+		}
+		if uid, gid, ok := statOwner(info); ok {
+			item.UID, item.GID = &uid, &gid
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			item.LinkTarget, _ = os.Readlink(filepath.Join(path, entry.Name()))
+		}
+		listed = append(listed, item)
+	}
+
+	return struct {
+		Path      string           `json:"path"`
+		Entries   []directoryEntry `json:"entries"`
+		Truncated bool             `json:"truncated"`
+	}{path, listed, truncated}, nil
+}
+
+func directoryEntryType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "other"
+}
+
+// taskPath returns the absolute, cleaned path parameter of a task
+func taskPath(params map[string]string) (string, error) {
+	path := params["path"]
+	if !filepath.IsAbs(path) {
+		return "", errors.New("path parameter must be an absolute path")
+	}
+	return filepath.Clean(path), nil
+}
+
+// runContainerInspect returns the runtime's inspect output for a container,
+// trying the Docker and Podman APIs and then containerd, with its secrets
+// removed
+func (r *taskRunner) runContainerInspect(ctx context.Context, params map[string]string) (any, error) {
+	raw, err := inspectContainer(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return r.redactInspect(raw)
+}
+
+// redactInspect masks every environment variable's value in inspect output,
+// since any of them may hold a secret, and redacts argument lists as command
+// lines. Docker names these Env, Cmd, Entrypoint and Args, containerd env
+// and args.
+func (r *taskRunner) redactInspect(raw []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("failed to parse inspect output: %w", err)
+	}
+
+	var walk func(value any)
+	walk = func(value any) {
+		switch v := value.(type) {
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]any:
+			for key, item := range v {
+				list, isList := item.([]any)
+				switch strings.ToLower(key) {
+				case "env":
+					if isList {
+						for i, entry := range list {
+							if s, ok := entry.(string); ok {
+								name, _, _ := strings.Cut(s, "=")
+								list[i] = name + "=" + redactedText
+							}
+						}
+						continue
+					}
+				case "args", "cmd", "entrypoint":
+					if args, ok := stringList(list); isList && ok {
+						args, _ = r.redactor.Redact(args)
+						for i, arg := range args {
+							list[i] = arg
+						}
+						continue
+					}
+				}
+				walk(item)
+			}
+		}
+	}
+	walk(document)
+	return document, nil
+}
+
+// stringList returns list as strings, if it holds nothing else
+func stringList(list []any) ([]string, bool) {
+	strs := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		strs[i] = s
+	}
+	return strs, true
+}
+
+// inspectContainer returns the raw inspect output of the container a task
+// names
+func inspectContainer(ctx context.Context, params map[string]string) ([]byte, error) {
+	id := params["id"]
+	if id == "" || strings.HasPrefix(id, "-") {
+		return nil, errors.New("id parameter must be a container ID or name")
+	}
+
+	for _, endpoint := range append(dockerEndpoints(), podmanEndpoints()...) {
+		cli, err := client.NewClientWithOpts(endpoint.opts...)
+		if err != nil {
+			continue
+		}
+		_, raw, err := cli.ContainerInspectWithRaw(ctx, id, false)
+		cli.Close()
+		if err == nil {
+			return raw, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	if raw, err := inspectContainerdContainer(ctx, id, params["namespace"]); err == nil {
+		return raw, nil
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return nil, fmt.Errorf("container %s not found in any runtime", id)
+}
+
+// inspectContainerdContainer returns "ctr containers info" for a container in
+// namespace, or in every namespace when it is empty
+func inspectContainerdContainer(ctx context.Context, id, namespace string) ([]byte, error) {
+	for _, address := range containerdAddresses {
+		namespaces := []string{namespace}
+		if namespace == "" {
+			output, err := runCtr(ctx, address, "namespaces", "list", "--quiet")
+			if err != nil {
+				continue
+			}
+			namespaces = strings.Fields(string(output))
+			sort.Strings(namespaces)
+		}
+
+		for _, ns := range namespaces {
+			if output, err := runCtr(ctx, address, "--namespace", ns, "containers", "info", id); err == nil {
+				return output, nil
+			}
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+// defaultTasksEndpoint derives the task endpoint from the telemetry endpoint,
+// e.g. http://host/api/telemetry becomes http://host/api/agent/tasks
+func defaultTasksEndpoint(apiEndpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(apiEndpoint, "/"), "/telemetry") + "/agent/tasks"
+}
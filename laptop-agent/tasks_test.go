@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRedactInspect(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "docker env values",
+			raw:  `{"Config":{"Env":["PATH=/usr/bin","DB_URL=postgres://app:pw@db/app","EMPTY"]}}`,
+			want: `{"Config":{"Env":["PATH=[REDACTED]","DB_URL=[REDACTED]","EMPTY=[REDACTED]"]}}`,
+		},
+		{
+			name: "containerd env values",
+			raw:  `{"Spec":{"process":{"env":["TOKEN=abc"],"args":["sh"]}}}`,
+			want: `{"Spec":{"process":{"args":["sh"],"env":["TOKEN=[REDACTED]"]}}}`,
+		},
+		{
+			name: "flag and value as two arguments",
+			raw:  `{"Path":"mysql","Args":["--password","hunter2","--user","app"]}`,
+			want: `{"Args":["--password","[REDACTED]","--user","app"],"Path":"mysql"}`,
+		},
+		{
+			name: "short token after a flag",
+			raw:  `{"Config":{"Cmd":["tool","--token","ghp_short"]}}`,
+			want: `{"Config":{"Cmd":["tool","--token","[REDACTED]"]}}`,
+		},
+		{
+			name: "flag followed by another flag",
+			raw:  `{"Config":{"Entrypoint":["app","--api-key","--verbose"]}}`,
+			want: `{"Config":{"Entrypoint":["app","--api-key","--verbose"]}}`,
+		},
+		{
+			name: "flag and value as one argument",
+			raw:  `{"Args":["--password=hunter2"]}`,
+			want: `{"Args":["--password=[REDACTED]"]}`,
+		},
+		{
+			name: "other fields and large numbers kept",
+			raw:  `{"Id":"abc","SizeRw":12345678901234567890,"Args":null}`,
+			want: `{"Args":null,"Id":"abc","SizeRw":12345678901234567890}`,
+		},
+	}
+
+	r := &taskRunner{redactor: newRedactor(nil)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document, err := r.redactInspect([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("redactInspect() error = %v", err)
+			}
+			got, err := json.Marshal(document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("redactInspect() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactInspectInvalid(t *testing.T) {
+	r := &taskRunner{redactor: newRedactor(nil)}
+	if _, err := r.redactInspect([]byte("not json")); err == nil {
+		t.Error("redactInspect() error = nil, want an error")
+	}
+}
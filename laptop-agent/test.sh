@@ -3,15 +3,19 @@
 # Test script to verify the agent works
 echo "Testing SmartSec Laptop Agent..."
 
-# Set test environment variables for log-only mode
-export LOG_ONLY="true"
 export COLLECTION_INTERVAL="5"
 
 echo "Building agent..."
 go build -o laptop-agent .
 
+echo "Checking configuration and connectivity..."
+./laptop-agent check
+
+echo "Collecting telemetry once..."
+./laptop-agent collect --once --output telemetry-test.json && echo "Telemetry written to telemetry-test.json"
+
 echo "Running agent in log-only mode for 15 seconds..."
-./laptop-agent &
+./laptop-agent run --output log &
 AGENT_PID=$!
 sleep 15
 kill $AGENT_PID 2>/dev/null
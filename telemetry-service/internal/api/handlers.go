@@ -1,11 +1,21 @@
 package api
 
 import (
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog/log"
 
 	"telemetry-service/internal/models"
@@ -16,20 +26,49 @@ var validate = validator.New()
 
 type TelemetryHandler struct {
 	service *service.TelemetryService
+
+	// collectionInterval is recommended to agents in telemetry responses
+	collectionInterval time.Duration
 }
 
 func NewTelemetryHandler(service *service.TelemetryService) *TelemetryHandler {
 	return &TelemetryHandler{service: service}
 }
 
-func SetupRoutes(router *gin.Engine, service *service.TelemetryService) {
+// RouteOptions configures how the API treats agents
+type RouteOptions struct {
+	// CertificateRequired, set when the service verifies client
+	// certificates, makes agents authenticate with one for everything but
+	// enrolling and obtaining their first certificate
+	CertificateRequired bool
+
+	// CollectionInterval is recommended to agents in telemetry responses,
+	// unless 0
+	CollectionInterval time.Duration
+
+	// MaxConcurrentIngestion bounds the telemetry requests handled at once,
+	// unless 0; requests beyond it are told to retry after RetryAfter
+	MaxConcurrentIngestion int
+	RetryAfter             time.Duration
+
+	// AdminToken is the bearer token of the endpoints that change what
+	// agents do or read what tasks found; without one they are refused
+	AdminToken string
+}
+
+// SetupRoutes registers the API
+func SetupRoutes(router *gin.Engine, service *service.TelemetryService, options RouteOptions) {
 	handler := NewTelemetryHandler(service)
+	handler.collectionInterval = options.CollectionInterval
+	agentAuth := handler.authenticateAgent(options.CertificateRequired)
+	adminAuth := authenticateAdmin(options.AdminToken)
+	ingestionLimit := limitConcurrency(options.MaxConcurrentIngestion, options.RetryAfter)
 
 	api := router.Group("/api")
 	{
 		telemetry := api.Group("/telemetry")
 		{
-			telemetry.POST("", handler.PostTelemetry)
+			telemetry.POST("", ingestionLimit, agentAuth, handler.PostTelemetry)
 			telemetry.GET("", handler.GetTelemetry)
 		}
 
@@ -38,10 +77,56 @@ func SetupRoutes(router *gin.Engine, service *service.TelemetryService) {
 			devices.GET("", handler.GetDevices)
 			devices.GET("/:id", handler.GetDevice)
 			devices.GET("/:id/processes", handler.GetProcesses)
+			devices.GET("/:id/processes/tree", handler.GetProcessTree)
 			devices.GET("/:id/containers", handler.GetContainers)
+			devices.GET("/:id/containers/timeline", handler.GetContainerTimeline)
+			devices.GET("/:id/connections", handler.GetConnections)
+			devices.GET("/:id/files/changes", handler.GetFileChanges)
+			devices.GET("/:id/metrics", handler.GetMetrics)
+			devices.GET("/:id/sessions", handler.GetSessions)
+			devices.GET("/:id/persistence", handler.GetPersistenceItems)
+			devices.GET("/:id/auth-events", handler.GetAuthEvents)
+			devices.GET("/:id/packages", handler.GetPackages)
+			devices.GET("/:id/packages/history", handler.GetPackageHistory)
 			devices.GET("/:id/threats", handler.GetThreatFindings)
+			devices.POST("/:id/tasks", adminAuth, handler.CreateTask)
+			devices.GET("/:id/tasks", adminAuth, handler.GetTasks)
+			devices.GET("/:id/tasks/:task_id", adminAuth, handler.GetTask)
+			devices.PUT("/:id/policy-group", adminAuth, handler.SetDevicePolicyGroup)
+		}
+
+		// Agents enroll once with a bootstrap token, then poll for their
+		// tasks and report the results; only enrolled agents get tasks
+		agent := api.Group("/agent")
+		{
+			agent.POST("/enroll", handler.Enroll)
+			agent.POST("/certificate", handler.authenticateAgent(false), handler.IssueCertificate)
+			agent.POST("/tasks/poll", agentAuth, requireEnrolledAgent, handler.PollTasks)
+			agent.POST("/tasks/:task_id/result", agentAuth, requireEnrolledAgent, handler.PostTaskResult)
+		}
+
+		// Agents fetch the signed policy of their device; administrators
+		// set the policies, by default, group or device
+		api.GET("/agents/policy", agentAuth, handler.GetAgentPolicy)
+		policies := api.Group("/policies", adminAuth)
+		{
+			policies.PUT("", handler.SetAgentPolicy)
+			policies.GET("", handler.GetAgentPolicies)
+			policies.DELETE("/:id", handler.DeleteAgentPolicy)
 		}
 
+		// Bootstrap tokens let anyone holding one enroll a device, so only
+		// administrators create them
+		enrollmentTokens := api.Group("/enrollment-tokens", adminAuth)
+		{
+			enrollmentTokens.POST("", handler.CreateEnrollmentToken)
+			enrollmentTokens.GET("", handler.GetEnrollmentTokens)
+			enrollmentTokens.DELETE("/:id", handler.RevokeEnrollmentToken)
+		}
+
+		api.GET("/software", handler.SearchSoftware)
+		api.GET("/containers", handler.SearchContainers)
+
 		threats := api.Group("/threats")
 		{
 			threats.GET("", handler.GetThreatsBySeverity)
@@ -50,42 +135,360 @@ func SetupRoutes(router *gin.Engine, service *service.TelemetryService) {
 	}
 }
 
+const (
+	// maxTelemetryBodySize bounds a telemetry request, or one chunk of it,
+	// after decompression
+	maxTelemetryBodySize = 64 * 1024 * 1024
+
+	// maxCompressedBodySize bounds a compressed telemetry request as sent
+	maxCompressedBodySize = 32 * 1024 * 1024
+
+	// chunkStagingRetryAfter is how long an agent is asked to wait when its
+	// device has as many chunks staged as it may
+	chunkStagingRetryAfter = 5 * time.Minute
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBodyTooLarge        = errors.New("request body too large")
+)
+
+// PostTelemetry ingests a snapshot. The body may be compressed with gzip or
+// zstd, as the Content-Encoding header says. A snapshot too large for one
+// request comes as chunks of its JSON with X-Snapshot-ID, X-Chunk-Index and
+// X-Chunk-Count headers; each chunk is acknowledged with 202 and the last one
+// is answered as the whole snapshot would be.
 func (h *TelemetryHandler) PostTelemetry(c *gin.Context) {
-	var req models.TelemetryRequest
+	body, err := readTelemetryBody(c)
+	if err != nil {
+		log.Error().Err(err).Str("content_encoding", c.GetHeader("Content-Encoding")).Msg("Failed to read telemetry request")
+		switch {
+		case errors.Is(err, errUnsupportedEncoding):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported Content-Encoding; use gzip or zstd"})
+		case errors.Is(err, errBodyTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Telemetry too large; send it in chunks"})
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		}
+		return
+	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
+	var req *models.TelemetryRequest
+	deviceID := c.GetString(agentDeviceKey)
+	if snapshotID := c.GetHeader("X-Snapshot-ID"); snapshotID != "" {
+		chunk := &models.TelemetryChunk{SnapshotID: snapshotID, DeviceID: deviceID, Data: body}
+		chunk.Index, err = strconv.Atoi(c.GetHeader("X-Chunk-Index"))
+		if err == nil {
+			chunk.Count, err = strconv.Atoi(c.GetHeader("X-Chunk-Count"))
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "X-Chunk-Index and X-Chunk-Count must be numbers"})
+			return
+		}
+
+		// The snapshot is decoded and ingested with its chunks taken, in one
+		// transaction
+		req, err = h.service.AddTelemetryChunk(chunk, func(snapshot []byte) (*models.TelemetryRequest, error) {
+			log.Debug().
+				Str("snapshot_id", chunk.SnapshotID).
+				Int("chunks", chunk.Count).
+				Int("bytes", len(snapshot)).
+				Msg("Telemetry chunks reassembled")
+			return decodeTelemetryRequest(snapshot)
+		})
+		if errors.Is(err, service.ErrInvalidChunk) {
+			log.Warn().Err(err).Str("device_id", deviceID).Msg("Rejecting telemetry chunk")
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, service.ErrChunkStagingFull) {
+			log.Warn().Str("device_id", deviceID).Str("client_ip", c.ClientIP()).Msg("Too many telemetry chunks staged, asking agent to retry later")
+			c.Header("Retry-After", strconv.Itoa(int(chunkStagingRetryAfter/time.Second)))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many telemetry chunks staged; retry later"})
+			return
+		}
+		if err == nil && req == nil {
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":     "Telemetry chunk received",
+				"snapshot_id": chunk.SnapshotID,
+				"chunk_index": chunk.Index,
+			})
+			return
+		}
+	} else {
+		req, err = decodeTelemetryRequest(body)
+		if err == nil {
+			err = h.service.ProcessTelemetry(deviceID, req)
+		}
+	}
+
+	var validationErrs validator.ValidationErrors
+	if errors.Is(err, errInvalidTelemetry) {
 		log.Error().Err(err).Msg("Failed to bind telemetry request")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
-
-	if err := validate.Struct(&req); err != nil {
+	if errors.As(err, &validationErrs) {
 		log.Error().Err(err).Msg("Failed to validate telemetry request")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": validationErrs.Error()})
+		return
+	}
+	if errors.Is(err, service.ErrSnapshotExpired) {
+		// Acknowledge so the agent drops it from its spool
+		log.Warn().
+			Str("mac_address", req.MacAddress).
+			Time("timestamp", req.Timestamp).
+			Msg("Ignoring telemetry older than retention window")
+		c.JSON(http.StatusOK, gin.H{"message": "Telemetry older than retention window ignored"})
+		return
+	}
+	var resyncErr *service.ResyncRequiredError
+	if errors.As(err, &resyncErr) {
+		log.Warn().
+			Str("mac_address", req.MacAddress).
+			Uint64("expected_sequence", resyncErr.Expected).
+			Uint64("received_sequence", resyncErr.Received).
+			Msg("Telemetry sequence gap, requesting full resync")
+		c.JSON(http.StatusConflict, gin.H{
+			"error":             "Telemetry sequence gap",
+			"resync_required":   true,
+			"expected_sequence": resyncErr.Expected,
+		})
+		return
+	}
+	if errors.Is(err, service.ErrSnapshotInFuture) {
+		log.Warn().
+			Str("mac_address", req.MacAddress).
+			Time("timestamp", req.Timestamp).
+			Msg("Rejecting telemetry with future timestamp")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Telemetry timestamp is in the future"})
+		return
+	}
+	if errors.Is(err, service.ErrUnredactedCmdline) {
+		log.Warn().
+			Str("mac_address", req.MacAddress).
+			Str("hostname", req.HostMetadata.Hostname).
+			Msg("Rejecting telemetry with unredacted command lines")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Command lines must be redacted by the agent; upgrade the agent"})
 		return
 	}
-
-	err := h.service.ProcessTelemetry(&req)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to process telemetry")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process telemetry"})
 		return
 	}
 
+	stats := telemetryStats(req)
+
 	log.Info().
+		Str("device_id", deviceID).
 		Str("mac_address", req.MacAddress).
 		Str("hostname", req.HostMetadata.Hostname).
-		Int("processes", len(req.Processes)).
-		Int("containers", len(req.Containers)).
+		Time("timestamp", req.Timestamp).
+		Bool("replayed", req.Replayed).
+		Str("snapshot_type", req.SnapshotType).
+		Uint64("sequence", req.Sequence).
+		Fields(map[string]interface{}(stats)).
 		Msg("Telemetry processed successfully")
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Telemetry processed successfully",
-		"stats": gin.H{
-			"processes":  len(req.Processes),
-			"containers": len(req.Containers),
-		},
-	})
+	response := gin.H{
+		"message":  "Telemetry processed successfully",
+		"sequence": req.Sequence,
+		"stats":    stats,
+	}
+	if h.collectionInterval > 0 {
+		response["collection_interval_seconds"] = int(h.collectionInterval / time.Second)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// errInvalidTelemetry is returned for a telemetry request that is not JSON
+var errInvalidTelemetry = errors.New("invalid telemetry request")
+
+// decodeTelemetryRequest parses and validates a telemetry request
+func decodeTelemetryRequest(body []byte) (*models.TelemetryRequest, error) {
+	var req models.TelemetryRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTelemetry, err)
+	}
+	if err := validate.Struct(&req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// limitConcurrency refuses requests beyond max at once with 503 and a
+// Retry-After header, so a fleet of agents backs off instead of queueing on
+// the database. A max of 0 lets every request through.
+func limitConcurrency(max int, retryAfter time.Duration) gin.HandlerFunc {
+	if max <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	slots := make(chan struct{}, max)
+	return func(c *gin.Context) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			c.Next()
+		default:
+			log.Warn().Str("client_ip", c.ClientIP()).Msg("Ingestion at capacity, asking agent to retry later")
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Telemetry service is at capacity; retry later"})
+		}
+	}
+}
+
+// readTelemetryBody reads a telemetry request, decompressing it as its
+// Content-Encoding says. Both the body as sent and as decompressed are
+// bounded, so a small body cannot expand without limit.
+func readTelemetryBody(c *gin.Context) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return readLimited(http.MaxBytesReader(c.Writer, c.Request.Body, maxTelemetryBodySize), maxTelemetryBodySize)
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxCompressedBodySize)
+	switch encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer reader.Close()
+		return readLimited(reader, maxTelemetryBodySize)
+	case "zstd":
+		reader, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxTelemetryBodySize))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		defer reader.Close()
+		return readLimited(reader, maxTelemetryBodySize)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// readLimited reads r to the end, failing with errBodyTooLarge beyond limit
+// bytes
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, errBodyTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// telemetryStats summarises what a telemetry request carried
+func telemetryStats(req *models.TelemetryRequest) gin.H {
+	var stats gin.H
+	if req.SnapshotType != models.SnapshotTypeDelta {
+		stats = gin.H{
+			"processes":   len(req.Processes),
+			"containers":  len(req.Containers),
+			"connections": len(req.Connections),
+		}
+	} else {
+		delta := req.Delta
+		if delta == nil {
+			delta = &models.TelemetryDelta{}
+		}
+
+		stats = gin.H{
+			"connections":        len(req.Connections),
+			"processes_started":  len(delta.ProcessesStarted),
+			"processes_exited":   len(delta.ProcessesExited),
+			"containers_created": len(delta.ContainersCreated),
+			"containers_updated": len(delta.ContainersUpdated),
+			"containers_removed": len(delta.ContainersRemoved),
+		}
+		if len(delta.PersistenceChanged) > 0 || len(delta.PersistenceRemoved) > 0 {
+			stats["persistence_changed"] = len(delta.PersistenceChanged)
+			stats["persistence_removed"] = len(delta.PersistenceRemoved)
+		}
+	}
+
+	// Agents only send the package inventory when it has changed
+	if req.Packages != nil {
+		stats["packages"] = len(req.Packages)
+	}
+	if len(req.Events) > 0 {
+		stats["events"] = len(req.Events)
+	}
+	if len(req.ContainerEvents) > 0 {
+		stats["container_events"] = len(req.ContainerEvents)
+	}
+	if len(req.FileChanges) > 0 {
+		stats["file_changes"] = len(req.FileChanges)
+	}
+	if req.Metrics != nil {
+		stats["metrics"] = true
+	}
+	if req.Sessions != nil {
+		stats["sessions"] = len(req.Sessions)
+	}
+	if req.Persistence != nil {
+		stats["persistence"] = len(req.Persistence)
+	}
+	if count := redactedByServer(req); count > 0 {
+		stats["cmdlines_redacted_by_server"] = count
+	}
+	if len(req.AuthEvents) > 0 {
+		stats["auth_events"] = len(req.AuthEvents)
+	}
+	if len(req.CollectionErrors) > 0 {
+		stats["collection_errors"] = len(req.CollectionErrors)
+	}
+	failed, skipped := 0, 0
+	for _, collector := range req.Collectors {
+		switch collector.Status {
+		case models.CollectorStatusFailed:
+			failed++
+		case models.CollectorStatusSkipped:
+			skipped++
+		}
+	}
+	if failed > 0 {
+		stats["collectors_failed"] = failed
+	}
+	if skipped > 0 {
+		stats["collectors_skipped"] = skipped
+	}
+	if req.Truncated {
+		stats["truncated"] = true
+	}
+	if req.HashCache != nil {
+		stats["hash_cache_hits"] = req.HashCache.Hits
+		stats["hash_cache_misses"] = req.HashCache.Misses
+	}
+
+	return stats
+}
+
+// redactedByServer counts the processes whose command line the agent sent
+// unredacted
+func redactedByServer(req *models.TelemetryRequest) int {
+	lists := [][]models.ProcessInfo{req.Processes}
+	if req.Delta != nil {
+		lists = append(lists, req.Delta.ProcessesStarted)
+	}
+
+	count := 0
+	for _, processes := range lists {
+		for _, process := range processes {
+			if process.Redaction != nil && process.Redaction.RedactedBy == models.RedactedByServer {
+				count++
+			}
+		}
+	}
+	return count
 }
 
 func (h *TelemetryHandler) GetTelemetry(c *gin.Context) {
@@ -212,6 +615,45 @@ func (h *TelemetryHandler) GetProcesses(c *gin.Context) {
 	})
 }
 
+func (h *TelemetryHandler) GetProcessTree(c *gin.Context) {
+	deviceID := c.Param("id")
+	processKey := c.Query("process_key")
+
+	var pid int32
+	if processKey == "" {
+		pidValue, err := strconv.ParseInt(c.Query("pid"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "process_key or pid parameter is required"})
+			return
+		}
+		pid = int32(pidValue)
+	}
+
+	at := time.Now()
+	if atValue := c.Query("at"); atValue != "" {
+		parsed, err := time.Parse(time.RFC3339, atValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		at = parsed
+	}
+
+	tree, err := h.service.GetProcessTree(deviceID, processKey, pid, at)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get process tree")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get process tree"})
+		return
+	}
+
+	if tree == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Process not found in snapshot"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tree)
+}
+
 func (h *TelemetryHandler) GetContainers(c *gin.Context) {
 	deviceID := c.Param("id")
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
@@ -230,77 +672,1063 @@ func (h *TelemetryHandler) GetContainers(c *gin.Context) {
 	})
 }
 
-func (h *TelemetryHandler) GetThreatFindings(c *gin.Context) {
+// GetContainerTimeline returns the container lifecycle events of a device
+// in the order they happened, by default over the last 24 hours
+func (h *TelemetryHandler) GetContainerTimeline(c *gin.Context) {
 	deviceID := c.Param("id")
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	containerID := c.Query("container_id")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "1000"))
 	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
 
-	threats, err := h.service.GetThreatFindings(deviceID, limit, offset)
+	to := time.Now()
+	if toValue := c.Query("to"); toValue != "" {
+		parsed, err := time.Parse(time.RFC3339, toValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if fromValue := c.Query("from"); fromValue != "" {
+		parsed, err := time.Parse(time.RFC3339, fromValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		from = parsed
+	}
+
+	events, err := h.service.GetContainerTimeline(deviceID, containerID, from, to, limit, offset)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to get threat findings")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get threat findings"})
+		log.Error().Err(err).Msg("Failed to get container timeline")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get container timeline"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"threats": threats,
-		"count":   len(threats),
+		"events": events,
+		"count":  len(events),
 	})
 }
 
-func (h *TelemetryHandler) GetThreatsBySeverity(c *gin.Context) {
-	severity := c.Query("severity")
-	if severity == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "severity parameter is required"})
+// GetFileChanges returns the file integrity changes of a device, most recent
+// first, by default over the last 24 hours
+func (h *TelemetryHandler) GetFileChanges(c *gin.Context) {
+	deviceID := c.Param("id")
+	path := c.Query("path")
+	action := c.Query("action")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	switch action {
+	case "", models.FileActionCreate, models.FileActionModify, models.FileActionDelete, models.FileActionChmod:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action parameter must be create, modify, delete or chmod"})
 		return
 	}
 
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	to := time.Now()
+	if toValue := c.Query("to"); toValue != "" {
+		parsed, err := time.Parse(time.RFC3339, toValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if fromValue := c.Query("from"); fromValue != "" {
+		parsed, err := time.Parse(time.RFC3339, fromValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		from = parsed
+	}
+
+	changes, err := h.service.GetFileChanges(deviceID, path, action, from, to, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get file changes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_changes": changes,
+		"count":        len(changes),
+	})
+}
+
+// GetPersistenceItems returns what a device runs automatically, most recently
+// changed first. Removed items are only included with include_removed=true.
+func (h *TelemetryHandler) GetPersistenceItems(c *gin.Context) {
+	deviceID := c.Param("id")
+	itemType := c.Query("type")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "500"))
 	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
 
-	threats, err := h.service.GetThreatFindingsBySeverity(severity, limit, offset)
+	switch itemType {
+	case "", models.PersistenceSystemdUnit, models.PersistenceCron, models.PersistenceAutostart, models.PersistenceShellRC,
+		models.PersistenceLDPreload, models.PersistenceKernelModule, models.PersistenceLaunchd:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type parameter must be systemd_unit, cron, autostart, shell_rc, ld_preload, kernel_module or launchd"})
+		return
+	}
+
+	includeRemoved, err := parseOptionalBool(c.Query("include_removed"))
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to get threats by severity")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get threats by severity"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "include_removed parameter must be true or false"})
+		return
+	}
+
+	items, err := h.service.GetPersistenceItems(deviceID, itemType, includeRemoved != nil && *includeRemoved, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get persistence items")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get persistence items"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"threats": threats,
-		"count":   len(threats),
+		"persistence": items,
+		"count":       len(items),
 	})
 }
 
-func (h *TelemetryHandler) CreateThreatFinding(c *gin.Context) {
-	var threat models.ThreatFinding
+// GetSessions returns the login sessions open on a device, by default now
+func (h *TelemetryHandler) GetSessions(c *gin.Context) {
+	deviceID := c.Param("id")
 
-	if err := c.ShouldBindJSON(&threat); err != nil {
-		log.Error().Err(err).Msg("Failed to bind threat finding request")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+	at := time.Now()
+	if atValue := c.Query("at"); atValue != "" {
+		parsed, err := time.Parse(time.RFC3339, atValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		at = parsed
+	}
+
+	sessions, err := h.service.GetSessions(deviceID, at)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get user sessions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user sessions"})
 		return
 	}
 
-	if err := validate.Struct(&threat); err != nil {
-		log.Error().Err(err).Msg("Failed to validate threat finding request")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
+// GetAuthEvents returns the authentication events of a device, most recent
+// first, by default over the last 24 hours
+func (h *TelemetryHandler) GetAuthEvents(c *gin.Context) {
+	deviceID := c.Param("id")
+	eventType := c.Query("type")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	switch eventType {
+	case "", models.AuthEventSSH, models.AuthEventSudo, models.AuthEventLogin, models.AuthEventLogout:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type parameter must be ssh, sudo, login or logout"})
 		return
 	}
 
-	err := h.service.CreateThreatFinding(&threat)
+	success, err := parseOptionalBool(c.Query("success"))
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create threat finding")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create threat finding"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "success parameter must be true or false"})
 		return
 	}
 
-	log.Info().
-		Str("device_id", threat.DeviceID).
-		Str("severity", threat.Severity).
-		Str("rule_id", threat.RuleID).
-		Msg("Threat finding created successfully")
+	to := time.Now()
+	if toValue := c.Query("to"); toValue != "" {
+		parsed, err := time.Parse(time.RFC3339, toValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		to = parsed
+	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"message": "Threat finding created successfully",
-		"id":      threat.ID,
+	from := to.Add(-24 * time.Hour)
+	if fromValue := c.Query("from"); fromValue != "" {
+		parsed, err := time.Parse(time.RFC3339, fromValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		from = parsed
+	}
+
+	events, err := h.service.GetAuthEvents(deviceID, eventType, success, from, to, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get auth events")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get auth events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"auth_events": events,
+		"count":       len(events),
 	})
 }
+
+// GetMetrics returns the resource usage series of a device, by default over
+// the last 24 hours at a step picked from the range. step is a duration such
+// as 30s, 5m or 1h.
+func (h *TelemetryHandler) GetMetrics(c *gin.Context) {
+	deviceID := c.Param("id")
+
+	to := time.Now()
+	if toValue := c.Query("to"); toValue != "" {
+		parsed, err := time.Parse(time.RFC3339, toValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if fromValue := c.Query("from"); fromValue != "" {
+		parsed, err := time.Parse(time.RFC3339, fromValue)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from parameter must be an RFC 3339 timestamp"})
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	var step time.Duration
+	if stepValue := c.Query("step"); stepValue != "" {
+		parsed, err := time.ParseDuration(stepValue)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "step parameter must be a positive duration such as 5m"})
+			return
+		}
+		step = parsed
+	}
+
+	series, err := h.service.GetMetrics(deviceID, from, to, step)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get device metrics")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device metrics"})
+		return
+	}
+
+	c.JSON(http.StatusOK, series)
+}
+
+// SearchContainers lists containers across the fleet by runtime and security
+// flags, e.g. /api/containers?docker_socket_mounted=true. Only live containers are
+// returned unless include_removed=true.
+func (h *TelemetryHandler) SearchContainers(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	filter := models.ContainerFilter{
+		Runtime:     c.Query("runtime"),
+		ImageDigest: c.Query("image_digest"),
+	}
+	flags := map[string]**bool{
+		"docker_socket_mounted": &filter.DockerSocketMounted,
+		"privileged":            &filter.Privileged,
+		"host_pid":              &filter.HostPID,
+		"host_network":          &filter.HostNetwork,
+		"runs_as_root":          &filter.RunsAsRoot,
+	}
+	for name, flag := range flags {
+		value, err := parseOptionalBool(c.Query(name))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s parameter", name)})
+			return
+		}
+		*flag = value
+	}
+	includeRemoved, err := parseOptionalBool(c.Query("include_removed"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid include_removed parameter"})
+		return
+	}
+	filter.IncludeRemoved = includeRemoved != nil && *includeRemoved
+
+	containers, err := h.service.SearchContainers(filter, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to search containers")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search containers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"containers": containers,
+		"count":      len(containers),
+	})
+}
+
+// parseOptionalBool parses a boolean query parameter, returning nil when it
+// is absent
+func parseOptionalBool(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func (h *TelemetryHandler) GetConnections(c *gin.Context) {
+	deviceID := c.Param("id")
+	state := strings.ToUpper(c.Query("state"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	connections, err := h.service.GetConnections(deviceID, state, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get network connections")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get network connections"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"connections": connections,
+		"count":       len(connections),
+	})
+}
+
+func (h *TelemetryHandler) GetPackages(c *gin.Context) {
+	deviceID := c.Param("id")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	packages, err := h.service.GetPackages(deviceID, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get packages")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get packages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"packages": packages,
+		"count":    len(packages),
+	})
+}
+
+func (h *TelemetryHandler) GetPackageHistory(c *gin.Context) {
+	deviceID := c.Param("id")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	changes, err := h.service.GetPackageHistory(deviceID, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get package history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get package history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"changes": changes,
+		"count":   len(changes),
+	})
+}
+
+// SearchSoftware lists the devices that have a package installed, e.g.
+// /api/software?name=openssl&version<3.0.7. The version filter is written as
+// part of the query string, so "version<3.0.7" arrives as a key without a
+// value and "version<=3.0.7" as the key "version<" with the value "3.0.7".
+func (h *TelemetryHandler) SearchSoftware(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name parameter is required"})
+		return
+	}
+
+	op, version, err := parseVersionFilter(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	packages, err := h.service.SearchSoftware(name, c.Query("source"), op, version)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to search software")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search software"})
+		return
+	}
+
+	devices := make(map[string]bool)
+	for _, pkg := range packages {
+		devices[pkg.DeviceID] = true
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"packages":     packages,
+		"count":        len(packages),
+		"device_count": len(devices),
+	})
+}
+
+// parseVersionFilter extracts the version comparison from a software search
+// query. It returns an empty operator when no version filter was given.
+func parseVersionFilter(query map[string][]string) (string, string, error) {
+	var op, version string
+	found := 0
+
+	for key, values := range query {
+		if !strings.HasPrefix(key, "version") {
+			continue
+		}
+		value := ""
+		if len(values) > 0 {
+			value = values[0]
+		}
+
+		rest := strings.TrimPrefix(key, "version")
+		switch {
+		case rest == "":
+			op, version = "=", value
+		case rest == "!" || rest == "<" || rest == ">":
+			// "version!=x", "version<=x" and "version>=x" split at the "="
+			op, version = rest+"=", value
+		case value == "" && (rest[0] == '<' || rest[0] == '>'):
+			op, version = rest[:1], rest[1:]
+		default:
+			continue
+		}
+		found++
+	}
+
+	if found == 0 {
+		return "", "", nil
+	}
+	if found > 1 {
+		return "", "", errors.New("only one version filter is supported")
+	}
+	if version == "" {
+		return "", "", errors.New("version filter requires a version")
+	}
+	return op, version, nil
+}
+
+func (h *TelemetryHandler) GetThreatFindings(c *gin.Context) {
+	deviceID := c.Param("id")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	threats, err := h.service.GetThreatFindings(deviceID, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get threat findings")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get threat findings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"threats": threats,
+		"count":   len(threats),
+	})
+}
+
+func (h *TelemetryHandler) GetThreatsBySeverity(c *gin.Context) {
+	severity := c.Query("severity")
+	if severity == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "severity parameter is required"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	threats, err := h.service.GetThreatFindingsBySeverity(severity, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get threats by severity")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get threats by severity"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"threats": threats,
+		"count":   len(threats),
+	})
+}
+
+func (h *TelemetryHandler) CreateThreatFinding(c *gin.Context) {
+	var threat models.ThreatFinding
+
+	if err := c.ShouldBindJSON(&threat); err != nil {
+		log.Error().Err(err).Msg("Failed to bind threat finding request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&threat); err != nil {
+		log.Error().Err(err).Msg("Failed to validate threat finding request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	err := h.service.CreateThreatFinding(&threat)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create threat finding")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create threat finding"})
+		return
+	}
+
+	log.Info().
+		Str("device_id", threat.DeviceID).
+		Str("severity", threat.Severity).
+		Str("rule_id", threat.RuleID).
+		Msg("Threat finding created successfully")
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Threat finding created successfully",
+		"id":      threat.ID,
+	})
+}
+
+// maxTaskResultSize bounds the result an agent may report for one task
+const maxTaskResultSize = 1024 * 1024
+
+// CreateTask queues a task for a device's agent
+func (h *TelemetryHandler) CreateTask(c *gin.Context) {
+	deviceID := c.Param("id")
+
+	var req models.CreateTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind task request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to validate task request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	task, err := h.service.CreateTask(deviceID, &req)
+	if errors.Is(err, service.ErrInvalidTask) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, service.ErrDeviceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create task")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+		return
+	}
+
+	log.Info().
+		Str("device_id", task.DeviceID).
+		Str("task_id", task.ID).
+		Str("type", task.Type).
+		Str("requested_by", task.RequestedBy).
+		Msg("Task queued")
+
+	c.JSON(http.StatusCreated, task)
+}
+
+// GetTasks returns a device's tasks, most recent first, optionally only
+// those with the given status
+func (h *TelemetryHandler) GetTasks(c *gin.Context) {
+	deviceID := c.Param("id")
+	status := c.Query("status")
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	switch status {
+	case "", models.TaskStatusPending, models.TaskStatusDispatched, models.TaskStatusCompleted,
+		models.TaskStatusFailed, models.TaskStatusExpired:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status parameter must be pending, dispatched, completed, failed or expired"})
+		return
+	}
+
+	tasks, err := h.service.GetTasks(deviceID, status, limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get tasks")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get tasks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tasks": tasks,
+		"count": len(tasks),
+	})
+}
+
+// GetTask returns one of a device's tasks with its result
+func (h *TelemetryHandler) GetTask(c *gin.Context) {
+	task, err := h.service.GetTask(c.Param("id"), c.Param("task_id"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get task")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get task"})
+		return
+	}
+
+	if task == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, task)
+}
+
+// PollTasks hands an enrolled agent the tasks queued for its device
+func (h *TelemetryHandler) PollTasks(c *gin.Context) {
+	deviceID := c.GetString(agentDeviceKey)
+	tasks, err := h.service.PollTasks(deviceID)
+	if errors.Is(err, service.ErrDeviceNotFound) {
+		// Agents poll before their first telemetry is stored
+		c.JSON(http.StatusOK, gin.H{"tasks": []*models.AgentTask{}})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to poll tasks")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to poll tasks"})
+		return
+	}
+
+	for _, task := range tasks {
+		log.Info().
+			Str("device_id", deviceID).
+			Str("task_id", task.ID).
+			Str("type", task.Type).
+			Msg("Task dispatched")
+	}
+
+	if tasks == nil {
+		tasks = []*models.AgentTask{}
+	}
+	c.JSON(http.StatusOK, gin.H{"tasks": tasks})
+}
+
+// PostTaskResult records the result an agent sends for a task
+func (h *TelemetryHandler) PostTaskResult(c *gin.Context) {
+	taskID := c.Param("task_id")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTaskResultSize)
+
+	var req models.TaskResultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Task result too large"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to bind task result")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to validate task result")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	deviceID := c.GetString(agentDeviceKey)
+	err := h.service.CompleteTask(deviceID, taskID, &req)
+	if errors.Is(err, service.ErrDeviceNotFound) || errors.Is(err, service.ErrTaskNotFound) {
+		log.Warn().
+			Str("device_id", deviceID).
+			Str("task_id", taskID).
+			Msg("Ignoring result for a task not dispatched to this device")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to record task result")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record task result"})
+		return
+	}
+
+	log.Info().
+		Str("device_id", deviceID).
+		Str("task_id", taskID).
+		Str("status", req.Status).
+		Bool("output_truncated", req.OutputTruncated).
+		Msg("Task result recorded")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Task result recorded"})
+}
+
+// agentDeviceKey holds the device an agent request authenticated as in the
+// gin context; it is empty for agents that have not enrolled
+const agentDeviceKey = "agent_device_id"
+
+// authenticateAgent identifies the enrolled device an agent request comes
+// from, by the subject of its verified client certificate or else by the
+// credential it sends as a bearer token. With certificateRequired, requests
+// without a client certificate are refused.
+func (h *TelemetryHandler) authenticateAgent(certificateRequired bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credential, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		var deviceID string
+		var err error
+		if certificate := clientCertificate(c.Request); certificate != nil {
+			deviceID, err = h.service.AuthenticateCertificate(certificate.Subject.CommonName, credential)
+		} else if certificateRequired {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Client certificate required"})
+			return
+		} else {
+			deviceID, err = h.service.AuthenticateAgent(credential)
+		}
+		h.authenticated(c, deviceID, err)
+	}
+}
+
+// requireEnrolledAgent refuses agents that authenticated without a device
+// credential, which only identify themselves by what they claim
+func requireEnrolledAgent(c *gin.Context) {
+	if c.GetString(agentDeviceKey) == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Agent must enroll", "enrollment_required": true})
+		return
+	}
+	c.Next()
+}
+
+// authenticateAdmin guards the administration endpoints, and those serving
+// task results, with the ADMIN_API_TOKEN bearer token. Without a token
+// configured they are refused, rather than left open.
+func authenticateAdmin(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Administration is disabled; set ADMIN_API_TOKEN"})
+			return
+		}
+		presented, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			log.Warn().Str("client_ip", c.ClientIP()).Str("path", c.FullPath()).Msg("Rejecting admin request with invalid token")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// clientCertificate returns the client certificate the TLS handshake
+// verified, or nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// authenticated ends agent authentication, refusing the request on err
+func (h *TelemetryHandler) authenticated(c *gin.Context, deviceID string, err error) {
+	if errors.Is(err, service.ErrEnrollmentRequired) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Agent must enroll", "enrollment_required": true})
+		return
+	}
+	if errors.Is(err, service.ErrInvalidCredential) {
+		log.Warn().Str("client_ip", c.ClientIP()).Msg("Rejecting agent request with invalid credential")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid device credential"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to authenticate agent")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate agent"})
+		return
+	}
+
+	c.Set(agentDeviceKey, deviceID)
+	c.Next()
+}
+
+// Enroll issues an agent presenting a bootstrap token its device ID and
+// credential
+func (h *TelemetryHandler) Enroll(c *gin.Context) {
+	var req models.EnrollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	response, err := h.service.Enroll(&req)
+	if errors.Is(err, service.ErrInvalidEnrollmentToken) {
+		log.Warn().
+			Str("mac_address", req.MacAddress).
+			Str("hostname", req.HostMetadata.Hostname).
+			Str("client_ip", c.ClientIP()).
+			Msg("Rejecting enrollment with invalid token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Enrollment token is invalid, expired or used up"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to enroll device")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enroll device"})
+		return
+	}
+
+	log.Info().
+		Str("device_id", response.DeviceID).
+		Str("mac_address", req.MacAddress).
+		Str("machine_id", req.HostMetadata.MachineID).
+		Str("hostname", req.HostMetadata.Hostname).
+		Msg("Device enrolled")
+
+	c.JSON(http.StatusOK, response)
+}
+
+// CreateEnrollmentToken creates a bootstrap token; its value is only
+// returned in this response
+func (h *TelemetryHandler) CreateEnrollmentToken(c *gin.Context) {
+	var req models.CreateEnrollmentTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind enrollment token request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to validate enrollment token request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	token, err := h.service.CreateEnrollmentToken(&req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create enrollment token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create enrollment token"})
+		return
+	}
+
+	log.Info().
+		Str("token_id", token.ID).
+		Str("created_by", token.CreatedBy).
+		Time("expires_at", token.ExpiresAt).
+		Msg("Enrollment token created")
+
+	c.JSON(http.StatusCreated, token)
+}
+
+// GetEnrollmentTokens lists the bootstrap tokens without their values
+func (h *TelemetryHandler) GetEnrollmentTokens(c *gin.Context) {
+	tokens, err := h.service.ListEnrollmentTokens()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list enrollment tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list enrollment tokens"})
+		return
+	}
+
+	if tokens == nil {
+		tokens = []*models.EnrollmentToken{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enrollment_tokens": tokens,
+		"count":             len(tokens),
+	})
+}
+
+// RevokeEnrollmentToken stops a bootstrap token from enrolling more devices
+func (h *TelemetryHandler) RevokeEnrollmentToken(c *gin.Context) {
+	tokenID := c.Param("id")
+
+	err := h.service.RevokeEnrollmentToken(tokenID)
+	if errors.Is(err, service.ErrEnrollmentTokenNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Enrollment token not found"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to revoke enrollment token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke enrollment token"})
+		return
+	}
+
+	log.Info().Str("token_id", tokenID).Msg("Enrollment token revoked")
+	c.JSON(http.StatusOK, gin.H{"message": "Enrollment token revoked"})
+}
+
+// IssueCertificate signs the certificate signing request of an enrolled
+// agent, for a client certificate naming its device
+func (h *TelemetryHandler) IssueCertificate(c *gin.Context) {
+	deviceID := c.GetString(agentDeviceKey)
+
+	var req models.CertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	response, err := h.service.IssueCertificate(deviceID, &req)
+	if errors.Is(err, service.ErrCertificatesDisabled) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Certificate issuance is not configured"})
+		return
+	}
+	if errors.Is(err, service.ErrEnrollmentRequired) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Agent must enroll", "enrollment_required": true})
+		return
+	}
+	if errors.Is(err, service.ErrInvalidCertificateRequest) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to issue certificate")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue certificate"})
+		return
+	}
+
+	log.Info().
+		Str("device_id", deviceID).
+		Str("serial_number", response.SerialNumber).
+		Time("expires_at", response.ExpiresAt).
+		Msg("Client certificate issued")
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetAgentPolicy serves an enrolled agent the policy of its device. The body
+// is signed as sent, with the Ed25519 signature in the X-Policy-Signature
+// header, so agents can trust it whatever carried it.
+func (h *TelemetryHandler) GetAgentPolicy(c *gin.Context) {
+	deviceID := c.GetString(agentDeviceKey)
+
+	document, signature, err := h.service.AgentPolicy(deviceID)
+	if errors.Is(err, service.ErrPoliciesDisabled) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Agent policies are not configured"})
+		return
+	}
+	if errors.Is(err, service.ErrEnrollmentRequired) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Agent must enroll", "enrollment_required": true})
+		return
+	}
+	if errors.Is(err, service.ErrDeviceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("device_id", deviceID).Msg("Failed to build agent policy")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build agent policy"})
+		return
+	}
+
+	c.Header("X-Policy-Signature", signature)
+	c.Data(http.StatusOK, "application/json", document)
+}
+
+// SetAgentPolicy creates or replaces the default policy, or that of a group
+// or device
+func (h *TelemetryHandler) SetAgentPolicy(c *gin.Context) {
+	var req models.SetAgentPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	policy, err := h.service.SetAgentPolicy(&req)
+	if errors.Is(err, service.ErrInvalidPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set agent policy")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set agent policy"})
+		return
+	}
+
+	log.Info().
+		Str("policy_id", policy.ID).
+		Str("scope", policy.Scope).
+		Str("target", policy.Target).
+		Str("updated_by", policy.UpdatedBy).
+		Msg("Agent policy set")
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// GetAgentPolicies lists the policies, the broadest first
+func (h *TelemetryHandler) GetAgentPolicies(c *gin.Context) {
+	policies, err := h.service.ListAgentPolicies()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list agent policies")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list agent policies"})
+		return
+	}
+
+	if policies == nil {
+		policies = []*models.AgentPolicy{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"policies": policies,
+		"count":    len(policies),
+	})
+}
+
+// DeleteAgentPolicy removes a policy
+func (h *TelemetryHandler) DeleteAgentPolicy(c *gin.Context) {
+	policyID := c.Param("id")
+
+	err := h.service.DeleteAgentPolicy(policyID)
+	if errors.Is(err, service.ErrPolicyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent policy not found"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete agent policy")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete agent policy"})
+		return
+	}
+
+	log.Info().Str("policy_id", policyID).Msg("Agent policy deleted")
+	c.JSON(http.StatusOK, gin.H{"message": "Agent policy deleted"})
+}
+
+// SetDevicePolicyGroup puts a device in a policy group
+func (h *TelemetryHandler) SetDevicePolicyGroup(c *gin.Context) {
+	deviceID := c.Param("id")
+
+	var req models.SetPolicyGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := validate.Struct(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+		return
+	}
+
+	err := h.service.SetDevicePolicyGroup(deviceID, req.Group)
+	if errors.Is(err, service.ErrDeviceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set device policy group")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set device policy group"})
+		return
+	}
+
+	log.Info().Str("device_id", deviceID).Str("group", req.Group).Msg("Device policy group set")
+	c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "group": req.Group})
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestParseVersionFilter(t *testing.T) {
+	tests := []struct {
+		rawQuery    string
+		wantOp      string
+		wantVersion string
+		wantErr     bool
+	}{
+		{"name=openssl", "", "", false},
+		{"name=openssl&version=3.0.7", "=", "3.0.7", false},
+		// The operator is part of the key, and "version<3.0.7" has no value
+		{"name=openssl&version<3.0.7", "<", "3.0.7", false},
+		{"name=openssl&version>1:2.0-1", ">", "1:2.0-1", false},
+		// "<=", ">=" and "!=" split the key at their "="
+		{"name=openssl&version<=3.0.7", "<=", "3.0.7", false},
+		{"name=openssl&version>=3.0.7", ">=", "3.0.7", false},
+		{"name=openssl&version!=3.0.7", "!=", "3.0.7", false},
+		{"name=openssl&version%3C3.0.7", "<", "3.0.7", false},
+		{"name=openssl&version=", "", "", true},
+		{"name=openssl&version<", "", "", true},
+		{"name=openssl&version<=", "", "", true},
+		{"name=openssl&version>1.0&version<2.0", "", "", true},
+		{"name=openssl&versions=1.0", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rawQuery, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.rawQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			op, version, err := parseVersionFilter(query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVersionFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if op != tt.wantOp || version != tt.wantVersion {
+				t.Errorf("parseVersionFilter() = %q, %q, want %q, %q", op, version, tt.wantOp, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestReadTelemetryBody(t *testing.T) {
+	payload := []byte(`{"mac_address":"00:11:22:33:44:55"}`)
+	gzipped := func(data []byte, level int) []byte {
+		var b bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&b, level)
+		w.Write(data)
+		w.Close()
+		return b.Bytes()
+	}
+	zstded := func(data []byte) []byte {
+		w, _ := zstd.NewWriter(nil)
+		defer w.Close()
+		return w.EncodeAll(data, nil)
+	}
+	// Zeros compress far below maxCompressedBodySize
+	oversized := make([]byte, maxTelemetryBodySize+1)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		wantErr  error
+	}{
+		{"plain", "", payload, payload, nil},
+		{"identity", "identity", payload, payload, nil},
+		{"gzip", "gzip", gzipped(payload, gzip.DefaultCompression), payload, nil},
+		{"zstd", "zstd", zstded(payload), payload, nil},
+		{"encoding in upper case", " GZIP ", gzipped(payload, gzip.DefaultCompression), payload, nil},
+		{"unsupported encoding", "br", payload, nil, errUnsupportedEncoding},
+		{"plain body too large", "", oversized, nil, errBodyTooLarge},
+		{"gzip expanding too far", "gzip", gzipped(oversized, gzip.DefaultCompression), nil, errBodyTooLarge},
+		{"zstd expanding too far", "zstd", zstded(oversized), nil, errBodyTooLarge},
+		// Stored uncompressed, a body under maxTelemetryBodySize once
+		// decompressed exceeds maxCompressedBodySize as sent
+		{"compressed body too large", "gzip", gzipped(make([]byte, maxCompressedBodySize+1), gzip.NoCompression), nil, errBodyTooLarge},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/telemetry", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				c.Request.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			got, err := readTelemetryBody(c)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("readTelemetryBody() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readTelemetryBody() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("readTelemetryBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
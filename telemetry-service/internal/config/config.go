@@ -9,14 +9,75 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
+	Server     ServerConfig
+	Database   DatabaseConfig
+	Redaction  RedactionConfig
+	Enrollment EnrollmentConfig
+	TLS        TLSConfig
+	Ingestion  IngestionConfig
+	Policy     PolicyConfig
+	Admin      AdminConfig
 }
 
 type ServerConfig struct {
 	Port string
 }
 
+// RedactionConfig decides what happens to command lines older agents send
+// unredacted: Policy is "redact" to redact them on arrival or "reject" to
+// refuse the payload. RulesFile holds the organisation's own rules, in the
+// agent's format.
+type RedactionConfig struct {
+	Policy    string
+	RulesFile string
+}
+
+// EnrollmentConfig decides whether agents must enroll. While Required is
+// false, agents that have not enrolled are still accepted and identified by
+// their MAC address.
+type EnrollmentConfig struct {
+	Required bool
+}
+
+// TLSConfig serves the API over TLS when CertFile and KeyFile are set. With
+// ClientCAFile, agents must present a client certificate issued by one of
+// its CAs, naming their device ID; other clients need none. With
+// IssuerCertFile and IssuerKeyFile, the service issues agents their
+// certificates, valid for ClientCertDays.
+type TLSConfig struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	IssuerCertFile string
+	IssuerKeyFile  string
+	ClientCertDays int
+}
+
+// IngestionConfig paces agents. CollectionInterval, in seconds, is the
+// interval recommended to agents in telemetry responses; 0 leaves it to
+// each agent. Beyond MaxConcurrent telemetry requests at once, further ones
+// are refused with 503 and a Retry-After of RetryAfter seconds; 0 allows any
+// number.
+type IngestionConfig struct {
+	CollectionInterval int
+	MaxConcurrent      int
+	RetryAfter         int
+}
+
+// PolicyConfig serves agents their policies, signed with the Ed25519 key in
+// SigningKeyFile; without one, agents are served none
+type PolicyConfig struct {
+	SigningKeyFile string
+}
+
+// AdminConfig guards the endpoints that change what agents do, such as
+// queueing tasks, creating enrollment tokens and setting policies, and
+// those serving task results: they need Token as a bearer token, and are
+// refused without one configured
+type AdminConfig struct {
+	Token string
+}
+
 type DatabaseConfig struct {
 	URL      string
 	Host     string
@@ -43,6 +104,58 @@ func Load() (*Config, error) {
 			Password: getEnvOrDefault("CHOREO_TELEMETRYDB_PASSWORD", ""),
 			SSLMode:  getEnvOrDefault("DB_SSL_MODE", "require"),
 		},
+		Redaction: RedactionConfig{
+			Policy:    getEnvOrDefault("UNREDACTED_CMDLINE_POLICY", "redact"),
+			RulesFile: os.Getenv("REDACTION_RULES_FILE"),
+		},
+		Enrollment: EnrollmentConfig{
+			Required: getEnvOrDefault("REQUIRE_ENROLLMENT", "false") == "true",
+		},
+		TLS: TLSConfig{
+			CertFile:       os.Getenv("TLS_CERT_FILE"),
+			KeyFile:        os.Getenv("TLS_KEY_FILE"),
+			ClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+			IssuerCertFile: os.Getenv("TLS_ISSUER_CERT_FILE"),
+			IssuerKeyFile:  os.Getenv("TLS_ISSUER_KEY_FILE"),
+			ClientCertDays: getEnvOrDefaultInt("TLS_CLIENT_CERT_DAYS", 30),
+		},
+		Ingestion: IngestionConfig{
+			CollectionInterval: getEnvOrDefaultInt("AGENT_COLLECTION_INTERVAL", 0),
+			MaxConcurrent:      getEnvOrDefaultInt("MAX_CONCURRENT_INGESTION", 0),
+			RetryAfter:         getEnvOrDefaultInt("INGESTION_RETRY_AFTER", 30),
+		},
+		Policy: PolicyConfig{
+			SigningKeyFile: os.Getenv("POLICY_SIGNING_KEY_FILE"),
+		},
+		Admin: AdminConfig{
+			Token: os.Getenv("ADMIN_API_TOKEN"),
+		},
+	}
+
+	if config.Redaction.Policy != "redact" && config.Redaction.Policy != "reject" {
+		return nil, fmt.Errorf("invalid UNREDACTED_CMDLINE_POLICY %q: must be redact or reject", config.Redaction.Policy)
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if config.TLS.ClientCAFile != "" && config.TLS.CertFile == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if (config.TLS.IssuerCertFile == "") != (config.TLS.IssuerKeyFile == "") {
+		return nil, fmt.Errorf("TLS_ISSUER_CERT_FILE and TLS_ISSUER_KEY_FILE must be set together")
+	}
+	if config.TLS.ClientCertDays < 1 {
+		return nil, fmt.Errorf("invalid TLS_CLIENT_CERT_DAYS %d: must be at least 1", config.TLS.ClientCertDays)
+	}
+	if config.Ingestion.CollectionInterval != 0 && config.Ingestion.CollectionInterval < 10 {
+		return nil, fmt.Errorf("invalid AGENT_COLLECTION_INTERVAL %d: must be 0 or at least 10 seconds", config.Ingestion.CollectionInterval)
+	}
+	if config.Ingestion.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("invalid MAX_CONCURRENT_INGESTION %d: must not be negative", config.Ingestion.MaxConcurrent)
+	}
+	if config.Ingestion.RetryAfter < 1 {
+		return nil, fmt.Errorf("invalid INGESTION_RETRY_AFTER %d: must be at least 1 second", config.Ingestion.RetryAfter)
 	}
 
 	// Log which environment variables were found
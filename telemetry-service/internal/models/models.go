@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -18,39 +19,398 @@ type Device struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 	LastSeenAt  time.Time `json:"last_seen_at" db:"last_seen_at"`
+
+	TelemetrySequence uint64     `json:"telemetry_sequence" db:"telemetry_sequence"`
+	LastCheckpointAt  *time.Time `json:"last_checkpoint_at" db:"last_checkpoint_at"`
+
+	// Secondary identifiers; an enrolled device is identified by its ID alone
+	MachineID      string     `json:"machine_id" db:"machine_id"`
+	HardwareSerial string     `json:"hardware_serial" db:"hardware_serial"`
+	EnrolledAt     *time.Time `json:"enrolled_at" db:"enrolled_at"`
 }
 
-// Process represents a process record
+// Process represents a process record. Each row covers one process lifetime,
+// from the collection that first saw it until the one that saw it exit. CPU
+// and memory use are as of the last full snapshot that listed the process.
 type Process struct {
-	ID          string    `json:"id" db:"id"`
-	DeviceID    string    `json:"device_id" db:"device_id"`
-	PID         int32     `json:"pid" db:"pid"`
-	Name        string    `json:"name" db:"name"`
-	Cmdline     []string  `json:"cmdline" db:"cmdline"`
-	Username    string    `json:"username" db:"username"`
-	ExePath     string    `json:"exe_path" db:"exe_path"`
-	StartTime   int64     `json:"start_time" db:"start_time"`
-	Status      string    `json:"status" db:"status"`
-	SHA256      string    `json:"sha256" db:"sha256"`
-	Version     string    `json:"version" db:"version"`
-	FileSize    int64     `json:"file_size" db:"file_size"`
-	CollectedAt time.Time `json:"collected_at" db:"collected_at"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID                string       `json:"id" db:"id"`
+	DeviceID          string       `json:"device_id" db:"device_id"`
+	PID               int32        `json:"pid" db:"pid"`
+	PPID              int32        `json:"ppid" db:"ppid"`
+	Name              string       `json:"name" db:"name"`
+	Cmdline           []string     `json:"cmdline" db:"cmdline"`
+	RedactedBy        string       `json:"redacted_by" db:"redacted_by"`
+	RedactionRules    []string     `json:"redaction_rules" db:"redaction_rules"`
+	Username          string       `json:"username" db:"username"`
+	ExePath           string       `json:"exe_path" db:"exe_path"`
+	StartTime         int64        `json:"start_time" db:"start_time"`
+	ParentStartTime   int64        `json:"parent_start_time" db:"parent_start_time"`
+	ProcessKey        string       `json:"process_key" db:"process_key"`
+	ParentKey         string       `json:"parent_key" db:"parent_key"`
+	Status            string       `json:"status" db:"status"`
+	SHA256            string       `json:"sha256" db:"sha256"`
+	Version           string       `json:"version" db:"version"`
+	VersionSource     string       `json:"version_source" db:"version_source"`
+	VersionConfidence string       `json:"version_confidence" db:"version_confidence"`
+	VersionInfo       *VersionInfo `json:"version_info,omitempty" db:"version_info"`
+	FileSize          int64        `json:"file_size" db:"file_size"`
+	CPUPercent        float64      `json:"cpu_percent" db:"cpu_percent"`
+	MemoryRSS         uint64       `json:"memory_rss" db:"memory_rss"`
+	CollectedAt       time.Time    `json:"collected_at" db:"collected_at"`
+	LastSeenAt        time.Time    `json:"last_seen_at" db:"last_seen_at"`
+	ExitedAt          *time.Time   `json:"exited_at" db:"exited_at"`
+	CreatedAt         time.Time    `json:"created_at" db:"created_at"`
 }
 
-// Container represents a container record
+// Container represents a container record. Each row covers one container
+// lifetime, from the collection that first saw it until it was removed.
 type Container struct {
-	ID               string            `json:"id" db:"id"`
-	DeviceID         string            `json:"device_id" db:"device_id"`
-	ContainerID      string            `json:"container_id" db:"container_id"`
-	Image            string            `json:"image" db:"image"`
-	Names            []string          `json:"names" db:"names"`
-	Status           string            `json:"status" db:"status"`
-	Ports            []string          `json:"ports" db:"ports"`
-	Labels           map[string]string `json:"labels" db:"labels"`
-	ContainerCreated int64             `json:"container_created" db:"container_created"`
-	CollectedAt      time.Time         `json:"collected_at" db:"collected_at"`
-	CreatedAt        time.Time         `json:"created_at" db:"created_at"`
+	ID               string             `json:"id" db:"id"`
+	DeviceID         string             `json:"device_id" db:"device_id"`
+	ContainerID      string             `json:"container_id" db:"container_id"`
+	Runtime          string             `json:"runtime" db:"runtime"`
+	Namespace        string             `json:"namespace,omitempty" db:"namespace"`
+	Image            string             `json:"image" db:"image"`
+	Names            []string           `json:"names" db:"names"`
+	Status           string             `json:"status" db:"status"`
+	State            string             `json:"state" db:"state"`
+	Ports            []string           `json:"ports" db:"ports"`
+	Labels           map[string]string  `json:"labels" db:"labels"`
+	ContainerCreated int64              `json:"container_created" db:"container_created"`
+	ImageDigest      string             `json:"image_digest" db:"image_digest"`
+	Security         *ContainerSecurity `json:"security" db:"security_profile"`
+	Hostname         string             `json:"hostname,omitempty" db:"-"`
+	CollectedAt      time.Time          `json:"collected_at" db:"collected_at"`
+	LastSeenAt       time.Time          `json:"last_seen_at" db:"last_seen_at"`
+	RemovedAt        *time.Time         `json:"removed_at" db:"removed_at"`
+	CreatedAt        time.Time          `json:"created_at" db:"created_at"`
+}
+
+// ContainerEvent is a container lifecycle event from the Docker events
+// stream. Events capture containers that start and exit between two
+// collections and so never appear in the containers table.
+type ContainerEvent struct {
+	ID          string            `json:"id" db:"id"`
+	DeviceID    string            `json:"device_id" db:"device_id"`
+	ContainerID string            `json:"container_id" db:"container_id"`
+	Runtime     string            `json:"runtime" db:"runtime"`
+	Action      string            `json:"action" db:"action"`
+	Image       string            `json:"image" db:"image"`
+	Name        string            `json:"name" db:"name"`
+	ExitCode    *int              `json:"exit_code" db:"exit_code"`
+	ExecCommand string            `json:"exec_command,omitempty" db:"exec_command"`
+	Attributes  map[string]string `json:"attributes" db:"attributes"`
+	EventTime   time.Time         `json:"event_time" db:"event_time"`
+	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
+}
+
+// FileChange is a change to a file monitored by the agent's file integrity
+// monitor, with the file's state before and after the change
+type FileChange struct {
+	ID           string     `json:"id" db:"id"`
+	DeviceID     string     `json:"device_id" db:"device_id"`
+	Path         string     `json:"path" db:"path"`
+	Action       string     `json:"action" db:"action"`
+	DetectedBy   string     `json:"detected_by" db:"detected_by"`
+	BeforeSHA256 string     `json:"before_sha256" db:"before_sha256"`
+	AfterSHA256  string     `json:"after_sha256" db:"after_sha256"`
+	Before       *FileState `json:"before" db:"before_state"`
+	After        *FileState `json:"after" db:"after_state"`
+	ChangeTime   time.Time  `json:"change_time" db:"change_time"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// UserSession is a login session a device listed. A session is open until
+// a snapshot no longer lists it; EndedAt is when that snapshot was taken.
+type UserSession struct {
+	ID          string     `json:"id" db:"id"`
+	DeviceID    string     `json:"device_id" db:"device_id"`
+	SessionID   string     `json:"session_id" db:"session_id"`
+	Username    string     `json:"username" db:"username"`
+	UID         *uint32    `json:"uid" db:"uid"`
+	TTY         string     `json:"tty" db:"tty"`
+	Seat        string     `json:"seat" db:"seat"`
+	RemoteHost  string     `json:"remote_host" db:"remote_host"`
+	Remote      bool       `json:"remote" db:"remote"`
+	Service     string     `json:"service" db:"service"`
+	Type        string     `json:"type" db:"session_type"`
+	Class       string     `json:"class" db:"class"`
+	State       string     `json:"state" db:"state"`
+	Source      string     `json:"source" db:"source"`
+	StartedAt   *time.Time `json:"started_at" db:"started_at"`
+	FirstSeenAt time.Time  `json:"first_seen_at" db:"first_seen_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	EndedAt     *time.Time `json:"ended_at" db:"ended_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Authentication event types reported by the agent
+const (
+	AuthEventSSH    = "ssh"
+	AuthEventSudo   = "sudo"
+	AuthEventLogin  = "login"
+	AuthEventLogout = "logout"
+)
+
+// AuthEvent is an SSH or sudo authentication attempt, or a login or logout,
+// on a device. AttemptCount is the number of identical attempts it stands
+// for. Failures counted towards a brute-force finding link to it.
+type AuthEvent struct {
+	ID              string    `json:"id" db:"id"`
+	DeviceID        string    `json:"device_id" db:"device_id"`
+	Type            string    `json:"type" db:"event_type"`
+	Success         bool      `json:"success" db:"success"`
+	Username        string    `json:"username" db:"username"`
+	SourceIP        string    `json:"source_ip" db:"source_ip"`
+	SourcePort      int       `json:"source_port" db:"source_port"`
+	Method          string    `json:"method" db:"method"`
+	TTY             string    `json:"tty" db:"tty"`
+	TargetUser      string    `json:"target_user" db:"target_user"`
+	Command         string    `json:"command" db:"command"`
+	PID             int32     `json:"pid" db:"pid"`
+	AttemptCount    int       `json:"attempt_count" db:"attempt_count"`
+	Source          string    `json:"source" db:"source"`
+	Message         string    `json:"message" db:"message"`
+	ThreatFindingID *string   `json:"threat_finding_id" db:"threat_finding_id"`
+	EventTime       time.Time `json:"event_time" db:"event_time"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+}
+
+// Persistence item types reported by the agent
+const (
+	PersistenceSystemdUnit  = "systemd_unit"
+	PersistenceCron         = "cron"
+	PersistenceAutostart    = "autostart"
+	PersistenceShellRC      = "shell_rc"
+	PersistenceLDPreload    = "ld_preload"
+	PersistenceKernelModule = "kernel_module"
+	PersistenceLaunchd      = "launchd"
+)
+
+// PersistenceItem is something a device runs automatically, e.g. a systemd
+// unit or cron table. Each row covers one item from the collection that
+// first saw it until it was removed; ChangedAt is when its content or
+// ownership last changed.
+type PersistenceItem struct {
+	ID          string     `json:"id" db:"id"`
+	DeviceID    string     `json:"device_id" db:"device_id"`
+	Key         string     `json:"key" db:"item_key"`
+	Type        string     `json:"type" db:"item_type"`
+	Path        string     `json:"path" db:"path"`
+	Name        string     `json:"name" db:"name"`
+	Scope       string     `json:"scope" db:"scope"`
+	Username    string     `json:"username" db:"username"`
+	Owner       string     `json:"owner" db:"owner"`
+	UID         *uint32    `json:"uid" db:"uid"`
+	SHA256      string     `json:"sha256" db:"sha256"`
+	FileSize    int64      `json:"file_size" db:"file_size"`
+	Mode        string     `json:"mode" db:"mode"`
+	LinkTarget  string     `json:"link_target" db:"link_target"`
+	Commands    []string   `json:"commands" db:"commands"`
+	Detail      string     `json:"detail" db:"detail"`
+	ModifiedAt  *time.Time `json:"modified_at" db:"modified_at"`
+	FirstSeenAt time.Time  `json:"first_seen_at" db:"first_seen_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	ChangedAt   time.Time  `json:"changed_at" db:"changed_at"`
+	RemovedAt   *time.Time `json:"removed_at" db:"removed_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// AgentTask is work queued for a device's agent. The row is also the audit
+// record of the task: who asked for it and why, when the agent picked it up
+// and what it sent back.
+type AgentTask struct {
+	ID              string            `json:"id" db:"id"`
+	DeviceID        string            `json:"device_id" db:"device_id"`
+	Type            string            `json:"type" db:"task_type"`
+	Parameters      map[string]string `json:"parameters" db:"parameters"`
+	Status          string            `json:"status" db:"status"`
+	RequestedBy     string            `json:"requested_by" db:"requested_by"`
+	Reason          string            `json:"reason" db:"reason"`
+	TimeoutSeconds  int               `json:"timeout_seconds" db:"timeout_seconds"`
+	Result          json.RawMessage   `json:"result,omitempty" db:"result"`
+	Error           string            `json:"error,omitempty" db:"error"`
+	OutputTruncated bool              `json:"output_truncated" db:"output_truncated"`
+	ExpiresAt       time.Time         `json:"expires_at" db:"expires_at"`
+	DispatchedAt    *time.Time        `json:"dispatched_at" db:"dispatched_at"`
+	CompletedAt     *time.Time        `json:"completed_at" db:"completed_at"`
+	CreatedAt       time.Time         `json:"created_at" db:"created_at"`
+}
+
+// EnrollmentToken is an organisation bootstrap token agents present once to
+// enroll. The token itself is only returned when it is created.
+type EnrollmentToken struct {
+	ID          string     `json:"id" db:"id"`
+	Token       string     `json:"token,omitempty" db:"-"`
+	Description string     `json:"description" db:"description"`
+	CreatedBy   string     `json:"created_by" db:"created_by"`
+	MaxUses     *int       `json:"max_uses" db:"max_uses"`
+	Uses        int        `json:"uses" db:"uses"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at" db:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Policy scopes, from the broadest: the default policy applies to every
+// device, a group's to the devices in the group and a device's to it alone
+const (
+	PolicyScopeDefault = "default"
+	PolicyScopeGroup   = "group"
+	PolicyScopeDevice  = "device"
+)
+
+// AgentPolicy holds settings the service pushes to agents, overriding their
+// local configuration. Target names the group or device the policy is for,
+// and is empty for the default policy.
+type AgentPolicy struct {
+	ID        string          `json:"id" db:"id"`
+	Scope     string          `json:"scope" db:"scope"`
+	Target    string          `json:"target" db:"target"`
+	Settings  json.RawMessage `json:"settings" db:"settings"`
+	UpdatedBy string          `json:"updated_by" db:"updated_by"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// PolicyDocument is the policy served to one agent: the settings of the
+// policies that apply to its device, merged. The service signs it as sent.
+type PolicyDocument struct {
+	DeviceID string          `json:"device_id"`
+	Group    string          `json:"group,omitempty"`
+	IssuedAt time.Time       `json:"issued_at"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// Task types the agent runs
+const (
+	TaskCollectNow       = "collect_now"
+	TaskHashFile         = "hash_file"
+	TaskListDirectory    = "list_directory"
+	TaskContainerInspect = "container_inspect"
+)
+
+// Task statuses. A pending task expires when no agent picks it up in time,
+// and a dispatched one fails when its result does not arrive.
+const (
+	TaskStatusPending    = "pending"
+	TaskStatusDispatched = "dispatched"
+	TaskStatusCompleted  = "completed"
+	TaskStatusFailed     = "failed"
+	TaskStatusExpired    = "expired"
+)
+
+// Metric resolutions: raw agent samples and the rollups built from them
+const (
+	MetricResolutionRaw     = "raw"
+	MetricResolution5Minute = "5m"
+	MetricResolutionHourly  = "1h"
+)
+
+// DeviceMetric is a point in a device's resource usage series: a raw sample,
+// or the average and peak of the samples within a step. Rates are nil when
+// no sample in the step had them.
+type DeviceMetric struct {
+	Timestamp            time.Time        `json:"timestamp"`
+	SampleCount          int              `json:"sample_count"`
+	CPUCount             int              `json:"cpu_count"`
+	CPUPercent           float64          `json:"cpu_percent"`
+	CPUPercentMax        float64          `json:"cpu_percent_max"`
+	Load1                float64          `json:"load1"`
+	Load1Max             float64          `json:"load1_max"`
+	MemoryTotal          uint64           `json:"memory_total"`
+	MemoryUsed           uint64           `json:"memory_used"`
+	MemoryPercent        float64          `json:"memory_percent"`
+	MemoryPercentMax     float64          `json:"memory_percent_max"`
+	SwapTotal            uint64           `json:"swap_total"`
+	SwapUsed             uint64           `json:"swap_used"`
+	DiskTotal            uint64           `json:"disk_total"`
+	DiskPercent          float64          `json:"disk_percent"`
+	DiskReadBytesPerSec  *float64         `json:"disk_read_bytes_per_sec"`
+	DiskWriteBytesPerSec *float64         `json:"disk_write_bytes_per_sec"`
+	NetworkRxBytesPerSec *float64         `json:"network_rx_bytes_per_sec"`
+	NetworkTxBytesPerSec *float64         `json:"network_tx_bytes_per_sec"`
+	ProcessCount         float64          `json:"process_count"`
+	ProcessCountMax      int              `json:"process_count_max"`
+	ContainerCount       float64          `json:"container_count"`
+	TopProcesses         []ProcessMetrics `json:"top_processes,omitempty"`
+}
+
+// DeviceMetricSeries is a device's resource usage between two times at one step
+type DeviceMetricSeries struct {
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	StepSeconds int64           `json:"step_seconds"`
+	Resolution  string          `json:"resolution"`
+	Points      []*DeviceMetric `json:"points"`
+}
+
+// ProcessTree is the lineage of one process in a device snapshot
+type ProcessTree struct {
+	SnapshotAt  time.Time      `json:"snapshot_at"`
+	Process     *Process       `json:"process"`
+	Ancestors   []*Process     `json:"ancestors"`
+	Descendants []*ProcessNode `json:"descendants"`
+}
+
+// ProcessNode is a process and the processes it spawned
+type ProcessNode struct {
+	Process  *Process       `json:"process"`
+	Children []*ProcessNode `json:"children"`
+}
+
+// NetworkConnection represents a TCP or UDP socket seen in one collection
+type NetworkConnection struct {
+	ID            string    `json:"id" db:"id"`
+	DeviceID      string    `json:"device_id" db:"device_id"`
+	ProcessID     *string   `json:"process_id" db:"process_id"`
+	ProcessName   string    `json:"process_name" db:"-"`
+	PID           int32     `json:"pid" db:"pid"`
+	ProcessKey    string    `json:"process_key" db:"process_key"`
+	Protocol      string    `json:"protocol" db:"protocol"`
+	Family        string    `json:"family" db:"family"`
+	LocalAddress  string    `json:"local_address" db:"local_address"`
+	LocalPort     uint32    `json:"local_port" db:"local_port"`
+	RemoteAddress string    `json:"remote_address" db:"remote_address"`
+	RemotePort    uint32    `json:"remote_port" db:"remote_port"`
+	State         string    `json:"state" db:"state"`
+	CollectedAt   time.Time `json:"collected_at" db:"collected_at"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+// DevicePackage represents a software package currently installed on a device
+type DevicePackage struct {
+	ID           string    `json:"id" db:"id"`
+	DeviceID     string    `json:"device_id" db:"device_id"`
+	Hostname     string    `json:"hostname,omitempty" db:"-"`
+	Name         string    `json:"name" db:"name"`
+	Version      string    `json:"version" db:"version"`
+	Architecture string    `json:"architecture" db:"architecture"`
+	Source       string    `json:"source" db:"source"`
+	InstalledAt  time.Time `json:"installed_at" db:"installed_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// Package history actions
+const (
+	PackageActionInstall   = "install"
+	PackageActionUpgrade   = "upgrade"
+	PackageActionDowngrade = "downgrade"
+	PackageActionRemove    = "remove"
+)
+
+// PackageChange represents an observed install, upgrade or removal
+type PackageChange struct {
+	ID              string    `json:"id" db:"id"`
+	DeviceID        string    `json:"device_id" db:"device_id"`
+	Name            string    `json:"name" db:"name"`
+	Architecture    string    `json:"architecture" db:"architecture"`
+	Source          string    `json:"source" db:"source"`
+	Action          string    `json:"action" db:"action"`
+	PreviousVersion string    `json:"previous_version" db:"previous_version"`
+	Version         string    `json:"version" db:"version"`
+	ObservedAt      time.Time `json:"observed_at" db:"observed_at"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
 }
 
 // BrowserSession represents a browser session record
@@ -65,27 +425,330 @@ type BrowserSession struct {
 	CreatedAt          time.Time `json:"created_at" db:"created_at"`
 }
 
-// ThreatFinding represents a threat finding record
+// ThreatFinding represents a threat finding record. Evidence is what the
+// agent saw that matched the rule, for findings its local rules raised.
 type ThreatFinding struct {
-	ID          string    `json:"id" db:"id"`
-	DeviceID    string    `json:"device_id" db:"device_id"`
-	ProcessID   *string   `json:"process_id" db:"process_id"`
-	ContainerID *string   `json:"container_id" db:"container_id"`
-	Description string    `json:"description" db:"description"`
-	Severity    string    `json:"severity" db:"severity"`
-	RuleID      string    `json:"rule_id" db:"rule_id"`
-	RuleName    string    `json:"rule_name" db:"rule_name"`
-	Timestamp   time.Time `json:"timestamp" db:"timestamp"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID          string            `json:"id" db:"id"`
+	DeviceID    string            `json:"device_id" db:"device_id"`
+	ProcessID   *string           `json:"process_id" db:"process_id"`
+	ContainerID *string           `json:"container_id" db:"container_id"`
+	Description string            `json:"description" db:"description"`
+	Severity    string            `json:"severity" db:"severity"`
+	RuleID      string            `json:"rule_id" db:"rule_id"`
+	RuleName    string            `json:"rule_name" db:"rule_name"`
+	DetectedBy  string            `json:"detected_by" db:"detected_by"`
+	Evidence    map[string]string `json:"evidence,omitempty" db:"evidence"`
+	Timestamp   time.Time         `json:"timestamp" db:"timestamp"`
+	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
 }
 
-// TelemetryRequest represents the incoming telemetry request
+// What raised a threat finding: the agent's local detection rules, or the
+// service, including findings posted to /api/threats
+const (
+	DetectedByAgent  = "agent"
+	DetectedByServer = "server"
+)
+
+// Snapshot types sent by the agent
+const (
+	SnapshotTypeFull  = "full"
+	SnapshotTypeDelta = "delta"
+)
+
+// TelemetryRequest represents the incoming telemetry request. A full snapshot
+// carries the complete process and container lists; a delta carries only the
+// changes since the previous sequence number. Agents that predate deltas
+// send no snapshot type and are treated as full snapshots.
 type TelemetryRequest struct {
-	Timestamp    time.Time       `json:"timestamp" validate:"required"`
-	HostMetadata HostMetadata    `json:"host_metadata" validate:"required"`
-	Processes    []ProcessInfo   `json:"processes"`
-	Containers   []ContainerInfo `json:"containers"`
-	MacAddress   string          `json:"mac_address" validate:"required"`
+	Timestamp        time.Time             `json:"timestamp" validate:"required"`
+	HostMetadata     HostMetadata          `json:"host_metadata" validate:"required"`
+	Processes        []ProcessInfo         `json:"processes"`
+	Containers       []ContainerInfo       `json:"containers"`
+	Connections      []ConnectionInfo      `json:"connections"`
+	Packages         []PackageInfo         `json:"packages"`
+	Events           []AgentEvent          `json:"events" validate:"dive"`
+	Findings         []AgentFinding        `json:"findings" validate:"dive"`
+	ContainerEvents  []ContainerEventInfo  `json:"container_events" validate:"dive"`
+	FileChanges      []FileChangeInfo      `json:"file_changes" validate:"dive"`
+	Metrics          *HostMetrics          `json:"metrics"`
+	Sessions         []SessionInfo         `json:"sessions" validate:"dive"`
+	AuthEvents       []AuthEventInfo       `json:"auth_events" validate:"dive"`
+	Persistence      []PersistenceItemInfo `json:"persistence" validate:"dive"`
+	HashCache        *HashCacheStats       `json:"hash_cache"`
+	CollectionErrors []CollectionError     `json:"collection_errors"`
+	Collectors       []CollectorStatus     `json:"collectors" validate:"dive"`
+	Truncated        bool                  `json:"truncated"`
+	MacAddress       string                `json:"mac_address" validate:"required"`
+	Replayed         bool                  `json:"replayed"`
+	SnapshotType     string                `json:"snapshot_type" validate:"omitempty,oneof=full delta"`
+	Sequence         uint64                `json:"sequence"`
+	Delta            *TelemetryDelta       `json:"delta"`
+}
+
+// TelemetryChunk is one part of a snapshot an agent uploads in chunks: a
+// slice of the snapshot's JSON, numbered Index of Count. The chunks of a
+// snapshot share its SnapshotID and the device they came from.
+type TelemetryChunk struct {
+	SnapshotID string
+	Index      int
+	Count      int
+	DeviceID   string
+	Data       []byte
+}
+
+// ListingComplete reports whether the named collector's listing can be taken
+// as complete: the collector ran in this collection and did not fail as a
+// whole. Agents that predate collector statuses only report failures.
+func (r *TelemetryRequest) ListingComplete(collector string) bool {
+	for _, status := range r.Collectors {
+		if status.Name == collector && status.Status != CollectorStatusOK {
+			return false
+		}
+	}
+	for _, collectionError := range r.CollectionErrors {
+		if collectionError.Collector == collector && collectionError.Target == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Event types reported by the agent
+const (
+	EventTypeBinaryModifiedInPlace = "binary_modified_in_place"
+)
+
+// AgentEvent is a notable change the agent observed on the host
+type AgentEvent struct {
+	Type           string    `json:"type" validate:"required"`
+	Timestamp      time.Time `json:"timestamp" validate:"required"`
+	Path           string    `json:"path"`
+	PID            int32     `json:"pid"`
+	ProcessKey     string    `json:"process_key"`
+	PreviousSHA256 string    `json:"previous_sha256"`
+	SHA256         string    `json:"sha256"`
+}
+
+// AgentFinding is a match of one of the agent's local detection rules, on
+// the process with ProcessKey or the container with ContainerID
+type AgentFinding struct {
+	RuleID      string            `json:"rule_id" validate:"required,max=100"`
+	RuleName    string            `json:"rule_name" validate:"required,max=255"`
+	Severity    string            `json:"severity" validate:"required,oneof=low medium high critical"`
+	Description string            `json:"description"`
+	Timestamp   time.Time         `json:"timestamp" validate:"required"`
+	ProcessKey  string            `json:"process_key"`
+	ContainerID string            `json:"container_id"`
+	Evidence    map[string]string `json:"evidence"`
+}
+
+// Container runtimes reported by the agent. Containers from agents that
+// predate runtime support are Docker containers.
+const (
+	RuntimeDocker     = "docker"
+	RuntimePodman     = "podman"
+	RuntimeContainerd = "containerd"
+)
+
+// Container event actions forwarded by the agent
+const (
+	ContainerActionCreate     = "create"
+	ContainerActionStart      = "start"
+	ContainerActionDie        = "die"
+	ContainerActionExecCreate = "exec_create"
+	ContainerActionDestroy    = "destroy"
+)
+
+// ContainerEventInfo is a container lifecycle event from the agent
+type ContainerEventInfo struct {
+	ContainerID string            `json:"container_id" validate:"required"`
+	Runtime     string            `json:"runtime" validate:"omitempty,oneof=docker podman containerd"`
+	Action      string            `json:"action" validate:"required,oneof=create start die exec_create destroy"`
+	Image       string            `json:"image"`
+	Name        string            `json:"name"`
+	ExitCode    *int              `json:"exit_code"`
+	ExecCommand string            `json:"exec_command"`
+	Attributes  map[string]string `json:"attributes"`
+	Timestamp   time.Time         `json:"timestamp" validate:"required"`
+}
+
+// File change actions reported by the agent
+const (
+	FileActionCreate = "create"
+	FileActionModify = "modify"
+	FileActionDelete = "delete"
+	FileActionChmod  = "chmod"
+)
+
+// FileChangeInfo is a change to a monitored file from the agent. Before is
+// nil for a create and After for a delete.
+type FileChangeInfo struct {
+	Path       string     `json:"path" validate:"required"`
+	Action     string     `json:"action" validate:"required,oneof=create modify delete chmod"`
+	Timestamp  time.Time  `json:"timestamp" validate:"required"`
+	DetectedBy string     `json:"detected_by" validate:"omitempty,oneof=watch rescan"`
+	Before     *FileState `json:"before"`
+	After      *FileState `json:"after"`
+}
+
+// FileState is the content hash, permissions and ownership of a file. The
+// hash is empty for symlinks and files too large to hash.
+type FileState struct {
+	SHA256     string    `json:"sha256,omitempty"`
+	LinkTarget string    `json:"link_target,omitempty"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	UID        *uint32   `json:"uid,omitempty"`
+	GID        *uint32   `json:"gid,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// SessionInfo is a login session from the agent, listed by systemd-logind or
+// read from utmp
+type SessionInfo struct {
+	ID         string    `json:"id" validate:"required"`
+	User       string    `json:"user"`
+	UID        *uint32   `json:"uid"`
+	TTY        string    `json:"tty"`
+	Seat       string    `json:"seat"`
+	RemoteHost string    `json:"remote_host"`
+	Remote     bool      `json:"remote"`
+	Service    string    `json:"service"`
+	Type       string    `json:"type"`
+	Class      string    `json:"class"`
+	State      string    `json:"state"`
+	StartedAt  time.Time `json:"started_at"`
+	Source     string    `json:"source" validate:"omitempty,oneof=logind utmp"`
+}
+
+// AuthEventInfo is an authentication event from the agent, parsed from the
+// auth log or journal, or read from wtmp. Count is zero for a single attempt.
+type AuthEventInfo struct {
+	Timestamp  time.Time `json:"timestamp" validate:"required"`
+	Type       string    `json:"type" validate:"required,oneof=ssh sudo login logout"`
+	Success    bool      `json:"success"`
+	User       string    `json:"user"`
+	SourceIP   string    `json:"source_ip"`
+	SourcePort int       `json:"source_port"`
+	Method     string    `json:"method"`
+	TTY        string    `json:"tty"`
+	TargetUser string    `json:"target_user"`
+	Command    string    `json:"command"`
+	PID        int32     `json:"pid"`
+	Count      int       `json:"count" validate:"gte=0"`
+	Source     string    `json:"source" validate:"omitempty,oneof=auth_log journal wtmp"`
+	Message    string    `json:"message"`
+}
+
+// PersistenceItemInfo is a persistence item from the agent's autoruns
+// collector. Key identifies the item across collections.
+type PersistenceItemInfo struct {
+	Key        string    `json:"key" validate:"required"`
+	Type       string    `json:"type" validate:"required"`
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Scope      string    `json:"scope" validate:"omitempty,oneof=system user"`
+	User       string    `json:"user"`
+	Owner      string    `json:"owner"`
+	UID        *uint32   `json:"uid"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	LinkTarget string    `json:"link_target"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Commands   []string  `json:"commands"`
+	Detail     string    `json:"detail"`
+}
+
+// HostMetrics is a host resource usage sample from the agent. Rates are
+// averaged over the interval since the agent's previous sample and missing
+// from its first one. Process CPU percentages are of one core.
+type HostMetrics struct {
+	CPUPercent           float64          `json:"cpu_percent"`
+	CPUCount             int              `json:"cpu_count"`
+	Load1                float64          `json:"load1"`
+	Load5                float64          `json:"load5"`
+	Load15               float64          `json:"load15"`
+	MemoryTotal          uint64           `json:"memory_total"`
+	MemoryUsed           uint64           `json:"memory_used"`
+	MemoryPercent        float64          `json:"memory_percent"`
+	SwapTotal            uint64           `json:"swap_total"`
+	SwapUsed             uint64           `json:"swap_used"`
+	DiskTotal            uint64           `json:"disk_total"`
+	DiskUsed             uint64           `json:"disk_used"`
+	DiskPercent          float64          `json:"disk_percent"`
+	DiskReadBytesPerSec  *float64         `json:"disk_read_bytes_per_sec"`
+	DiskWriteBytesPerSec *float64         `json:"disk_write_bytes_per_sec"`
+	NetworkRxBytesPerSec *float64         `json:"network_rx_bytes_per_sec"`
+	NetworkTxBytesPerSec *float64         `json:"network_tx_bytes_per_sec"`
+	ProcessCount         int              `json:"process_count"`
+	ContainerCount       int              `json:"container_count"`
+	TopProcesses         []ProcessMetrics `json:"top_processes"`
+}
+
+// ProcessMetrics is the resource usage of one of the busiest processes in a
+// sample
+type ProcessMetrics struct {
+	PID        int32   `json:"pid"`
+	ProcessKey string  `json:"process_key"`
+	Name       string  `json:"name"`
+	Username   string  `json:"username"`
+	ExePath    string  `json:"exe_path,omitempty"`
+	CPUPercent float64 `json:"cpu_percent"`
+	MemoryRSS  uint64  `json:"memory_rss"`
+}
+
+// Outcomes of an agent collector in one collection
+const (
+	CollectorStatusOK       = "ok"
+	CollectorStatusFailed   = "failed"
+	CollectorStatusSkipped  = "skipped"  // not due in this collection
+	CollectorStatusDisabled = "disabled" // turned off in the agent's configuration
+)
+
+// CollectorStatus reports how an agent collector fared in one collection
+type CollectorStatus struct {
+	Name       string `json:"name" validate:"required"`
+	Status     string `json:"status" validate:"oneof=ok failed skipped disabled"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error"`
+}
+
+// CollectionError reports something an agent collector could not collect.
+// An empty Target means the collector as a whole failed.
+type CollectionError struct {
+	Collector string `json:"collector"`
+	Target    string `json:"target"`
+	Error     string `json:"error"`
+}
+
+// HashCacheStats reports how the agent's executable hash cache performed in
+// the collection
+type HashCacheStats struct {
+	Hits            int   `json:"hits"`
+	Misses          int   `json:"misses"`
+	BytesHashed     int64 `json:"bytes_hashed"`
+	BudgetSkipped   int   `json:"budget_skipped"`
+	ModifiedInPlace int   `json:"modified_in_place"`
+	Entries         int   `json:"entries"`
+}
+
+// TelemetryDelta represents the changes since the previous telemetry request
+type TelemetryDelta struct {
+	ProcessesStarted  []ProcessInfo   `json:"processes_started"`
+	ProcessesExited   []ProcessRef    `json:"processes_exited"`
+	ContainersCreated []ContainerInfo `json:"containers_created"`
+	ContainersUpdated []ContainerInfo `json:"containers_updated"`
+	ContainersRemoved []string        `json:"containers_removed"`
+	// Persistence items added or modified, and the keys of those removed
+	PersistenceChanged []PersistenceItemInfo `json:"persistence_changed" validate:"dive"`
+	PersistenceRemoved []string              `json:"persistence_removed"`
+}
+
+// ProcessRef identifies a process instance on a device
+type ProcessRef struct {
+	PID       int32 `json:"pid"`
+	StartTime int64 `json:"start_time"`
 }
 
 // HostMetadata represents host metadata from the agent
@@ -94,31 +757,231 @@ type HostMetadata struct {
 	OS          string `json:"os" validate:"required"`
 	Platform    string `json:"platform" validate:"required"`
 	Version     string `json:"version" validate:"required"`
-	CurrentUser string `json:"current_user" validate:"required"`
+	CurrentUser string `json:"current_user"`
 	Uptime      uint64 `json:"uptime"`
+
+	MachineID      string `json:"machine_id" validate:"max=255"`
+	HardwareSerial string `json:"hardware_serial" validate:"max=255"`
 }
 
 // ProcessInfo represents process information from the agent
 type ProcessInfo struct {
-	PID       int32    `json:"pid" validate:"required"`
-	Name      string   `json:"name" validate:"required"`
-	Cmdline   []string `json:"cmdline"`
-	Username  string   `json:"username"`
-	ExePath   string   `json:"exe_path"`
-	StartTime int64    `json:"start_time"`
-	Status    string   `json:"status"`
-	SHA256    string   `json:"sha256"`
-	Version   string   `json:"version"`
-	FileSize  int64    `json:"file_size"`
+	PID             int32        `json:"pid" validate:"required"`
+	PPID            int32        `json:"ppid"`
+	Name            string       `json:"name" validate:"required"`
+	Cmdline         []string     `json:"cmdline"`
+	Redaction       *Redaction   `json:"redaction"`
+	Username        string       `json:"username"`
+	ExePath         string       `json:"exe_path"`
+	StartTime       int64        `json:"start_time"`
+	ParentStartTime int64        `json:"parent_start_time"`
+	ProcessKey      string       `json:"process_key"`
+	ParentKey       string       `json:"parent_key"`
+	Status          string       `json:"status"`
+	SHA256          string       `json:"sha256"`
+	Version         string       `json:"version"`
+	VersionInfo     *VersionInfo `json:"version_info"`
+	FileSize        int64        `json:"file_size"`
+	CPUPercent      float64      `json:"cpu_percent"`
+	MemoryRSS       uint64       `json:"memory_rss"`
+}
+
+// Redaction marks a process whose command line went through the agent's
+// redaction engine; agents that predate redaction send none. Rules names the
+// detectors that found something.
+type Redaction struct {
+	Version int      `json:"version"`
+	Rules   []string `json:"rules"`
+
+	// RedactedBy is set by the service: RedactedByAgent, or RedactedByServer
+	// for command lines it had to redact itself
+	RedactedBy string `json:"-"`
+}
+
+// Where a process's command line was redacted. Processes stored before
+// redaction have neither.
+const (
+	RedactedByAgent  = "agent"
+	RedactedByServer = "server"
+)
+
+// Version sources reported by the agent, from most to least authoritative.
+// VersionSourceLegacy marks versions from agents that scraped them from the
+// binary's strings.
+const (
+	VersionSourcePackage     = "package"
+	VersionSourceGoBuildInfo = "go_buildinfo"
+	VersionSourceELFNote     = "elf_note"
+	VersionSourceBundleInfo  = "bundle_info"
+	VersionSourceELFComment  = "elf_comment"
+	VersionSourceLegacy      = "legacy"
+
+	VersionConfidenceHigh   = "high"
+	VersionConfidenceMedium = "medium"
+	VersionConfidenceLow    = "low"
+)
+
+// VersionInfo is the structured version metadata of an executable
+type VersionInfo struct {
+	Version       string `json:"version,omitempty"`
+	Source        string `json:"source,omitempty"`
+	Confidence    string `json:"confidence,omitempty"`
+	Package       string `json:"package,omitempty"`
+	PackageSource string `json:"package_source,omitempty"`
+	GoVersion     string `json:"go_version,omitempty"`
+	ModulePath    string `json:"module_path,omitempty"`
+	ModuleVersion string `json:"module_version,omitempty"`
+	VCSRevision   string `json:"vcs_revision,omitempty"`
+	VCSTime       string `json:"vcs_time,omitempty"`
+	VCSModified   bool   `json:"vcs_modified,omitempty"`
+	BuildID       string `json:"build_id,omitempty"`
+	Toolchain     string `json:"toolchain,omitempty"`
 }
 
 // ContainerInfo represents container information from the agent
 type ContainerInfo struct {
-	ID      string            `json:"id" validate:"required"`
-	Image   string            `json:"image" validate:"required"`
-	Names   []string          `json:"names"`
-	Status  string            `json:"status"`
-	Ports   []string          `json:"ports"`
-	Labels  map[string]string `json:"labels"`
-	Created int64             `json:"created"`
+	ID        string             `json:"id" validate:"required"`
+	Runtime   string             `json:"runtime" validate:"omitempty,oneof=docker podman containerd"`
+	Namespace string             `json:"namespace"`
+	Image     string             `json:"image" validate:"required"`
+	Names     []string           `json:"names"`
+	Status    string             `json:"status"`
+	State     string             `json:"state"`
+	Ports     []string           `json:"ports"`
+	Labels    map[string]string  `json:"labels"`
+	Created   int64              `json:"created"`
+	Security  *ContainerSecurity `json:"security"`
+}
+
+// ContainerSecurity is the security-relevant configuration of a container,
+// as inspected by the agent
+type ContainerSecurity struct {
+	Privileged          bool             `json:"privileged"`
+	HostPID             bool             `json:"host_pid"`
+	HostNetwork         bool             `json:"host_network"`
+	HostIPC             bool             `json:"host_ipc"`
+	User                string           `json:"user"`
+	RunsAsRoot          bool             `json:"runs_as_root"`
+	CapAdd              []string         `json:"cap_add,omitempty"`
+	CapDrop             []string         `json:"cap_drop,omitempty"`
+	SecurityOpt         []string         `json:"security_opt,omitempty"`
+	ReadonlyRootfs      bool             `json:"readonly_rootfs"`
+	Mounts              []ContainerMount `json:"mounts,omitempty"`
+	DockerSocketMounted bool             `json:"docker_socket_mounted"`
+	ImageID             string           `json:"image_id,omitempty"`
+	ImageDigest         string           `json:"image_digest,omitempty"`
+}
+
+// ContainerMount is a bind mount or volume of a container
+type ContainerMount struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only"`
+}
+
+// ContainerFilter selects containers across the fleet. Nil flags and empty
+// strings match any value; removed containers are only included when IncludeRemoved is set.
+type ContainerFilter struct {
+	Runtime             string
+	DockerSocketMounted *bool
+	Privileged          *bool
+	HostPID             *bool
+	HostNetwork         *bool
+	RunsAsRoot          *bool
+	ImageDigest         string
+	IncludeRemoved      bool
+}
+
+// ConnectionInfo represents a network socket from the agent
+type ConnectionInfo struct {
+	Protocol      string `json:"protocol" validate:"required"`
+	Family        string `json:"family"`
+	LocalAddress  string `json:"local_address"`
+	LocalPort     uint32 `json:"local_port"`
+	RemoteAddress string `json:"remote_address"`
+	RemotePort    uint32 `json:"remote_port"`
+	State         string `json:"state"`
+	PID           int32  `json:"pid"`
+	ProcessKey    string `json:"process_key"`
+}
+
+// PackageInfo represents an installed package from the agent. The agent only
+// sends its inventory when it changed or with a full snapshot.
+type PackageInfo struct {
+	Name         string `json:"name" validate:"required"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	Source       string `json:"source" validate:"required"`
+}
+
+// CreateTaskRequest queues a task for a device
+type CreateTaskRequest struct {
+	Type           string            `json:"type" validate:"required,oneof=collect_now hash_file list_directory container_inspect"`
+	Parameters     map[string]string `json:"parameters"`
+	RequestedBy    string            `json:"requested_by" validate:"required,max=255"`
+	Reason         string            `json:"reason"`
+	TimeoutSeconds int               `json:"timeout_seconds" validate:"omitempty,min=1,max=300"`
+}
+
+// CreateEnrollmentTokenRequest creates a bootstrap token. Tokens expire after
+// a week unless ExpiresInHours says otherwise, and can be used any number of
+// times unless MaxUses is set.
+type CreateEnrollmentTokenRequest struct {
+	Description    string `json:"description"`
+	CreatedBy      string `json:"created_by" validate:"required,max=255"`
+	MaxUses        *int   `json:"max_uses" validate:"omitempty,min=1"`
+	ExpiresInHours int    `json:"expires_in_hours" validate:"omitempty,min=1,max=8760"`
+}
+
+// SetAgentPolicyRequest creates or replaces the policy of a scope. Target is
+// the group name or device ID, and must be empty for the default policy.
+type SetAgentPolicyRequest struct {
+	Scope     string          `json:"scope" validate:"required,oneof=default group device"`
+	Target    string          `json:"target" validate:"max=255"`
+	Settings  json.RawMessage `json:"settings" validate:"required"`
+	UpdatedBy string          `json:"updated_by" validate:"required,max=255"`
+}
+
+// SetPolicyGroupRequest puts a device in a policy group, or takes it out of
+// its group when Group is empty
+type SetPolicyGroupRequest struct {
+	Group string `json:"group" validate:"max=255"`
+}
+
+// EnrollRequest is sent once by an agent, with a bootstrap token, to obtain
+// its device ID and credential
+type EnrollRequest struct {
+	Token        string       `json:"token" validate:"required"`
+	MacAddress   string       `json:"mac_address" validate:"required"`
+	HostMetadata HostMetadata `json:"host_metadata" validate:"required"`
+}
+
+// EnrollResponse carries the identity issued to an enrolled agent. The
+// credential is shown only once; the agent sends it as a bearer token with
+// every request.
+type EnrollResponse struct {
+	DeviceID   string `json:"device_id"`
+	Credential string `json:"credential"`
+}
+
+// CertificateRequest carries the PEM certificate signing request an agent
+// sends for its client certificate
+type CertificateRequest struct {
+	CSR string `json:"csr" validate:"required"`
+}
+
+// CertificateResponse carries the PEM client certificate issued to an agent
+type CertificateResponse struct {
+	Certificate  string    `json:"certificate"`
+	SerialNumber string    `json:"serial_number"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// TaskResultRequest is sent by an agent when a task has finished
+type TaskResultRequest struct {
+	Status          string          `json:"status" validate:"required,oneof=completed failed"`
+	Result          json.RawMessage `json:"result"`
+	Error           string          `json:"error"`
+	OutputTruncated bool            `json:"output_truncated"`
 }
@@ -0,0 +1,286 @@
+// Package pki issues the certificates agents authenticate with over mutual
+// TLS. A device's certificate names its device ID as the subject common name.
+// It also handles the Ed25519 key agent policies are signed with.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// clockSkew backdates certificates so hosts with a slow clock accept them
+const clockSkew = 5 * time.Minute
+
+// Issuer signs certificates with a CA's key
+type Issuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// NewCA creates a self-signed CA and its key
+func NewCA(commonName string, validity time.Duration) (*Issuer, *ecdsa.PrivateKey, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := newTemplate(commonName, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	return &Issuer{cert: cert, key: key}, key, nil
+}
+
+// LoadIssuer reads a CA certificate and its key from PEM files
+func LoadIssuer(certFile, keyFile string) (*Issuer, error) {
+	certs, err := LoadCertificates(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !certs[0].IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", keyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		// Keys written by openssl ecparam are in the SEC 1 format
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key %s: %w", keyFile, err)
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA key %s cannot sign", keyFile)
+	}
+
+	return &Issuer{cert: certs[0], key: key}, nil
+}
+
+// Certificate returns the CA certificate
+func (i *Issuer) Certificate() *x509.Certificate {
+	return i.cert
+}
+
+// IssueClient issues a client certificate for a device. The device ID is the
+// subject common name, whatever the requester asked for.
+func (i *Issuer) IssueClient(publicKey crypto.PublicKey, deviceID string, validity time.Duration) (*x509.Certificate, error) {
+	template, err := newTemplate(deviceID, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return i.sign(template, publicKey)
+}
+
+// IssueServer issues a server certificate for the given host names and IP
+// addresses
+func (i *Issuer) IssueServer(publicKey crypto.PublicKey, hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("a server certificate needs at least one host")
+	}
+
+	template, err := newTemplate(hosts[0], validity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return i.sign(template, publicKey)
+}
+
+// sign issues the certificate, never outliving the CA
+func (i *Issuer) sign(template *x509.Certificate, publicKey crypto.PublicKey) (*x509.Certificate, error) {
+	if template.NotAfter.After(i.cert.NotAfter) {
+		template.NotAfter = i.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.cert, publicKey, i.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issued certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"SmartSec"}},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// ParseCSR reads a PEM certificate signing request and checks its signature
+func ParseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+	return csr, nil
+}
+
+// GenerateKey generates a P-256 key
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// GenerateSigningKey generates an Ed25519 key for signing agent policies
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	return key, nil
+}
+
+// LoadSigningKey reads an Ed25519 key in PKCS #8 PEM form
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	keyPEM, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", file, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", file)
+	}
+	return key, nil
+}
+
+// LoadCertificates reads every certificate in a PEM bundle
+func LoadCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificates: %w", err)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate in %s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return certs, nil
+}
+
+// LoadCertPool reads a PEM bundle of trusted CAs
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	certs, err := LoadCertificates(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// EncodeCertificate returns a certificate in PEM form
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// EncodeKey returns a private key in PKCS #8 PEM form
+func EncodeKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncodePublicKey returns a public key in PKIX PEM form
+func EncodePublicKey(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
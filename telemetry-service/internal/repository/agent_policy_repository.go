@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type AgentPolicyRepository struct {
+	db DBTX
+}
+
+func NewAgentPolicyRepository(db DBTX) *AgentPolicyRepository {
+	return &AgentPolicyRepository{db: db}
+}
+
+// Set creates the policy of its scope and target, or replaces its settings
+func (r *AgentPolicyRepository) Set(policy *models.AgentPolicy) error {
+	query := `
+		INSERT INTO agent_policies (id, scope, target, settings, updated_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (scope, target) DO UPDATE SET
+			settings = EXCLUDED.settings,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id, created_at, updated_at`
+
+	if policy.ID == "" {
+		policy.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		policy.ID,
+		policy.Scope,
+		policy.Target,
+		[]byte(policy.Settings),
+		policy.UpdatedBy,
+	).Scan(&policy.ID, &policy.CreatedAt, &policy.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to set agent policy: %w", err)
+	}
+
+	return nil
+}
+
+// List returns every policy, the broadest first
+func (r *AgentPolicyRepository) List() ([]*models.AgentPolicy, error) {
+	query := `
+		SELECT id, scope, target, settings, updated_by, created_at, updated_at
+		FROM agent_policies
+		ORDER BY CASE scope WHEN 'default' THEN 0 WHEN 'group' THEN 1 ELSE 2 END, target`
+
+	return r.query(query)
+}
+
+// ForDevice returns the policies that apply to a device in the given group,
+// the broadest first, so each overrides the ones before it
+func (r *AgentPolicyRepository) ForDevice(deviceID, group string) ([]*models.AgentPolicy, error) {
+	query := `
+		SELECT id, scope, target, settings, updated_by, created_at, updated_at
+		FROM agent_policies
+		WHERE scope = 'default'
+			OR (scope = 'group' AND target = $2 AND $2 <> '')
+			OR (scope = 'device' AND target = $1)
+		ORDER BY CASE scope WHEN 'default' THEN 0 WHEN 'group' THEN 1 ELSE 2 END`
+
+	return r.query(query, deviceID, group)
+}
+
+// Delete removes a policy, reporting false if there is no such policy
+func (r *AgentPolicyRepository) Delete(id string) (bool, error) {
+	query := `DELETE FROM agent_policies WHERE id = $1`
+
+	result, err := r.db.Exec(query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete agent policy: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete agent policy: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+func (r *AgentPolicyRepository) query(query string, args ...interface{}) ([]*models.AgentPolicy, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agent policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []*models.AgentPolicy
+	for rows.Next() {
+		policy := &models.AgentPolicy{}
+		var settings []byte
+		err := rows.Scan(
+			&policy.ID,
+			&policy.Scope,
+			&policy.Target,
+			&settings,
+			&policy.UpdatedBy,
+			&policy.CreatedAt,
+			&policy.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan agent policy row: %w", err)
+		}
+		policy.Settings = settings
+		policies = append(policies, policy)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating agent policy rows: %w", err)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"telemetry-service/internal/models"
+)
+
+// authSourceCondition matches the events of one attacker: those from a source
+// IP, or for local attempts without one, those for a username
+const authSourceCondition = `event_type = $2 AND source_ip = $3 AND ($3 <> '' OR username = $4)`
+
+type AuthEventRepository struct {
+	db DBTX
+}
+
+func NewAuthEventRepository(db DBTX) *AuthEventRepository {
+	return &AuthEventRepository{db: db}
+}
+
+// Create stores an authentication event. Events already stored for the
+// device, e.g. from a replayed snapshot, are ignored.
+func (r *AuthEventRepository) Create(event *models.AuthEvent) error {
+	query := `
+		INSERT INTO auth_events (id, device_id, event_type, success, username, source_ip, source_port, method, tty,
+			target_user, command, pid, attempt_count, source, message, event_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		ON CONFLICT (device_id, event_type, username, source_ip, source_port, tty, pid, event_time) DO NOTHING`
+
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+
+	_, err := r.db.Exec(
+		query,
+		event.ID,
+		event.DeviceID,
+		event.Type,
+		event.Success,
+		event.Username,
+		event.SourceIP,
+		event.SourcePort,
+		event.Method,
+		event.TTY,
+		event.TargetUser,
+		event.Command,
+		event.PID,
+		event.AttemptCount,
+		event.Source,
+		event.Message,
+		event.EventTime,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create auth event: %w", err)
+	}
+
+	return nil
+}
+
+// GetByDeviceID returns the device's authentication events between from and
+// to, most recent first. Empty eventType and nil success match anything.
+func (r *AuthEventRepository) GetByDeviceID(deviceID, eventType string, success *bool, from, to time.Time, limit, offset int) ([]*models.AuthEvent, error) {
+	query := `
+		SELECT id, device_id, event_type, success, username, source_ip, source_port, method, tty, target_user,
+			command, pid, attempt_count, source, message, threat_finding_id, event_time, created_at
+		FROM auth_events
+		WHERE device_id = $1 AND ($2 = '' OR event_type = $2) AND ($3::boolean IS NULL OR success = $3)
+			AND event_time >= $4 AND event_time <= $5
+		ORDER BY event_time DESC, created_at DESC
+		LIMIT $6 OFFSET $7`
+
+	rows, err := r.db.Query(query, deviceID, eventType, success, from, to, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get auth events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*models.AuthEvent
+	for rows.Next() {
+		event := &models.AuthEvent{}
+		err := rows.Scan(
+			&event.ID,
+			&event.DeviceID,
+			&event.Type,
+			&event.Success,
+			&event.Username,
+			&event.SourceIP,
+			&event.SourcePort,
+			&event.Method,
+			&event.TTY,
+			&event.TargetUser,
+			&event.Command,
+			&event.PID,
+			&event.AttemptCount,
+			&event.Source,
+			&event.Message,
+			&event.ThreatFindingID,
+			&event.EventTime,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan auth event row: %w", err)
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating auth event rows: %w", err)
+	}
+
+	return events, nil
+}
+
+// CountFailures returns the failed attempts from a source between from and
+// to that no threat finding accounts for yet, and the usernames they tried
+func (r *AuthEventRepository) CountFailures(deviceID, eventType, sourceIP, username string, from, to time.Time) (int, []string, error) {
+	query := `
+		SELECT COALESCE(SUM(attempt_count), 0), COALESCE(array_agg(DISTINCT username) FILTER (WHERE username <> ''), '{}')
+		FROM auth_events
+		WHERE device_id = $1 AND ` + authSourceCondition + ` AND NOT success AND threat_finding_id IS NULL
+			AND event_time >= $5 AND event_time <= $6`
+
+	var attempts int
+	var usernames []string
+	err := r.db.QueryRow(query, deviceID, eventType, sourceIP, username, from, to).Scan(&attempts, pq.Array(&usernames))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to count failed auth events: %w", err)
+	}
+
+	return attempts, usernames, nil
+}
+
+// LatestSuccess returns the username of the latest successful attempt from a
+// source since from, or "" when there is none
+func (r *AuthEventRepository) LatestSuccess(deviceID, eventType, sourceIP, username string, from time.Time) (string, error) {
+	query := `
+		SELECT username
+		FROM auth_events
+		WHERE device_id = $1 AND ` + authSourceCondition + ` AND success AND event_time >= $5
+		ORDER BY event_time DESC
+		LIMIT 1`
+
+	var successful string
+	err := r.db.QueryRow(query, deviceID, eventType, sourceIP, username, from).Scan(&successful)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get successful auth event: %w", err)
+	}
+
+	return successful, nil
+}
+
+// LinkToThreat links the attempts from a source since from that no threat
+// finding accounts for yet to threatID
+func (r *AuthEventRepository) LinkToThreat(deviceID, eventType, sourceIP, username string, from time.Time, threatID string) error {
+	query := `
+		UPDATE auth_events SET threat_finding_id = $6
+		WHERE device_id = $1 AND ` + authSourceCondition + ` AND threat_finding_id IS NULL AND event_time >= $5`
+
+	_, err := r.db.Exec(query, deviceID, eventType, sourceIP, username, from, threatID)
+	if err != nil {
+		return fmt.Errorf("failed to link auth events to threat finding: %w", err)
+	}
+
+	return nil
+}
+
+func (r *AuthEventRepository) DeleteOldEvents(deviceID string, before time.Time) error {
+	query := `DELETE FROM auth_events WHERE device_id = $1 AND event_time < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old auth events: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type ConnectionRepository struct {
+	db DBTX
+}
+
+func NewConnectionRepository(db DBTX) *ConnectionRepository {
+	return &ConnectionRepository{db: db}
+}
+
+func (r *ConnectionRepository) Create(connection *models.NetworkConnection) error {
+	query := `
+		INSERT INTO network_connections (id, device_id, process_id, pid, process_key, protocol, family,
+			local_address, local_port, remote_address, remote_port, state, collected_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING created_at`
+
+	if connection.ID == "" {
+		connection.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		connection.ID,
+		connection.DeviceID,
+		connection.ProcessID,
+		connection.PID,
+		connection.ProcessKey,
+		connection.Protocol,
+		connection.Family,
+		connection.LocalAddress,
+		connection.LocalPort,
+		connection.RemoteAddress,
+		connection.RemotePort,
+		connection.State,
+		connection.CollectedAt,
+	).Scan(&connection.CreatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to create network connection: %w", err)
+	}
+
+	return nil
+}
+
+// GetByDeviceID returns the device's connections, newest collection first,
+// with the owning process name. An empty state matches every state.
+func (r *ConnectionRepository) GetByDeviceID(deviceID, state string, limit, offset int) ([]*models.NetworkConnection, error) {
+	query := `
+		SELECT c.id, c.device_id, c.process_id, COALESCE(p.name, ''), c.pid, c.process_key, c.protocol, c.family,
+			   c.local_address, c.local_port, c.remote_address, c.remote_port, c.state, c.collected_at, c.created_at
+		FROM network_connections c
+		LEFT JOIN processes p ON p.id = c.process_id
+		WHERE c.device_id = $1 AND ($2 = '' OR c.state = $2)
+		ORDER BY c.collected_at DESC, c.protocol, c.local_port
+		LIMIT $3 OFFSET $4`
+
+	rows, err := r.db.Query(query, deviceID, state, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network connections by device ID: %w", err)
+	}
+	defer rows.Close()
+
+	var connections []*models.NetworkConnection
+	for rows.Next() {
+		connection := &models.NetworkConnection{}
+		err := rows.Scan(
+			&connection.ID,
+			&connection.DeviceID,
+			&connection.ProcessID,
+			&connection.ProcessName,
+			&connection.PID,
+			&connection.ProcessKey,
+			&connection.Protocol,
+			&connection.Family,
+			&connection.LocalAddress,
+			&connection.LocalPort,
+			&connection.RemoteAddress,
+			&connection.RemotePort,
+			&connection.State,
+			&connection.CollectedAt,
+			&connection.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan network connection row: %w", err)
+		}
+		connections = append(connections, connection)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating network connection rows: %w", err)
+	}
+
+	return connections, nil
+}
+
+func (r *ConnectionRepository) DeleteOldConnections(deviceID string, before time.Time) error {
+	query := `DELETE FROM network_connections WHERE device_id = $1 AND collected_at < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old network connections: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type ContainerEventRepository struct {
+	db DBTX
+}
+
+func NewContainerEventRepository(db DBTX) *ContainerEventRepository {
+	return &ContainerEventRepository{db: db}
+}
+
+// Create stores a container event. Events already stored for the device,
+// e.g. from a replayed snapshot, are ignored.
+func (r *ContainerEventRepository) Create(event *models.ContainerEvent) error {
+	attributesJSON, err := json.Marshal(event.Attributes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal container event attributes: %w", err)
+	}
+
+	query := `
+		INSERT INTO container_events (id, device_id, container_id, runtime, action, image, name, exit_code,
+			exec_command, attributes, event_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (device_id, container_id, action, event_time) DO NOTHING`
+
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+
+	_, err = r.db.Exec(
+		query,
+		event.ID,
+		event.DeviceID,
+		event.ContainerID,
+		event.Runtime,
+		event.Action,
+		event.Image,
+		event.Name,
+		event.ExitCode,
+		event.ExecCommand,
+		attributesJSON,
+		event.EventTime,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create container event: %w", err)
+	}
+
+	return nil
+}
+
+// GetTimeline returns the device's container events between from and to in
+// the order they happened. An empty containerID matches every container.
+func (r *ContainerEventRepository) GetTimeline(deviceID, containerID string, from, to time.Time, limit, offset int) ([]*models.ContainerEvent, error) {
+	query := `
+		SELECT id, device_id, container_id, runtime, action, image, name, exit_code, exec_command, attributes, event_time, created_at
+		FROM container_events
+		WHERE device_id = $1 AND ($2 = '' OR container_id = $2) AND event_time >= $3 AND event_time <= $4
+		ORDER BY event_time, created_at
+		LIMIT $5 OFFSET $6`
+
+	rows, err := r.db.Query(query, deviceID, containerID, from, to, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*models.ContainerEvent
+	for rows.Next() {
+		event := &models.ContainerEvent{}
+		var attributesJSON []byte
+
+		err := rows.Scan(
+			&event.ID,
+			&event.DeviceID,
+			&event.ContainerID,
+			&event.Runtime,
+			&event.Action,
+			&event.Image,
+			&event.Name,
+			&event.ExitCode,
+			&event.ExecCommand,
+			&attributesJSON,
+			&event.EventTime,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan container event row: %w", err)
+		}
+
+		if len(attributesJSON) > 0 {
+			if err := json.Unmarshal(attributesJSON, &event.Attributes); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal container event attributes: %w", err)
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating container event rows: %w", err)
+	}
+
+	return events, nil
+}
+
+func (r *ContainerEventRepository) DeleteOldEvents(deviceID string, before time.Time) error {
+	query := `DELETE FROM container_events WHERE device_id = $1 AND event_time < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old container events: %w", err)
+	}
+
+	return nil
+}
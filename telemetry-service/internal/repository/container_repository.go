@@ -13,13 +13,18 @@ import (
 )
 
 type ContainerRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
-func NewContainerRepository(db *sql.DB) *ContainerRepository {
+func NewContainerRepository(db DBTX) *ContainerRepository {
 	return &ContainerRepository{db: db}
 }
 
+// containerColumns is the column list shared by every container SELECT; it
+// must stay in the order scanContainers expects.
+const containerColumns = `c.id, c.device_id, c.container_id, c.runtime, c.namespace, c.image, c.names, c.status, COALESCE(c.state, ''), c.ports, c.labels,
+			   c.container_created, c.image_digest, c.security_profile, c.collected_at, c.last_seen_at, c.removed_at, c.created_at`
+
 func (r *ContainerRepository) Create(container *models.Container) error {
 	// Convert labels map to JSON
 	labelsJSON, err := json.Marshal(container.Labels)
@@ -27,9 +32,17 @@ func (r *ContainerRepository) Create(container *models.Container) error {
 		return fmt.Errorf("failed to marshal labels: %w", err)
 	}
 
+	securityJSON, err := marshalContainerSecurity(container.Security)
+	if err != nil {
+		return err
+	}
+	security := containerSecurityFlags(container.Security)
+
 	query := `
-		INSERT INTO containers (id, device_id, container_id, image, names, status, ports, labels, container_created, collected_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO containers (id, device_id, container_id, runtime, namespace, image, names, status, state, ports, labels,
+			container_created, image_digest, security_profile, privileged, host_pid, host_network, docker_socket_mounted,
+			runs_as_root, collected_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
 		RETURNING created_at`
 
 	if container.ID == "" {
@@ -41,13 +54,24 @@ func (r *ContainerRepository) Create(container *models.Container) error {
 		container.ID,
 		container.DeviceID,
 		container.ContainerID,
+		container.Runtime,
+		container.Namespace,
 		container.Image,
 		pq.Array(container.Names),
 		container.Status,
+		container.State,
 		pq.Array(container.Ports),
 		labelsJSON,
 		container.ContainerCreated,
+		container.ImageDigest,
+		securityJSON,
+		security.Privileged,
+		security.HostPID,
+		security.HostNetwork,
+		security.DockerSocketMounted,
+		security.RunsAsRoot,
 		container.CollectedAt,
+		container.LastSeenAt,
 	).Scan(&container.CreatedAt)
 
 	if err != nil {
@@ -57,12 +81,118 @@ func (r *ContainerRepository) Create(container *models.Container) error {
 	return nil
 }
 
+// Upsert refreshes the live row for the same container if the device still
+// has one, and creates a new row otherwise.
+func (r *ContainerRepository) Upsert(container *models.Container) error {
+	// Convert labels map to JSON
+	labelsJSON, err := json.Marshal(container.Labels)
+	if err != nil {
+		return fmt.Errorf("failed to marshal labels: %w", err)
+	}
+
+	securityJSON, err := marshalContainerSecurity(container.Security)
+	if err != nil {
+		return err
+	}
+	security := containerSecurityFlags(container.Security)
+
+	query := `
+		UPDATE containers
+		SET runtime = $3, namespace = $4, image = $5, names = $6, status = $7, state = $8, ports = $9, labels = $10,
+			image_digest = $11, security_profile = $12, privileged = $13, host_pid = $14, host_network = $15,
+			docker_socket_mounted = $16, runs_as_root = $17, last_seen_at = $18
+		WHERE device_id = $1 AND container_id = $2 AND removed_at IS NULL
+		RETURNING id, container_created, collected_at, created_at`
+
+	err = r.db.QueryRow(
+		query,
+		container.DeviceID,
+		container.ContainerID,
+		container.Runtime,
+		container.Namespace,
+		container.Image,
+		pq.Array(container.Names),
+		container.Status,
+		container.State,
+		pq.Array(container.Ports),
+		labelsJSON,
+		container.ImageDigest,
+		securityJSON,
+		security.Privileged,
+		security.HostPID,
+		security.HostNetwork,
+		security.DockerSocketMounted,
+		security.RunsAsRoot,
+		container.LastSeenAt,
+	).Scan(&container.ID, &container.ContainerCreated, &container.CollectedAt, &container.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return r.Create(container)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update container: %w", err)
+	}
+
+	return nil
+}
+
+// marshalContainerSecurity encodes a security profile for the JSONB column,
+// storing NULL when the agent sent none
+func marshalContainerSecurity(security *models.ContainerSecurity) ([]byte, error) {
+	if security == nil {
+		return nil, nil
+	}
+	securityJSON, err := json.Marshal(security)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal container security profile: %w", err)
+	}
+	return securityJSON, nil
+}
+
+// containerSecurityFlags returns the profile to copy into the searchable
+// flag columns; containers without a profile get all flags cleared
+func containerSecurityFlags(security *models.ContainerSecurity) models.ContainerSecurity {
+	if security == nil {
+		return models.ContainerSecurity{}
+	}
+	return *security
+}
+
+// MarkRemoved closes the live row for a container.
+func (r *ContainerRepository) MarkRemoved(deviceID, containerID string, removedAt time.Time) error {
+	query := `
+		UPDATE containers SET removed_at = $3
+		WHERE device_id = $1 AND container_id = $2 AND removed_at IS NULL`
+
+	_, err := r.db.Exec(query, deviceID, containerID, removedAt)
+	if err != nil {
+		return fmt.Errorf("failed to mark container removed: %w", err)
+	}
+
+	return nil
+}
+
+// MarkUnseenRemoved closes every live row that was not refreshed by the full
+// snapshot taken at seenAt.
+func (r *ContainerRepository) MarkUnseenRemoved(deviceID string, seenAt time.Time) (int64, error) {
+	query := `
+		UPDATE containers SET removed_at = $2
+		WHERE device_id = $1 AND removed_at IS NULL AND last_seen_at < $2`
+
+	result, err := r.db.Exec(query, deviceID, seenAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark unseen containers removed: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
 func (r *ContainerRepository) GetByDeviceID(deviceID string, limit, offset int) ([]*models.Container, error) {
 	query := `
-		SELECT id, device_id, container_id, image, names, status, ports, labels, container_created, collected_at, created_at
-		FROM containers
-		WHERE device_id = $1
-		ORDER BY collected_at DESC
+		SELECT ` + containerColumns + `, ''
+		FROM containers c
+		WHERE c.device_id = $1
+		ORDER BY c.collected_at DESC
 		LIMIT $2 OFFSET $3`
 
 	rows, err := r.db.Query(query, deviceID, limit, offset)
@@ -71,23 +201,77 @@ func (r *ContainerRepository) GetByDeviceID(deviceID string, limit, offset int)
 	}
 	defer rows.Close()
 
+	return scanContainers(rows)
+}
+
+// Search lists containers across the fleet that match filter, newest first,
+// with the hostname of the device they run on.
+func (r *ContainerRepository) Search(filter models.ContainerFilter, limit, offset int) ([]*models.Container, error) {
+	query := `
+		SELECT ` + containerColumns + `, d.hostname
+		FROM containers c
+		JOIN devices d ON d.id = c.device_id
+		WHERE ($1 OR c.removed_at IS NULL)
+		  AND ($2::BOOLEAN IS NULL OR c.docker_socket_mounted = $2)
+		  AND ($3::BOOLEAN IS NULL OR c.privileged = $3)
+		  AND ($4::BOOLEAN IS NULL OR c.host_pid = $4)
+		  AND ($5::BOOLEAN IS NULL OR c.host_network = $5)
+		  AND ($6::BOOLEAN IS NULL OR c.runs_as_root = $6)
+		  AND ($7 = '' OR c.image_digest = $7)
+		  AND ($8 = '' OR c.runtime = $8)
+		ORDER BY c.last_seen_at DESC
+		LIMIT $9 OFFSET $10`
+
+	rows, err := r.db.Query(
+		query,
+		filter.IncludeRemoved,
+		filter.DockerSocketMounted,
+		filter.Privileged,
+		filter.HostPID,
+		filter.HostNetwork,
+		filter.RunsAsRoot,
+		filter.ImageDigest,
+		filter.Runtime,
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search containers: %w", err)
+	}
+	defer rows.Close()
+
+	return scanContainers(rows)
+}
+
+// scanContainers reads rows selected as containerColumns followed by the
+// device hostname
+func scanContainers(rows *sql.Rows) ([]*models.Container, error) {
 	var containers []*models.Container
 	for rows.Next() {
 		container := &models.Container{}
 		var labelsJSON []byte
+		var securityJSON []byte
 
 		err := rows.Scan(
 			&container.ID,
 			&container.DeviceID,
 			&container.ContainerID,
+			&container.Runtime,
+			&container.Namespace,
 			&container.Image,
 			pq.Array(&container.Names),
 			&container.Status,
+			&container.State,
 			pq.Array(&container.Ports),
 			&labelsJSON,
 			&container.ContainerCreated,
+			&container.ImageDigest,
+			&securityJSON,
 			&container.CollectedAt,
+			&container.LastSeenAt,
+			&container.RemovedAt,
 			&container.CreatedAt,
+			&container.Hostname,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan container row: %w", err)
@@ -101,6 +285,13 @@ func (r *ContainerRepository) GetByDeviceID(deviceID string, limit, offset int)
 			}
 		}
 
+		if len(securityJSON) > 0 {
+			err := json.Unmarshal(securityJSON, &container.Security)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal container security profile: %w", err)
+			}
+		}
+
 		containers = append(containers, container)
 	}
 
@@ -111,8 +302,35 @@ func (r *ContainerRepository) GetByDeviceID(deviceID string, limit, offset int)
 	return containers, nil
 }
 
+// GetLiveIDs maps the runtime ID of every container a device still has to
+// its row ID, for linking other records to the container.
+func (r *ContainerRepository) GetLiveIDs(deviceID string) (map[string]string, error) {
+	query := `SELECT container_id, id FROM containers WHERE device_id = $1 AND removed_at IS NULL`
+
+	rows, err := r.db.Query(query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live container IDs: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]string)
+	for rows.Next() {
+		var containerID, id string
+		if err := rows.Scan(&containerID, &id); err != nil {
+			return nil, fmt.Errorf("failed to scan live container ID row: %w", err)
+		}
+		ids[containerID] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating live container ID rows: %w", err)
+	}
+
+	return ids, nil
+}
+
 func (r *ContainerRepository) DeleteOldContainers(deviceID string, before time.Time) error {
-	query := `DELETE FROM containers WHERE device_id = $1 AND collected_at < $2`
+	query := `DELETE FROM containers WHERE device_id = $1 AND removed_at < $2`
 
 	_, err := r.db.Exec(query, deviceID, before)
 	if err != nil {
@@ -123,22 +341,39 @@ func (r *ContainerRepository) DeleteOldContainers(deviceID string, before time.T
 }
 
 type ThreatRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
-func NewThreatRepository(db *sql.DB) *ThreatRepository {
+func NewThreatRepository(db DBTX) *ThreatRepository {
 	return &ThreatRepository{db: db}
 }
 
+// threatColumns are the columns scanThreatFindings reads
+const threatColumns = `id, device_id, process_id, container_id, description, severity, rule_id, rule_name,
+			detected_by, evidence, timestamp, created_at`
+
 func (r *ThreatRepository) Create(threat *models.ThreatFinding) error {
 	query := `
-		INSERT INTO threat_findings (id, device_id, process_id, container_id, description, severity, rule_id, rule_name, timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO threat_findings (id, device_id, process_id, container_id, description, severity, rule_id, rule_name,
+			detected_by, evidence, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		RETURNING created_at`
 
 	if threat.ID == "" {
 		threat.ID = uuid.New().String()
 	}
+	if threat.DetectedBy == "" {
+		threat.DetectedBy = models.DetectedByServer
+	}
+
+	var evidenceJSON []byte
+	if threat.Evidence != nil {
+		var err error
+		evidenceJSON, err = json.Marshal(threat.Evidence)
+		if err != nil {
+			return fmt.Errorf("failed to marshal threat evidence: %w", err)
+		}
+	}
 
 	err := r.db.QueryRow(
 		query,
@@ -150,6 +385,8 @@ func (r *ThreatRepository) Create(threat *models.ThreatFinding) error {
 		threat.Severity,
 		threat.RuleID,
 		threat.RuleName,
+		threat.DetectedBy,
+		evidenceJSON,
 		threat.Timestamp,
 	).Scan(&threat.CreatedAt)
 
@@ -162,7 +399,7 @@ func (r *ThreatRepository) Create(threat *models.ThreatFinding) error {
 
 func (r *ThreatRepository) GetByDeviceID(deviceID string, limit, offset int) ([]*models.ThreatFinding, error) {
 	query := `
-		SELECT id, device_id, process_id, container_id, description, severity, rule_id, rule_name, timestamp, created_at
+		SELECT ` + threatColumns + `
 		FROM threat_findings
 		WHERE device_id = $1
 		ORDER BY timestamp DESC
@@ -174,37 +411,12 @@ func (r *ThreatRepository) GetByDeviceID(deviceID string, limit, offset int) ([]
 	}
 	defer rows.Close()
 
-	var threats []*models.ThreatFinding
-	for rows.Next() {
-		threat := &models.ThreatFinding{}
-		err := rows.Scan(
-			&threat.ID,
-			&threat.DeviceID,
-			&threat.ProcessID,
-			&threat.ContainerID,
-			&threat.Description,
-			&threat.Severity,
-			&threat.RuleID,
-			&threat.RuleName,
-			&threat.Timestamp,
-			&threat.CreatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan threat finding row: %w", err)
-		}
-		threats = append(threats, threat)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating threat finding rows: %w", err)
-	}
-
-	return threats, nil
+	return scanThreatFindings(rows)
 }
 
 func (r *ThreatRepository) GetBySeverity(severity string, limit, offset int) ([]*models.ThreatFinding, error) {
 	query := `
-		SELECT id, device_id, process_id, container_id, description, severity, rule_id, rule_name, timestamp, created_at
+		SELECT ` + threatColumns + `
 		FROM threat_findings
 		WHERE severity = $1
 		ORDER BY timestamp DESC
@@ -216,9 +428,14 @@ func (r *ThreatRepository) GetBySeverity(severity string, limit, offset int) ([]
 	}
 	defer rows.Close()
 
+	return scanThreatFindings(rows)
+}
+
+func scanThreatFindings(rows *sql.Rows) ([]*models.ThreatFinding, error) {
 	var threats []*models.ThreatFinding
 	for rows.Next() {
 		threat := &models.ThreatFinding{}
+		var evidenceJSON []byte
 		err := rows.Scan(
 			&threat.ID,
 			&threat.DeviceID,
@@ -228,12 +445,19 @@ func (r *ThreatRepository) GetBySeverity(severity string, limit, offset int) ([]
 			&threat.Severity,
 			&threat.RuleID,
 			&threat.RuleName,
+			&threat.DetectedBy,
+			&evidenceJSON,
 			&threat.Timestamp,
 			&threat.CreatedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan threat finding row: %w", err)
 		}
+		if evidenceJSON != nil {
+			if err := json.Unmarshal(evidenceJSON, &threat.Evidence); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal threat evidence: %w", err)
+			}
+		}
 		threats = append(threats, threat)
 	}
 
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// DBTX is what repositories run their statements on: the database, or a
+// transaction several repositories share
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Transactor runs work spanning several repositories in one transaction
+type Transactor struct {
+	db *sql.DB
+}
+
+func NewTransactor(db *sql.DB) *Transactor {
+	return &Transactor{db: db}
+}
+
+// InTx runs fn in a transaction, committed when fn returns nil and rolled
+// back otherwise. Repositories created on tx take part in it.
+func (t *Transactor) InTx(fn func(tx DBTX) error) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction of its own, or in db's when a repository
+// was created on one
+func inTx(db DBTX, fn func(tx DBTX) error) error {
+	if db, ok := db.(*sql.DB); ok {
+		return NewTransactor(db).InTx(fn)
+	}
+	return fn(db)
+}
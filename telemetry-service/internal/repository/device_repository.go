@@ -2,6 +2,7 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -12,28 +13,35 @@ import (
 )
 
 type DeviceRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
-func NewDeviceRepository(db *sql.DB) *DeviceRepository {
+func NewDeviceRepository(db DBTX) *DeviceRepository {
 	return &DeviceRepository{db: db}
 }
 
+// CreateOrUpdate upserts the device of an agent that has not enrolled, which
+// is keyed on its MAC address. Snapshots may arrive out of order when an agent
+// replays its spool, so metadata is only overwritten by a snapshot that is at
+// least as recent as the one already stored.
 func (r *DeviceRepository) CreateOrUpdate(device *models.Device) error {
 	query := `
-		INSERT INTO devices (id, mac_address, hostname, os, platform, version, current_user, user_id, org_unit, last_seen_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		ON CONFLICT (mac_address) DO UPDATE SET
-			hostname = EXCLUDED.hostname,
-			os = EXCLUDED.os,
-			platform = EXCLUDED.platform,
-			version = EXCLUDED.version,
-			current_user = EXCLUDED.current_user,
+		INSERT INTO devices (id, mac_address, hostname, os, platform, version, current_user, user_id, org_unit, last_seen_at,
+			machine_id, hardware_serial)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (mac_address) WHERE enrolled_at IS NULL DO UPDATE SET
+			hostname = CASE WHEN EXCLUDED.last_seen_at >= devices.last_seen_at THEN EXCLUDED.hostname ELSE devices.hostname END,
+			os = CASE WHEN EXCLUDED.last_seen_at >= devices.last_seen_at THEN EXCLUDED.os ELSE devices.os END,
+			platform = CASE WHEN EXCLUDED.last_seen_at >= devices.last_seen_at THEN EXCLUDED.platform ELSE devices.platform END,
+			version = CASE WHEN EXCLUDED.last_seen_at >= devices.last_seen_at THEN EXCLUDED.version ELSE devices.version END,
+			current_user = CASE WHEN EXCLUDED.last_seen_at >= devices.last_seen_at THEN EXCLUDED.current_user ELSE devices.current_user END,
+			machine_id = CASE WHEN EXCLUDED.machine_id <> '' THEN EXCLUDED.machine_id ELSE devices.machine_id END,
+			hardware_serial = CASE WHEN EXCLUDED.hardware_serial <> '' THEN EXCLUDED.hardware_serial ELSE devices.hardware_serial END,
 			user_id = EXCLUDED.user_id,
 			org_unit = EXCLUDED.org_unit,
-			last_seen_at = EXCLUDED.last_seen_at,
+			last_seen_at = GREATEST(devices.last_seen_at, EXCLUDED.last_seen_at),
 			updated_at = CURRENT_TIMESTAMP
-		RETURNING id, created_at, updated_at`
+		RETURNING id, created_at, updated_at, telemetry_sequence`
 
 	if device.ID == "" {
 		device.ID = uuid.New().String()
@@ -51,7 +59,9 @@ func (r *DeviceRepository) CreateOrUpdate(device *models.Device) error {
 		device.UserID,
 		device.OrgUnit,
 		device.LastSeenAt,
-	).Scan(&device.ID, &device.CreatedAt, &device.UpdatedAt)
+		device.MachineID,
+		device.HardwareSerial,
+	).Scan(&device.ID, &device.CreatedAt, &device.UpdatedAt, &device.TelemetrySequence)
 
 	if err != nil {
 		return fmt.Errorf("failed to create or update device: %w", err)
@@ -60,15 +70,161 @@ func (r *DeviceRepository) CreateOrUpdate(device *models.Device) error {
 	return nil
 }
 
-func (r *DeviceRepository) GetByMacAddress(macAddress string) (*models.Device, error) {
+// Update refreshes the metadata of an enrolled device, under the same
+// ordering rule as CreateOrUpdate. The MAC address is an attribute like any
+// other and follows the latest snapshot.
+func (r *DeviceRepository) Update(device *models.Device) error {
+	query := `
+		UPDATE devices SET
+			mac_address = CASE WHEN $10 >= last_seen_at THEN $2 ELSE mac_address END,
+			hostname = CASE WHEN $10 >= last_seen_at THEN $3 ELSE hostname END,
+			os = CASE WHEN $10 >= last_seen_at THEN $4 ELSE os END,
+			platform = CASE WHEN $10 >= last_seen_at THEN $5 ELSE platform END,
+			version = CASE WHEN $10 >= last_seen_at THEN $6 ELSE version END,
+			current_user = CASE WHEN $10 >= last_seen_at THEN $7 ELSE current_user END,
+			machine_id = CASE WHEN $8 <> '' THEN $8 ELSE machine_id END,
+			hardware_serial = CASE WHEN $9 <> '' THEN $9 ELSE hardware_serial END,
+			last_seen_at = GREATEST(last_seen_at, $10),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING created_at, updated_at, telemetry_sequence, enrolled_at`
+
+	err := r.db.QueryRow(
+		query,
+		device.ID,
+		device.MacAddress,
+		device.Hostname,
+		device.OS,
+		device.Platform,
+		device.Version,
+		device.CurrentUser,
+		device.MachineID,
+		device.HardwareSerial,
+		device.LastSeenAt,
+	).Scan(&device.CreatedAt, &device.UpdatedAt, &device.TelemetrySequence, &device.EnrolledAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+
+	return nil
+}
+
+// Enroll issues a device its credential: the device with device.ID when it
+// is an existing device being adopted, or a new one. Only the hash of the
+// credential is stored.
+func (r *DeviceRepository) Enroll(device *models.Device, credentialHash, tokenID string) error {
+	query := `
+		INSERT INTO devices (id, mac_address, hostname, os, platform, version, current_user, machine_id, hardware_serial,
+			credential_hash, enrollment_token_id, enrolled_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+		ON CONFLICT (id) DO UPDATE SET
+			mac_address = EXCLUDED.mac_address,
+			hostname = EXCLUDED.hostname,
+			os = EXCLUDED.os,
+			platform = EXCLUDED.platform,
+			version = EXCLUDED.version,
+			current_user = EXCLUDED.current_user,
+			machine_id = EXCLUDED.machine_id,
+			hardware_serial = EXCLUDED.hardware_serial,
+			credential_hash = EXCLUDED.credential_hash,
+			enrollment_token_id = EXCLUDED.enrollment_token_id,
+			enrolled_at = EXCLUDED.enrolled_at,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING created_at, updated_at, last_seen_at, telemetry_sequence, enrolled_at`
+
+	if device.ID == "" {
+		device.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		device.ID,
+		device.MacAddress,
+		device.Hostname,
+		device.OS,
+		device.Platform,
+		device.Version,
+		device.CurrentUser,
+		device.MachineID,
+		device.HardwareSerial,
+		credentialHash,
+		tokenID,
+		time.Now(),
+	).Scan(&device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt, &device.TelemetrySequence, &device.EnrolledAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to enroll device: %w", err)
+	}
+
+	return nil
+}
+
+// GetCredentialHash returns the hash of an enrolled device's credential, or
+// "" if there is no such enrolled device
+func (r *DeviceRepository) GetCredentialHash(deviceID string) (string, error) {
+	query := `SELECT credential_hash FROM devices WHERE id = $1 AND credential_hash IS NOT NULL`
+
+	var credentialHash string
+	err := r.db.QueryRow(query, deviceID).Scan(&credentialHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get device credential: %w", err)
+	}
+
+	return credentialHash, nil
+}
+
+// GetPolicyGroup returns the policy group of a device, and whether the
+// device exists
+func (r *DeviceRepository) GetPolicyGroup(deviceID string) (string, bool, error) {
+	query := `SELECT policy_group FROM devices WHERE id = $1`
+
+	var group string
+	err := r.db.QueryRow(query, deviceID).Scan(&group)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to get device policy group: %w", err)
+	}
+
+	return group, true, nil
+}
+
+// SetPolicyGroup puts a device in a policy group, reporting false if there
+// is no such device
+func (r *DeviceRepository) SetPolicyGroup(deviceID, group string) (bool, error) {
+	query := `UPDATE devices SET policy_group = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+
+	result, err := r.db.Exec(query, deviceID, group)
+	if err != nil {
+		return false, fmt.Errorf("failed to set device policy group: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to set device policy group: %w", err)
+	}
+	return updated > 0, nil
+}
+
+// GetUnenrolled returns the device an agent reported as before it enrolled,
+// matched on its machine ID or else its MAC address, or nil if there is none
+func (r *DeviceRepository) GetUnenrolled(machineID, macAddress string) (*models.Device, error) {
 	query := `
 		SELECT id, mac_address, hostname, os, platform, version, current_user, user_id, org_unit,
-			   created_at, updated_at, last_seen_at
+			   created_at, updated_at, last_seen_at, telemetry_sequence, last_checkpoint_at,
+			   machine_id, hardware_serial, enrolled_at
 		FROM devices
-		WHERE mac_address = $1`
+		WHERE enrolled_at IS NULL AND ((machine_id <> '' AND machine_id = $1) OR mac_address = $2)
+		ORDER BY machine_id = $1 DESC, last_seen_at DESC
+		LIMIT 1`
 
 	device := &models.Device{}
-	err := r.db.QueryRow(query, macAddress).Scan(
+	err := r.db.QueryRow(query, machineID, macAddress).Scan(
 		&device.ID,
 		&device.MacAddress,
 		&device.Hostname,
@@ -81,13 +237,18 @@ func (r *DeviceRepository) GetByMacAddress(macAddress string) (*models.Device, e
 		&device.CreatedAt,
 		&device.UpdatedAt,
 		&device.LastSeenAt,
+		&device.TelemetrySequence,
+		&device.LastCheckpointAt,
+		&device.MachineID,
+		&device.HardwareSerial,
+		&device.EnrolledAt,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("failed to get device by mac address: %w", err)
+		return nil, fmt.Errorf("failed to get unenrolled device: %w", err)
 	}
 
 	return device, nil
@@ -96,7 +257,8 @@ func (r *DeviceRepository) GetByMacAddress(macAddress string) (*models.Device, e
 func (r *DeviceRepository) GetByID(id string) (*models.Device, error) {
 	query := `
 		SELECT id, mac_address, hostname, os, platform, version, current_user, user_id, org_unit,
-			   created_at, updated_at, last_seen_at
+			   created_at, updated_at, last_seen_at, telemetry_sequence, last_checkpoint_at,
+			   machine_id, hardware_serial, enrolled_at
 		FROM devices
 		WHERE id = $1`
 
@@ -114,6 +276,11 @@ func (r *DeviceRepository) GetByID(id string) (*models.Device, error) {
 		&device.CreatedAt,
 		&device.UpdatedAt,
 		&device.LastSeenAt,
+		&device.TelemetrySequence,
+		&device.LastCheckpointAt,
+		&device.MachineID,
+		&device.HardwareSerial,
+		&device.EnrolledAt,
 	)
 
 	if err != nil {
@@ -129,7 +296,8 @@ func (r *DeviceRepository) GetByID(id string) (*models.Device, error) {
 func (r *DeviceRepository) List(limit, offset int) ([]*models.Device, error) {
 	query := `
 		SELECT id, mac_address, hostname, os, platform, version, current_user, user_id, org_unit,
-			   created_at, updated_at, last_seen_at
+			   created_at, updated_at, last_seen_at, telemetry_sequence, last_checkpoint_at,
+			   machine_id, hardware_serial, enrolled_at
 		FROM devices
 		ORDER BY last_seen_at DESC
 		LIMIT $1 OFFSET $2`
@@ -156,6 +324,11 @@ func (r *DeviceRepository) List(limit, offset int) ([]*models.Device, error) {
 			&device.CreatedAt,
 			&device.UpdatedAt,
 			&device.LastSeenAt,
+			&device.TelemetrySequence,
+			&device.LastCheckpointAt,
+			&device.MachineID,
+			&device.HardwareSerial,
+			&device.EnrolledAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan device row: %w", err)
@@ -170,39 +343,80 @@ func (r *DeviceRepository) List(limit, offset int) ([]*models.Device, error) {
 	return devices, nil
 }
 
+// UpdateSequence records the last telemetry sequence number accepted from a
+// device. checkpointAt is set when the sequence was a full snapshot.
+func (r *DeviceRepository) UpdateSequence(deviceID string, sequence uint64, checkpointAt *time.Time) error {
+	query := `
+		UPDATE devices
+		SET telemetry_sequence = $2, last_checkpoint_at = COALESCE($3, last_checkpoint_at)
+		WHERE id = $1`
+
+	_, err := r.db.Exec(query, deviceID, sequence, checkpointAt)
+	if err != nil {
+		return fmt.Errorf("failed to update device telemetry sequence: %w", err)
+	}
+
+	return nil
+}
+
 type ProcessRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
-func NewProcessRepository(db *sql.DB) *ProcessRepository {
+func NewProcessRepository(db DBTX) *ProcessRepository {
 	return &ProcessRepository{db: db}
 }
 
+// processColumns is the column list shared by every process SELECT; it must
+// stay in the order scanProcesses expects.
+const processColumns = `id, device_id, pid, ppid, name, cmdline, redacted_by, redaction_rules, username, exe_path, start_time, parent_start_time,
+			   process_key, parent_key, status, sha256, version, version_source, version_confidence, version_info,
+			   file_size, cpu_percent, memory_rss, collected_at, last_seen_at, exited_at, created_at`
+
 func (r *ProcessRepository) Create(process *models.Process) error {
+	versionInfoJSON, err := marshalVersionInfo(process.VersionInfo)
+	if err != nil {
+		return err
+	}
+
 	query := `
-		INSERT INTO processes (id, device_id, pid, name, cmdline, username, exe_path, start_time, status, sha256, version, file_size, collected_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		INSERT INTO processes (id, device_id, pid, ppid, name, cmdline, username, exe_path, start_time, parent_start_time,
+			process_key, parent_key, status, sha256, version, version_source, version_confidence, version_info,
+			file_size, cpu_percent, memory_rss, collected_at, last_seen_at, redacted_by, redaction_rules)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25)
 		RETURNING created_at`
 
 	if process.ID == "" {
 		process.ID = uuid.New().String()
 	}
 
-	err := r.db.QueryRow(
+	err = r.db.QueryRow(
 		query,
 		process.ID,
 		process.DeviceID,
 		process.PID,
+		process.PPID,
 		process.Name,
 		pq.Array(process.Cmdline),
 		process.Username,
 		process.ExePath,
 		process.StartTime,
+		process.ParentStartTime,
+		process.ProcessKey,
+		process.ParentKey,
 		process.Status,
 		process.SHA256,
 		process.Version,
+		process.VersionSource,
+		process.VersionConfidence,
+		versionInfoJSON,
 		process.FileSize,
+		process.CPUPercent,
+		process.MemoryRSS,
 		process.CollectedAt,
+		process.LastSeenAt,
+		process.RedactedBy,
+		pq.Array(process.RedactionRules),
 	).Scan(&process.CreatedAt)
 
 	if err != nil {
@@ -212,9 +426,92 @@ func (r *ProcessRepository) Create(process *models.Process) error {
 	return nil
 }
 
+// Upsert refreshes the live row for the same process instance (PID and start
+// time) if the device still has one, and creates a new row otherwise.
+func (r *ProcessRepository) Upsert(process *models.Process) error {
+	versionInfoJSON, err := marshalVersionInfo(process.VersionInfo)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE processes
+		SET ppid = $4, name = $5, cmdline = $6, username = $7, exe_path = $8, parent_start_time = $9,
+			process_key = $10, parent_key = $11, status = $12, sha256 = $13, version = $14,
+			version_source = $15, version_confidence = $16, version_info = $17, file_size = $18,
+			cpu_percent = $19, memory_rss = $20, last_seen_at = $21, redacted_by = $22, redaction_rules = $23
+		WHERE device_id = $1 AND pid = $2 AND start_time = $3 AND exited_at IS NULL
+		RETURNING id, collected_at, created_at`
+
+	err = r.db.QueryRow(
+		query,
+		process.DeviceID,
+		process.PID,
+		process.StartTime,
+		process.PPID,
+		process.Name,
+		pq.Array(process.Cmdline),
+		process.Username,
+		process.ExePath,
+		process.ParentStartTime,
+		process.ProcessKey,
+		process.ParentKey,
+		process.Status,
+		process.SHA256,
+		process.Version,
+		process.VersionSource,
+		process.VersionConfidence,
+		versionInfoJSON,
+		process.FileSize,
+		process.CPUPercent,
+		process.MemoryRSS,
+		process.LastSeenAt,
+		process.RedactedBy,
+		pq.Array(process.RedactionRules),
+	).Scan(&process.ID, &process.CollectedAt, &process.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return r.Create(process)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update process: %w", err)
+	}
+
+	return nil
+}
+
+// MarkExited closes the live row for a process instance.
+func (r *ProcessRepository) MarkExited(deviceID string, pid int32, startTime int64, exitedAt time.Time) error {
+	query := `
+		UPDATE processes SET exited_at = $4
+		WHERE device_id = $1 AND pid = $2 AND start_time = $3 AND exited_at IS NULL`
+
+	_, err := r.db.Exec(query, deviceID, pid, startTime, exitedAt)
+	if err != nil {
+		return fmt.Errorf("failed to mark process exited: %w", err)
+	}
+
+	return nil
+}
+
+// MarkUnseenExited closes every live row that was not refreshed by the full
+// snapshot taken at seenAt.
+func (r *ProcessRepository) MarkUnseenExited(deviceID string, seenAt time.Time) (int64, error) {
+	query := `
+		UPDATE processes SET exited_at = $2
+		WHERE device_id = $1 AND exited_at IS NULL AND last_seen_at < $2`
+
+	result, err := r.db.Exec(query, deviceID, seenAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark unseen processes exited: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
 func (r *ProcessRepository) GetByDeviceID(deviceID string, limit, offset int) ([]*models.Process, error) {
 	query := `
-		SELECT id, device_id, pid, name, cmdline, username, exe_path, start_time, status, sha256, version, file_size, collected_at, created_at
+		SELECT ` + processColumns + `
 		FROM processes
 		WHERE device_id = $1
 		ORDER BY collected_at DESC
@@ -226,28 +523,98 @@ func (r *ProcessRepository) GetByDeviceID(deviceID string, limit, offset int) ([
 	}
 	defer rows.Close()
 
+	return scanProcesses(rows)
+}
+
+// GetSnapshot returns the processes that were running on a device at the
+// given time, i.e. first seen at or before it and not yet exited.
+func (r *ProcessRepository) GetSnapshot(deviceID string, at time.Time) ([]*models.Process, error) {
+	query := `
+		SELECT ` + processColumns + `
+		FROM processes
+		WHERE device_id = $1 AND collected_at <= $2 AND (exited_at IS NULL OR exited_at > $2)
+		ORDER BY start_time`
+
+	rows, err := r.db.Query(query, deviceID, at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get process snapshot: %w", err)
+	}
+	defer rows.Close()
+
+	return scanProcesses(rows)
+}
+
+// GetLiveIDs maps the process key of every running process on a device to
+// its row ID, for linking other records to the process.
+func (r *ProcessRepository) GetLiveIDs(deviceID string) (map[string]string, error) {
+	query := `SELECT process_key, id FROM processes WHERE device_id = $1 AND exited_at IS NULL`
+
+	rows, err := r.db.Query(query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live process IDs: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]string)
+	for rows.Next() {
+		var key, id string
+		if err := rows.Scan(&key, &id); err != nil {
+			return nil, fmt.Errorf("failed to scan live process ID row: %w", err)
+		}
+		ids[key] = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating live process ID rows: %w", err)
+	}
+
+	return ids, nil
+}
+
+func scanProcesses(rows *sql.Rows) ([]*models.Process, error) {
 	var processes []*models.Process
 	for rows.Next() {
 		process := &models.Process{}
+		var versionInfoJSON []byte
+
 		err := rows.Scan(
 			&process.ID,
 			&process.DeviceID,
 			&process.PID,
+			&process.PPID,
 			&process.Name,
 			pq.Array(&process.Cmdline),
+			&process.RedactedBy,
+			pq.Array(&process.RedactionRules),
 			&process.Username,
 			&process.ExePath,
 			&process.StartTime,
+			&process.ParentStartTime,
+			&process.ProcessKey,
+			&process.ParentKey,
 			&process.Status,
 			&process.SHA256,
 			&process.Version,
+			&process.VersionSource,
+			&process.VersionConfidence,
+			&versionInfoJSON,
 			&process.FileSize,
+			&process.CPUPercent,
+			&process.MemoryRSS,
 			&process.CollectedAt,
+			&process.LastSeenAt,
+			&process.ExitedAt,
 			&process.CreatedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan process row: %w", err)
 		}
+
+		if len(versionInfoJSON) > 0 {
+			if err := json.Unmarshal(versionInfoJSON, &process.VersionInfo); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal version info: %w", err)
+			}
+		}
 		processes = append(processes, process)
 	}
 
@@ -258,8 +625,21 @@ func (r *ProcessRepository) GetByDeviceID(deviceID string, limit, offset int) ([
 	return processes, nil
 }
 
+// marshalVersionInfo encodes version metadata for the JSONB column, storing
+// NULL when the agent sent none
+func marshalVersionInfo(versionInfo *models.VersionInfo) ([]byte, error) {
+	if versionInfo == nil {
+		return nil, nil
+	}
+	versionInfoJSON, err := json.Marshal(versionInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal version info: %w", err)
+	}
+	return versionInfoJSON, nil
+}
+
 func (r *ProcessRepository) DeleteOldProcesses(deviceID string, before time.Time) error {
-	query := `DELETE FROM processes WHERE device_id = $1 AND collected_at < $2`
+	query := `DELETE FROM processes WHERE device_id = $1 AND exited_at < $2`
 
 	_, err := r.db.Exec(query, deviceID, before)
 	if err != nil {
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type EnrollmentTokenRepository struct {
+	db DBTX
+}
+
+func NewEnrollmentTokenRepository(db DBTX) *EnrollmentTokenRepository {
+	return &EnrollmentTokenRepository{db: db}
+}
+
+// Create stores a bootstrap token by the hash of its value
+func (r *EnrollmentTokenRepository) Create(token *models.EnrollmentToken, tokenHash string) error {
+	query := `
+		INSERT INTO enrollment_tokens (id, token_hash, description, created_by, max_uses, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at`
+
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		token.ID,
+		tokenHash,
+		token.Description,
+		token.CreatedBy,
+		token.MaxUses,
+		token.ExpiresAt,
+	).Scan(&token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create enrollment token: %w", err)
+	}
+
+	return nil
+}
+
+// List returns every bootstrap token, newest first
+func (r *EnrollmentTokenRepository) List() ([]*models.EnrollmentToken, error) {
+	query := `
+		SELECT id, description, created_by, max_uses, uses, expires_at, revoked_at, created_at
+		FROM enrollment_tokens
+		ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollment tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*models.EnrollmentToken
+	for rows.Next() {
+		token := &models.EnrollmentToken{}
+		err := rows.Scan(
+			&token.ID,
+			&token.Description,
+			&token.CreatedBy,
+			&token.MaxUses,
+			&token.Uses,
+			&token.ExpiresAt,
+			&token.RevokedAt,
+			&token.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan enrollment token row: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating enrollment token rows: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Revoke stops a token from enrolling more devices, reporting false if there
+// is no such token. Devices already enrolled with it are not affected.
+func (r *EnrollmentTokenRepository) Revoke(id string, revokedAt time.Time) (bool, error) {
+	query := `UPDATE enrollment_tokens SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1`
+
+	result, err := r.db.Exec(query, id, revokedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke enrollment token: %w", err)
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke enrollment token: %w", err)
+	}
+	return revoked > 0, nil
+}
+
+// Consume counts one use of the token with the given hash and returns its
+// ID, or "" if the token is unknown, revoked, expired or used up. The check
+// and the count are one statement, so concurrent enrollments cannot exceed
+// the token's uses.
+func (r *EnrollmentTokenRepository) Consume(tokenHash string, now time.Time) (string, error) {
+	query := `
+		UPDATE enrollment_tokens SET uses = uses + 1
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > $2
+			AND (max_uses IS NULL OR uses < max_uses)
+		RETURNING id`
+
+	var id string
+	err := r.db.QueryRow(query, tokenHash, now).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to use enrollment token: %w", err)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type FileChangeRepository struct {
+	db DBTX
+}
+
+func NewFileChangeRepository(db DBTX) *FileChangeRepository {
+	return &FileChangeRepository{db: db}
+}
+
+// Create stores a file change. Changes already stored for the device, e.g.
+// from a replayed snapshot, are ignored.
+func (r *FileChangeRepository) Create(change *models.FileChange) error {
+	beforeJSON, err := marshalFileState(change.Before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := marshalFileState(change.After)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO file_changes (id, device_id, path, action, detected_by, before_sha256, after_sha256,
+			before_state, after_state, change_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (device_id, path, action, change_time) DO NOTHING`
+
+	if change.ID == "" {
+		change.ID = uuid.New().String()
+	}
+
+	_, err = r.db.Exec(
+		query,
+		change.ID,
+		change.DeviceID,
+		change.Path,
+		change.Action,
+		change.DetectedBy,
+		change.BeforeSHA256,
+		change.AfterSHA256,
+		beforeJSON,
+		afterJSON,
+		change.ChangeTime,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create file change: %w", err)
+	}
+
+	return nil
+}
+
+// GetByDeviceID returns the device's file changes between from and to, most
+// recent first. path matches the file itself and everything below it when it
+// is a directory; empty path and action match anything.
+func (r *FileChangeRepository) GetByDeviceID(deviceID, path, action string, from, to time.Time, limit, offset int) ([]*models.FileChange, error) {
+	query := `
+		SELECT id, device_id, path, action, detected_by, before_sha256, after_sha256, before_state, after_state,
+			change_time, created_at
+		FROM file_changes
+		WHERE device_id = $1 AND ($2 = '' OR path = $2 OR starts_with(path, rtrim($2, '/') || '/'))
+			AND ($3 = '' OR action = $3) AND change_time >= $4 AND change_time <= $5
+		ORDER BY change_time DESC, created_at DESC
+		LIMIT $6 OFFSET $7`
+
+	rows, err := r.db.Query(query, deviceID, path, action, from, to, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file changes: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []*models.FileChange
+	for rows.Next() {
+		change := &models.FileChange{}
+		var beforeJSON, afterJSON []byte
+
+		err := rows.Scan(
+			&change.ID,
+			&change.DeviceID,
+			&change.Path,
+			&change.Action,
+			&change.DetectedBy,
+			&change.BeforeSHA256,
+			&change.AfterSHA256,
+			&beforeJSON,
+			&afterJSON,
+			&change.ChangeTime,
+			&change.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file change row: %w", err)
+		}
+
+		if len(beforeJSON) > 0 {
+			if err := json.Unmarshal(beforeJSON, &change.Before); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal file state: %w", err)
+			}
+		}
+		if len(afterJSON) > 0 {
+			if err := json.Unmarshal(afterJSON, &change.After); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal file state: %w", err)
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating file change rows: %w", err)
+	}
+
+	return changes, nil
+}
+
+func (r *FileChangeRepository) DeleteOldChanges(deviceID string, before time.Time) error {
+	query := `DELETE FROM file_changes WHERE device_id = $1 AND change_time < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old file changes: %w", err)
+	}
+
+	return nil
+}
+
+// marshalFileState encodes a file state for a JSONB column; a missing state
+// is stored as NULL
+func marshalFileState(state *models.FileState) ([]byte, error) {
+	if state == nil {
+		return nil, nil
+	}
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal file state: %w", err)
+	}
+	return stateJSON, nil
+}
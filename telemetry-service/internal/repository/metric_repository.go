@@ -0,0 +1,267 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+// metricRollups are the coarser resolutions every raw sample is added to
+var metricRollups = []struct {
+	resolution string
+	size       time.Duration
+}{
+	{models.MetricResolution5Minute, 5 * time.Minute},
+	{models.MetricResolutionHourly, time.Hour},
+}
+
+// metricColumns is the column list of a device_metrics row; it must stay in
+// the order metricValues returns.
+const metricColumns = `id, device_id, resolution, bucket_start, sample_count, cpu_count, cpu_percent_sum, cpu_percent_max,
+			load1_sum, load1_max, memory_total, memory_used_sum, memory_percent_sum, memory_percent_max,
+			swap_total, swap_used_sum, disk_total, disk_percent_sum, rate_sample_count, disk_read_sum, disk_write_sum,
+			network_rx_sum, network_tx_sum, process_count_sum, process_count_max, container_count_sum, top_processes`
+
+const metricPlaceholders = `$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20,
+			$21, $22, $23, $24, $25, $26, $27`
+
+type MetricRepository struct {
+	db DBTX
+}
+
+func NewMetricRepository(db DBTX) *MetricRepository {
+	return &MetricRepository{db: db}
+}
+
+// Record stores a raw sample and adds it to the device's 5-minute and hourly
+// rollups. A sample already stored, e.g. from a replayed snapshot, is ignored
+// so it is not counted twice.
+func (r *MetricRepository) Record(deviceID string, sampledAt time.Time, metrics *models.HostMetrics) error {
+	var topProcessesJSON []byte
+	if len(metrics.TopProcesses) > 0 {
+		var err error
+		topProcessesJSON, err = json.Marshal(metrics.TopProcesses)
+		if err != nil {
+			return fmt.Errorf("failed to marshal top processes: %w", err)
+		}
+	}
+
+	return inTx(r.db, func(tx DBTX) error {
+		return recordMetrics(tx, deviceID, sampledAt, metrics, topProcessesJSON)
+	})
+}
+
+// recordMetrics is Record on a transaction
+func recordMetrics(tx DBTX, deviceID string, sampledAt time.Time, metrics *models.HostMetrics, topProcessesJSON []byte) error {
+	query := `
+		INSERT INTO device_metrics (` + metricColumns + `)
+		VALUES (` + metricPlaceholders + `)
+		ON CONFLICT (device_id, resolution, bucket_start) DO NOTHING`
+
+	result, err := tx.Exec(query, metricValues(deviceID, models.MetricResolutionRaw, sampledAt, metrics, topProcessesJSON)...)
+	if err != nil {
+		return fmt.Errorf("failed to create device metric: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to create device metric: %w", err)
+	}
+	if inserted == 0 {
+		return nil
+	}
+
+	query = `
+		INSERT INTO device_metrics (` + metricColumns + `)
+		VALUES (` + metricPlaceholders + `)
+		ON CONFLICT (device_id, resolution, bucket_start) DO UPDATE SET
+			sample_count = device_metrics.sample_count + EXCLUDED.sample_count,
+			cpu_count = EXCLUDED.cpu_count,
+			cpu_percent_sum = device_metrics.cpu_percent_sum + EXCLUDED.cpu_percent_sum,
+			cpu_percent_max = GREATEST(device_metrics.cpu_percent_max, EXCLUDED.cpu_percent_max),
+			load1_sum = device_metrics.load1_sum + EXCLUDED.load1_sum,
+			load1_max = GREATEST(device_metrics.load1_max, EXCLUDED.load1_max),
+			memory_total = EXCLUDED.memory_total,
+			memory_used_sum = device_metrics.memory_used_sum + EXCLUDED.memory_used_sum,
+			memory_percent_sum = device_metrics.memory_percent_sum + EXCLUDED.memory_percent_sum,
+			memory_percent_max = GREATEST(device_metrics.memory_percent_max, EXCLUDED.memory_percent_max),
+			swap_total = EXCLUDED.swap_total,
+			swap_used_sum = device_metrics.swap_used_sum + EXCLUDED.swap_used_sum,
+			disk_total = EXCLUDED.disk_total,
+			disk_percent_sum = device_metrics.disk_percent_sum + EXCLUDED.disk_percent_sum,
+			rate_sample_count = device_metrics.rate_sample_count + EXCLUDED.rate_sample_count,
+			disk_read_sum = device_metrics.disk_read_sum + EXCLUDED.disk_read_sum,
+			disk_write_sum = device_metrics.disk_write_sum + EXCLUDED.disk_write_sum,
+			network_rx_sum = device_metrics.network_rx_sum + EXCLUDED.network_rx_sum,
+			network_tx_sum = device_metrics.network_tx_sum + EXCLUDED.network_tx_sum,
+			process_count_sum = device_metrics.process_count_sum + EXCLUDED.process_count_sum,
+			process_count_max = GREATEST(device_metrics.process_count_max, EXCLUDED.process_count_max),
+			container_count_sum = device_metrics.container_count_sum + EXCLUDED.container_count_sum`
+
+	for _, rollup := range metricRollups {
+		bucketStart := sampledAt.UTC().Truncate(rollup.size)
+		if _, err := tx.Exec(query, metricValues(deviceID, rollup.resolution, bucketStart, metrics, nil)...); err != nil {
+			return fmt.Errorf("failed to roll up device metric: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// metricValues returns the column values of a row holding a single sample.
+// Rates only count when the sample has all of them.
+func metricValues(deviceID, resolution string, bucketStart time.Time, metrics *models.HostMetrics, topProcessesJSON []byte) []interface{} {
+	rateSamples := 0
+	var diskRead, diskWrite, networkRx, networkTx float64
+	if metrics.DiskReadBytesPerSec != nil && metrics.DiskWriteBytesPerSec != nil &&
+		metrics.NetworkRxBytesPerSec != nil && metrics.NetworkTxBytesPerSec != nil {
+		rateSamples = 1
+		diskRead, diskWrite = *metrics.DiskReadBytesPerSec, *metrics.DiskWriteBytesPerSec
+		networkRx, networkTx = *metrics.NetworkRxBytesPerSec, *metrics.NetworkTxBytesPerSec
+	}
+
+	return []interface{}{
+		uuid.New().String(),
+		deviceID,
+		resolution,
+		bucketStart,
+		1,
+		metrics.CPUCount,
+		metrics.CPUPercent,
+		metrics.CPUPercent,
+		metrics.Load1,
+		metrics.Load1,
+		metrics.MemoryTotal,
+		float64(metrics.MemoryUsed),
+		metrics.MemoryPercent,
+		metrics.MemoryPercent,
+		metrics.SwapTotal,
+		float64(metrics.SwapUsed),
+		metrics.DiskTotal,
+		metrics.DiskPercent,
+		rateSamples,
+		diskRead,
+		diskWrite,
+		networkRx,
+		networkTx,
+		metrics.ProcessCount,
+		metrics.ProcessCount,
+		metrics.ContainerCount,
+		topProcessesJSON,
+	}
+}
+
+// GetSeries averages the device's rows at resolution over steps of step
+// between from and to, oldest first. Each point carries the top processes of
+// the latest raw sample in its step.
+func (r *MetricRepository) GetSeries(deviceID, resolution string, from, to time.Time, step time.Duration) ([]*models.DeviceMetric, error) {
+	query := `
+		SELECT to_timestamp(floor(extract(epoch FROM bucket_start)::double precision / $5::double precision) * $5::double precision) AS step_start,
+			SUM(sample_count), MAX(cpu_count), SUM(cpu_percent_sum), MAX(cpu_percent_max), SUM(load1_sum), MAX(load1_max),
+			MAX(memory_total), SUM(memory_used_sum), SUM(memory_percent_sum), MAX(memory_percent_max),
+			MAX(swap_total), SUM(swap_used_sum), MAX(disk_total), SUM(disk_percent_sum),
+			SUM(rate_sample_count), SUM(disk_read_sum), SUM(disk_write_sum), SUM(network_rx_sum), SUM(network_tx_sum),
+			SUM(process_count_sum), MAX(process_count_max), SUM(container_count_sum),
+			(array_agg(top_processes ORDER BY bucket_start DESC))[1]
+		FROM device_metrics
+		WHERE device_id = $1 AND resolution = $2 AND bucket_start >= $3 AND bucket_start <= $4
+		GROUP BY step_start
+		ORDER BY step_start`
+
+	rows, err := r.db.Query(query, deviceID, resolution, from, to, step.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device metrics: %w", err)
+	}
+	defer rows.Close()
+
+	var points []*models.DeviceMetric
+	for rows.Next() {
+		point := &models.DeviceMetric{}
+		var sampleCount, rateSampleCount int
+		var cpuSum, load1Sum, memoryUsedSum, memoryPercentSum, swapUsedSum, diskPercentSum float64
+		var diskReadSum, diskWriteSum, networkRxSum, networkTxSum float64
+		var processCountSum, containerCountSum int64
+		var topProcessesJSON []byte
+
+		err := rows.Scan(
+			&point.Timestamp,
+			&sampleCount,
+			&point.CPUCount,
+			&cpuSum,
+			&point.CPUPercentMax,
+			&load1Sum,
+			&point.Load1Max,
+			&point.MemoryTotal,
+			&memoryUsedSum,
+			&memoryPercentSum,
+			&point.MemoryPercentMax,
+			&point.SwapTotal,
+			&swapUsedSum,
+			&point.DiskTotal,
+			&diskPercentSum,
+			&rateSampleCount,
+			&diskReadSum,
+			&diskWriteSum,
+			&networkRxSum,
+			&networkTxSum,
+			&processCountSum,
+			&point.ProcessCountMax,
+			&containerCountSum,
+			&topProcessesJSON,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan device metric row: %w", err)
+		}
+		if sampleCount == 0 {
+			continue
+		}
+
+		samples := float64(sampleCount)
+		point.SampleCount = sampleCount
+		point.CPUPercent = cpuSum / samples
+		point.Load1 = load1Sum / samples
+		point.MemoryUsed = uint64(memoryUsedSum / samples)
+		point.MemoryPercent = memoryPercentSum / samples
+		point.SwapUsed = uint64(swapUsedSum / samples)
+		point.DiskPercent = diskPercentSum / samples
+		point.ProcessCount = float64(processCountSum) / samples
+		point.ContainerCount = float64(containerCountSum) / samples
+
+		if rateSampleCount > 0 {
+			rateSamples := float64(rateSampleCount)
+			diskRead, diskWrite := diskReadSum/rateSamples, diskWriteSum/rateSamples
+			networkRx, networkTx := networkRxSum/rateSamples, networkTxSum/rateSamples
+			point.DiskReadBytesPerSec, point.DiskWriteBytesPerSec = &diskRead, &diskWrite
+			point.NetworkRxBytesPerSec, point.NetworkTxBytesPerSec = &networkRx, &networkTx
+		}
+
+		if len(topProcessesJSON) > 0 {
+			if err := json.Unmarshal(topProcessesJSON, &point.TopProcesses); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal top processes: %w", err)
+			}
+		}
+
+		points = append(points, point)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating device metric rows: %w", err)
+	}
+
+	return points, nil
+}
+
+// DeleteOldMetrics removes the device's rows at resolution older than before
+func (r *MetricRepository) DeleteOldMetrics(deviceID, resolution string, before time.Time) error {
+	query := `DELETE FROM device_metrics WHERE device_id = $1 AND resolution = $2 AND bucket_start < $3`
+
+	_, err := r.db.Exec(query, deviceID, resolution, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old device metrics: %w", err)
+	}
+
+	return nil
+}
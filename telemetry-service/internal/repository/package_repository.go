@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type PackageRepository struct {
+	db DBTX
+}
+
+func NewPackageRepository(db DBTX) *PackageRepository {
+	return &PackageRepository{db: db}
+}
+
+// Upsert records a package as installed on the device. installed_at is kept
+// from the first time the package was seen.
+func (r *PackageRepository) Upsert(pkg *models.DevicePackage) error {
+	query := `
+		INSERT INTO device_packages (id, device_id, name, version, architecture, source, installed_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (device_id, source, name, architecture) DO UPDATE SET
+			version = EXCLUDED.version,
+			updated_at = EXCLUDED.updated_at
+		RETURNING id, installed_at, created_at`
+
+	if pkg.ID == "" {
+		pkg.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		pkg.ID,
+		pkg.DeviceID,
+		pkg.Name,
+		pkg.Version,
+		pkg.Architecture,
+		pkg.Source,
+		pkg.InstalledAt,
+		pkg.UpdatedAt,
+	).Scan(&pkg.ID, &pkg.InstalledAt, &pkg.CreatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to upsert device package: %w", err)
+	}
+
+	return nil
+}
+
+func (r *PackageRepository) Delete(id string) error {
+	query := `DELETE FROM device_packages WHERE id = $1`
+
+	_, err := r.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete device package: %w", err)
+	}
+
+	return nil
+}
+
+// ListByDeviceID returns the device's complete current inventory
+func (r *PackageRepository) ListByDeviceID(deviceID string) ([]*models.DevicePackage, error) {
+	query := `
+		SELECT id, device_id, '', name, version, architecture, source, installed_at, updated_at, created_at
+		FROM device_packages
+		WHERE device_id = $1
+		ORDER BY source, name, architecture`
+
+	rows, err := r.db.Query(query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list device packages: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDevicePackages(rows)
+}
+
+func (r *PackageRepository) GetByDeviceID(deviceID string, limit, offset int) ([]*models.DevicePackage, error) {
+	query := `
+		SELECT id, device_id, '', name, version, architecture, source, installed_at, updated_at, created_at
+		FROM device_packages
+		WHERE device_id = $1
+		ORDER BY source, name, architecture
+		LIMIT $2 OFFSET $3`
+
+	rows, err := r.db.Query(query, deviceID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device packages by device ID: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDevicePackages(rows)
+}
+
+// SearchByName finds installed packages across the fleet. namePattern is a
+// case-insensitive LIKE pattern; an empty source matches every source.
+func (r *PackageRepository) SearchByName(namePattern, source string) ([]*models.DevicePackage, error) {
+	query := `
+		SELECT p.id, p.device_id, d.hostname, p.name, p.version, p.architecture, p.source, p.installed_at, p.updated_at, p.created_at
+		FROM device_packages p
+		JOIN devices d ON d.id = p.device_id
+		WHERE LOWER(p.name) LIKE LOWER($1) AND ($2 = '' OR p.source = $2)
+		ORDER BY p.name, d.hostname`
+
+	rows, err := r.db.Query(query, namePattern, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search device packages: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDevicePackages(rows)
+}
+
+func scanDevicePackages(rows *sql.Rows) ([]*models.DevicePackage, error) {
+	var packages []*models.DevicePackage
+	for rows.Next() {
+		pkg := &models.DevicePackage{}
+		err := rows.Scan(
+			&pkg.ID,
+			&pkg.DeviceID,
+			&pkg.Hostname,
+			&pkg.Name,
+			&pkg.Version,
+			&pkg.Architecture,
+			&pkg.Source,
+			&pkg.InstalledAt,
+			&pkg.UpdatedAt,
+			&pkg.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan device package row: %w", err)
+		}
+		packages = append(packages, pkg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating device package rows: %w", err)
+	}
+
+	return packages, nil
+}
+
+func (r *PackageRepository) CreateChange(change *models.PackageChange) error {
+	query := `
+		INSERT INTO package_history (id, device_id, name, architecture, source, action, previous_version, version, observed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING created_at`
+
+	if change.ID == "" {
+		change.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		change.ID,
+		change.DeviceID,
+		change.Name,
+		change.Architecture,
+		change.Source,
+		change.Action,
+		change.PreviousVersion,
+		change.Version,
+		change.ObservedAt,
+	).Scan(&change.CreatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to create package change: %w", err)
+	}
+
+	return nil
+}
+
+func (r *PackageRepository) GetHistoryByDeviceID(deviceID string, limit, offset int) ([]*models.PackageChange, error) {
+	query := `
+		SELECT id, device_id, name, architecture, source, action, previous_version, version, observed_at, created_at
+		FROM package_history
+		WHERE device_id = $1
+		ORDER BY observed_at DESC, name
+		LIMIT $2 OFFSET $3`
+
+	rows, err := r.db.Query(query, deviceID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get package history by device ID: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []*models.PackageChange
+	for rows.Next() {
+		change := &models.PackageChange{}
+		err := rows.Scan(
+			&change.ID,
+			&change.DeviceID,
+			&change.Name,
+			&change.Architecture,
+			&change.Source,
+			&change.Action,
+			&change.PreviousVersion,
+			&change.Version,
+			&change.ObservedAt,
+			&change.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan package change row: %w", err)
+		}
+		changes = append(changes, change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating package change rows: %w", err)
+	}
+
+	return changes, nil
+}
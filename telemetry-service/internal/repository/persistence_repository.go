@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"telemetry-service/internal/models"
+)
+
+type PersistenceRepository struct {
+	db DBTX
+}
+
+func NewPersistenceRepository(db DBTX) *PersistenceRepository {
+	return &PersistenceRepository{db: db}
+}
+
+func (r *PersistenceRepository) Create(item *models.PersistenceItem) error {
+	query := `
+		INSERT INTO persistence_items (id, device_id, item_key, item_type, path, name, scope, username, owner, uid, sha256,
+			file_size, mode, link_target, commands, detail, modified_at, first_seen_at, last_seen_at, changed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+		RETURNING created_at`
+
+	if item.ID == "" {
+		item.ID = uuid.New().String()
+	}
+
+	err := r.db.QueryRow(
+		query,
+		item.ID,
+		item.DeviceID,
+		item.Key,
+		item.Type,
+		item.Path,
+		item.Name,
+		item.Scope,
+		item.Username,
+		item.Owner,
+		item.UID,
+		item.SHA256,
+		item.FileSize,
+		item.Mode,
+		item.LinkTarget,
+		pq.Array(item.Commands),
+		item.Detail,
+		item.ModifiedAt,
+		item.FirstSeenAt,
+		item.LastSeenAt,
+		item.ChangedAt,
+	).Scan(&item.CreatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to create persistence item: %w", err)
+	}
+
+	return nil
+}
+
+// Upsert refreshes the device's present item with the same key, or creates
+// it. ChangedAt moves to the item's LastSeenAt when its content, link
+// target, permissions, owner or detail differ from what was stored.
+func (r *PersistenceRepository) Upsert(item *models.PersistenceItem) error {
+	query := `
+		UPDATE persistence_items
+		SET changed_at = CASE
+				WHEN sha256 <> $5 OR link_target <> $6 OR mode <> $7 OR uid IS DISTINCT FROM $8 OR detail <> $9 THEN $16
+				ELSE changed_at
+			END,
+			item_type = $3, path = $4, sha256 = $5, link_target = $6, mode = $7, uid = $8, detail = $9, name = $10,
+			scope = $11, username = $12, owner = $13, file_size = $14, commands = $15, modified_at = $17,
+			last_seen_at = $16
+		WHERE device_id = $1 AND item_key = $2 AND removed_at IS NULL
+		RETURNING id, first_seen_at, changed_at, created_at`
+
+	err := r.db.QueryRow(
+		query,
+		item.DeviceID,
+		item.Key,
+		item.Type,
+		item.Path,
+		item.SHA256,
+		item.LinkTarget,
+		item.Mode,
+		item.UID,
+		item.Detail,
+		item.Name,
+		item.Scope,
+		item.Username,
+		item.Owner,
+		item.FileSize,
+		pq.Array(item.Commands),
+		item.LastSeenAt,
+		item.ModifiedAt,
+	).Scan(&item.ID, &item.FirstSeenAt, &item.ChangedAt, &item.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return r.Create(item)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update persistence item: %w", err)
+	}
+
+	return nil
+}
+
+func (r *PersistenceRepository) MarkRemoved(deviceID, key string, removedAt time.Time) error {
+	query := `
+		UPDATE persistence_items SET removed_at = $3
+		WHERE device_id = $1 AND item_key = $2 AND removed_at IS NULL`
+
+	_, err := r.db.Exec(query, deviceID, key, removedAt)
+	if err != nil {
+		return fmt.Errorf("failed to mark persistence item removed: %w", err)
+	}
+
+	return nil
+}
+
+// MarkUnseenRemoved closes the device's present items a full snapshot taken
+// at seenAt did not list
+func (r *PersistenceRepository) MarkUnseenRemoved(deviceID string, seenAt time.Time) (int64, error) {
+	query := `
+		UPDATE persistence_items SET removed_at = $2
+		WHERE device_id = $1 AND removed_at IS NULL AND last_seen_at < $2`
+
+	result, err := r.db.Exec(query, deviceID, seenAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark unseen persistence items removed: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// MarkSeen moves the last-seen time of the device's present items to seenAt;
+// a delta only carries the items that changed
+func (r *PersistenceRepository) MarkSeen(deviceID string, seenAt time.Time) error {
+	query := `
+		UPDATE persistence_items SET last_seen_at = $2
+		WHERE device_id = $1 AND removed_at IS NULL AND last_seen_at < $2`
+
+	_, err := r.db.Exec(query, deviceID, seenAt)
+	if err != nil {
+		return fmt.Errorf("failed to update persistence items last seen: %w", err)
+	}
+
+	return nil
+}
+
+// GetByDeviceID returns the device's persistence items, most recently
+// changed first. An empty itemType matches every type; removed items are
+// only included when includeRemoved is set.
+func (r *PersistenceRepository) GetByDeviceID(deviceID, itemType string, includeRemoved bool, limit, offset int) ([]*models.PersistenceItem, error) {
+	query := `
+		SELECT id, device_id, item_key, item_type, path, name, scope, username, owner, uid, sha256, file_size, mode,
+			link_target, commands, detail, modified_at, first_seen_at, last_seen_at, changed_at, removed_at, created_at
+		FROM persistence_items
+		WHERE device_id = $1 AND ($2 = '' OR item_type = $2) AND ($3 OR removed_at IS NULL)
+		ORDER BY changed_at DESC, item_key
+		LIMIT $4 OFFSET $5`
+
+	rows, err := r.db.Query(query, deviceID, itemType, includeRemoved, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get persistence items: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*models.PersistenceItem
+	for rows.Next() {
+		item := &models.PersistenceItem{}
+		var uid sql.NullInt64
+
+		err := rows.Scan(
+			&item.ID,
+			&item.DeviceID,
+			&item.Key,
+			&item.Type,
+			&item.Path,
+			&item.Name,
+			&item.Scope,
+			&item.Username,
+			&item.Owner,
+			&uid,
+			&item.SHA256,
+			&item.FileSize,
+			&item.Mode,
+			&item.LinkTarget,
+			pq.Array(&item.Commands),
+			&item.Detail,
+			&item.ModifiedAt,
+			&item.FirstSeenAt,
+			&item.LastSeenAt,
+			&item.ChangedAt,
+			&item.RemovedAt,
+			&item.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan persistence item row: %w", err)
+		}
+		if uid.Valid {
+			value := uint32(uid.Int64)
+			item.UID = &value
+		}
+
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating persistence item rows: %w", err)
+	}
+
+	return items, nil
+}
+
+// DeleteOldItems removes the device's items that were removed before before
+func (r *PersistenceRepository) DeleteOldItems(deviceID string, before time.Time) error {
+	query := `DELETE FROM persistence_items WHERE device_id = $1 AND removed_at < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old persistence items: %w", err)
+	}
+
+	return nil
+}
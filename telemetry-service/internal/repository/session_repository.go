@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type SessionRepository struct {
+	db DBTX
+}
+
+func NewSessionRepository(db DBTX) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+// Sync reconciles the device's open sessions with a complete listing taken at
+// seenAt. Listed sessions are opened or refreshed; open sessions missing from
+// the listing are ended at seenAt. A session ID reused with a different start
+// time, e.g. after a reboot, is a new session.
+func (r *SessionRepository) Sync(deviceID string, sessions []*models.UserSession, seenAt time.Time) error {
+	return inTx(r.db, func(tx DBTX) error {
+		return syncSessions(tx, deviceID, sessions, seenAt)
+	})
+}
+
+// syncSessions is Sync on a transaction
+func syncSessions(tx DBTX, deviceID string, sessions []*models.UserSession, seenAt time.Time) error {
+	listed := make(map[string]*models.UserSession, len(sessions))
+	for _, session := range sessions {
+		listed[session.SessionID] = session
+	}
+
+	rows, err := tx.Query(`SELECT id, session_id, started_at FROM user_sessions WHERE device_id = $1 AND ended_at IS NULL`, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to get open sessions: %w", err)
+	}
+	var ended []string
+	for rows.Next() {
+		var id, sessionID string
+		var startedAt *time.Time
+		if err := rows.Scan(&id, &sessionID, &startedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan user session row: %w", err)
+		}
+		if session, found := listed[sessionID]; !found || !sameStart(session.StartedAt, startedAt) {
+			ended = append(ended, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("error iterating user session rows: %w", err)
+	}
+	rows.Close()
+
+	for _, id := range ended {
+		if _, err := tx.Exec(`UPDATE user_sessions SET ended_at = $2 WHERE id = $1`, id, seenAt); err != nil {
+			return fmt.Errorf("failed to end user session: %w", err)
+		}
+	}
+
+	query := `
+		INSERT INTO user_sessions (id, device_id, session_id, username, uid, tty, seat, remote_host, remote, service,
+			session_type, class, state, source, started_at, first_seen_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $16)
+		ON CONFLICT (device_id, session_id) WHERE ended_at IS NULL DO UPDATE SET
+			username = EXCLUDED.username,
+			state = EXCLUDED.state,
+			last_seen_at = GREATEST(user_sessions.last_seen_at, EXCLUDED.last_seen_at)`
+
+	for _, session := range sessions {
+		if session.ID == "" {
+			session.ID = uuid.New().String()
+		}
+
+		_, err := tx.Exec(
+			query,
+			session.ID,
+			deviceID,
+			session.SessionID,
+			session.Username,
+			session.UID,
+			session.TTY,
+			session.Seat,
+			session.RemoteHost,
+			session.Remote,
+			session.Service,
+			session.Type,
+			session.Class,
+			session.State,
+			session.Source,
+			session.StartedAt,
+			seenAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to upsert user session: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func sameStart(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// GetActiveAt returns the device's sessions open at the given time, earliest
+// first. A session without a start time counts from when it was first seen.
+func (r *SessionRepository) GetActiveAt(deviceID string, at time.Time) ([]*models.UserSession, error) {
+	query := `
+		SELECT id, device_id, session_id, username, uid, tty, seat, remote_host, remote, service, session_type,
+			class, state, source, started_at, first_seen_at, last_seen_at, ended_at, created_at
+		FROM user_sessions
+		WHERE device_id = $1 AND COALESCE(started_at, first_seen_at) <= $2 AND (ended_at IS NULL OR ended_at > $2)
+		ORDER BY COALESCE(started_at, first_seen_at)`
+
+	rows, err := r.db.Query(query, deviceID, at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*models.UserSession
+	for rows.Next() {
+		session := &models.UserSession{}
+		var uid sql.NullInt64
+
+		err := rows.Scan(
+			&session.ID,
+			&session.DeviceID,
+			&session.SessionID,
+			&session.Username,
+			&uid,
+			&session.TTY,
+			&session.Seat,
+			&session.RemoteHost,
+			&session.Remote,
+			&session.Service,
+			&session.Type,
+			&session.Class,
+			&session.State,
+			&session.Source,
+			&session.StartedAt,
+			&session.FirstSeenAt,
+			&session.LastSeenAt,
+			&session.EndedAt,
+			&session.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user session row: %w", err)
+		}
+		if uid.Valid {
+			value := uint32(uid.Int64)
+			session.UID = &value
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user session rows: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// DeleteOldSessions removes the device's sessions that ended before before
+func (r *SessionRepository) DeleteOldSessions(deviceID string, before time.Time) error {
+	query := `DELETE FROM user_sessions WHERE device_id = $1 AND ended_at < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old user sessions: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+type TaskRepository struct {
+	db DBTX
+}
+
+func NewTaskRepository(db DBTX) *TaskRepository {
+	return &TaskRepository{db: db}
+}
+
+// taskColumns is the column list shared by every task SELECT; it must stay in
+// the order scanTasks expects.
+const taskColumns = `id, device_id, task_type, parameters, status, requested_by, reason, timeout_seconds,
+			   result, error, output_truncated, expires_at, dispatched_at, completed_at, created_at`
+
+// Create queues a task
+func (r *TaskRepository) Create(task *models.AgentTask) error {
+	parametersJSON, err := json.Marshal(task.Parameters)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task parameters: %w", err)
+	}
+
+	query := `
+		INSERT INTO agent_tasks (id, device_id, task_type, parameters, status, requested_by, reason,
+			timeout_seconds, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING created_at`
+
+	if task.ID == "" {
+		task.ID = uuid.New().String()
+	}
+
+	err = r.db.QueryRow(
+		query,
+		task.ID,
+		task.DeviceID,
+		task.Type,
+		parametersJSON,
+		task.Status,
+		task.RequestedBy,
+		task.Reason,
+		task.TimeoutSeconds,
+		task.ExpiresAt,
+	).Scan(&task.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create task: %w", err)
+	}
+
+	return nil
+}
+
+// Claim marks the device's pending tasks as dispatched and returns them,
+// oldest first. Tasks claimed concurrently by another poll are skipped, so
+// each task is handed out once.
+func (r *TaskRepository) Claim(deviceID string, dispatchedAt time.Time, limit int) ([]*models.AgentTask, error) {
+	query := `
+		UPDATE agent_tasks SET status = $2, dispatched_at = $3
+		WHERE id IN (
+			SELECT id FROM agent_tasks
+			WHERE device_id = $1 AND status = $4 AND expires_at > $3
+			ORDER BY created_at
+			LIMIT $5
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + taskColumns
+
+	rows, err := r.db.Query(query, deviceID, models.TaskStatusDispatched, dispatchedAt, models.TaskStatusPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim tasks: %w", err)
+	}
+	defer rows.Close()
+
+	return scanTasks(rows)
+}
+
+// Complete records the result of a task dispatched to the device. It returns
+// sql.ErrNoRows when the device has no such dispatched task.
+func (r *TaskRepository) Complete(task *models.AgentTask) error {
+	query := `
+		UPDATE agent_tasks
+		SET status = $3, result = $4, error = $5, output_truncated = $6, completed_at = $7
+		WHERE id = $1 AND device_id = $2 AND status = $8`
+
+	var resultJSON []byte
+	if len(task.Result) > 0 {
+		resultJSON = task.Result
+	}
+
+	result, err := r.db.Exec(query, task.ID, task.DeviceID, task.Status, resultJSON, task.Error,
+		task.OutputTruncated, task.CompletedAt, models.TaskStatusDispatched)
+	if err != nil {
+		return fmt.Errorf("failed to complete task: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to complete task: %w", err)
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ExpireStale closes the device's tasks that can no longer finish: pending
+// tasks past their expiry, and dispatched tasks whose result has not arrived
+// within their timeout plus grace.
+func (r *TaskRepository) ExpireStale(deviceID string, now time.Time, grace time.Duration) error {
+	query := `
+		UPDATE agent_tasks SET status = $3, completed_at = $2
+		WHERE device_id = $1 AND status = $4 AND expires_at <= $2`
+
+	if _, err := r.db.Exec(query, deviceID, now, models.TaskStatusExpired, models.TaskStatusPending); err != nil {
+		return fmt.Errorf("failed to expire pending tasks: %w", err)
+	}
+
+	query = `
+		UPDATE agent_tasks SET status = $3, completed_at = $2, error = 'no result before the task timed out'
+		WHERE device_id = $1 AND status = $4
+			AND dispatched_at + make_interval(secs => timeout_seconds + $5) <= $2`
+
+	if _, err := r.db.Exec(query, deviceID, now, models.TaskStatusFailed, models.TaskStatusDispatched, int(grace.Seconds())); err != nil {
+		return fmt.Errorf("failed to fail timed out tasks: %w", err)
+	}
+
+	return nil
+}
+
+// GetByID returns one of the device's tasks, or nil if it has no such task
+func (r *TaskRepository) GetByID(deviceID, taskID string) (*models.AgentTask, error) {
+	query := `SELECT ` + taskColumns + ` FROM agent_tasks WHERE id = $1 AND device_id = $2`
+
+	rows, err := r.db.Query(query, taskID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	}
+	defer rows.Close()
+
+	tasks, err := scanTasks(rows)
+	if err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	return tasks[0], nil
+}
+
+// GetByDeviceID returns the device's tasks, most recent first. An empty
+// status matches any.
+func (r *TaskRepository) GetByDeviceID(deviceID, status string, limit, offset int) ([]*models.AgentTask, error) {
+	query := `
+		SELECT ` + taskColumns + `
+		FROM agent_tasks
+		WHERE device_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4`
+
+	rows, err := r.db.Query(query, deviceID, status, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tasks: %w", err)
+	}
+	defer rows.Close()
+
+	return scanTasks(rows)
+}
+
+func scanTasks(rows *sql.Rows) ([]*models.AgentTask, error) {
+	var tasks []*models.AgentTask
+	for rows.Next() {
+		task := &models.AgentTask{}
+		var parametersJSON, resultJSON []byte
+
+		err := rows.Scan(
+			&task.ID,
+			&task.DeviceID,
+			&task.Type,
+			&parametersJSON,
+			&task.Status,
+			&task.RequestedBy,
+			&task.Reason,
+			&task.TimeoutSeconds,
+			&resultJSON,
+			&task.Error,
+			&task.OutputTruncated,
+			&task.ExpiresAt,
+			&task.DispatchedAt,
+			&task.CompletedAt,
+			&task.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task row: %w", err)
+		}
+
+		if err := json.Unmarshal(parametersJSON, &task.Parameters); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal task parameters: %w", err)
+		}
+		if len(resultJSON) > 0 {
+			task.Result = resultJSON
+		}
+		tasks = append(tasks, task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating task rows: %w", err)
+	}
+
+	return tasks, nil
+}
+
+// DeleteOldTasks removes the device's tasks created before the given time
+func (r *TaskRepository) DeleteOldTasks(deviceID string, before time.Time) error {
+	query := `DELETE FROM agent_tasks WHERE device_id = $1 AND created_at < $2`
+
+	_, err := r.db.Exec(query, deviceID, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete old tasks: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"telemetry-service/internal/models"
+)
+
+var (
+	// ErrSnapshotTooLarge is returned by Save for a chunk that would take its
+	// snapshot past the size it may reach
+	ErrSnapshotTooLarge = errors.New("snapshot too large")
+
+	// ErrDeviceStagingFull is returned by Save for a chunk that would take
+	// the chunks staged for its device past the bytes it may stage
+	ErrDeviceStagingFull = errors.New("too many telemetry chunks staged for the device")
+)
+
+type TelemetryChunkRepository struct {
+	db DBTX
+}
+
+func NewTelemetryChunkRepository(db DBTX) *TelemetryChunkRepository {
+	return &TelemetryChunkRepository{db: db}
+}
+
+// Save stages a chunk and returns how many chunks of its snapshot are staged.
+// A chunk sent again is kept as first received. A new chunk that would take
+// the bytes staged for its snapshot past maxSnapshotBytes, or those staged
+// for its device past maxDeviceBytes, is not staged and Save returns
+// ErrSnapshotTooLarge or ErrDeviceStagingFull.
+func (r *TelemetryChunkRepository) Save(chunk *models.TelemetryChunk, maxSnapshotBytes, maxDeviceBytes int64) (int, error) {
+	var staged int
+	err := inTx(r.db, func(tx DBTX) error {
+		// Chunks of one device are staged one at a time, so that two at once
+		// cannot both fit under a limit they pass together
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('telemetry_chunks'), hashtext($1))`, chunk.DeviceID); err != nil {
+			return fmt.Errorf("failed to lock telemetry chunks: %w", err)
+		}
+
+		var exists bool
+		var snapshotBytes, deviceBytes int64
+		err := tx.QueryRow(`
+			SELECT
+				EXISTS (SELECT 1 FROM telemetry_chunks WHERE snapshot_id = $1 AND chunk_index = $2),
+				COALESCE(SUM(octet_length(data)) FILTER (WHERE snapshot_id = $1), 0),
+				COALESCE(SUM(octet_length(data)), 0)
+			FROM telemetry_chunks
+			WHERE device_id = $3`,
+			chunk.SnapshotID,
+			chunk.Index,
+			chunk.DeviceID,
+		).Scan(&exists, &snapshotBytes, &deviceBytes)
+		if err != nil {
+			return fmt.Errorf("failed to measure staged telemetry chunks: %w", err)
+		}
+
+		if !exists {
+			size := int64(len(chunk.Data))
+			if snapshotBytes+size > maxSnapshotBytes {
+				return ErrSnapshotTooLarge
+			}
+			if deviceBytes+size > maxDeviceBytes {
+				return ErrDeviceStagingFull
+			}
+
+			query := `
+				INSERT INTO telemetry_chunks (snapshot_id, chunk_index, chunk_count, device_id, data)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (snapshot_id, chunk_index) DO NOTHING`
+
+			_, err = tx.Exec(query, chunk.SnapshotID, chunk.Index, chunk.Count, chunk.DeviceID, chunk.Data)
+			if err != nil {
+				return fmt.Errorf("failed to save telemetry chunk: %w", err)
+			}
+		}
+
+		err = tx.QueryRow(
+			`SELECT COUNT(*) FROM telemetry_chunks WHERE snapshot_id = $1 AND device_id = $2`,
+			chunk.SnapshotID,
+			chunk.DeviceID,
+		).Scan(&staged)
+		if err != nil {
+			return fmt.Errorf("failed to count telemetry chunks: %w", err)
+		}
+		return nil
+	})
+	return staged, err
+}
+
+// Take removes and returns the staged chunks of a snapshot, in no particular
+// order. Removing them in the same statement means only one request gets a
+// snapshot's chunks, however many complete it at once; in a transaction, the
+// others wait for it and get them only if it rolls back.
+func (r *TelemetryChunkRepository) Take(snapshotID, deviceID string) ([]*models.TelemetryChunk, error) {
+	query := `
+		DELETE FROM telemetry_chunks
+		WHERE snapshot_id = $1 AND device_id = $2
+		RETURNING chunk_index, chunk_count, data`
+
+	rows, err := r.db.Query(query, snapshotID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take telemetry chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []*models.TelemetryChunk
+	for rows.Next() {
+		chunk := &models.TelemetryChunk{SnapshotID: snapshotID, DeviceID: deviceID}
+		if err := rows.Scan(&chunk.Index, &chunk.Count, &chunk.Data); err != nil {
+			return nil, fmt.Errorf("failed to scan telemetry chunk row: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating telemetry chunk rows: %w", err)
+	}
+
+	return chunks, nil
+}
+
+// Delete removes the staged chunks of a snapshot that was refused
+func (r *TelemetryChunkRepository) Delete(snapshotID, deviceID string) error {
+	_, err := r.db.Exec(`DELETE FROM telemetry_chunks WHERE snapshot_id = $1 AND device_id = $2`, snapshotID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete telemetry chunks: %w", err)
+	}
+	return nil
+}
+
+// DeleteReceivedBefore removes the chunks of uploads abandoned before their
+// last chunk arrived
+func (r *TelemetryChunkRepository) DeleteReceivedBefore(threshold time.Time) (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM telemetry_chunks WHERE received_at < $1`, threshold)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale telemetry chunks: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale telemetry chunks: %w", err)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+	"telemetry-service/internal/pki"
+)
+
+var (
+	// ErrCertificatesDisabled is returned for certificate requests when the
+	// service has no CA to issue them with
+	ErrCertificatesDisabled = errors.New("certificate issuance is not configured")
+
+	// ErrInvalidCertificateRequest wraps what is wrong with a certificate
+	// signing request
+	ErrInvalidCertificateRequest = errors.New("invalid certificate request")
+)
+
+// CertificateIssuer issues agents the client certificates they authenticate
+// with over mutual TLS
+type CertificateIssuer struct {
+	issuer   *pki.Issuer
+	validity time.Duration
+}
+
+func NewCertificateIssuer(issuer *pki.Issuer, validity time.Duration) *CertificateIssuer {
+	return &CertificateIssuer{issuer: issuer, validity: validity}
+}
+
+// IssueCertificate signs an enrolled agent's certificate signing request.
+// The certificate names the authenticated device, whatever subject the
+// request asked for, so an agent can only renew its own identity.
+func (s *TelemetryService) IssueCertificate(deviceID string, req *models.CertificateRequest) (*models.CertificateResponse, error) {
+	if s.certIssuer == nil {
+		return nil, ErrCertificatesDisabled
+	}
+	if deviceID == "" {
+		return nil, ErrEnrollmentRequired
+	}
+
+	csr, err := pki.ParseCSR([]byte(req.CSR))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificateRequest, err)
+	}
+
+	cert, err := s.certIssuer.issuer.IssueClient(csr.PublicKey, deviceID, s.certIssuer.validity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.CertificateResponse{
+		Certificate:  string(pki.EncodeCertificate(cert)),
+		SerialNumber: cert.SerialNumber.Text(16),
+		ExpiresAt:    cert.NotAfter,
+	}, nil
+}
+
+// AuthenticateCertificate returns the device a verified client certificate
+// names in its subject. A credential sent along with it must belong to the
+// same device.
+func (s *TelemetryService) AuthenticateCertificate(deviceID, credential string) (string, error) {
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return "", ErrInvalidCredential
+	}
+
+	device, err := s.deviceRepo.GetByID(deviceID)
+	if err != nil {
+		return "", err
+	}
+	if device == nil || device.EnrolledAt == nil {
+		return "", ErrInvalidCredential
+	}
+
+	if credential != "" {
+		credentialDeviceID, err := s.AuthenticateAgent(credential)
+		if err != nil {
+			return "", err
+		}
+		if credentialDeviceID != deviceID {
+			return "", ErrInvalidCredential
+		}
+	}
+	return deviceID, nil
+}
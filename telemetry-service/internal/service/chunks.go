@@ -0,0 +1,153 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+	"telemetry-service/internal/repository"
+)
+
+const (
+	// maxChunkCount bounds the chunks a snapshot may be split into
+	maxChunkCount = 256
+
+	// maxSnapshotSize bounds a snapshot reassembled from chunks
+	maxSnapshotSize = 256 * 1024 * 1024
+
+	// maxStagedBytesPerDevice bounds the chunks a device may have staged, over
+	// all its snapshots. Agents that have not enrolled share one device ID, ''.
+	maxStagedBytesPerDevice = 2 * maxSnapshotSize
+
+	// chunkRetention is how long the chunks of an unfinished upload are kept.
+	// An agent whose upload failed part way sends the snapshot again under a
+	// new snapshot ID.
+	chunkRetention = time.Hour
+)
+
+var (
+	// ErrInvalidChunk wraps what is wrong with a telemetry chunk or the chunks
+	// of a snapshot
+	ErrInvalidChunk = errors.New("invalid telemetry chunk")
+
+	// ErrChunkStagingFull is returned for a chunk of a device that has as
+	// much staged as it may; its snapshot may be sent again once the device's
+	// other uploads complete or expire
+	ErrChunkStagingFull = errors.New("too many telemetry chunks staged")
+)
+
+// AddTelemetryChunk stages one chunk of a snapshot. The chunk that completes
+// the snapshot takes every staged chunk, has decode parse the snapshot's JSON
+// and ingests it as ProcessTelemetry does, returning the request; until then
+// it returns nil. Taking the chunks and ingesting them is one transaction:
+// the chunks are only removed once the snapshot is stored, and are kept for
+// the agent to complete the upload again if storing it fails. A snapshot
+// that is refused, whether for its size, its content or its timestamp, can
+// never be stored, and its chunks are removed.
+func (s *TelemetryService) AddTelemetryChunk(chunk *models.TelemetryChunk, decode func(snapshot []byte) (*models.TelemetryRequest, error)) (*models.TelemetryRequest, error) {
+	if _, err := uuid.Parse(chunk.SnapshotID); err != nil {
+		return nil, fmt.Errorf("%w: snapshot ID %q is not a UUID", ErrInvalidChunk, chunk.SnapshotID)
+	}
+	if chunk.Count < 1 || chunk.Count > maxChunkCount {
+		return nil, fmt.Errorf("%w: chunk count must be between 1 and %d", ErrInvalidChunk, maxChunkCount)
+	}
+	if chunk.Index < 0 || chunk.Index >= chunk.Count {
+		return nil, fmt.Errorf("%w: chunk index %d out of range", ErrInvalidChunk, chunk.Index)
+	}
+
+	// Uploads start with their first chunk, which is when abandoned ones
+	// are swept
+	if chunk.Index == 0 {
+		if _, err := s.chunkRepo.DeleteReceivedBefore(time.Now().Add(-chunkRetention)); err != nil {
+			return nil, err
+		}
+	}
+
+	staged, err := s.chunkRepo.Save(chunk, maxSnapshotSize, maxStagedBytesPerDevice)
+	switch {
+	case errors.Is(err, repository.ErrSnapshotTooLarge):
+		return nil, s.refuseChunks(chunk, fmt.Errorf("%w: snapshot exceeds %d bytes", ErrInvalidChunk, maxSnapshotSize))
+	case errors.Is(err, repository.ErrDeviceStagingFull):
+		return nil, s.refuseChunks(chunk, ErrChunkStagingFull)
+	case err != nil:
+		return nil, err
+	}
+	if staged < chunk.Count {
+		return nil, nil
+	}
+
+	var req *models.TelemetryRequest
+	var resync *ResyncRequiredError
+	var refused bool
+	err = s.transactor.InTx(func(tx repository.DBTX) error {
+		txService := s.withTx(tx)
+		chunks, err := txService.chunkRepo.Take(chunk.SnapshotID, chunk.DeviceID)
+		if err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			// Another request completed the snapshot at the same time
+			return nil
+		}
+
+		snapshot, err := assembleChunks(chunks)
+		if err != nil {
+			refused = true
+			return err
+		}
+		if req, err = decode(snapshot); err != nil {
+			refused = true
+			return err
+		}
+		resync, err = txService.processTelemetry(chunk.DeviceID, req)
+		refused = errors.Is(err, ErrSnapshotExpired) ||
+			errors.Is(err, ErrSnapshotInFuture) ||
+			errors.Is(err, ErrUnredactedCmdline)
+		return err
+	})
+	if refused {
+		return req, s.refuseChunks(chunk, err)
+	}
+	if err == nil && resync != nil {
+		return req, resync
+	}
+	return req, err
+}
+
+// refuseChunks removes the staged chunks of a snapshot refused for err, and
+// returns err
+func (s *TelemetryService) refuseChunks(chunk *models.TelemetryChunk, err error) error {
+	if deleteErr := s.chunkRepo.Delete(chunk.SnapshotID, chunk.DeviceID); deleteErr != nil {
+		return errors.Join(err, deleteErr)
+	}
+	return err
+}
+
+// assembleChunks joins the chunks of a snapshot in order, checking that they
+// agree on their count and that none is missing
+func assembleChunks(chunks []*models.TelemetryChunk) ([]byte, error) {
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+
+	size := 0
+	for i, chunk := range chunks {
+		if chunk.Count != len(chunks) || chunk.Index != i {
+			return nil, fmt.Errorf("%w: chunks of snapshot %s disagree on their count", ErrInvalidChunk, chunk.SnapshotID)
+		}
+		size += len(chunk.Data)
+	}
+	if size > maxSnapshotSize {
+		return nil, fmt.Errorf("%w: snapshot exceeds %d bytes", ErrInvalidChunk, maxSnapshotSize)
+	}
+
+	var snapshot bytes.Buffer
+	snapshot.Grow(size)
+	for _, chunk := range chunks {
+		snapshot.Write(chunk.Data)
+	}
+	return snapshot.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"telemetry-service/internal/models"
+)
+
+func TestAssembleChunks(t *testing.T) {
+	chunk := func(index, count int, data string) *models.TelemetryChunk {
+		return &models.TelemetryChunk{SnapshotID: "snapshot", Index: index, Count: count, Data: []byte(data)}
+	}
+
+	tests := []struct {
+		name    string
+		chunks  []*models.TelemetryChunk
+		want    string
+		wantErr bool
+	}{
+		{"one chunk", []*models.TelemetryChunk{chunk(0, 1, `{"a":1}`)}, `{"a":1}`, false},
+		{"in order", []*models.TelemetryChunk{chunk(0, 3, `{"a"`), chunk(1, 3, `:`), chunk(2, 3, `1}`)}, `{"a":1}`, false},
+		{"out of order", []*models.TelemetryChunk{chunk(2, 3, `1}`), chunk(0, 3, `{"a"`), chunk(1, 3, `:`)}, `{"a":1}`, false},
+		{"chunk missing", []*models.TelemetryChunk{chunk(0, 3, `{"a"`), chunk(2, 3, `1}`)}, "", true},
+		{"counts disagree", []*models.TelemetryChunk{chunk(0, 2, `{"a"`), chunk(1, 3, `:1}`)}, "", true},
+		{"more chunks than counted", []*models.TelemetryChunk{chunk(0, 1, `{"a"`), chunk(1, 1, `:1}`)}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := assembleChunks(tt.chunks)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidChunk) {
+					t.Errorf("assembleChunks() error = %v, want ErrInvalidChunk", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("assembleChunks() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("assembleChunks() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssembleChunksTooLarge(t *testing.T) {
+	// The chunks share one buffer, which is never written
+	half := make([]byte, maxSnapshotSize/2+1)
+	chunks := []*models.TelemetryChunk{
+		{SnapshotID: "snapshot", Index: 0, Count: 2, Data: half},
+		{SnapshotID: "snapshot", Index: 1, Count: 2, Data: half},
+	}
+	if _, err := assembleChunks(chunks); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("assembleChunks() error = %v, want ErrInvalidChunk", err)
+	}
+}
+
+func TestAddTelemetryChunkValidation(t *testing.T) {
+	const snapshotID = "0b6f1a8e-55a4-4d4e-9b8f-3f0f6c1f1d2a"
+
+	tests := []struct {
+		name  string
+		chunk models.TelemetryChunk
+	}{
+		{"snapshot ID not a UUID", models.TelemetryChunk{SnapshotID: "snapshot-1", Index: 0, Count: 2}},
+		{"no chunks", models.TelemetryChunk{SnapshotID: snapshotID, Index: 0, Count: 0}},
+		{"too many chunks", models.TelemetryChunk{SnapshotID: snapshotID, Index: 0, Count: maxChunkCount + 1}},
+		{"negative index", models.TelemetryChunk{SnapshotID: snapshotID, Index: -1, Count: 2}},
+		{"index past the count", models.TelemetryChunk{SnapshotID: snapshotID, Index: 2, Count: 2}},
+	}
+
+	// Invalid chunks are refused before anything is staged, so the service
+	// needs no repositories
+	s := &TelemetryService{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := s.AddTelemetryChunk(&tt.chunk, nil)
+			if !errors.Is(err, ErrInvalidChunk) || req != nil {
+				t.Errorf("AddTelemetryChunk() = %v, %v, want ErrInvalidChunk", req, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+// defaultEnrollmentTokenExpiry applies to tokens created without an expiry
+const defaultEnrollmentTokenExpiry = 7 * 24 * time.Hour
+
+var (
+	// ErrInvalidEnrollmentToken is returned for enrollments with a token that
+	// is unknown, revoked, expired or used up
+	ErrInvalidEnrollmentToken = errors.New("enrollment token is invalid, expired or used up")
+
+	// ErrEnrollmentTokenNotFound is returned when revoking an unknown token
+	ErrEnrollmentTokenNotFound = errors.New("enrollment token not found")
+
+	// ErrInvalidCredential is returned for agent requests whose credential
+	// does not match an enrolled device
+	ErrInvalidCredential = errors.New("invalid device credential")
+
+	// ErrEnrollmentRequired is returned for agent requests without a
+	// credential when enrollment is required
+	ErrEnrollmentRequired = errors.New("device is not enrolled")
+)
+
+// CreateEnrollmentToken creates a bootstrap token. Its value is only
+// returned now; the token is stored by its hash.
+func (s *TelemetryService) CreateEnrollmentToken(req *models.CreateEnrollmentTokenRequest) (*models.EnrollmentToken, error) {
+	value, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := defaultEnrollmentTokenExpiry
+	if req.ExpiresInHours > 0 {
+		expiry = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+
+	token := &models.EnrollmentToken{
+		Description: req.Description,
+		CreatedBy:   req.CreatedBy,
+		MaxUses:     req.MaxUses,
+		ExpiresAt:   time.Now().Add(expiry),
+	}
+	if err := s.tokenRepo.Create(token, hashSecret(value)); err != nil {
+		return nil, err
+	}
+	token.Token = value
+	return token, nil
+}
+
+// ListEnrollmentTokens returns every bootstrap token, without their values
+func (s *TelemetryService) ListEnrollmentTokens() ([]*models.EnrollmentToken, error) {
+	return s.tokenRepo.List()
+}
+
+// RevokeEnrollmentToken stops a bootstrap token from enrolling more devices
+func (s *TelemetryService) RevokeEnrollmentToken(id string) error {
+	revoked, err := s.tokenRepo.Revoke(id, time.Now())
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrEnrollmentTokenNotFound
+	}
+	return nil
+}
+
+// Enroll issues an agent presenting a valid bootstrap token its device ID
+// and credential. A device the agent reported as before it enrolled, found
+// by machine ID or MAC address, keeps its history; a device that is already
+// enrolled is never handed to another agent, so an agent that lost its
+// credential enrolls as a new device.
+func (s *TelemetryService) Enroll(req *models.EnrollRequest) (*models.EnrollResponse, error) {
+	tokenID, err := s.tokenRepo.Consume(hashSecret(req.Token), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if tokenID == "" {
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	device, err := s.deviceRepo.GetUnenrolled(req.HostMetadata.MachineID, req.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		device = &models.Device{}
+	}
+	device.MacAddress = req.MacAddress
+	device.Hostname = req.HostMetadata.Hostname
+	device.OS = req.HostMetadata.OS
+	device.Platform = req.HostMetadata.Platform
+	device.Version = req.HostMetadata.Version
+	device.CurrentUser = req.HostMetadata.CurrentUser
+	device.MachineID = req.HostMetadata.MachineID
+	device.HardwareSerial = req.HostMetadata.HardwareSerial
+
+	secret, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.deviceRepo.Enroll(device, hashSecret(secret), tokenID); err != nil {
+		return nil, err
+	}
+
+	return &models.EnrollResponse{DeviceID: device.ID, Credential: device.ID + "." + secret}, nil
+}
+
+// AuthenticateAgent returns the device a credential was issued to. Without
+// a credential it returns "", for the agent to be identified by its MAC
+// address, unless enrollment is required.
+func (s *TelemetryService) AuthenticateAgent(credential string) (string, error) {
+	if credential == "" {
+		if s.requireEnrollment {
+			return "", ErrEnrollmentRequired
+		}
+		return "", nil
+	}
+
+	deviceID, secret, found := strings.Cut(credential, ".")
+	if !found || secret == "" {
+		return "", ErrInvalidCredential
+	}
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return "", ErrInvalidCredential
+	}
+
+	credentialHash, err := s.deviceRepo.GetCredentialHash(deviceID)
+	if err != nil {
+		return "", err
+	}
+	if credentialHash == "" || subtle.ConstantTimeCompare([]byte(credentialHash), []byte(hashSecret(secret))) != 1 {
+		return "", ErrInvalidCredential
+	}
+	return deviceID, nil
+}
+
+// randomSecret returns 256 random bits, URL-safe encoded
+func randomSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashSecret is how tokens and credentials are stored; they are random, so
+// an unsalted hash is enough
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,271 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry-service/internal/models"
+)
+
+var (
+	// ErrPoliciesDisabled is returned for policy requests when the service
+	// has no key to sign policies with
+	ErrPoliciesDisabled = errors.New("agent policies are not configured")
+
+	// ErrInvalidPolicy wraps what is wrong with a policy's settings
+	ErrInvalidPolicy = errors.New("invalid agent policy")
+
+	// ErrPolicyNotFound is returned when deleting an unknown policy
+	ErrPolicyNotFound = errors.New("agent policy not found")
+)
+
+// policySettings are the settings a policy may hold, with the JSON kind of
+// their values. They are the agent settings a running agent can change;
+// agents ignore any others.
+var policySettings = map[string]string{
+	"collection_interval":  "duration",
+	"checkpoint_interval":  "duration",
+	"collection_timeout":   "duration",
+	"collectors":           "object",
+	"redaction_rules":      "strings",
+	"upload_compression":   "compression",
+	"upload_chunk_size_mb": "number",
+}
+
+// PolicySigner signs the policy documents served to agents, which verify
+// them with its public key
+type PolicySigner struct {
+	key ed25519.PrivateKey
+}
+
+func NewPolicySigner(key ed25519.PrivateKey) *PolicySigner {
+	return &PolicySigner{key: key}
+}
+
+// sign returns the base64 signature of a document as sent
+func (p *PolicySigner) sign(document []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, document))
+}
+
+// SetAgentPolicy creates or replaces the policy of a scope
+func (s *TelemetryService) SetAgentPolicy(req *models.SetAgentPolicyRequest) (*models.AgentPolicy, error) {
+	if req.Scope == models.PolicyScopeDefault && req.Target != "" {
+		return nil, fmt.Errorf("%w: the default policy has no target", ErrInvalidPolicy)
+	}
+	if req.Scope != models.PolicyScopeDefault && req.Target == "" {
+		return nil, fmt.Errorf("%w: a %s policy needs a target", ErrInvalidPolicy, req.Scope)
+	}
+	if req.Scope == models.PolicyScopeDevice {
+		if _, err := uuid.Parse(req.Target); err != nil {
+			return nil, fmt.Errorf("%w: target %q is not a device ID", ErrInvalidPolicy, req.Target)
+		}
+	}
+	if err := validatePolicySettings(req.Settings); err != nil {
+		return nil, err
+	}
+
+	policy := &models.AgentPolicy{
+		Scope:     req.Scope,
+		Target:    req.Target,
+		Settings:  req.Settings,
+		UpdatedBy: req.UpdatedBy,
+	}
+	if err := s.policyRepo.Set(policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// ListAgentPolicies returns every policy, the broadest first
+func (s *TelemetryService) ListAgentPolicies() ([]*models.AgentPolicy, error) {
+	return s.policyRepo.List()
+}
+
+// DeleteAgentPolicy removes a policy; its devices fall back on the broader
+// policies
+func (s *TelemetryService) DeleteAgentPolicy(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrPolicyNotFound
+	}
+	deleted, err := s.policyRepo.Delete(id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrPolicyNotFound
+	}
+	return nil
+}
+
+// SetDevicePolicyGroup puts a device in a policy group, or takes it out of
+// its group with an empty group
+func (s *TelemetryService) SetDevicePolicyGroup(deviceID, group string) error {
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return ErrDeviceNotFound
+	}
+	updated, err := s.deviceRepo.SetPolicyGroup(deviceID, strings.TrimSpace(group))
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// AgentPolicy returns the policy document of an enrolled device and its
+// signature. Its settings are those of the default policy, overridden by
+// the device's group's and then by its own, merged as a JSON merge patch
+// (RFC 7386): objects merge key by key, and null removes a setting.
+func (s *TelemetryService) AgentPolicy(deviceID string) ([]byte, string, error) {
+	if s.policySigner == nil {
+		return nil, "", ErrPoliciesDisabled
+	}
+	if deviceID == "" {
+		return nil, "", ErrEnrollmentRequired
+	}
+
+	group, found, err := s.deviceRepo.GetPolicyGroup(deviceID)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		return nil, "", ErrDeviceNotFound
+	}
+
+	policies, err := s.policyRepo.ForDevice(deviceID, group)
+	if err != nil {
+		return nil, "", err
+	}
+	settings := map[string]interface{}{}
+	for _, policy := range policies {
+		var patch map[string]interface{}
+		if err := json.Unmarshal(policy.Settings, &patch); err != nil {
+			return nil, "", fmt.Errorf("failed to parse settings of policy %s: %w", policy.ID, err)
+		}
+		settings = mergePatch(settings, patch)
+	}
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal policy settings: %w", err)
+	}
+
+	document, err := json.Marshal(models.PolicyDocument{
+		DeviceID: deviceID,
+		Group:    group,
+		IssuedAt: time.Now().UTC(),
+		Settings: settingsJSON,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	return document, s.policySigner.sign(document), nil
+}
+
+// validatePolicySettings checks that settings is a JSON object of known
+// settings with values of the right kind. A null value is allowed, for a
+// narrower policy to remove a setting of a broader one.
+func validatePolicySettings(settings json.RawMessage) error {
+	decoder := json.NewDecoder(bytes.NewReader(settings))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil || values == nil {
+		return fmt.Errorf("%w: settings must be a JSON object", ErrInvalidPolicy)
+	}
+
+	for name, value := range values {
+		kind, known := policySettings[name]
+		if !known {
+			names := make([]string, 0, len(policySettings))
+			for known := range policySettings {
+				names = append(names, known)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("%w: unknown setting %q, expected one of %s", ErrInvalidPolicy, name, strings.Join(names, ", "))
+		}
+		if value == nil {
+			continue
+		}
+
+		valid := false
+		switch kind {
+		case "duration":
+			// Seconds, or a duration such as "5m"
+			switch v := value.(type) {
+			case json.Number:
+				seconds, err := v.Int64()
+				valid = err == nil && seconds > 0
+			case string:
+				d, err := time.ParseDuration(v)
+				valid = err == nil && d > 0
+			}
+		case "number":
+			number, ok := value.(json.Number)
+			if ok {
+				n, err := number.Int64()
+				valid = err == nil && n > 0
+			}
+		case "compression":
+			compression, _ := value.(string)
+			valid = compression == "zstd" || compression == "gzip" || compression == "none"
+		case "object":
+			_, valid = value.(map[string]interface{})
+		case "strings":
+			list, ok := value.([]interface{})
+			valid = ok
+			for _, item := range list {
+				if _, ok := item.(string); !ok {
+					valid = false
+				}
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%w: setting %q must be %s", ErrInvalidPolicy, name, describeKind(kind))
+		}
+	}
+	return nil
+}
+
+func describeKind(kind string) string {
+	switch kind {
+	case "duration":
+		return "a positive number of seconds or a duration such as \"5m\""
+	case "number":
+		return "a positive whole number"
+	case "strings":
+		return "a list of strings"
+	case "compression":
+		return "zstd, gzip or none"
+	default:
+		return "an object"
+	}
+}
+
+// mergePatch applies a JSON merge patch to target
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for name, value := range patch {
+		if value == nil {
+			delete(target, name)
+			continue
+		}
+		if patchObject, ok := value.(map[string]interface{}); ok {
+			targetObject, _ := target[name].(map[string]interface{})
+			if targetObject == nil {
+				targetObject = map[string]interface{}{}
+			}
+			target[name] = mergePatch(targetObject, patchObject)
+			continue
+		}
+		target[name] = value
+	}
+	return target
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"telemetry-service/internal/models"
+)
+
+// redactionVersion is the version of the built-in detectors, matching the
+// agent's. Processes redacted by an older version are redacted again.
+const redactionVersion = 2
+
+// redactedText replaces every secret found in a command line
+const redactedText = "[REDACTED]"
+
+// Policies for processes whose command line the agent did not redact
+const (
+	RedactionPolicyRedact = "redact"
+	RedactionPolicyReject = "reject"
+)
+
+// ErrUnredactedCmdline is returned under RedactionPolicyReject for payloads
+// carrying command lines the agent did not redact
+var ErrUnredactedCmdline = errors.New("payload contains unredacted command lines")
+
+// RedactionRule finds secrets in a command line. When the pattern has a
+// capture group only the first group is redacted; otherwise the whole match
+// is. Accept, when set, must also approve the redacted text. A RedactsNext
+// rule matches an argument naming a secret and redacts the one after it.
+type RedactionRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Accept      func(string) bool
+	RedactsNext bool
+}
+
+// builtinRedactionRuleText is a copy of the agent's built-in rules, the one
+// definition of them
+//
+//go:generate cp ../../../laptop-agent/redaction_rules.txt redaction_rules.txt
+//go:embed redaction_rules.txt
+var builtinRedactionRuleText string
+
+// builtinRedactionRules are the agent's detectors, applied in the same order
+var builtinRedactionRules = mustParseBuiltinRedactionRules()
+
+// redactionChecks approve what the built-in rule of the same name matched
+var redactionChecks = map[string]func(string) bool{
+	"high_entropy": isHighEntropyToken,
+}
+
+// redactionFlagRules are the built-in rules that redact the argument after
+// the one they match
+var redactionFlagRules = map[string]bool{
+	"secret_flag": true,
+}
+
+func mustParseBuiltinRedactionRules() []RedactionRule {
+	rules, err := parseRedactionRules("redaction_rules.txt", bufio.NewScanner(strings.NewReader(builtinRedactionRuleText)))
+	if err != nil {
+		panic(err)
+	}
+	for i := range rules {
+		rules[i].Accept = redactionChecks[rules[i].Name]
+		rules[i].RedactsNext = redactionFlagRules[rules[i].Name]
+	}
+	return rules
+}
+
+// Redactor enforces command-line redaction on incoming telemetry. Processes
+// from agents that predate redaction are redacted here, or their payload is
+// rejected, depending on the policy.
+type Redactor struct {
+	policy string
+	rules  []RedactionRule
+}
+
+// NewRedactor returns a redactor applying custom, then the built-in rules
+func NewRedactor(policy string, custom []RedactionRule) *Redactor {
+	rules := make([]RedactionRule, 0, len(custom)+len(builtinRedactionRules))
+	rules = append(rules, custom...)
+	rules = append(rules, builtinRedactionRules...)
+	return &Redactor{policy: policy, rules: rules}
+}
+
+// Enforce checks every process in the request. Command lines the agent
+// redacted with the current detectors are kept as sent; the rest are
+// redacted again, or ErrUnredactedCmdline is returned for unredacted ones
+// when the policy rejects them. The command lines of events, persistence
+// items and findings carry no marker, so they are always redacted again,
+// which leaves what the agent redacted as it was.
+func (r *Redactor) Enforce(req *models.TelemetryRequest) error {
+	processes := [][]models.ProcessInfo{req.Processes}
+	if req.Delta != nil {
+		processes = append(processes, req.Delta.ProcessesStarted)
+	}
+
+	for _, list := range processes {
+		for i := range list {
+			process := &list[i]
+			if process.Redaction != nil && process.Redaction.Version >= redactionVersion {
+				process.Redaction.RedactedBy = models.RedactedByAgent
+				continue
+			}
+			// An agent with older detectors did redact; only agents that
+			// predate redaction are refused
+			if r.policy == RedactionPolicyReject && process.Redaction == nil && len(process.Cmdline) > 0 {
+				return ErrUnredactedCmdline
+			}
+
+			cmdline, rules := r.Redact(process.Cmdline)
+			process.Cmdline = cmdline
+			process.Redaction = &models.Redaction{
+				Version:    redactionVersion,
+				Rules:      rules,
+				RedactedBy: models.RedactedByServer,
+			}
+		}
+	}
+
+	for i := range req.AuthEvents {
+		req.AuthEvents[i].Command = r.RedactText(req.AuthEvents[i].Command)
+	}
+	for i := range req.ContainerEvents {
+		req.ContainerEvents[i].ExecCommand = r.RedactText(req.ContainerEvents[i].ExecCommand)
+	}
+	persistence := [][]models.PersistenceItemInfo{req.Persistence}
+	if req.Delta != nil {
+		persistence = append(persistence, req.Delta.PersistenceChanged)
+	}
+	for _, list := range persistence {
+		for i := range list {
+			list[i].Commands, _ = r.Redact(list[i].Commands)
+		}
+	}
+	for i := range req.Findings {
+		if cmdline, found := req.Findings[i].Evidence["cmdline"]; found {
+			req.Findings[i].Evidence["cmdline"] = r.RedactText(cmdline)
+		}
+	}
+
+	return nil
+}
+
+// RedactText returns a command line stored as one string, e.g. a sudo
+// command, with every secret replaced
+func (r *Redactor) RedactText(text string) string {
+	if text == "" {
+		return text
+	}
+	redacted, _ := r.Redact([]string{text})
+	return redacted[0]
+}
+
+// RedactJSON replaces the secrets in every string of a JSON document, such
+// as a task's result
+func (r *Redactor) RedactJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(r.redactValue(document))
+}
+
+func (r *Redactor) redactValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		return r.RedactText(v)
+	case []any:
+		for i := range v {
+			v[i] = r.redactValue(v[i])
+		}
+	case map[string]any:
+		for key := range v {
+			v[key] = r.redactValue(v[key])
+		}
+	}
+	return value
+}
+
+// Redact returns the command line with every secret replaced, and the names
+// of the rules that found something
+func (r *Redactor) Redact(cmdline []string) ([]string, []string) {
+	if len(cmdline) == 0 {
+		return cmdline, nil
+	}
+
+	fired := make(map[string]bool)
+	redacted := make([]string, len(cmdline))
+	flag := "" // the rule that matched the previous argument, naming a secret
+	for i, arg := range cmdline {
+		if flag != "" && isSecretValue(arg) {
+			fired[flag] = true
+			redacted[i], flag = redactedText, ""
+			continue
+		}
+		flag = ""
+		for _, rule := range r.rules {
+			if rule.RedactsNext {
+				if rule.Pattern.MatchString(arg) {
+					flag = rule.Name
+				}
+				continue
+			}
+			var found bool
+			arg, found = rule.apply(arg)
+			if found {
+				fired[rule.Name] = true
+			}
+		}
+		redacted[i] = arg
+	}
+
+	var names []string
+	for name := range fired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return redacted, names
+}
+
+// isSecretValue reports whether the argument after a flag naming a secret
+// is its value, rather than another flag
+func isSecretValue(arg string) bool {
+	return arg != "" && arg != redactedText && !strings.HasPrefix(arg, "-")
+}
+
+// apply replaces every match of the rule in text and reports whether any was
+// found
+func (rule RedactionRule) apply(text string) (string, bool) {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, false
+	}
+
+	var b strings.Builder
+	last, found := 0, false
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) >= 4 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		secret := text[start:end]
+		if secret == "" || secret == redactedText || (rule.Accept != nil && !rule.Accept(secret)) {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(redactedText)
+		last, found = end, true
+	}
+	if !found {
+		return text, false
+	}
+	b.WriteString(text[last:])
+	return b.String(), true
+}
+
+// isHighEntropyToken reports tokens that look randomly generated: letters of
+// both cases and digits, and at least 4.2 bits of entropy per character
+func isHighEntropyToken(token string) bool {
+	var upper, lower, digit bool
+	counts := make(map[rune]int)
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		counts[c]++
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	var entropy float64
+	length := float64(len(token))
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= 4.2
+}
+
+// LoadRedactionRules reads the organisation's redaction rules, in the format
+// the agent reads: one rule per line, a name followed by a regular
+// expression, with blank lines and lines starting with "#" ignored
+func LoadRedactionRules(path string) ([]RedactionRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open redaction rules: %w", err)
+	}
+	defer file.Close()
+
+	return parseRedactionRules(path, bufio.NewScanner(file))
+}
+
+// parseRedactionRules parses the rules scanner reads, in the format of
+// LoadRedactionRules; source names where they came from in errors
+func parseRedactionRules(source string, scanner *bufio.Scanner) ([]RedactionRule, error) {
+	var rules []RedactionRule
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.IndexAny(line, " \t")
+		if separator < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a rule name and a regular expression", source, lineNumber)
+		}
+		name, expr := line[:separator], strings.TrimSpace(line[separator:])
+		if expr == "" {
+			return nil, fmt.Errorf("%s:%d: expected a rule name and a regular expression", source, lineNumber)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", source, lineNumber, err)
+		}
+		rules = append(rules, RedactionRule{Name: name, Pattern: pattern})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read redaction rules: %w", err)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"telemetry-service/internal/models"
+)
+
+const (
+	// defaultTaskTimeout applies to tasks queued without a timeout
+	defaultTaskTimeout = 60
+
+	// taskExpiry is how long a task waits for the agent to pick it up
+	taskExpiry = time.Hour
+
+	// taskResultGrace is how long past its timeout a dispatched task waits for
+	// its result before it is failed
+	taskResultGrace = time.Minute
+
+	// maxTasksPerPoll bounds the tasks handed to an agent at once
+	maxTasksPerPoll = 10
+
+	// taskRetention is how long task audit records are kept
+	taskRetention = 90 * 24 * time.Hour
+)
+
+var (
+	// ErrDeviceNotFound is returned for tasks addressed to an unknown device
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrTaskNotFound is returned for results of tasks that were not
+	// dispatched to the reporting device, or were already closed
+	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrInvalidTask wraps what is wrong with the parameters of a new task
+	ErrInvalidTask = errors.New("invalid task")
+)
+
+// CreateTask queues a task for a device's agent
+func (s *TelemetryService) CreateTask(deviceID string, req *models.CreateTaskRequest) (*models.AgentTask, error) {
+	if err := validateTaskParameters(req.Type, req.Parameters); err != nil {
+		return nil, err
+	}
+
+	device, err := s.deviceRepo.GetByID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	timeout := req.TimeoutSeconds
+	if timeout == 0 {
+		timeout = defaultTaskTimeout
+	}
+	parameters := req.Parameters
+	if parameters == nil {
+		parameters = map[string]string{}
+	}
+
+	task := &models.AgentTask{
+		DeviceID:       device.ID,
+		Type:           req.Type,
+		Parameters:     parameters,
+		Status:         models.TaskStatusPending,
+		RequestedBy:    req.RequestedBy,
+		Reason:         req.Reason,
+		TimeoutSeconds: timeout,
+		ExpiresAt:      time.Now().Add(taskExpiry),
+	}
+	if err := s.taskRepo.Create(task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// validateTaskParameters checks that a task carries exactly the parameters
+// its type takes
+func validateTaskParameters(taskType string, parameters map[string]string) error {
+	var allowed []string
+	switch taskType {
+	case models.TaskCollectNow:
+	case models.TaskHashFile, models.TaskListDirectory:
+		allowed = []string{"path"}
+		if p := parameters["path"]; !path.IsAbs(p) && !isWindowsAbs(p) {
+			return fmt.Errorf("%w: path parameter must be an absolute path", ErrInvalidTask)
+		}
+	case models.TaskContainerInspect:
+		allowed = []string{"id", "namespace"}
+		if id := parameters["id"]; id == "" || strings.HasPrefix(id, "-") {
+			return fmt.Errorf("%w: id parameter must be a container ID or name", ErrInvalidTask)
+		}
+	default:
+		return fmt.Errorf("%w: unknown task type %q", ErrInvalidTask, taskType)
+	}
+
+	for name := range parameters {
+		if !slices.Contains(allowed, name) {
+			return fmt.Errorf("%w: %s does not take a %q parameter", ErrInvalidTask, taskType, name)
+		}
+	}
+	return nil
+}
+
+// isWindowsAbs reports absolute Windows paths such as C:\Users
+func isWindowsAbs(p string) bool {
+	return len(p) >= 3 && p[1] == ':' && (p[2] == '\\' || p[2] == '/')
+}
+
+// PollTasks hands an agent the tasks queued for its device, marking them
+// dispatched. deviceID is the authenticated device of an enrolled agent;
+// tasks are never handed out on a MAC address the agent claims.
+func (s *TelemetryService) PollTasks(deviceID string) ([]*models.AgentTask, error) {
+	device, err := s.deviceRepo.GetByID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	now := time.Now()
+	if err := s.taskRepo.ExpireStale(device.ID, now, taskResultGrace); err != nil {
+		return nil, err
+	}
+	return s.taskRepo.Claim(device.ID, now, maxTasksPerPoll)
+}
+
+// CompleteTask records the result an enrolled agent sent for a task
+// dispatched to its device
+func (s *TelemetryService) CompleteTask(deviceID, taskID string, req *models.TaskResultRequest) error {
+	device, err := s.deviceRepo.GetByID(deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return ErrDeviceNotFound
+	}
+
+	// Results are redacted like command lines, for agents that predate
+	// redacting them
+	result := req.Result
+	if len(result) > 0 && string(result) != "null" {
+		if result, err = s.redactor.RedactJSON(result); err != nil {
+			return fmt.Errorf("failed to redact task result: %w", err)
+		}
+	}
+
+	completedAt := time.Now()
+	task := &models.AgentTask{
+		ID:              taskID,
+		DeviceID:        device.ID,
+		Status:          req.Status,
+		Result:          result,
+		Error:           s.redactor.RedactText(req.Error),
+		OutputTruncated: req.OutputTruncated,
+		CompletedAt:     &completedAt,
+	}
+	err = s.taskRepo.Complete(task)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTaskNotFound
+	}
+	return err
+}
+
+// GetTasks returns the device's tasks, most recent first
+func (s *TelemetryService) GetTasks(deviceID, status string, limit, offset int) ([]*models.AgentTask, error) {
+	if err := s.taskRepo.ExpireStale(deviceID, time.Now(), taskResultGrace); err != nil {
+		return nil, err
+	}
+	return s.taskRepo.GetByDeviceID(deviceID, status, limit, offset)
+}
+
+// GetTask returns one of the device's tasks, or nil if it has no such task
+func (s *TelemetryService) GetTask(deviceID, taskID string) (*models.AgentTask, error) {
+	if err := s.taskRepo.ExpireStale(deviceID, time.Now(), taskResultGrace); err != nil {
+		return nil, err
+	}
+	return s.taskRepo.GetByID(deviceID, taskID)
+}
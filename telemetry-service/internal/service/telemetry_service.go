@@ -1,18 +1,90 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"telemetry-service/internal/models"
 	"telemetry-service/internal/repository"
 )
 
+const (
+	// dataRetention is how long process and container history is kept per device
+	dataRetention = 7 * 24 * time.Hour
+
+	// maxClockSkew bounds how far ahead of server time a snapshot may be stamped
+	maxClockSkew = 5 * time.Minute
+
+	// maxMetricPoints bounds the points of a metrics query; longer ranges are
+	// served at a coarser step
+	maxMetricPoints = 1000
+
+	// bruteForceWindow and bruteForceThreshold define a brute-force attack:
+	// that many failed attempts from one source within the window
+	bruteForceWindow    = 10 * time.Minute
+	bruteForceThreshold = 10
+)
+
+// metricResolutions are the resolutions device metrics are kept at, finest
+// first, with the bucket size and retention of each
+var metricResolutions = []struct {
+	name      string
+	size      time.Duration
+	retention time.Duration
+}{
+	{models.MetricResolutionRaw, 0, 48 * time.Hour},
+	{models.MetricResolution5Minute, 5 * time.Minute, dataRetention},
+	{models.MetricResolutionHourly, time.Hour, 90 * 24 * time.Hour},
+}
+
+var (
+	// ErrSnapshotExpired is returned for replayed snapshots that fall outside
+	// the retention window and would be deleted again immediately
+	ErrSnapshotExpired = errors.New("snapshot is older than the retention window")
+
+	// ErrSnapshotInFuture is returned for snapshots stamped beyond maxClockSkew
+	ErrSnapshotInFuture = errors.New("snapshot timestamp is in the future")
+)
+
+// ResyncRequiredError is returned when a delta does not directly follow the
+// last sequence number accepted from the device, meaning at least one payload
+// was lost and the agent must send a full snapshot.
+type ResyncRequiredError struct {
+	Expected uint64
+	Received uint64
+}
+
+func (e *ResyncRequiredError) Error() string {
+	return fmt.Sprintf("telemetry sequence gap: expected %d, received %d", e.Expected, e.Received)
+}
+
 type TelemetryService struct {
-	deviceRepo    *repository.DeviceRepository
-	processRepo   *repository.ProcessRepository
-	containerRepo *repository.ContainerRepository
-	threatRepo    *repository.ThreatRepository
+	deviceRepo      *repository.DeviceRepository
+	processRepo     *repository.ProcessRepository
+	containerRepo   *repository.ContainerRepository
+	threatRepo      *repository.ThreatRepository
+	connectionRepo  *repository.ConnectionRepository
+	packageRepo     *repository.PackageRepository
+	eventRepo       *repository.ContainerEventRepository
+	fileChangeRepo  *repository.FileChangeRepository
+	metricRepo      *repository.MetricRepository
+	sessionRepo     *repository.SessionRepository
+	authEventRepo   *repository.AuthEventRepository
+	persistenceRepo *repository.PersistenceRepository
+	taskRepo        *repository.TaskRepository
+	tokenRepo       *repository.EnrollmentTokenRepository
+	chunkRepo       *repository.TelemetryChunkRepository
+	policyRepo      *repository.AgentPolicyRepository
+	transactor      *repository.Transactor
+	redactor        *Redactor
+	certIssuer      *CertificateIssuer // nil unless the service issues agent certificates
+	policySigner    *PolicySigner      // nil unless the service serves agent policies
+
+	// requireEnrollment refuses agents that have not enrolled, rather than
+	// identifying them by MAC address
+	requireEnrollment bool
 }
 
 func NewTelemetryService(
@@ -20,93 +92,936 @@ func NewTelemetryService(
 	processRepo *repository.ProcessRepository,
 	containerRepo *repository.ContainerRepository,
 	threatRepo *repository.ThreatRepository,
+	connectionRepo *repository.ConnectionRepository,
+	packageRepo *repository.PackageRepository,
+	eventRepo *repository.ContainerEventRepository,
+	fileChangeRepo *repository.FileChangeRepository,
+	metricRepo *repository.MetricRepository,
+	sessionRepo *repository.SessionRepository,
+	authEventRepo *repository.AuthEventRepository,
+	persistenceRepo *repository.PersistenceRepository,
+	taskRepo *repository.TaskRepository,
+	tokenRepo *repository.EnrollmentTokenRepository,
+	chunkRepo *repository.TelemetryChunkRepository,
+	policyRepo *repository.AgentPolicyRepository,
+	transactor *repository.Transactor,
+	redactor *Redactor,
+	certIssuer *CertificateIssuer,
+	policySigner *PolicySigner,
+	requireEnrollment bool,
 ) *TelemetryService {
 	return &TelemetryService{
-		deviceRepo:    deviceRepo,
-		processRepo:   processRepo,
-		containerRepo: containerRepo,
-		threatRepo:    threatRepo,
+		deviceRepo:      deviceRepo,
+		processRepo:     processRepo,
+		containerRepo:   containerRepo,
+		threatRepo:      threatRepo,
+		connectionRepo:  connectionRepo,
+		packageRepo:     packageRepo,
+		eventRepo:       eventRepo,
+		fileChangeRepo:  fileChangeRepo,
+		metricRepo:      metricRepo,
+		sessionRepo:     sessionRepo,
+		authEventRepo:   authEventRepo,
+		persistenceRepo: persistenceRepo,
+		taskRepo:        taskRepo,
+		tokenRepo:       tokenRepo,
+		chunkRepo:       chunkRepo,
+		policyRepo:      policyRepo,
+		transactor:      transactor,
+		redactor:        redactor,
+		certIssuer:      certIssuer,
+		policySigner:    policySigner,
+
+		requireEnrollment: requireEnrollment,
 	}
 }
 
-func (s *TelemetryService) ProcessTelemetry(req *models.TelemetryRequest) error {
+// withTx returns a copy of the service whose repositories run on tx
+func (s *TelemetryService) withTx(tx repository.DBTX) *TelemetryService {
+	clone := *s
+	clone.deviceRepo = repository.NewDeviceRepository(tx)
+	clone.processRepo = repository.NewProcessRepository(tx)
+	clone.containerRepo = repository.NewContainerRepository(tx)
+	clone.threatRepo = repository.NewThreatRepository(tx)
+	clone.connectionRepo = repository.NewConnectionRepository(tx)
+	clone.packageRepo = repository.NewPackageRepository(tx)
+	clone.eventRepo = repository.NewContainerEventRepository(tx)
+	clone.fileChangeRepo = repository.NewFileChangeRepository(tx)
+	clone.metricRepo = repository.NewMetricRepository(tx)
+	clone.sessionRepo = repository.NewSessionRepository(tx)
+	clone.authEventRepo = repository.NewAuthEventRepository(tx)
+	clone.persistenceRepo = repository.NewPersistenceRepository(tx)
+	clone.taskRepo = repository.NewTaskRepository(tx)
+	clone.tokenRepo = repository.NewEnrollmentTokenRepository(tx)
+	clone.chunkRepo = repository.NewTelemetryChunkRepository(tx)
+	clone.policyRepo = repository.NewAgentPolicyRepository(tx)
+	return &clone
+}
+
+// ProcessTelemetry stores a snapshot using the agent's original collection
+// timestamp, so snapshots replayed from an agent's spool land at the point in
+// history where they were collected. Full snapshots are reconciled against the
+// device's live state; deltas are applied on top of it. deviceID is the
+// authenticated device of an enrolled agent, or "" for an agent that has not
+// enrolled, whose device is keyed on its MAC address. The snapshot is stored
+// in one transaction, so a failure part way leaves nothing of it behind.
+//
+// A delta that does not follow the last one accepted gets a
+// ResyncRequiredError. After a gap, its events, findings and the other
+// sections that report what happened, rather than state, are still stored:
+// the agent drops the delta and the full snapshot it sends instead does not
+// carry them. A stale or duplicate delta stores nothing, so a resent one
+// does not record its findings twice.
+func (s *TelemetryService) ProcessTelemetry(deviceID string, req *models.TelemetryRequest) error {
+	var resync *ResyncRequiredError
+	err := s.transactor.InTx(func(tx repository.DBTX) (err error) {
+		resync, err = s.withTx(tx).processTelemetry(deviceID, req)
+		return err
+	})
+	if err == nil && resync != nil {
+		return resync
+	}
+	return err
+}
+
+// processTelemetry is ProcessTelemetry on a service bound to a transaction.
+// A resync is returned apart from errors, as what was stored before it must
+// be committed.
+func (s *TelemetryService) processTelemetry(deviceID string, req *models.TelemetryRequest) (*ResyncRequiredError, error) {
+	now := time.Now()
+	cleanupThreshold := now.Add(-dataRetention)
+
+	if req.Timestamp.Before(cleanupThreshold) {
+		return nil, ErrSnapshotExpired
+	}
+	if req.Timestamp.After(now.Add(maxClockSkew)) {
+		return nil, ErrSnapshotInFuture
+	}
+
+	// Nothing is stored before every command line is redacted
+	if err := s.redactor.Enforce(req); err != nil {
+		return nil, err
+	}
+
 	// First, create or update the device
 	device := &models.Device{
-		MacAddress:  req.MacAddress,
-		Hostname:    req.HostMetadata.Hostname,
-		OS:          req.HostMetadata.OS,
-		Platform:    req.HostMetadata.Platform,
-		Version:     req.HostMetadata.Version,
-		CurrentUser: req.HostMetadata.CurrentUser,
-		LastSeenAt:  req.Timestamp,
+		ID:             deviceID,
+		MacAddress:     req.MacAddress,
+		Hostname:       req.HostMetadata.Hostname,
+		OS:             req.HostMetadata.OS,
+		Platform:       req.HostMetadata.Platform,
+		Version:        req.HostMetadata.Version,
+		CurrentUser:    req.HostMetadata.CurrentUser,
+		MachineID:      req.HostMetadata.MachineID,
+		HardwareSerial: req.HostMetadata.HardwareSerial,
+		LastSeenAt:     req.Timestamp,
 	}
 
-	err := s.deviceRepo.CreateOrUpdate(device)
+	var err error
+	if deviceID != "" {
+		err = s.deviceRepo.Update(device)
+	} else {
+		err = s.deviceRepo.CreateOrUpdate(device)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create or update device: %w", err)
+		return nil, fmt.Errorf("failed to create or update device: %w", err)
 	}
 
 	// Clean up old data (keep only last 7 days)
-	cleanupThreshold := time.Now().AddDate(0, 0, -7)
-
-	// Clean up old processes
 	err = s.processRepo.DeleteOldProcesses(device.ID, cleanupThreshold)
 	if err != nil {
-		return fmt.Errorf("failed to clean up old processes: %w", err)
+		return nil, fmt.Errorf("failed to clean up old processes: %w", err)
 	}
 
 	// Clean up old containers
 	err = s.containerRepo.DeleteOldContainers(device.ID, cleanupThreshold)
 	if err != nil {
-		return fmt.Errorf("failed to clean up old containers: %w", err)
+		return nil, fmt.Errorf("failed to clean up old containers: %w", err)
+	}
+
+	// Clean up old network connections
+	err = s.connectionRepo.DeleteOldConnections(device.ID, cleanupThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old network connections: %w", err)
+	}
+
+	// Clean up old container events
+	err = s.eventRepo.DeleteOldEvents(device.ID, cleanupThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old container events: %w", err)
+	}
+
+	// Clean up old file changes
+	err = s.fileChangeRepo.DeleteOldChanges(device.ID, cleanupThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old file changes: %w", err)
+	}
+
+	// Clean up persistence items removed before the retention window
+	err = s.persistenceRepo.DeleteOldItems(device.ID, cleanupThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old persistence items: %w", err)
+	}
+
+	// Clean up old authentication events and ended login sessions
+	err = s.authEventRepo.DeleteOldEvents(device.ID, cleanupThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old auth events: %w", err)
+	}
+	err = s.sessionRepo.DeleteOldSessions(device.ID, cleanupThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old user sessions: %w", err)
+	}
+
+	// Task audit records are kept longer than telemetry
+	err = s.taskRepo.DeleteOldTasks(device.ID, now.Add(-taskRetention))
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up old tasks: %w", err)
+	}
+
+	// Clean up old device metrics, keeping each resolution for its retention
+	for _, resolution := range metricResolutions {
+		err = s.metricRepo.DeleteOldMetrics(device.ID, resolution.name, now.Add(-resolution.retention))
+		if err != nil {
+			return nil, fmt.Errorf("failed to clean up old device metrics: %w", err)
+		}
+	}
+
+	var checkpointAt *time.Time
+	if req.SnapshotType == models.SnapshotTypeDelta {
+		// A delta only makes sense on top of the previous sequence number.
+		// After a gap, what happened is kept all the same, linked to the
+		// processes already known. A delta at or before the last sequence
+		// number, such as one resent after its response was lost, was
+		// already stored or superseded, and is dropped whole.
+		expected := device.TelemetrySequence + 1
+		if req.Sequence != expected {
+			if req.Sequence > expected {
+				if err := s.storeEventSections(device.ID, req); err != nil {
+					return nil, err
+				}
+			}
+			return &ResyncRequiredError{Expected: expected, Received: req.Sequence}, nil
+		}
+
+		err = s.applyDelta(device.ID, req)
+	} else {
+		checkpointAt = &req.Timestamp
+		err = s.applyFullSnapshot(device.ID, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.storeConnections(device.ID, req); err != nil {
+		return nil, err
+	}
+
+	if err := s.storeEventSections(device.ID, req); err != nil {
+		return nil, err
+	}
+
+	// Sessions are listed in full; a replayed listing is out of date and would
+	// end sessions that are still open
+	if req.Sessions != nil && !req.Replayed && req.ListingComplete("sessions") {
+		if err := s.syncSessions(device.ID, req); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Metrics != nil {
+		if err := s.metricRepo.Record(device.ID, req.Timestamp, req.Metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Packages != nil {
+		if err := s.syncPackages(device.ID, req.Packages, req.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, s.deviceRepo.UpdateSequence(device.ID, req.Sequence, checkpointAt)
+}
+
+// storeEventSections records the sections of a request that report what
+// happened since the agent's previous payload, rather than its state:
+// events, findings, container events, file changes and auth events
+func (s *TelemetryService) storeEventSections(deviceID string, req *models.TelemetryRequest) error {
+	if err := s.storeEvents(deviceID, req); err != nil {
+		return err
+	}
+
+	if err := s.storeFindings(deviceID, req); err != nil {
+		return err
+	}
+
+	if err := s.storeContainerEvents(deviceID, req); err != nil {
+		return err
+	}
+
+	if err := s.storeFileChanges(deviceID, req); err != nil {
+		return err
+	}
+
+	return s.storeAuthEvents(deviceID, req)
+}
+
+// storeConnections records the request's network connections, linking each
+// to the live process row with the same process key.
+func (s *TelemetryService) storeConnections(deviceID string, req *models.TelemetryRequest) error {
+	if len(req.Connections) == 0 {
+		return nil
+	}
+
+	processIDs, err := s.processRepo.GetLiveIDs(deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve connection processes: %w", err)
+	}
+
+	for _, connectionInfo := range req.Connections {
+		connection := &models.NetworkConnection{
+			DeviceID:      deviceID,
+			PID:           connectionInfo.PID,
+			ProcessKey:    connectionInfo.ProcessKey,
+			Protocol:      connectionInfo.Protocol,
+			Family:        connectionInfo.Family,
+			LocalAddress:  connectionInfo.LocalAddress,
+			LocalPort:     connectionInfo.LocalPort,
+			RemoteAddress: connectionInfo.RemoteAddress,
+			RemotePort:    connectionInfo.RemotePort,
+			State:         connectionInfo.State,
+			CollectedAt:   req.Timestamp,
+		}
+		if processID, found := processIDs[connectionInfo.ProcessKey]; found {
+			connection.ProcessID = &processID
+		}
+
+		if err := s.connectionRepo.Create(connection); err != nil {
+			return fmt.Errorf("failed to create network connection record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// storeContainerEvents records the container lifecycle events the agent
+// received from the Docker events stream since its previous payload
+func (s *TelemetryService) storeContainerEvents(deviceID string, req *models.TelemetryRequest) error {
+	for _, eventInfo := range req.ContainerEvents {
+		event := &models.ContainerEvent{
+			DeviceID:    deviceID,
+			ContainerID: eventInfo.ContainerID,
+			Runtime:     containerRuntime(eventInfo.Runtime),
+			Action:      eventInfo.Action,
+			Image:       eventInfo.Image,
+			Name:        eventInfo.Name,
+			ExitCode:    eventInfo.ExitCode,
+			ExecCommand: eventInfo.ExecCommand,
+			Attributes:  eventInfo.Attributes,
+			EventTime:   eventInfo.Timestamp,
+		}
+
+		if err := s.eventRepo.Create(event); err != nil {
+			return fmt.Errorf("failed to create container event record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// storeFileChanges records the changes the agent's file integrity monitor
+// found since its previous payload
+func (s *TelemetryService) storeFileChanges(deviceID string, req *models.TelemetryRequest) error {
+	for _, changeInfo := range req.FileChanges {
+		change := &models.FileChange{
+			DeviceID:   deviceID,
+			Path:       changeInfo.Path,
+			Action:     changeInfo.Action,
+			DetectedBy: changeInfo.DetectedBy,
+			Before:     changeInfo.Before,
+			After:      changeInfo.After,
+			ChangeTime: changeInfo.Timestamp,
+		}
+		if changeInfo.Before != nil {
+			change.BeforeSHA256 = changeInfo.Before.SHA256
+		}
+		if changeInfo.After != nil {
+			change.AfterSHA256 = changeInfo.After.SHA256
+		}
+
+		if err := s.fileChangeRepo.Create(change); err != nil {
+			return fmt.Errorf("failed to create file change record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// syncSessions reconciles the device's open login sessions with the listing
+func (s *TelemetryService) syncSessions(deviceID string, req *models.TelemetryRequest) error {
+	sessions := make([]*models.UserSession, 0, len(req.Sessions))
+	for _, sessionInfo := range req.Sessions {
+		session := &models.UserSession{
+			SessionID:  sessionInfo.ID,
+			Username:   sessionInfo.User,
+			UID:        sessionInfo.UID,
+			TTY:        sessionInfo.TTY,
+			Seat:       sessionInfo.Seat,
+			RemoteHost: sessionInfo.RemoteHost,
+			Remote:     sessionInfo.Remote,
+			Service:    sessionInfo.Service,
+			Type:       sessionInfo.Type,
+			Class:      sessionInfo.Class,
+			State:      sessionInfo.State,
+			Source:     sessionInfo.Source,
+		}
+		if !sessionInfo.StartedAt.IsZero() {
+			startedAt := sessionInfo.StartedAt
+			session.StartedAt = &startedAt
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := s.sessionRepo.Sync(deviceID, sessions, req.Timestamp); err != nil {
+		return fmt.Errorf("failed to sync user sessions: %w", err)
+	}
+
+	return nil
+}
+
+// storeAuthEvents records the authentication events the agent read since its
+// previous payload, then checks the sources of failed attempts for brute
+// forcing
+func (s *TelemetryService) storeAuthEvents(deviceID string, req *models.TelemetryRequest) error {
+	events := make([]*models.AuthEvent, 0, len(req.AuthEvents))
+	for _, eventInfo := range req.AuthEvents {
+		event := &models.AuthEvent{
+			DeviceID:     deviceID,
+			Type:         eventInfo.Type,
+			Success:      eventInfo.Success,
+			Username:     eventInfo.User,
+			SourceIP:     eventInfo.SourceIP,
+			SourcePort:   eventInfo.SourcePort,
+			Method:       eventInfo.Method,
+			TTY:          eventInfo.TTY,
+			TargetUser:   eventInfo.TargetUser,
+			Command:      eventInfo.Command,
+			PID:          eventInfo.PID,
+			AttemptCount: max(eventInfo.Count, 1),
+			Source:       eventInfo.Source,
+			Message:      eventInfo.Message,
+			EventTime:    eventInfo.Timestamp,
+		}
+
+		if err := s.authEventRepo.Create(event); err != nil {
+			return fmt.Errorf("failed to create auth event record: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	for source, latest := range failedAttemptSources(events) {
+		if err := s.detectBruteForce(deviceID, source, latest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attemptSource is where authentication attempts come from: a remote
+// address, or the user when there is none, as for sudo
+type attemptSource struct {
+	eventType, sourceIP, username string
+}
+
+// failedAttemptSources returns the sources of the failed SSH and sudo
+// attempts among events, with the time of each one's latest failure
+func failedAttemptSources(events []*models.AuthEvent) map[attemptSource]time.Time {
+	latestFailures := make(map[attemptSource]time.Time)
+	for _, event := range events {
+		if event.Success || (event.Type != models.AuthEventSSH && event.Type != models.AuthEventSudo) {
+			continue
+		}
+		source := attemptSource{eventType: event.Type, sourceIP: event.SourceIP}
+		if source.sourceIP == "" {
+			source.username = event.Username
+		}
+		if event.EventTime.After(latestFailures[source]) {
+			latestFailures[source] = event.EventTime
+		}
+	}
+	return latestFailures
+}
+
+// detectBruteForce raises a threat finding when the failed attempts from a
+// source within bruteForceWindow of its latest failure reach
+// bruteForceThreshold. The attempts are linked to the finding so they are
+// only counted once.
+func (s *TelemetryService) detectBruteForce(deviceID string, source attemptSource, latest time.Time) error {
+	from := latest.Add(-bruteForceWindow)
+	attempts, usernames, err := s.authEventRepo.CountFailures(deviceID, source.eventType, source.sourceIP, source.username, from, latest)
+	if err != nil {
+		return err
+	}
+	if attempts < bruteForceThreshold {
+		return nil
+	}
+
+	successful, err := s.authEventRepo.LatestSuccess(deviceID, source.eventType, source.sourceIP, source.username, from)
+	if err != nil {
+		return err
+	}
+
+	threat := bruteForceThreat(deviceID, source, attempts, usernames, successful, latest)
+	if err := s.threatRepo.Create(threat); err != nil {
+		return fmt.Errorf("failed to create threat finding for brute force: %w", err)
+	}
+
+	return s.authEventRepo.LinkToThreat(deviceID, source.eventType, source.sourceIP, source.username, from, threat.ID)
+}
+
+// bruteForceThreat describes the failed attempts from a source as a threat
+// finding. It is critical when an attempt from the source then succeeded, as
+// the user successful.
+func bruteForceThreat(deviceID string, source attemptSource, attempts int, usernames []string, successful string, latest time.Time) *models.ThreatFinding {
+	from := "from " + source.sourceIP
+	if source.sourceIP == "" {
+		from = "for " + source.username
+	}
+	description := fmt.Sprintf("%d failed %s attempts %s within %v", attempts, source.eventType, from, bruteForceWindow)
+	if len(usernames) > 0 && source.sourceIP != "" {
+		description += fmt.Sprintf(" (users: %s)", strings.Join(usernames, ", "))
+	}
+
+	threat := &models.ThreatFinding{
+		DeviceID:    deviceID,
+		Description: description,
+		Severity:    "high",
+		RuleID:      "auth-brute-force",
+		RuleName:    "Authentication brute force",
+		Timestamp:   latest,
+	}
+	if successful != "" {
+		threat.Severity = "critical"
+		threat.Description += fmt.Sprintf(", followed by a successful %s attempt as %s", source.eventType, successful)
+	}
+	return threat
+}
+
+// storeEvents records agent events that warrant attention as threat
+// findings, linked to the live process they were observed on.
+func (s *TelemetryService) storeEvents(deviceID string, req *models.TelemetryRequest) error {
+	if len(req.Events) == 0 {
+		return nil
+	}
+
+	processIDs, err := s.processRepo.GetLiveIDs(deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve event processes: %w", err)
+	}
+
+	for _, event := range req.Events {
+		if event.Type != models.EventTypeBinaryModifiedInPlace {
+			continue
+		}
+
+		threat := &models.ThreatFinding{
+			DeviceID: deviceID,
+			Description: fmt.Sprintf("Executable %s was modified in place while keeping its inode (sha256 %s -> %s)",
+				event.Path, event.PreviousSHA256, event.SHA256),
+			Severity:  "high",
+			RuleID:    "binary-modified-in-place",
+			RuleName:  "Binary modified in place",
+			Timestamp: event.Timestamp,
+		}
+		if processID, found := processIDs[event.ProcessKey]; found {
+			threat.ProcessID = &processID
+		}
+
+		if err := s.threatRepo.Create(threat); err != nil {
+			return fmt.Errorf("failed to create threat finding for event: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// storeFindings records the matches of the agent's local detection rules as
+// threat findings, linked to the live process or container that matched.
+// The agent reports each match once, so a finding it spooled while offline
+// still arrives, with the time it was detected.
+func (s *TelemetryService) storeFindings(deviceID string, req *models.TelemetryRequest) error {
+	if len(req.Findings) == 0 {
+		return nil
+	}
+
+	processIDs, err := s.processRepo.GetLiveIDs(deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve finding processes: %w", err)
+	}
+	containerIDs, err := s.containerRepo.GetLiveIDs(deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve finding containers: %w", err)
+	}
+
+	for _, finding := range req.Findings {
+		threat := &models.ThreatFinding{
+			DeviceID:    deviceID,
+			Description: finding.Description,
+			Severity:    finding.Severity,
+			RuleID:      finding.RuleID,
+			RuleName:    finding.RuleName,
+			DetectedBy:  models.DetectedByAgent,
+			Evidence:    finding.Evidence,
+			Timestamp:   finding.Timestamp,
+		}
+		if threat.Description == "" {
+			threat.Description = finding.RuleName
+		}
+		if processID, found := processIDs[finding.ProcessKey]; found && finding.ProcessKey != "" {
+			threat.ProcessID = &processID
+		}
+		if containerID, found := containerIDs[finding.ContainerID]; found && finding.ContainerID != "" {
+			threat.ContainerID = &containerID
+		}
+
+		if err := s.threatRepo.Create(threat); err != nil {
+			return fmt.Errorf("failed to create threat finding for agent detection: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// syncPackages reconciles the device's package inventory with a complete
+// listing and records every install, upgrade, downgrade and removal. The
+// first inventory a device reports becomes its baseline without history.
+func (s *TelemetryService) syncPackages(deviceID string, packages []models.PackageInfo, observedAt time.Time) error {
+	existing, err := s.packageRepo.ListByDeviceID(deviceID)
+	if err != nil {
+		return err
+	}
+	baseline := len(existing) == 0
+
+	current := make(map[string]*models.DevicePackage, len(existing))
+	for _, pkg := range existing {
+		current[packageIdentity(pkg.Source, pkg.Name, pkg.Architecture)] = pkg
+	}
+
+	for _, packageInfo := range packages {
+		identity := packageIdentity(packageInfo.Source, packageInfo.Name, packageInfo.Architecture)
+		previous, found := current[identity]
+		delete(current, identity)
+
+		if found && previous.Version == packageInfo.Version {
+			continue
+		}
+
+		pkg := &models.DevicePackage{
+			DeviceID:     deviceID,
+			Name:         packageInfo.Name,
+			Version:      packageInfo.Version,
+			Architecture: packageInfo.Architecture,
+			Source:       packageInfo.Source,
+			InstalledAt:  observedAt,
+			UpdatedAt:    observedAt,
+		}
+		if err := s.packageRepo.Upsert(pkg); err != nil {
+			return err
+		}
+
+		if baseline {
+			continue
+		}
+
+		change := &models.PackageChange{
+			DeviceID:     deviceID,
+			Name:         packageInfo.Name,
+			Architecture: packageInfo.Architecture,
+			Source:       packageInfo.Source,
+			Action:       models.PackageActionInstall,
+			Version:      packageInfo.Version,
+			ObservedAt:   observedAt,
+		}
+		if found {
+			change.PreviousVersion = previous.Version
+			change.Action = models.PackageActionUpgrade
+			if CompareVersions(packageInfo.Version, previous.Version) < 0 {
+				change.Action = models.PackageActionDowngrade
+			}
+		}
+		if err := s.packageRepo.CreateChange(change); err != nil {
+			return err
+		}
+	}
+
+	// Whatever is left was not reported and has been uninstalled
+	for _, pkg := range current {
+		if err := s.packageRepo.Delete(pkg.ID); err != nil {
+			return err
+		}
+
+		change := &models.PackageChange{
+			DeviceID:        deviceID,
+			Name:            pkg.Name,
+			Architecture:    pkg.Architecture,
+			Source:          pkg.Source,
+			Action:          models.PackageActionRemove,
+			PreviousVersion: pkg.Version,
+			ObservedAt:      observedAt,
+		}
+		if err := s.packageRepo.CreateChange(change); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+func packageIdentity(source, name, architecture string) string {
+	return source + "/" + name + "/" + architecture
+}
+
+// applyFullSnapshot reconciles the device's live processes and containers
+// against a complete listing: everything listed is refreshed or created, and
+// everything not listed is closed, unless the agent reported the listing as
+// truncated or its collector as failed.
+func (s *TelemetryService) applyFullSnapshot(deviceID string, req *models.TelemetryRequest) error {
 	// Process the processes
 	for _, processInfo := range req.Processes {
-		process := &models.Process{
-			DeviceID:    device.ID,
-			PID:         processInfo.PID,
-			Name:        processInfo.Name,
-			Cmdline:     processInfo.Cmdline,
-			Username:    processInfo.Username,
-			ExePath:     processInfo.ExePath,
-			StartTime:   processInfo.StartTime,
-			Status:      processInfo.Status,
-			SHA256:      processInfo.SHA256,
-			Version:     processInfo.Version,
-			FileSize:    processInfo.FileSize,
-			CollectedAt: req.Timestamp,
-		}
-
-		err := s.processRepo.Create(process)
+		process := newProcessRecord(deviceID, processInfo, req.Timestamp)
+
+		err := s.processRepo.Upsert(process)
 		if err != nil {
-			return fmt.Errorf("failed to create process record: %w", err)
+			return fmt.Errorf("failed to upsert process record: %w", err)
+		}
+	}
+
+	// A truncated, failed or skipped listing says nothing about the processes
+	// it lacks
+	if !req.Truncated && req.ListingComplete("processes") {
+		if _, err := s.processRepo.MarkUnseenExited(deviceID, req.Timestamp); err != nil {
+			return fmt.Errorf("failed to close exited processes: %w", err)
 		}
 	}
 
 	// Process the containers
 	for _, containerInfo := range req.Containers {
-		container := &models.Container{
-			DeviceID:         device.ID,
-			ContainerID:      containerInfo.ID,
-			Image:            containerInfo.Image,
-			Names:            containerInfo.Names,
-			Status:           containerInfo.Status,
-			Ports:            containerInfo.Ports,
-			Labels:           containerInfo.Labels,
-			ContainerCreated: containerInfo.Created,
-			CollectedAt:      req.Timestamp,
-		}
-
-		err := s.containerRepo.Create(container)
+		container := newContainerRecord(deviceID, containerInfo, req.Timestamp)
+
+		err := s.containerRepo.Upsert(container)
+		if err != nil {
+			return fmt.Errorf("failed to upsert container record: %w", err)
+		}
+	}
+
+	if req.ListingComplete("containers") {
+		if _, err := s.containerRepo.MarkUnseenRemoved(deviceID, req.Timestamp); err != nil {
+			return fmt.Errorf("failed to close removed containers: %w", err)
+		}
+	}
+
+	// Process the persistence items; agents that predate the autoruns
+	// collector send none
+	for _, itemInfo := range req.Persistence {
+		if err := s.persistenceRepo.Upsert(newPersistenceRecord(deviceID, itemInfo, req.Timestamp)); err != nil {
+			return fmt.Errorf("failed to upsert persistence item record: %w", err)
+		}
+	}
+
+	if req.Persistence != nil && req.ListingComplete("persistence") {
+		if _, err := s.persistenceRepo.MarkUnseenRemoved(deviceID, req.Timestamp); err != nil {
+			return fmt.Errorf("failed to close removed persistence items: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// applyDelta applies started/exited processes, created/updated/removed
+// containers and changed/removed persistence items on top of the device's
+// live state.
+func (s *TelemetryService) applyDelta(deviceID string, req *models.TelemetryRequest) error {
+	if req.Delta == nil {
+		return nil
+	}
+
+	for _, processInfo := range req.Delta.ProcessesStarted {
+		process := newProcessRecord(deviceID, processInfo, req.Timestamp)
+
+		err := s.processRepo.Upsert(process)
+		if err != nil {
+			return fmt.Errorf("failed to upsert process record: %w", err)
+		}
+	}
+
+	for _, ref := range req.Delta.ProcessesExited {
+		err := s.processRepo.MarkExited(deviceID, ref.PID, ref.StartTime, req.Timestamp)
 		if err != nil {
-			return fmt.Errorf("failed to create container record: %w", err)
+			return fmt.Errorf("failed to close process record: %w", err)
+		}
+	}
+
+	changed := append(req.Delta.ContainersCreated, req.Delta.ContainersUpdated...)
+	for _, containerInfo := range changed {
+		container := newContainerRecord(deviceID, containerInfo, req.Timestamp)
+
+		err := s.containerRepo.Upsert(container)
+		if err != nil {
+			return fmt.Errorf("failed to upsert container record: %w", err)
+		}
+	}
+
+	for _, containerID := range req.Delta.ContainersRemoved {
+		err := s.containerRepo.MarkRemoved(deviceID, containerID, req.Timestamp)
+		if err != nil {
+			return fmt.Errorf("failed to close container record: %w", err)
+		}
+	}
+
+	for _, itemInfo := range req.Delta.PersistenceChanged {
+		if err := s.persistenceRepo.Upsert(newPersistenceRecord(deviceID, itemInfo, req.Timestamp)); err != nil {
+			return fmt.Errorf("failed to upsert persistence item record: %w", err)
+		}
+	}
+
+	for _, key := range req.Delta.PersistenceRemoved {
+		if err := s.persistenceRepo.MarkRemoved(deviceID, key, req.Timestamp); err != nil {
+			return fmt.Errorf("failed to close persistence item record: %w", err)
+		}
+	}
+
+	// Items the delta does not mention are unchanged and still present
+	if req.ListingComplete("persistence") {
+		if err := s.persistenceRepo.MarkSeen(deviceID, req.Timestamp); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+func newProcessRecord(deviceID string, processInfo models.ProcessInfo, seenAt time.Time) *models.Process {
+	// Agents that predate lineage collection send no process key
+	key := processInfo.ProcessKey
+	if key == "" {
+		key = processKey(processInfo.PID, processInfo.StartTime)
+	}
+
+	// Older agents send a version scraped from the binary with no metadata
+	versionSource, versionConfidence := "", ""
+	if processInfo.VersionInfo != nil {
+		versionSource = processInfo.VersionInfo.Source
+		versionConfidence = processInfo.VersionInfo.Confidence
+	} else if processInfo.Version != "" {
+		versionSource = models.VersionSourceLegacy
+		versionConfidence = models.VersionConfidenceLow
+	}
+
+	var redactedBy string
+	var redactionRules []string
+	if processInfo.Redaction != nil {
+		redactedBy = processInfo.Redaction.RedactedBy
+		redactionRules = processInfo.Redaction.Rules
+	}
+
+	return &models.Process{
+		DeviceID:          deviceID,
+		PID:               processInfo.PID,
+		PPID:              processInfo.PPID,
+		Name:              processInfo.Name,
+		Cmdline:           processInfo.Cmdline,
+		RedactedBy:        redactedBy,
+		RedactionRules:    redactionRules,
+		Username:          processInfo.Username,
+		ExePath:           processInfo.ExePath,
+		StartTime:         processInfo.StartTime,
+		ParentStartTime:   processInfo.ParentStartTime,
+		ProcessKey:        key,
+		ParentKey:         processInfo.ParentKey,
+		Status:            processInfo.Status,
+		SHA256:            processInfo.SHA256,
+		Version:           processInfo.Version,
+		VersionSource:     versionSource,
+		VersionConfidence: versionConfidence,
+		VersionInfo:       processInfo.VersionInfo,
+		FileSize:          processInfo.FileSize,
+		CPUPercent:        processInfo.CPUPercent,
+		MemoryRSS:         processInfo.MemoryRSS,
+		CollectedAt:       seenAt,
+		LastSeenAt:        seenAt,
+	}
+}
+
+// processKey identifies a process instance by PID and start time, matching
+// the key the agent computes
+func processKey(pid int32, startTime int64) string {
+	return fmt.Sprintf("%d:%d", pid, startTime)
+}
+
+func newContainerRecord(deviceID string, containerInfo models.ContainerInfo, seenAt time.Time) *models.Container {
+	var imageDigest string
+	if containerInfo.Security != nil {
+		imageDigest = containerInfo.Security.ImageDigest
+	}
+
+	return &models.Container{
+		DeviceID:         deviceID,
+		ContainerID:      containerInfo.ID,
+		Runtime:          containerRuntime(containerInfo.Runtime),
+		Namespace:        containerInfo.Namespace,
+		Image:            containerInfo.Image,
+		Names:            containerInfo.Names,
+		Status:           containerInfo.Status,
+		State:            containerInfo.State,
+		Ports:            containerInfo.Ports,
+		Labels:           containerInfo.Labels,
+		ContainerCreated: containerInfo.Created,
+		ImageDigest:      imageDigest,
+		Security:         containerInfo.Security,
+		CollectedAt:      seenAt,
+		LastSeenAt:       seenAt,
+	}
+}
+
+func newPersistenceRecord(deviceID string, itemInfo models.PersistenceItemInfo, seenAt time.Time) *models.PersistenceItem {
+	item := &models.PersistenceItem{
+		DeviceID:    deviceID,
+		Key:         itemInfo.Key,
+		Type:        itemInfo.Type,
+		Path:        itemInfo.Path,
+		Name:        itemInfo.Name,
+		Scope:       itemInfo.Scope,
+		Username:    itemInfo.User,
+		Owner:       itemInfo.Owner,
+		UID:         itemInfo.UID,
+		SHA256:      itemInfo.SHA256,
+		FileSize:    itemInfo.Size,
+		Mode:        itemInfo.Mode,
+		LinkTarget:  itemInfo.LinkTarget,
+		Commands:    itemInfo.Commands,
+		Detail:      itemInfo.Detail,
+		FirstSeenAt: seenAt,
+		LastSeenAt:  seenAt,
+		ChangedAt:   seenAt,
+	}
+	if !itemInfo.ModifiedAt.IsZero() {
+		modifiedAt := itemInfo.ModifiedAt
+		item.ModifiedAt = &modifiedAt
+	}
+	return item
+}
+
+// containerRuntime defaults the runtime of containers reported by agents
+// that only knew Docker
+func containerRuntime(runtime string) string {
+	if runtime == "" {
+		return models.RuntimeDocker
+	}
+	return runtime
+}
+
 func (s *TelemetryService) GetDevices(limit, offset int) ([]*models.Device, error) {
 	return s.deviceRepo.List(limit, offset)
 }
@@ -119,10 +1034,190 @@ func (s *TelemetryService) GetProcesses(deviceID string, limit, offset int) ([]*
 	return s.processRepo.GetByDeviceID(deviceID, limit, offset)
 }
 
+// GetProcessTree returns the ancestry and descendants of a process in the
+// device's snapshot at the given time. The process is selected by key, or by
+// PID when no key is given (the most recently started instance wins). It
+// returns nil when no such process was running.
+func (s *TelemetryService) GetProcessTree(deviceID, key string, pid int32, at time.Time) (*models.ProcessTree, error) {
+	processes, err := s.processRepo.GetSnapshot(deviceID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]*models.Process, len(processes))
+	children := make(map[string][]*models.Process)
+	var target *models.Process
+	for _, process := range processes {
+		byKey[process.ProcessKey] = process
+		if process.ParentKey != "" {
+			children[process.ParentKey] = append(children[process.ParentKey], process)
+		}
+		if key == "" && process.PID == pid {
+			target = process // Sorted by start time, so the last match is the newest
+		}
+	}
+	if key != "" {
+		target = byKey[key]
+	}
+	if target == nil {
+		return nil, nil
+	}
+
+	// Walk up to the root, nearest parent first
+	ancestors := []*models.Process{}
+	visited := map[string]bool{target.ProcessKey: true}
+	for current := target; current.ParentKey != ""; {
+		parent, found := byKey[current.ParentKey]
+		if !found || visited[parent.ProcessKey] {
+			break
+		}
+		visited[parent.ProcessKey] = true
+		ancestors = append(ancestors, parent)
+		current = parent
+	}
+
+	return &models.ProcessTree{
+		SnapshotAt:  at,
+		Process:     target,
+		Ancestors:   ancestors,
+		Descendants: buildProcessNodes(target.ProcessKey, children, map[string]bool{target.ProcessKey: true}),
+	}, nil
+}
+
+// buildProcessNodes builds the subtree of processes spawned by parentKey
+func buildProcessNodes(parentKey string, children map[string][]*models.Process, visited map[string]bool) []*models.ProcessNode {
+	nodes := []*models.ProcessNode{}
+	for _, child := range children[parentKey] {
+		if visited[child.ProcessKey] {
+			continue
+		}
+		visited[child.ProcessKey] = true
+		nodes = append(nodes, &models.ProcessNode{
+			Process:  child,
+			Children: buildProcessNodes(child.ProcessKey, children, visited),
+		})
+	}
+	return nodes
+}
+
 func (s *TelemetryService) GetContainers(deviceID string, limit, offset int) ([]*models.Container, error) {
 	return s.containerRepo.GetByDeviceID(deviceID, limit, offset)
 }
 
+// GetContainerTimeline returns the device's container lifecycle events
+// between from and to, oldest first, optionally for a single container
+func (s *TelemetryService) GetContainerTimeline(deviceID, containerID string, from, to time.Time, limit, offset int) ([]*models.ContainerEvent, error) {
+	return s.eventRepo.GetTimeline(deviceID, containerID, from, to, limit, offset)
+}
+
+// GetFileChanges returns the device's file changes between from and to, most
+// recent first, optionally for one file or directory and one action
+func (s *TelemetryService) GetFileChanges(deviceID, path, action string, from, to time.Time, limit, offset int) ([]*models.FileChange, error) {
+	return s.fileChangeRepo.GetByDeviceID(deviceID, path, action, from, to, limit, offset)
+}
+
+// GetPersistenceItems returns the device's persistence items, most recently
+// changed first
+func (s *TelemetryService) GetPersistenceItems(deviceID, itemType string, includeRemoved bool, limit, offset int) ([]*models.PersistenceItem, error) {
+	return s.persistenceRepo.GetByDeviceID(deviceID, itemType, includeRemoved, limit, offset)
+}
+
+// GetSessions returns the login sessions open on the device at the given time
+func (s *TelemetryService) GetSessions(deviceID string, at time.Time) ([]*models.UserSession, error) {
+	return s.sessionRepo.GetActiveAt(deviceID, at)
+}
+
+// GetAuthEvents returns the device's authentication events between from and
+// to, most recent first, optionally of one type and outcome
+func (s *TelemetryService) GetAuthEvents(deviceID, eventType string, success *bool, from, to time.Time, limit, offset int) ([]*models.AuthEvent, error) {
+	return s.authEventRepo.GetByDeviceID(deviceID, eventType, success, from, to, limit, offset)
+}
+
+// GetMetrics returns the device's resource usage between from and to,
+// averaged over steps of step. The series is read from the coarsest
+// resolution that fits in the step, or the finest one still covering from;
+// the step is widened to at most maxMetricPoints points and rounded up to
+// whole buckets of that resolution. A step of zero picks one from the range.
+func (s *TelemetryService) GetMetrics(deviceID string, from, to time.Time, step time.Duration) (*models.DeviceMetricSeries, error) {
+	if minStep := to.Sub(from) / maxMetricPoints; step < minStep {
+		step = minStep
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+
+	// Finer resolutions are kept for less time
+	now := time.Now()
+	resolution := metricResolutions[len(metricResolutions)-1]
+	for i := len(metricResolutions) - 1; i >= 0; i-- {
+		candidate := metricResolutions[i]
+		if from.Before(now.Add(-candidate.retention)) {
+			break
+		}
+		resolution = candidate
+		if step >= candidate.size {
+			break
+		}
+	}
+	if resolution.size > 0 && step%resolution.size != 0 {
+		step = (step/resolution.size + 1) * resolution.size
+	}
+
+	points, err := s.metricRepo.GetSeries(deviceID, resolution.name, from, to, step)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.DeviceMetricSeries{
+		From:        from,
+		To:          to,
+		StepSeconds: int64(step / time.Second),
+		Resolution:  resolution.name,
+		Points:      points,
+	}, nil
+}
+
+// SearchContainers lists containers across the fleet matching filter, e.g.
+// every running container that mounts the Docker socket
+func (s *TelemetryService) SearchContainers(filter models.ContainerFilter, limit, offset int) ([]*models.Container, error) {
+	return s.containerRepo.Search(filter, limit, offset)
+}
+
+func (s *TelemetryService) GetConnections(deviceID, state string, limit, offset int) ([]*models.NetworkConnection, error) {
+	return s.connectionRepo.GetByDeviceID(deviceID, state, limit, offset)
+}
+
+func (s *TelemetryService) GetPackages(deviceID string, limit, offset int) ([]*models.DevicePackage, error) {
+	return s.packageRepo.GetByDeviceID(deviceID, limit, offset)
+}
+
+func (s *TelemetryService) GetPackageHistory(deviceID string, limit, offset int) ([]*models.PackageChange, error) {
+	return s.packageRepo.GetHistoryByDeviceID(deviceID, limit, offset)
+}
+
+// SearchSoftware finds installed packages across the fleet by name, where
+// "*" matches any run of characters. When op is set, only packages whose
+// version compares to version accordingly (<, <=, >, >=, =, !=) are returned.
+func (s *TelemetryService) SearchSoftware(name, source, op, version string) ([]*models.DevicePackage, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%").Replace(name)
+
+	packages, err := s.packageRepo.SearchByName(pattern, source)
+	if err != nil {
+		return nil, err
+	}
+	if op == "" {
+		return packages, nil
+	}
+
+	matches := []*models.DevicePackage{}
+	for _, pkg := range packages {
+		if versionMatches(CompareVersions(pkg.Version, version), op) {
+			matches = append(matches, pkg)
+		}
+	}
+	return matches, nil
+}
+
 func (s *TelemetryService) GetThreatFindings(deviceID string, limit, offset int) ([]*models.ThreatFinding, error) {
 	return s.threatRepo.GetByDeviceID(deviceID, limit, offset)
 }
@@ -132,5 +1227,6 @@ func (s *TelemetryService) GetThreatFindingsBySeverity(severity string, limit, o
 }
 
 func (s *TelemetryService) CreateThreatFinding(threat *models.ThreatFinding) error {
+	threat.DetectedBy = models.DetectedByServer
 	return s.threatRepo.Create(threat)
 }
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"telemetry-service/internal/models"
+)
+
+func TestFailedAttemptSources(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	sshFrom := attemptSource{eventType: models.AuthEventSSH, sourceIP: "203.0.113.5"}
+	sudoFor := attemptSource{eventType: models.AuthEventSudo, username: "alice"}
+
+	tests := []struct {
+		name   string
+		events []*models.AuthEvent
+		want   map[attemptSource]time.Time
+	}{
+		{
+			name:   "no events",
+			events: nil,
+			want:   map[attemptSource]time.Time{},
+		},
+		{
+			name: "failures from one address over several users",
+			events: []*models.AuthEvent{
+				{Type: models.AuthEventSSH, SourceIP: "203.0.113.5", Username: "root", EventTime: t0},
+				{Type: models.AuthEventSSH, SourceIP: "203.0.113.5", Username: "admin", EventTime: t0.Add(2 * time.Minute)},
+				{Type: models.AuthEventSSH, SourceIP: "203.0.113.5", Username: "oracle", EventTime: t0.Add(time.Minute)},
+			},
+			want: map[attemptSource]time.Time{sshFrom: t0.Add(2 * time.Minute)},
+		},
+		{
+			name: "failures without an address counted per user",
+			events: []*models.AuthEvent{
+				{Type: models.AuthEventSudo, Username: "alice", EventTime: t0},
+				{Type: models.AuthEventSudo, Username: "bob", EventTime: t0},
+			},
+			want: map[attemptSource]time.Time{
+				sudoFor: t0,
+				{eventType: models.AuthEventSudo, username: "bob"}: t0,
+			},
+		},
+		{
+			name: "ssh and sudo from the same user kept apart",
+			events: []*models.AuthEvent{
+				{Type: models.AuthEventSSH, SourceIP: "203.0.113.5", Username: "alice", EventTime: t0},
+				{Type: models.AuthEventSudo, Username: "alice", EventTime: t0.Add(time.Minute)},
+			},
+			want: map[attemptSource]time.Time{sshFrom: t0, sudoFor: t0.Add(time.Minute)},
+		},
+		{
+			name: "successes and other event types ignored",
+			events: []*models.AuthEvent{
+				{Type: models.AuthEventSSH, SourceIP: "203.0.113.5", Username: "root", Success: true, EventTime: t0},
+				{Type: models.AuthEventLogin, Username: "alice", EventTime: t0},
+				{Type: models.AuthEventLogout, Username: "alice", EventTime: t0},
+			},
+			want: map[attemptSource]time.Time{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failedAttemptSources(tt.events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failedAttemptSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBruteForceThreat(t *testing.T) {
+	latest := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		source          attemptSource
+		usernames       []string
+		successful      string
+		wantSeverity    string
+		wantDescription string
+	}{
+		{
+			name:            "from an address",
+			source:          attemptSource{eventType: models.AuthEventSSH, sourceIP: "203.0.113.5"},
+			usernames:       []string{"admin", "root"},
+			wantSeverity:    "high",
+			wantDescription: "12 failed ssh attempts from 203.0.113.5 within 10m0s (users: admin, root)",
+		},
+		{
+			name:            "followed by a success",
+			source:          attemptSource{eventType: models.AuthEventSSH, sourceIP: "203.0.113.5"},
+			usernames:       []string{"root"},
+			successful:      "root",
+			wantSeverity:    "critical",
+			wantDescription: "12 failed ssh attempts from 203.0.113.5 within 10m0s (users: root), followed by a successful ssh attempt as root",
+		},
+		{
+			name:            "for a user without an address",
+			source:          attemptSource{eventType: models.AuthEventSudo, username: "alice"},
+			usernames:       []string{"alice"},
+			wantSeverity:    "high",
+			wantDescription: "12 failed sudo attempts for alice within 10m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			threat := bruteForceThreat("device-1", tt.source, 12, tt.usernames, tt.successful, latest)
+			if threat.Severity != tt.wantSeverity {
+				t.Errorf("severity = %q, want %q", threat.Severity, tt.wantSeverity)
+			}
+			if threat.Description != tt.wantDescription {
+				t.Errorf("description = %q, want %q", threat.Description, tt.wantDescription)
+			}
+			if threat.DeviceID != "device-1" || threat.RuleID != "auth-brute-force" || !threat.Timestamp.Equal(latest) {
+				t.Errorf("threat = %+v, want device-1's auth-brute-force at %v", threat, latest)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareVersions orders two package version strings using the Debian
+// algorithm, which also orders RPM, snap and flatpak versions sensibly:
+// an optional numeric epoch ("1:"), then the upstream version, then the
+// revision after the last hyphen. Within each part, runs of digits compare
+// numerically, letters sort before other characters, and "~" sorts before
+// everything, even the end of the string (so 1.0~rc1 < 1.0). It returns -1,
+// 0 or 1.
+func CompareVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+
+	upstreamA, revisionA := splitRevision(restA)
+	upstreamB, revisionB := splitRevision(restB)
+	if result := compareVersionPart(upstreamA, upstreamB); result != 0 {
+		return result
+	}
+	return compareVersionPart(revisionA, revisionB)
+}
+
+// versionMatches applies a comparison operator to a CompareVersions result
+func versionMatches(result int, op string) bool {
+	switch op {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	}
+	return false
+}
+
+func splitEpoch(version string) (int, string) {
+	if prefix, rest, found := strings.Cut(version, ":"); found {
+		if epoch, err := strconv.Atoi(prefix); err == nil {
+			return epoch, rest
+		}
+	}
+	return 0, version
+}
+
+func splitRevision(version string) (string, string) {
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+	return version, ""
+}
+
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		// Compare the non-digit prefixes character by character
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			orderA, orderB := versionCharOrder(a), versionCharOrder(b)
+			if orderA != orderB {
+				if orderA < orderB {
+					return -1
+				}
+				return 1
+			}
+			a, b = a[1:], b[1:]
+		}
+
+		// Then the numeric runs, ignoring leading zeros
+		digitsA, digitsB := leadingDigits(a), leadingDigits(b)
+		a, b = a[len(digitsA):], b[len(digitsB):]
+		digitsA, digitsB = strings.TrimLeft(digitsA, "0"), strings.TrimLeft(digitsB, "0")
+		if len(digitsA) != len(digitsB) {
+			if len(digitsA) < len(digitsB) {
+				return -1
+			}
+			return 1
+		}
+		if digitsA != digitsB {
+			if digitsA < digitsB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionCharOrder weights the first character of s: "~" lowest, then the
+// end of the string or a digit, then letters, then everything else.
+func versionCharOrder(s string) int {
+	if s == "" || isDigit(s[0]) {
+		return 0
+	}
+	c := s[0]
+	switch {
+	case c == '~':
+		return -1
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,63 @@
+package service
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"3.0.7", "3.0.10", -1},
+		{"1.01", "1.1", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0+", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0", "1.0-1", -1},
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"2:1.0", "10:0.1", -1},
+		{"1.2.3-4ubuntu1", "1.2.3-4ubuntu2", -1},
+		{"3.0.2-0ubuntu1.10", "3.0.2-0ubuntu1.9", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := CompareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionMatches(t *testing.T) {
+	tests := []struct {
+		op   string
+		want [3]bool // for results -1, 0 and 1
+	}{
+		{"<", [3]bool{true, false, false}},
+		{"<=", [3]bool{true, true, false}},
+		{">", [3]bool{false, false, true}},
+		{">=", [3]bool{false, true, true}},
+		{"=", [3]bool{false, true, false}},
+		{"!=", [3]bool{true, false, true}},
+		{"~", [3]bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		for i, result := range []int{-1, 0, 1} {
+			if got := versionMatches(result, tt.op); got != tt.want[i] {
+				t.Errorf("versionMatches(%d, %q) = %v, want %v", result, tt.op, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"net/http"
 	"os"
@@ -16,6 +17,7 @@ import (
 	"telemetry-service/internal/api"
 	"telemetry-service/internal/config"
 	"telemetry-service/internal/database"
+	"telemetry-service/internal/pki"
 	"telemetry-service/internal/repository"
 	"telemetry-service/internal/service"
 )
@@ -71,21 +73,120 @@ func main() {
 	processRepo := repository.NewProcessRepository(db)
 	containerRepo := repository.NewContainerRepository(db)
 	threatRepo := repository.NewThreatRepository(db)
+	connectionRepo := repository.NewConnectionRepository(db)
+	packageRepo := repository.NewPackageRepository(db)
+	eventRepo := repository.NewContainerEventRepository(db)
+	fileChangeRepo := repository.NewFileChangeRepository(db)
+	metricRepo := repository.NewMetricRepository(db)
+	sessionRepo := repository.NewSessionRepository(db)
+	authEventRepo := repository.NewAuthEventRepository(db)
+	persistenceRepo := repository.NewPersistenceRepository(db)
+	taskRepo := repository.NewTaskRepository(db)
+	tokenRepo := repository.NewEnrollmentTokenRepository(db)
+	chunkRepo := repository.NewTelemetryChunkRepository(db)
+	policyRepo := repository.NewAgentPolicyRepository(db)
+	transactor := repository.NewTransactor(db)
+
+	// Load the organisation's redaction rules
+	var redactionRules []service.RedactionRule
+	if cfg.Redaction.RulesFile != "" {
+		redactionRules, err = service.LoadRedactionRules(cfg.Redaction.RulesFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load redaction rules")
+		}
+	}
+	log.Info().
+		Str("policy", cfg.Redaction.Policy).
+		Int("custom_rules", len(redactionRules)).
+		Msg("Command-line redaction configured")
+	log.Info().Bool("required", cfg.Enrollment.Required).Msg("Agent enrollment configured")
+	log.Info().
+		Int("collection_interval", cfg.Ingestion.CollectionInterval).
+		Int("max_concurrent", cfg.Ingestion.MaxConcurrent).
+		Int("retry_after", cfg.Ingestion.RetryAfter).
+		Msg("Ingestion pacing configured")
+
+	// Load the CA that issues agents their client certificates
+	var certIssuer *service.CertificateIssuer
+	if cfg.TLS.IssuerCertFile != "" {
+		issuer, err := pki.LoadIssuer(cfg.TLS.IssuerCertFile, cfg.TLS.IssuerKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load certificate issuer")
+		}
+		certIssuer = service.NewCertificateIssuer(issuer, time.Duration(cfg.TLS.ClientCertDays)*24*time.Hour)
+	}
+	log.Info().
+		Bool("tls", cfg.TLS.CertFile != "").
+		Bool("client_certificates_required", cfg.TLS.ClientCAFile != "").
+		Bool("certificate_issuer", certIssuer != nil).
+		Msg("TLS configured")
+
+	// Load the key agent policies are signed with
+	var policySigner *service.PolicySigner
+	if cfg.Policy.SigningKeyFile != "" {
+		key, err := pki.LoadSigningKey(cfg.Policy.SigningKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load policy signing key")
+		}
+		policySigner = service.NewPolicySigner(key)
+	}
+	log.Info().Bool("enabled", policySigner != nil).Msg("Agent policies configured")
+	log.Info().Bool("enabled", cfg.Admin.Token != "").Msg("Admin API configured")
 
 	// Initialize services
-	telemetryService := service.NewTelemetryService(deviceRepo, processRepo, containerRepo, threatRepo)
+	redactor := service.NewRedactor(cfg.Redaction.Policy, redactionRules)
+	telemetryService := service.NewTelemetryService(deviceRepo, processRepo, containerRepo, threatRepo, connectionRepo, packageRepo, eventRepo, fileChangeRepo, metricRepo, sessionRepo, authEventRepo, persistenceRepo, taskRepo, tokenRepo, chunkRepo, policyRepo, transactor, redactor, certIssuer, policySigner, cfg.Enrollment.Required)
 
 	// Initialize HTTP server
 	router := setupRouter(db)
-	api.SetupRoutes(router, telemetryService)
+	api.SetupRoutes(router, telemetryService, api.RouteOptions{
+		CertificateRequired:    cfg.TLS.ClientCAFile != "",
+		CollectionInterval:     time.Duration(cfg.Ingestion.CollectionInterval) * time.Second,
+		MaxConcurrentIngestion: cfg.Ingestion.MaxConcurrent,
+		RetryAfter:             time.Duration(cfg.Ingestion.RetryAfter) * time.Second,
+		AdminToken:             cfg.Admin.Token,
+	})
+
+	server := &http.Server{
+		Addr:    ":" + cfg.Server.Port,
+		Handler: router,
+	}
 
 	// Start server
 	log.Info().Str("port", cfg.Server.Port).Msg("Starting telemetry service")
-	if err := http.ListenAndServe(":"+cfg.Server.Port, router); err != nil {
+	if cfg.TLS.CertFile == "" {
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig, err = setupTLS(cfg.TLS)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to configure TLS")
+		}
+		err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	}
+	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to start server")
 	}
 }
 
+// setupTLS verifies client certificates against the client CA bundle when
+// one is configured. A certificate is only requested, not demanded, in the
+// handshake: agents enroll and obtain their first certificate without one,
+// and the routes that need one refuse requests that come without.
+func setupTLS(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	clientCAs, err := pki.LoadCertPool(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
 func setupLogging() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).With().Timestamp().Logger()
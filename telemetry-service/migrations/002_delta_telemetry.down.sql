@@ -0,0 +1,16 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_containers_removed_at;
+DROP INDEX IF EXISTS idx_containers_live;
+DROP INDEX IF EXISTS idx_processes_exited_at;
+DROP INDEX IF EXISTS idx_processes_live;
+
+-- Drop lifetime columns
+ALTER TABLE containers DROP COLUMN IF EXISTS removed_at;
+ALTER TABLE containers DROP COLUMN IF EXISTS last_seen_at;
+ALTER TABLE containers DROP COLUMN IF EXISTS state;
+ALTER TABLE processes DROP COLUMN IF EXISTS exited_at;
+ALTER TABLE processes DROP COLUMN IF EXISTS last_seen_at;
+
+-- Drop sequence tracking
+ALTER TABLE devices DROP COLUMN IF EXISTS last_checkpoint_at;
+ALTER TABLE devices DROP COLUMN IF EXISTS telemetry_sequence;
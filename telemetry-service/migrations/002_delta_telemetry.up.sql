@@ -0,0 +1,25 @@
+-- Track the last telemetry sequence number accepted from each device
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS telemetry_sequence BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_checkpoint_at TIMESTAMP WITH TIME ZONE;
+
+-- Processes become one row per process lifetime instead of one row per collection
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS exited_at TIMESTAMP WITH TIME ZONE;
+
+-- Existing rows are point-in-time copies; close them at their collection time
+UPDATE processes SET last_seen_at = collected_at, exited_at = collected_at WHERE last_seen_at IS NULL;
+ALTER TABLE processes ALTER COLUMN last_seen_at SET NOT NULL;
+
+-- Containers likewise become one row per container lifetime
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS state VARCHAR(50);
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS removed_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE containers SET last_seen_at = collected_at, removed_at = collected_at WHERE last_seen_at IS NULL;
+ALTER TABLE containers ALTER COLUMN last_seen_at SET NOT NULL;
+
+-- Create indexes for looking up the live state of a device
+CREATE INDEX IF NOT EXISTS idx_processes_live ON processes(device_id, pid, start_time) WHERE exited_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_processes_exited_at ON processes(exited_at);
+CREATE INDEX IF NOT EXISTS idx_containers_live ON containers(device_id, container_id) WHERE removed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_containers_removed_at ON containers(removed_at);
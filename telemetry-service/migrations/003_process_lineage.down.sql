@@ -0,0 +1,9 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_processes_device_parent_key;
+DROP INDEX IF EXISTS idx_processes_device_process_key;
+
+-- Drop lineage columns
+ALTER TABLE processes DROP COLUMN IF EXISTS parent_key;
+ALTER TABLE processes DROP COLUMN IF EXISTS process_key;
+ALTER TABLE processes DROP COLUMN IF EXISTS parent_start_time;
+ALTER TABLE processes DROP COLUMN IF EXISTS ppid;
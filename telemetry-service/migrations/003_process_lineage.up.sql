@@ -0,0 +1,12 @@
+-- Record each process's parent and a PID-reuse-safe identity
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS ppid INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS parent_start_time BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS process_key VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS parent_key VARCHAR(64) NOT NULL DEFAULT '';
+
+-- Existing rows get a process key derived from PID and start time
+UPDATE processes SET process_key = pid || ':' || COALESCE(start_time, 0) WHERE process_key = '';
+
+-- Create indexes for walking lineage within a device
+CREATE INDEX IF NOT EXISTS idx_processes_device_process_key ON processes(device_id, process_key);
+CREATE INDEX IF NOT EXISTS idx_processes_device_parent_key ON processes(device_id, parent_key);
@@ -0,0 +1,10 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_network_connections_remote_port;
+DROP INDEX IF EXISTS idx_network_connections_local_port;
+DROP INDEX IF EXISTS idx_network_connections_state;
+DROP INDEX IF EXISTS idx_network_connections_process_id;
+DROP INDEX IF EXISTS idx_network_connections_collected_at;
+DROP INDEX IF EXISTS idx_network_connections_device_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS network_connections;
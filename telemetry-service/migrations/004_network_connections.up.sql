@@ -0,0 +1,25 @@
+-- Create network_connections table
+CREATE TABLE IF NOT EXISTS network_connections (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    process_id UUID REFERENCES processes(id) ON DELETE SET NULL,
+    pid INTEGER NOT NULL DEFAULT 0,
+    process_key VARCHAR(64) NOT NULL DEFAULT '',
+    protocol VARCHAR(10) NOT NULL,
+    family VARCHAR(10) NOT NULL,
+    local_address VARCHAR(64) NOT NULL,
+    local_port INTEGER NOT NULL,
+    remote_address VARCHAR(64) NOT NULL DEFAULT '',
+    remote_port INTEGER NOT NULL DEFAULT 0,
+    state VARCHAR(20) NOT NULL,
+    collected_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_network_connections_device_id ON network_connections(device_id);
+CREATE INDEX IF NOT EXISTS idx_network_connections_collected_at ON network_connections(collected_at);
+CREATE INDEX IF NOT EXISTS idx_network_connections_process_id ON network_connections(process_id);
+CREATE INDEX IF NOT EXISTS idx_network_connections_state ON network_connections(state);
+CREATE INDEX IF NOT EXISTS idx_network_connections_local_port ON network_connections(local_port);
+CREATE INDEX IF NOT EXISTS idx_network_connections_remote_port ON network_connections(remote_port);
@@ -0,0 +1,10 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_package_history_name;
+DROP INDEX IF EXISTS idx_package_history_observed_at;
+DROP INDEX IF EXISTS idx_package_history_device_id;
+DROP INDEX IF EXISTS idx_device_packages_name;
+DROP INDEX IF EXISTS idx_device_packages_device_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS package_history;
+DROP TABLE IF EXISTS device_packages;
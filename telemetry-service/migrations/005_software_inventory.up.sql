@@ -0,0 +1,34 @@
+-- Create device_packages table holding each device's current inventory
+CREATE TABLE IF NOT EXISTS device_packages (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    version VARCHAR(255) NOT NULL,
+    architecture VARCHAR(50) NOT NULL DEFAULT '',
+    source VARCHAR(20) NOT NULL,
+    installed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (device_id, source, name, architecture)
+);
+
+-- Create package_history table recording install/upgrade/remove changes
+CREATE TABLE IF NOT EXISTS package_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    architecture VARCHAR(50) NOT NULL DEFAULT '',
+    source VARCHAR(20) NOT NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('install', 'upgrade', 'downgrade', 'remove')),
+    previous_version VARCHAR(255) NOT NULL DEFAULT '',
+    version VARCHAR(255) NOT NULL DEFAULT '',
+    observed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_device_packages_device_id ON device_packages(device_id);
+CREATE INDEX IF NOT EXISTS idx_device_packages_name ON device_packages(LOWER(name));
+CREATE INDEX IF NOT EXISTS idx_package_history_device_id ON package_history(device_id);
+CREATE INDEX IF NOT EXISTS idx_package_history_observed_at ON package_history(observed_at);
+CREATE INDEX IF NOT EXISTS idx_package_history_name ON package_history(LOWER(name));
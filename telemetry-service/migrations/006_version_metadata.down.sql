@@ -0,0 +1,4 @@
+-- Drop version metadata columns
+ALTER TABLE processes DROP COLUMN IF EXISTS version_info;
+ALTER TABLE processes DROP COLUMN IF EXISTS version_confidence;
+ALTER TABLE processes DROP COLUMN IF EXISTS version_source;
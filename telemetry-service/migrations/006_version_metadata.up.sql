@@ -0,0 +1,8 @@
+-- Record where each process's version came from and how far it can be trusted
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS version_source VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS version_confidence VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS version_info JSONB;
+
+-- Versions from older agents were scraped from the binary's strings
+UPDATE processes SET version_source = 'legacy', version_confidence = 'low'
+WHERE version IS NOT NULL AND version <> '' AND version_source = '';
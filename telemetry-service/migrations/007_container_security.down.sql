@@ -0,0 +1,13 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_containers_image_digest;
+DROP INDEX IF EXISTS idx_containers_privileged;
+DROP INDEX IF EXISTS idx_containers_docker_socket_mounted;
+
+-- Drop security profile columns
+ALTER TABLE containers DROP COLUMN IF EXISTS security_profile;
+ALTER TABLE containers DROP COLUMN IF EXISTS image_digest;
+ALTER TABLE containers DROP COLUMN IF EXISTS runs_as_root;
+ALTER TABLE containers DROP COLUMN IF EXISTS docker_socket_mounted;
+ALTER TABLE containers DROP COLUMN IF EXISTS host_network;
+ALTER TABLE containers DROP COLUMN IF EXISTS host_pid;
+ALTER TABLE containers DROP COLUMN IF EXISTS privileged;
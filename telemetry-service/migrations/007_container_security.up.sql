@@ -0,0 +1,14 @@
+-- Record each container's security profile; the flags worth searching the
+-- fleet for get their own columns
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS privileged BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS host_pid BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS host_network BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS docker_socket_mounted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS runs_as_root BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS image_digest VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS security_profile JSONB;
+
+-- Create indexes for fleet-wide searches over live containers
+CREATE INDEX IF NOT EXISTS idx_containers_docker_socket_mounted ON containers(device_id) WHERE docker_socket_mounted AND removed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_containers_privileged ON containers(device_id) WHERE privileged AND removed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_containers_image_digest ON containers(image_digest);
@@ -0,0 +1,7 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_container_events_action;
+DROP INDEX IF EXISTS idx_container_events_container_id;
+DROP INDEX IF EXISTS idx_container_events_device_time;
+
+-- Drop tables
+DROP TABLE IF EXISTS container_events;
@@ -0,0 +1,21 @@
+-- Create container_events table for the Docker events stream
+CREATE TABLE IF NOT EXISTS container_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    container_id VARCHAR(255) NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    image VARCHAR(500) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    exit_code INTEGER,
+    exec_command TEXT NOT NULL DEFAULT '',
+    attributes JSONB,
+    event_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    -- Replayed snapshots resend the same events
+    UNIQUE (device_id, container_id, action, event_time)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_container_events_device_time ON container_events(device_id, event_time);
+CREATE INDEX IF NOT EXISTS idx_container_events_container_id ON container_events(container_id);
+CREATE INDEX IF NOT EXISTS idx_container_events_action ON container_events(action);
@@ -0,0 +1,7 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_containers_runtime;
+
+-- Drop columns
+ALTER TABLE container_events DROP COLUMN IF EXISTS runtime;
+ALTER TABLE containers DROP COLUMN IF EXISTS namespace;
+ALTER TABLE containers DROP COLUMN IF EXISTS runtime;
@@ -0,0 +1,8 @@
+-- Record the runtime each container and container event came from; agents
+-- before runtime support only listed Docker containers
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS runtime VARCHAR(20) NOT NULL DEFAULT 'docker';
+ALTER TABLE containers ADD COLUMN IF NOT EXISTS namespace VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE container_events ADD COLUMN IF NOT EXISTS runtime VARCHAR(20) NOT NULL DEFAULT 'docker';
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_containers_runtime ON containers(runtime);
@@ -0,0 +1,7 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_file_changes_after_sha256;
+DROP INDEX IF EXISTS idx_file_changes_path;
+DROP INDEX IF EXISTS idx_file_changes_device_time;
+
+-- Drop tables
+DROP TABLE IF EXISTS file_changes;
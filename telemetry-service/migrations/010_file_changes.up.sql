@@ -0,0 +1,21 @@
+-- Create file_changes table for file integrity monitoring events
+CREATE TABLE IF NOT EXISTS file_changes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    detected_by VARCHAR(20) NOT NULL DEFAULT '',
+    before_sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    after_sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    before_state JSONB,
+    after_state JSONB,
+    change_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    -- Replayed snapshots resend the same changes
+    UNIQUE (device_id, path, action, change_time)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_file_changes_device_time ON file_changes(device_id, change_time);
+CREATE INDEX IF NOT EXISTS idx_file_changes_path ON file_changes(path);
+CREATE INDEX IF NOT EXISTS idx_file_changes_after_sha256 ON file_changes(after_sha256);
@@ -0,0 +1,9 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_device_metrics_resolution_time;
+
+-- Drop tables
+DROP TABLE IF EXISTS device_metrics;
+
+-- Drop columns
+ALTER TABLE processes DROP COLUMN IF EXISTS memory_rss;
+ALTER TABLE processes DROP COLUMN IF EXISTS cpu_percent;
@@ -0,0 +1,43 @@
+-- Record the CPU and memory use of each process as of the last snapshot
+-- that listed it
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS cpu_percent DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS memory_rss BIGINT NOT NULL DEFAULT 0;
+
+-- Create device_metrics table for host resource usage. Each row is a raw
+-- agent sample or a 5-minute or hourly rollup; rollups keep sums so they can
+-- be averaged again over any step.
+CREATE TABLE IF NOT EXISTS device_metrics (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    resolution VARCHAR(10) NOT NULL,
+    bucket_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    sample_count INTEGER NOT NULL DEFAULT 0,
+    cpu_count INTEGER NOT NULL DEFAULT 0,
+    cpu_percent_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    cpu_percent_max DOUBLE PRECISION NOT NULL DEFAULT 0,
+    load1_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    load1_max DOUBLE PRECISION NOT NULL DEFAULT 0,
+    memory_total BIGINT NOT NULL DEFAULT 0,
+    memory_used_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    memory_percent_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    memory_percent_max DOUBLE PRECISION NOT NULL DEFAULT 0,
+    swap_total BIGINT NOT NULL DEFAULT 0,
+    swap_used_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    disk_total BIGINT NOT NULL DEFAULT 0,
+    disk_percent_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    -- Rates are missing from an agent's first sample
+    rate_sample_count INTEGER NOT NULL DEFAULT 0,
+    disk_read_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    disk_write_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    network_rx_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    network_tx_sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    process_count_sum BIGINT NOT NULL DEFAULT 0,
+    process_count_max INTEGER NOT NULL DEFAULT 0,
+    container_count_sum BIGINT NOT NULL DEFAULT 0,
+    top_processes JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (device_id, resolution, bucket_start)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_device_metrics_resolution_time ON device_metrics(resolution, bucket_start);
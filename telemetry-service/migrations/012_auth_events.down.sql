@@ -0,0 +1,10 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_auth_events_threat_finding_id;
+DROP INDEX IF EXISTS idx_auth_events_source_ip;
+DROP INDEX IF EXISTS idx_auth_events_device_time;
+DROP INDEX IF EXISTS idx_user_sessions_device_time;
+DROP INDEX IF EXISTS idx_user_sessions_open;
+
+-- Drop tables
+DROP TABLE IF EXISTS auth_events;
+DROP TABLE IF EXISTS user_sessions;
@@ -0,0 +1,54 @@
+-- Create user_sessions table for the login sessions listed by each device
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    session_id VARCHAR(255) NOT NULL,
+    username VARCHAR(255) NOT NULL DEFAULT '',
+    uid BIGINT,
+    tty VARCHAR(64) NOT NULL DEFAULT '',
+    seat VARCHAR(64) NOT NULL DEFAULT '',
+    remote_host VARCHAR(255) NOT NULL DEFAULT '',
+    remote BOOLEAN NOT NULL DEFAULT false,
+    service VARCHAR(64) NOT NULL DEFAULT '',
+    session_type VARCHAR(32) NOT NULL DEFAULT '',
+    class VARCHAR(32) NOT NULL DEFAULT '',
+    state VARCHAR(32) NOT NULL DEFAULT '',
+    source VARCHAR(20) NOT NULL DEFAULT '',
+    started_at TIMESTAMP WITH TIME ZONE,
+    first_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ended_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create auth_events table for SSH, sudo and login events
+CREATE TABLE IF NOT EXISTS auth_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    event_type VARCHAR(20) NOT NULL,
+    success BOOLEAN NOT NULL,
+    username VARCHAR(255) NOT NULL DEFAULT '',
+    source_ip VARCHAR(255) NOT NULL DEFAULT '',
+    source_port INTEGER NOT NULL DEFAULT 0,
+    method VARCHAR(64) NOT NULL DEFAULT '',
+    tty VARCHAR(64) NOT NULL DEFAULT '',
+    target_user VARCHAR(255) NOT NULL DEFAULT '',
+    command TEXT NOT NULL DEFAULT '',
+    pid INTEGER NOT NULL DEFAULT 0,
+    attempt_count INTEGER NOT NULL DEFAULT 1,
+    source VARCHAR(20) NOT NULL DEFAULT '',
+    message TEXT NOT NULL DEFAULT '',
+    threat_finding_id UUID REFERENCES threat_findings(id) ON DELETE SET NULL,
+    event_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    -- Replayed snapshots resend the same events
+    UNIQUE (device_id, event_type, username, source_ip, source_port, tty, pid, event_time)
+);
+
+-- Create indexes for better performance
+-- A session is open until a snapshot no longer lists it
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_sessions_open ON user_sessions(device_id, session_id) WHERE ended_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_user_sessions_device_time ON user_sessions(device_id, first_seen_at);
+CREATE INDEX IF NOT EXISTS idx_auth_events_device_time ON auth_events(device_id, event_time);
+CREATE INDEX IF NOT EXISTS idx_auth_events_source_ip ON auth_events(device_id, source_ip, event_time) WHERE NOT success;
+CREATE INDEX IF NOT EXISTS idx_auth_events_threat_finding_id ON auth_events(threat_finding_id);
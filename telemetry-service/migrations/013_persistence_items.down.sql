@@ -0,0 +1,8 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_persistence_items_sha256;
+DROP INDEX IF EXISTS idx_persistence_items_first_seen;
+DROP INDEX IF EXISTS idx_persistence_items_device_type;
+DROP INDEX IF EXISTS idx_persistence_items_live;
+
+-- Drop tables
+DROP TABLE IF EXISTS persistence_items;
@@ -0,0 +1,32 @@
+-- Create persistence_items table for the autoruns inventory of each device
+CREATE TABLE IF NOT EXISTS persistence_items (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    item_key TEXT NOT NULL,
+    item_type VARCHAR(32) NOT NULL,
+    path TEXT NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    scope VARCHAR(20) NOT NULL DEFAULT '',
+    username VARCHAR(255) NOT NULL DEFAULT '',
+    owner VARCHAR(255) NOT NULL DEFAULT '',
+    uid BIGINT,
+    sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    file_size BIGINT NOT NULL DEFAULT 0,
+    mode VARCHAR(8) NOT NULL DEFAULT '',
+    link_target TEXT NOT NULL DEFAULT '',
+    commands TEXT[],
+    detail TEXT NOT NULL DEFAULT '',
+    modified_at TIMESTAMP WITH TIME ZONE,
+    first_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    changed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    removed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create indexes for better performance
+-- An item is present until a snapshot no longer lists it
+CREATE UNIQUE INDEX IF NOT EXISTS idx_persistence_items_live ON persistence_items(device_id, item_key) WHERE removed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_persistence_items_device_type ON persistence_items(device_id, item_type);
+CREATE INDEX IF NOT EXISTS idx_persistence_items_first_seen ON persistence_items(first_seen_at);
+CREATE INDEX IF NOT EXISTS idx_persistence_items_sha256 ON persistence_items(sha256);
@@ -0,0 +1,6 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_processes_redacted_by;
+
+-- Drop columns
+ALTER TABLE processes DROP COLUMN IF EXISTS redaction_rules;
+ALTER TABLE processes DROP COLUMN IF EXISTS redacted_by;
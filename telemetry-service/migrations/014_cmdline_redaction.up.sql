@@ -0,0 +1,7 @@
+-- Record where each process's command line was redacted and which detectors
+-- found secrets in it; processes stored before redaction have neither
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS redacted_by VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE processes ADD COLUMN IF NOT EXISTS redaction_rules TEXT[];
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_processes_redacted_by ON processes(redacted_by);
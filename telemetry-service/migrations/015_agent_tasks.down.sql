@@ -0,0 +1,6 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_agent_tasks_created_at;
+DROP INDEX IF EXISTS idx_agent_tasks_device_status;
+
+-- Drop tables
+DROP TABLE IF EXISTS agent_tasks;
@@ -0,0 +1,23 @@
+-- Create agent_tasks table for work queued for a device's agent; each row is
+-- also the audit record of who asked for the task and what came back
+CREATE TABLE IF NOT EXISTS agent_tasks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    task_type VARCHAR(32) NOT NULL,
+    parameters JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    requested_by VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    timeout_seconds INTEGER NOT NULL,
+    result JSONB,
+    error TEXT NOT NULL DEFAULT '',
+    output_truncated BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    dispatched_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_agent_tasks_device_status ON agent_tasks(device_id, status);
+CREATE INDEX IF NOT EXISTS idx_agent_tasks_created_at ON agent_tasks(created_at);
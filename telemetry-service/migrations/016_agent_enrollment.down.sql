@@ -0,0 +1,16 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_devices_machine_id;
+DROP INDEX IF EXISTS idx_devices_unenrolled_mac_address;
+
+-- Drop columns
+ALTER TABLE devices DROP COLUMN IF EXISTS enrollment_token_id;
+ALTER TABLE devices DROP COLUMN IF EXISTS enrolled_at;
+ALTER TABLE devices DROP COLUMN IF EXISTS credential_hash;
+ALTER TABLE devices DROP COLUMN IF EXISTS hardware_serial;
+ALTER TABLE devices DROP COLUMN IF EXISTS machine_id;
+
+-- Restore the MAC address key; fails while two devices share a MAC address
+ALTER TABLE devices ADD CONSTRAINT devices_mac_address_key UNIQUE (mac_address);
+
+-- Drop tables
+DROP TABLE IF EXISTS enrollment_tokens;
@@ -0,0 +1,29 @@
+-- Create enrollment_tokens table for the organisation's bootstrap tokens;
+-- only a hash of each token is stored
+CREATE TABLE IF NOT EXISTS enrollment_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL,
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Enrolled devices are identified by their ID and authenticate with the
+-- credential issued at enrollment; the MAC address, machine ID and hardware
+-- serial are only attributes
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS machine_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS hardware_serial VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS credential_hash VARCHAR(64);
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS enrolled_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS enrollment_token_id UUID REFERENCES enrollment_tokens(id) ON DELETE SET NULL;
+
+-- Only agents that have not enrolled are still keyed on their MAC address
+ALTER TABLE devices DROP CONSTRAINT IF EXISTS devices_mac_address_key;
+
+-- Create indexes for better performance
+CREATE UNIQUE INDEX IF NOT EXISTS idx_devices_unenrolled_mac_address ON devices(mac_address) WHERE enrolled_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_devices_machine_id ON devices(machine_id);
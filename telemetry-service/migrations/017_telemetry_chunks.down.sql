@@ -0,0 +1,5 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_telemetry_chunks_received_at;
+
+-- Drop tables
+DROP TABLE IF EXISTS telemetry_chunks;
@@ -0,0 +1,16 @@
+-- Create telemetry_chunks table staging the chunks of a snapshot an agent
+-- uploads in parts, until the last one arrives and the snapshot is ingested
+-- as a whole. device_id is the authenticated device, '' for an agent that has
+-- not enrolled.
+CREATE TABLE IF NOT EXISTS telemetry_chunks (
+    snapshot_id UUID NOT NULL,
+    chunk_index INTEGER NOT NULL,
+    chunk_count INTEGER NOT NULL,
+    device_id VARCHAR(36) NOT NULL DEFAULT '',
+    data BYTEA NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (snapshot_id, chunk_index)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_telemetry_chunks_received_at ON telemetry_chunks(received_at);
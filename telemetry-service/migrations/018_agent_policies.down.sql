@@ -0,0 +1,5 @@
+-- Drop columns
+ALTER TABLE devices DROP COLUMN IF EXISTS policy_group;
+
+-- Drop tables
+DROP TABLE IF EXISTS agent_policies;
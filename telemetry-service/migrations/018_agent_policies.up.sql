@@ -0,0 +1,16 @@
+-- Create agent_policies table for the settings the service pushes to agents.
+-- A device's policy is the default policy, overridden by its group's and
+-- then by its own.
+CREATE TABLE IF NOT EXISTS agent_policies (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    scope VARCHAR(10) NOT NULL CHECK (scope IN ('default', 'group', 'device')),
+    target VARCHAR(255) NOT NULL DEFAULT '',
+    settings JSONB NOT NULL,
+    updated_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (scope, target)
+);
+
+-- Devices are put in a policy group by an administrator
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS policy_group VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- Drop indexes
+DROP INDEX IF EXISTS idx_threat_findings_detected_by;
+
+-- Drop columns
+ALTER TABLE threat_findings DROP COLUMN IF EXISTS evidence;
+ALTER TABLE threat_findings DROP COLUMN IF EXISTS detected_by;
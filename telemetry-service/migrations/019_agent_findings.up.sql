@@ -0,0 +1,8 @@
+-- Record whether the agent's local detection rules or the service raised
+-- each threat finding, and what the agent saw that matched the rule;
+-- findings raised before agents detected locally were all the service's
+ALTER TABLE threat_findings ADD COLUMN IF NOT EXISTS detected_by VARCHAR(10) NOT NULL DEFAULT 'server';
+ALTER TABLE threat_findings ADD COLUMN IF NOT EXISTS evidence JSONB;
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_threat_findings_detected_by ON threat_findings(detected_by);
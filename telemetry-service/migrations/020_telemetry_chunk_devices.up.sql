@@ -0,0 +1,3 @@
+-- Index telemetry_chunks by device, to total the bytes each device has staged
+-- against the most it may stage
+CREATE INDEX IF NOT EXISTS idx_telemetry_chunks_device_id ON telemetry_chunks(device_id);